@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// runApps lists the apps the host can launch
+func runApps(args []string) error {
+	fs := flag.NewFlagSet("apps", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	fs.Parse(args)
+
+	cfg := opts.loadConfig()
+
+	host, err := opts.openHost(cfg)
+	if err != nil {
+		return err
+	}
+	client := host.Client
+	if !client.Paired() {
+		return fmt.Errorf("not paired with %s, run 'gamelight pair' first", host.Name)
+	}
+
+	apps, err := client.GetAppList()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tHDR")
+	for _, app := range apps {
+		hdr := "no"
+		if app.IsHDRSupport {
+			hdr = "yes"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", app.ID, app.Title, hdr)
+	}
+	return w.Flush()
+}
+
+// runInfo prints the host's server information
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	fs.Parse(args)
+
+	cfg := opts.loadConfig()
+
+	host, err := opts.openHost(cfg)
+	if err != nil {
+		return err
+	}
+	client := host.Client
+
+	info, err := host.ServerInfo()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", host.Name)
+	fmt.Fprintf(w, "Host:\t%s\n", client.Host())
+	fmt.Fprintf(w, "Hostname:\t%s\n", info.Hostname)
+	fmt.Fprintf(w, "Version:\t%s\n", info.AppVersion)
+	fmt.Fprintf(w, "Unique ID:\t%s\n", info.UniqueID)
+	fmt.Fprintf(w, "MAC:\t%s\n", info.MAC)
+	fmt.Fprintf(w, "Local IP:\t%s\n", info.LocalIP)
+	fmt.Fprintf(w, "State:\t%s\n", info.State)
+	fmt.Fprintf(w, "Current game:\t%d\n", info.CurrentGame)
+	fmt.Fprintf(w, "Paired:\t%t\n", info.PairStatus)
+	fmt.Fprintf(w, "Client ID:\t%s\n", client.UniqueID())
+	return w.Flush()
+}
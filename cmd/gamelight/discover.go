@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gamelight/gamelight/internal/config"
+	"github.com/gamelight/gamelight/pkg/discovery"
+)
+
+// runDiscover lists the Sunshine hosts found on the local network and
+// optionally adds the new ones to the config file
+func runDiscover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	timeout := fs.Duration("timeout", 3*time.Second, "How long to wait for hosts to answer")
+	add := fs.Bool("add", false, "Add new hosts to the config file")
+	fs.Parse(args)
+
+	cfg := opts.loadConfig()
+
+	fmt.Printf("Looking for Sunshine hosts for %s...\n", *timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	found, err := discovery.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		fmt.Println("No hosts found")
+		return nil
+	}
+
+	var added []string
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tADDRESS\tPORT\tUNIQUE ID\tCONFIGURED AS")
+	for _, h := range found {
+		name := "-"
+		if existing, ok := cfg.Sunshine.HostByAddress(h.Address); ok {
+			name = existing.Name
+		} else if *add {
+			hc := discoveredHostConfig(cfg, h)
+			if err := cfg.Sunshine.AddHost(hc); err != nil {
+				return err
+			}
+			name = hc.Name + " (new)"
+			added = append(added, hc.Name)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", h.Instance, h.Address, h.Port, h.UniqueID, name)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(added) > 0 {
+		if err := cfg.Save(*opts.configPath); err != nil {
+			return fmt.Errorf("saving config: %w", err)
+		}
+		fmt.Printf("Added %d host(s) to %s. Pair with 'gamelight pair -host %s'.\n", len(added), *opts.configPath, added[0])
+	}
+	return nil
+}
+
+// discoveredHostConfig returns the config for a discovered host, named
+// after its instance and made unique among the configured hosts
+func discoveredHostConfig(cfg *config.Config, h discovery.Host) config.HostConfig {
+	base := h.ConfigName()
+	name := base
+	for i := 2; hostNameTaken(cfg, name); i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	return newHostConfig(cfg, name, h.Address, h.Port)
+}
+
+// newHostConfig returns the config for a host at address whose HTTP port
+// is port, leaving the ports to default when they match
+func newHostConfig(cfg *config.Config, name, address string, port int) config.HostConfig {
+	hc := config.HostConfig{Name: name, Host: address}
+	if port != 0 && port != cfg.Sunshine.HTTPPort {
+		// Sunshine's HTTPS port is always 5 below its HTTP port
+		hc.HTTPPort = port
+		hc.HTTPSPort = port - 5
+	}
+	return hc
+}
+
+func hostNameTaken(cfg *config.Config, name string) bool {
+	for _, h := range cfg.Sunshine.HostList() {
+		if h.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gamelight/gamelight/pkg/sunshine"
+)
+
+// runPair pairs with the host and saves the credentials
+func runPair(args []string) error {
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	pin := fs.String("pin", "", "4-digit PIN to enter on the host (generated if empty)")
+	name := fs.String("name", "gamelight", "Device name shown on the host")
+	fs.Parse(args)
+
+	cfg := opts.loadConfig()
+
+	host, err := opts.openHost(cfg)
+	if err != nil {
+		return err
+	}
+	client := host.Client
+
+	if *pin == "" {
+		*pin, err = sunshine.GeneratePIN()
+		if err != nil {
+			return err
+		}
+	} else if !validPIN(*pin) {
+		return fmt.Errorf("PIN must be 4 digits")
+	}
+
+	state, err := sunshine.GeneratePairState(*name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pairing with %s (%s) as %q\n", host.Name, client.Host(), *name)
+	fmt.Printf("Enter PIN %s in the Sunshine web UI (PIN tab) to continue...\n", *pin)
+
+	state.OnStep(func(step sunshine.PairStep) {
+		if step > sunshine.PairStepServerCert {
+			fmt.Printf("Step %d/5: %s\n", int(step), step)
+		}
+	})
+
+	if err := host.Pair(*pin, state); err != nil {
+		return err
+	}
+
+	if err := host.SavePairing(state); err != nil {
+		return fmt.Errorf("saving credentials: %w", err)
+	}
+
+	fmt.Printf("Paired with %s. Credentials saved to %s\n", host.Name, host.Store.CertPath())
+	return nil
+}
+
+// runUnpair removes the pairing on the host and deletes the credentials
+func runUnpair(args []string) error {
+	fs := flag.NewFlagSet("unpair", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	fs.Parse(args)
+
+	cfg := opts.loadConfig()
+
+	host, err := opts.openHost(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := host.Client.Unpair(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: host did not confirm unpairing: %v\n", err)
+	}
+
+	if err := host.Store.Remove(); err != nil {
+		return fmt.Errorf("removing credentials: %w", err)
+	}
+
+	fmt.Printf("Unpaired from %s\n", host.Name)
+	return nil
+}
+
+// validPIN reports whether pin is 4 digits
+func validPIN(pin string) bool {
+	if len(pin) != 4 {
+		return false
+	}
+	for _, c := range pin {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"github.com/gamelight/gamelight/pkg/control"
+	"github.com/gamelight/gamelight/pkg/input"
+	"github.com/gamelight/gamelight/pkg/rtsp"
+	"github.com/gamelight/gamelight/pkg/session"
+	"github.com/gamelight/gamelight/pkg/sunshine"
+	"github.com/gamelight/gamelight/pkg/web"
+	rtcfanout "github.com/gamelight/gamelight/pkg/webrtc"
+)
+
+// wakeTimeout is how long to wait for a host to answer after sending
+// Wake-on-LAN, long enough for a cold boot
+const wakeTimeout = 2 * time.Minute
+
+// runServe runs the streaming server until it is interrupted
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	bindAddr := fs.String("bind", "", "Server bind address (overrides config)")
+	fs.Parse(args)
+
+	cfg := opts.loadConfig()
+	if *bindAddr != "" {
+		cfg.Server.BindAddress = *bindAddr
+	}
+
+	hosts, err := newRegistry(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Check Sunshine connections
+	for _, host := range hosts.Hosts() {
+		client := host.Client
+		if !client.Paired() {
+			log.Printf("[%s] No stored pairing credentials, run 'gamelight pair -host %s' first", host.Name, host.Name)
+		} else {
+			log.Printf("[%s] Loaded pairing credentials from %s", host.Name, host.Store.CertPath())
+		}
+
+		log.Printf("[%s] Connecting to Sunshine at %s...", host.Name, client.Host())
+		info, err := host.ServerInfo()
+		if err != nil {
+			log.Printf("[%s] Warning: Could not connect to Sunshine: %v", host.Name, err)
+			log.Printf("[%s] Streaming from this host won't work until Sunshine is available.", host.Name)
+		} else {
+			log.Printf("[%s] Connected to Sunshine: %s (version %s)", host.Name, info.Hostname, info.AppVersion)
+			if info.GameRunning() {
+				log.Printf("[%s] App %d is already running and will be resumed", host.Name, info.CurrentGame)
+			}
+			if !info.PairStatus {
+				log.Printf("[%s] Warning: Not paired with Sunshine. You may need to pair first.", host.Name)
+			}
+		}
+	}
+
+	// Create web server
+	webServer, err := web.NewServer(cfg)
+	if err != nil {
+		return fmt.Errorf("creating web server: %w", err)
+	}
+	webServer.SetHosts(hosts)
+
+	// Hosts found by discovery are added to the registry and saved to the
+	// config file so they are still there after a restart
+	var configMu sync.Mutex
+	webServer.OnAddHost(func(req web.AddHostRequest) (*sunshine.Host, error) {
+		configMu.Lock()
+		defer configMu.Unlock()
+
+		if hostNameTaken(cfg, req.Name) {
+			return nil, fmt.Errorf("%w: %q", web.ErrHostExists, req.Name)
+		}
+		hc := newHostConfig(cfg, req.Name, req.Address, req.Port)
+		prev := cfg.Sunshine.Hosts
+		if err := cfg.Sunshine.AddHost(hc); err != nil {
+			return nil, err
+		}
+
+		// Look the host up again so it gets the defaults filled in
+		for _, h := range cfg.Sunshine.HostList() {
+			if h.Name == hc.Name {
+				hc = h
+			}
+		}
+		host, err := newHost(cfg, hc)
+		if err == nil {
+			err = hosts.Add(host)
+		}
+		if err != nil {
+			cfg.Sunshine.Hosts = prev
+			return nil, err
+		}
+
+		if err := cfg.Save(*opts.configPath); err != nil {
+			log.Printf("Failed to save config with new host %s: %v", host.Name, err)
+		} else {
+			log.Printf("Added Sunshine host %s (%s)", host.Name, req.Address)
+		}
+		return host, nil
+	})
+
+	// Set up streaming callbacks
+	var rtspClient *rtsp.Client
+	var videoTrack *webrtc.TrackLocalStaticRTP
+	var audioTrack *webrtc.TrackLocalStaticRTP
+
+	var controlMu sync.RWMutex
+	var controlStream *control.Client
+
+	// The host the current session streams from
+	var sunshineClient *sunshine.Client
+
+	webServer.OnStartStream(func(settings session.StreamSettings, appID int) (_ *sunshine.App, err error) {
+		log.Printf("Starting stream with settings: %+v", settings)
+
+		host, err := hosts.Get(settings.Host)
+		if err != nil {
+			return nil, err
+		}
+		sunshineClient = host.Client
+		log.Printf("Streaming from %s (%s)", host.Name, sunshineClient.Host())
+
+		// A sleeping host doesn't answer, so wake it and wait for it. Other
+		// failures come from a host that is awake.
+		info, err := host.ServerInfo()
+		if err != nil && !errors.Is(err, sunshine.ErrHostUnreachable) {
+			return nil, fmt.Errorf("getting server info from %s: %w", host.Name, err)
+		}
+		if err != nil {
+			log.Printf("[%s] Host not answering (%v), sending Wake-on-LAN to %s", host.Name, err, sunshineClient.MAC())
+			webServer.ReportStreamProgress(web.StreamProgress{State: web.StreamWaking, Host: host.Name})
+
+			ctx, cancel := context.WithTimeout(context.Background(), wakeTimeout)
+			info, err = host.Wake(ctx, func(attempt int) {
+				webServer.ReportStreamProgress(web.StreamProgress{State: web.StreamWaking, Host: host.Name, Attempt: attempt})
+			})
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("waking %s: %w", host.Name, err)
+			}
+			log.Printf("[%s] Host is awake", host.Name)
+		}
+		webServer.ReportStreamProgress(web.StreamProgress{State: web.StreamLaunching, Host: host.Name})
+
+		// A game left running, for example by an earlier gamelight run, is
+		// resumed unless another app was asked for
+		running := 0
+		if info.GameRunning() {
+			running = info.CurrentGame
+			if appID == 0 {
+				appID = running
+			}
+		}
+
+		// Find the requested app, or the default
+		apps, err := sunshineClient.GetAppList()
+		if err != nil {
+			return nil, fmt.Errorf("getting app list: %w", err)
+		}
+		app, err := chooseApp(apps, appID, cfg.Stream.DefaultApp)
+		if err != nil {
+			return nil, err
+		}
+
+		// Send the best codec the host and every browser can handle. HDR
+		// also needs an app that supports it and a 10-bit codec.
+		hdr := settings.HDR && app.IsHDRSupport
+		if settings.HDR && !app.IsHDRSupport {
+			log.Printf("[%s] '%s' doesn't support HDR", host.Name, app.Title)
+		}
+		browserCodecs := func(hdr bool) []string {
+			// Until a browser sends its offer, assume H.264
+			codecs, ok := webServer.VideoCodecs(hdr)
+			if !ok {
+				return []string{webrtc.MimeTypeH264}
+			}
+			return codecs
+		}
+		var codec videoCodec
+		if hdr {
+			codec, err = chooseVideoCodec(info, browserCodecs(true), cfg.Stream.Codec, true)
+			if err != nil {
+				log.Printf("[%s] Not streaming HDR: %v", host.Name, err)
+				hdr = false
+			}
+		}
+		if !hdr {
+			codec, err = chooseVideoCodec(info, browserCodecs(false), cfg.Stream.Codec, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if hdr {
+			log.Printf("[%s] Streaming %s 10-bit HDR video", host.Name, codec.rtsp)
+		} else {
+			log.Printf("[%s] Streaming %s video", host.Name, codec.rtsp)
+		}
+
+		resume := running != 0 && app.ID == running
+		if running != 0 && !resume {
+			// Sunshine won't launch an app while another one runs
+			log.Printf("[%s] Quitting app %d to launch '%s'", host.Name, running, app.Title)
+			if err := sunshineClient.Cancel(); err != nil {
+				return nil, fmt.Errorf("quitting running app: %w", err)
+			}
+		}
+
+		// Generate a fresh input encryption key for this session
+		riKey, riKeyID, err := sunshine.GenerateRIKey()
+		if err != nil {
+			return nil, err
+		}
+
+		audioChannels := cfg.Stream.AudioChannels
+		if audioChannels == 0 {
+			audioChannels = 2
+		}
+		channelMask, err := rtsp.ChannelMask(audioChannels)
+		if err != nil {
+			return nil, err
+		}
+
+		// Launch the stream, or resume it with the same mode
+		launch, action := sunshineClient.Launch, "launching"
+		if resume {
+			launch, action = sunshineClient.Resume, "resuming"
+		}
+		log.Printf("[%s] Starting '%s' (%s)", host.Name, app.Title, action)
+		launchResp, err := launch(sunshine.LaunchRequest{
+			AppID:      app.ID,
+			Width:      settings.Width,
+			Height:     settings.Height,
+			FPS:        settings.FPS,
+			Bitrate:    settings.Bitrate,
+			RIKey:      riKey,
+			RIKeyID:    riKeyID,
+			LocalAudio: false,
+			Gamepads:   0xF, // All 4 gamepads
+
+			SurroundAudioInfo: sunshine.SurroundAudioInfo(audioChannels, channelMask),
+			HDR:               hdr,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s stream: %w", action, err)
+		}
+
+		// From here a failure leaves a stream nobody watches, so close the
+		// RTSP session and quit an app launched for it
+		defer func() {
+			if err == nil {
+				return
+			}
+			if rtspClient != nil {
+				rtspClient.Close()
+				rtspClient = nil
+			}
+			if !resume {
+				if err := sunshineClient.Cancel(); err != nil {
+					log.Printf("[%s] Failed to quit '%s': %v", host.Name, app.Title, err)
+				}
+			}
+		}()
+
+		log.Printf("Stream started, session URL: %s", launchResp.SessionURL)
+
+		// Create video and audio tracks
+		videoTrack, err = rtcfanout.CreateVideoTrack(codec.mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("creating video track: %w", err)
+		}
+
+		audioTrack, err = rtcfanout.CreateAudioTrack()
+		if err != nil {
+			return nil, fmt.Errorf("creating audio track: %w", err)
+		}
+
+		// Start the receivers on ephemeral ports before the handshake so
+		// they can ping the host as soon as it starts streaming
+		rtspClient = rtsp.NewClient(launchResp.SessionURL)
+
+		videoWriter, err := webServer.NewVideoWriter(videoTrack)
+		if err != nil {
+			return nil, fmt.Errorf("creating video packetizer: %w", err)
+		}
+		rtspClient.OnVideoFrame(func(frame rtsp.VideoFrame) {
+			videoWriter.WriteFrame(frame.Data, frame.Timestamp)
+		})
+		// Frames after a lost one refer to it, so every browser needs a
+		// new keyframe
+		rtspClient.OnVideoFrameLoss(func(lastGood, next uint32) {
+			webServer.RequestKeyframe()
+		})
+		if err := rtspClient.StartRTPReceiver("video", 0); err != nil {
+			return nil, fmt.Errorf("starting video receiver: %w", err)
+		}
+
+		audioPacketizer := rtcfanout.NewAudioPacketizer()
+		if err := rtspClient.SetAudioKey(riKey, riKeyID); err != nil {
+			return nil, fmt.Errorf("setting audio key: %w", err)
+		}
+		if err := rtspClient.StartRTPReceiver("audio", 0); err != nil {
+			return nil, fmt.Errorf("starting audio receiver: %w", err)
+		}
+
+		// Negotiate the stream over RTSP
+		media, err := rtspClient.Handshake(streamConfig(settings, audioChannels, codec.rtsp, hdr))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range media {
+			log.Printf("Host offers %s stream (codec: %s)", m.Type, m.Codec)
+		}
+
+		// Surround audio goes to browsers that negotiate multiopus; the rest
+		// get the front channels as stereo
+		opusTrack := audioTrack
+		var surroundTrack *webrtc.TrackLocalStaticRTP
+		var surround *rtcfanout.SurroundAudio
+		if opus, ok := rtspClient.OpusConfig(); ok && opus.Channels > 2 {
+			surround, err = rtcfanout.NewSurroundAudio(opus.Channels, opus.Streams, opus.CoupledStreams, opus.Mapping)
+			if err != nil {
+				return nil, fmt.Errorf("surround audio: %w", err)
+			}
+			if surround.Multiopus() {
+				surroundTrack, err = rtcfanout.CreateSurroundAudioTrack(opus.Channels)
+				if err != nil {
+					return nil, fmt.Errorf("creating surround audio track: %w", err)
+				}
+				log.Printf("Sending %d channel audio to browsers that support multiopus", opus.Channels)
+			} else {
+				log.Printf("Host Opus layout %+v doesn't match multiopus, sending stereo only", opus)
+			}
+		} else if audioChannels > 2 {
+			log.Printf("Host didn't describe a %d channel layout, assuming stereo", audioChannels)
+		}
+
+		surroundPacketizer := rtcfanout.NewAudioPacketizer()
+		rtspClient.OnAudioPacket(func(pkt rtsp.AudioPacket) {
+			if surround == nil {
+				opusTrack.WriteRTP(audioPacketizer.Packetize(pkt.Data, pkt.Timestamp))
+				return
+			}
+
+			if surroundTrack != nil {
+				if data, err := surround.ToMultiopus(pkt.Data); err == nil {
+					surroundTrack.WriteRTP(surroundPacketizer.Packetize(data, pkt.Timestamp))
+				}
+			}
+			if data, err := surround.ToStereo(pkt.Data); err == nil {
+				opusTrack.WriteRTP(audioPacketizer.Packetize(data, pkt.Timestamp))
+			}
+		})
+
+		// Set tracks on web server
+		webServer.SetVideoTrack(videoTrack)
+		webServer.SetSurroundAudioTrack(surroundTrack)
+		webServer.SetAudioTrack(audioTrack)
+
+		// Open the control stream used for input
+		ctrl := control.NewClient(sunshineClient.Host(), rtspClient.ControlPort())
+		ctrl.SetConnectData(rtspClient.ConnectData())
+		ctrl.OnHDRMode(func(enabled bool, metadata *control.HDRMetadata) {
+			if enabled && metadata != nil {
+				log.Printf("[%s] HDR display: %d nits peak, content light level %d nits", host.Name, metadata.MaxDisplayLuminance, metadata.MaxContentLightLevel)
+			} else if hdr && !enabled {
+				log.Printf("[%s] Host is sending SDR video; its display may not be in HDR mode", host.Name)
+			}
+			webServer.SetHDR(enabled)
+		})
+		if err := ctrl.SetInputKey(riKey, riKeyID); err != nil {
+			return nil, fmt.Errorf("control stream: %w", err)
+		}
+		if err := ctrl.Connect(); err != nil {
+			return nil, fmt.Errorf("control stream: %w", err)
+		}
+
+		controlMu.Lock()
+		controlStream = ctrl
+		controlMu.Unlock()
+
+		log.Printf("Stream started successfully")
+		return &app, nil
+	})
+
+	// Keyframe requests from browsers go to the host as IDR requests
+	webServer.OnKeyframeRequest(func() {
+		controlMu.RLock()
+		ctrl := controlStream
+		controlMu.RUnlock()
+
+		if ctrl != nil {
+			if err := ctrl.RequestIDRFrame(); err != nil {
+				log.Printf("Failed to request IDR frame: %v", err)
+			}
+		}
+	})
+
+	webServer.OnStopStream(func() {
+		log.Printf("Stopping stream...")
+
+		controlMu.Lock()
+		if controlStream != nil {
+			controlStream.Close()
+			controlStream = nil
+		}
+		controlMu.Unlock()
+
+		if rtspClient != nil {
+			rtspClient.Close()
+			rtspClient = nil
+		}
+
+		// The app keeps running on the host, so the next session resumes it
+		sunshineClient = nil
+
+		videoTrack = nil
+		audioTrack = nil
+
+		log.Printf("Stream stopped")
+	})
+
+	// Set up input handlers
+	inputHandler := webServer.InputHandler()
+	setupInputForwarding(inputHandler, func() *control.Client {
+		controlMu.RLock()
+		defer controlMu.RUnlock()
+		return controlStream
+	}, func() uint16 {
+		if sess := webServer.SessionManager().GetSession(); sess != nil {
+			return uint16(sess.GetActiveGamepads())
+		}
+		return 0
+	})
+
+	// Create HTTP server
+	srv := &http.Server{
+		Addr:    cfg.Server.BindAddress,
+		Handler: webServer.Router(),
+	}
+
+	// Start server
+	go func() {
+		log.Printf("Starting Gamelight server on %s", cfg.Server.BindAddress)
+		log.Printf("Open http://%s in your browser", cfg.Server.BindAddress)
+
+		var err error
+		if cfg.Server.TLSCert != "" && cfg.Server.TLSKey != "" {
+			err = srv.ListenAndServeTLS(cfg.Server.TLSCert, cfg.Server.TLSKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+
+	// Wait for shutdown signal
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Println("Shutting down server...")
+
+	// Graceful shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	controlMu.Lock()
+	if controlStream != nil {
+		controlStream.Close()
+	}
+	controlMu.Unlock()
+
+	// Leave the app running for the next run to resume
+	if rtspClient != nil {
+		rtspClient.Close()
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("server forced to shutdown: %w", err)
+	}
+
+	log.Println("Server stopped")
+	return nil
+}
+
+// chooseApp returns the app with the given ID or, for ID 0, the app named
+// defaultApp, falling back to the first app
+func chooseApp(apps []sunshine.App, appID int, defaultApp string) (sunshine.App, error) {
+	if len(apps) == 0 {
+		return sunshine.App{}, fmt.Errorf("host has no apps")
+	}
+
+	for _, app := range apps {
+		if (appID != 0 && app.ID == appID) || (appID == 0 && app.Title == defaultApp) {
+			return app, nil
+		}
+	}
+	if appID != 0 {
+		return sunshine.App{}, fmt.Errorf("host has no app with ID %d", appID)
+	}
+
+	log.Printf("Default app '%s' not found, using '%s'", defaultApp, apps[0].Title)
+	return apps[0], nil
+}
+
+func setupInputForwarding(handler *input.Handler, stream func() *control.Client, activeGamepads func() uint16) {
+	handler.OnMouseMove(func(e input.MouseMoveEvent) {
+		if ctrl := stream(); ctrl != nil {
+			if err := ctrl.SendMouseMove(e); err != nil {
+				log.Printf("Failed to send mouse move: %v", err)
+			}
+		}
+	})
+
+	handler.OnMousePosition(func(e input.MousePositionEvent) {
+		if ctrl := stream(); ctrl != nil {
+			if err := ctrl.SendMousePosition(e); err != nil {
+				log.Printf("Failed to send mouse position: %v", err)
+			}
+		}
+	})
+
+	handler.OnMouseButton(func(e input.MouseButtonEvent) {
+		if ctrl := stream(); ctrl != nil {
+			if err := ctrl.SendMouseButton(e); err != nil {
+				log.Printf("Failed to send mouse button: %v", err)
+			}
+		}
+	})
+
+	handler.OnMouseScroll(func(e input.MouseScrollEvent) {
+		if ctrl := stream(); ctrl != nil {
+			if err := ctrl.SendMouseScroll(e); err != nil {
+				log.Printf("Failed to send mouse scroll: %v", err)
+			}
+		}
+	})
+
+	handler.OnKeyboard(func(e input.KeyboardEvent) {
+		if ctrl := stream(); ctrl != nil {
+			if err := ctrl.SendKeyboard(e); err != nil {
+				log.Printf("Failed to send keyboard event: %v", err)
+			}
+		}
+	})
+
+	handler.OnController(func(e input.ControllerEvent) {
+		if ctrl := stream(); ctrl != nil {
+			if err := ctrl.SendController(e, activeGamepads()); err != nil {
+				log.Printf("Failed to send controller %d state: %v", e.ControllerNumber, err)
+			}
+		}
+	})
+
+	handler.OnTouch(func(e input.TouchEvent) {
+		if ctrl := stream(); ctrl != nil {
+			if err := ctrl.SendTouch(e); err != nil {
+				log.Printf("Failed to send touch event: %v", err)
+			}
+		}
+	})
+}
+
+// videoCodec is a video codec as WebRTC, RTSP and Sunshine name it
+type videoCodec struct {
+	mimeType string
+	rtsp     rtsp.VideoCodec
+	mode     int // sunshine.CodecMode* bit
+	hdrMode  int // sunshine.CodecMode* bit for 10-bit, 0 if there is none
+	name     string
+}
+
+// videoCodecs are the codecs gamelight can stream, with the names used in
+// the config
+var videoCodecs = []videoCodec{
+	{webrtc.MimeTypeH264, rtsp.CodecH264, sunshine.CodecModeH264, 0, "h264"},
+	{webrtc.MimeTypeH265, rtsp.CodecHEVC, sunshine.CodecModeHEVC, sunshine.CodecModeHEVCMain10, "hevc"},
+	{webrtc.MimeTypeAV1, rtsp.CodecAV1, sunshine.CodecModeAV1Main8, sunshine.CodecModeAV1Main10, "av1"},
+}
+
+// chooseVideoCodec picks the video codec for a stream: the preferred one if
+// the host and every browser support it, else the first of the browsers'
+// codecs, best first, that the host encodes. With hdr only codecs the host
+// encodes in 10-bit are candidates.
+func chooseVideoCodec(info *sunshine.ServerInfo, browserCodecs []string, preferred string, hdr bool) (videoCodec, error) {
+	if len(browserCodecs) == 0 {
+		if hdr {
+			return videoCodec{}, fmt.Errorf("the browsers have no 10-bit video codec in common")
+		}
+		return videoCodec{}, fmt.Errorf("the browsers have no video codec in common")
+	}
+
+	var candidates []videoCodec
+	for _, mimeType := range browserCodecs {
+		for _, codec := range videoCodecs {
+			mode := codec.mode
+			if hdr {
+				mode = codec.hdrMode
+			}
+			if strings.EqualFold(codec.mimeType, mimeType) && mode != 0 && info.SupportsCodecMode(mode) {
+				candidates = append(candidates, codec)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		if hdr {
+			return videoCodec{}, fmt.Errorf("no 10-bit video codec is supported by the host and every browser")
+		}
+		return videoCodec{}, fmt.Errorf("no video codec is supported by the host and every browser")
+	}
+
+	for _, codec := range candidates {
+		if codec.name == preferred {
+			return codec, nil
+		}
+	}
+	if preferred != "" && preferred != "auto" {
+		log.Printf("Preferred codec %s isn't supported by the host and every browser, using %s", preferred, candidates[0].rtsp)
+	}
+	return candidates[0], nil
+}
+
+// streamConfig converts the session's stream settings into the RTSP ANNOUNCE
+// configuration
+func streamConfig(settings session.StreamSettings, audioChannels int, codec rtsp.VideoCodec, hdr bool) rtsp.StreamConfig {
+	return rtsp.StreamConfig{
+		Width:   settings.Width,
+		Height:  settings.Height,
+		FPS:     settings.FPS,
+		Bitrate: settings.Bitrate,
+		Codec:   codec,
+		HDR:     hdr,
+
+		AudioChannels: audioChannels,
+		EncryptAudio:  true,
+	}
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,13 +16,71 @@ type Config struct {
 	Stream   StreamConfig   `yaml:"stream"`
 }
 
-// SunshineConfig holds Sunshine server connection settings
+// SunshineConfig holds Sunshine server connection settings. Without Hosts
+// it describes a single host named "default"; with Hosts, its ports and
+// certificate directory are the defaults for each listed host.
 type SunshineConfig struct {
+	Host         string       `yaml:"host"`
+	HTTPPort     int          `yaml:"http_port"`
+	HTTPSPort    int          `yaml:"https_port"`
+	ClientCert   string       `yaml:"client_cert"`
+	ClientKey    string       `yaml:"client_key"`
+	ServerCert   string       `yaml:"server_cert"`
+	IdentityFile string       `yaml:"identity_file"`
+	Hosts        []HostConfig `yaml:"hosts,omitempty"`
+}
+
+// HostConfig describes one named Sunshine host. Empty fields default to
+// the values in SunshineConfig, with credentials under a directory named
+// after the host.
+type HostConfig struct {
+	Name       string `yaml:"name"`
 	Host       string `yaml:"host"`
-	HTTPPort   int    `yaml:"http_port"`
-	HTTPSPort  int    `yaml:"https_port"`
-	ClientCert string `yaml:"client_cert"`
-	ClientKey  string `yaml:"client_key"`
+	HTTPPort   int    `yaml:"http_port,omitempty"`
+	HTTPSPort  int    `yaml:"https_port,omitempty"`
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+	ServerCert string `yaml:"server_cert,omitempty"`
+}
+
+// DefaultHostName is the name of the host described by SunshineConfig
+// itself when no hosts are listed
+const DefaultHostName = "default"
+
+// HostList returns the configured hosts with defaults filled in
+func (c SunshineConfig) HostList() []HostConfig {
+	if len(c.Hosts) == 0 {
+		return []HostConfig{{
+			Name:       DefaultHostName,
+			Host:       c.Host,
+			HTTPPort:   c.HTTPPort,
+			HTTPSPort:  c.HTTPSPort,
+			ClientCert: c.ClientCert,
+			ClientKey:  c.ClientKey,
+			ServerCert: c.ServerCert,
+		}}
+	}
+
+	hosts := make([]HostConfig, len(c.Hosts))
+	for i, h := range c.Hosts {
+		if h.HTTPPort == 0 {
+			h.HTTPPort = c.HTTPPort
+		}
+		if h.HTTPSPort == 0 {
+			h.HTTPSPort = c.HTTPSPort
+		}
+		if h.ClientCert == "" {
+			h.ClientCert = filepath.Join(filepath.Dir(c.ClientCert), h.Name, filepath.Base(c.ClientCert))
+		}
+		if h.ClientKey == "" {
+			h.ClientKey = filepath.Join(filepath.Dir(c.ClientKey), h.Name, filepath.Base(c.ClientKey))
+		}
+		if h.ServerCert == "" {
+			h.ServerCert = filepath.Join(filepath.Dir(c.ServerCert), h.Name, filepath.Base(c.ServerCert))
+		}
+		hosts[i] = h
+	}
+	return hosts
 }
 
 // ICEServer represents a STUN/TURN server configuration
@@ -56,15 +116,24 @@ type StreamConfig struct {
 	DefaultFPS     int    `yaml:"default_fps"`
 	DefaultWidth   int    `yaml:"default_width"`
 	DefaultHeight  int    `yaml:"default_height"`
+	AudioChannels  int    `yaml:"audio_channels"` // 2, 6 (5.1) or 8 (7.1)
+
+	// Codec is the preferred video codec: "auto", "h264", "hevc" or "av1".
+	// It is used when the host and every browser support it.
+	Codec string `yaml:"codec,omitempty"`
 }
 
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
 		Sunshine: SunshineConfig{
-			Host:      "localhost",
-			HTTPPort:  47989,
-			HTTPSPort: 47984,
+			Host:         "localhost",
+			HTTPPort:     47989,
+			HTTPSPort:    47984,
+			ClientCert:   "./certs/client.pem",
+			ClientKey:    "./certs/client.key",
+			ServerCert:   "./certs/server.pem",
+			IdentityFile: "./certs/identity.json",
 		},
 		WebRTC: WebRTCConfig{
 			ICEServers: []ICEServer{
@@ -83,6 +152,7 @@ func DefaultConfig() *Config {
 			DefaultFPS:     60,
 			DefaultWidth:   1920,
 			DefaultHeight:  1080,
+			AudioChannels:  2,
 		},
 	}
 }
@@ -103,9 +173,67 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// AddHost adds a named host. A config describing a single host is first
+// turned into a list holding it as "default", keeping its credentials.
+func (c *SunshineConfig) AddHost(h HostConfig) error {
+	if h.Name == "" || h.Host == "" {
+		return fmt.Errorf("sunshine host needs a name and an address")
+	}
+
+	if len(c.Hosts) == 0 {
+		c.Hosts = c.HostList()
+	}
+	for _, existing := range c.Hosts {
+		if existing.Name == h.Name {
+			return fmt.Errorf("duplicate sunshine host name %q", h.Name)
+		}
+	}
+
+	c.Hosts = append(c.Hosts, h)
+	return nil
+}
+
+// HostByAddress returns the configured host with the given address
+func (c SunshineConfig) HostByAddress(address string) (HostConfig, bool) {
+	for _, h := range c.HostList() {
+		if h.Host == address {
+			return h, true
+		}
+	}
+	return HostConfig{}, false
+}
+
+// validate checks settings that can't be defaulted
+func (c *Config) validate() error {
+	names := make(map[string]bool)
+	for _, h := range c.Sunshine.Hosts {
+		if h.Name == "" {
+			return fmt.Errorf("sunshine host %q has no name", h.Host)
+		}
+		if h.Host == "" {
+			return fmt.Errorf("sunshine host %q has no address", h.Name)
+		}
+		if names[h.Name] {
+			return fmt.Errorf("duplicate sunshine host name %q", h.Name)
+		}
+		names[h.Name] = true
+	}
+
+	switch c.Stream.Codec {
+	case "", "auto", "h264", "hevc", "av1":
+	default:
+		return fmt.Errorf("unknown stream codec %q, use auto, h264, hevc or av1", c.Stream.Codec)
+	}
+	return nil
+}
+
 // Save writes configuration to a YAML file
 func (c *Config) Save(path string) error {
 	data, err := yaml.Marshal(c)
@@ -0,0 +1,341 @@
+package control
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gamelight/gamelight/pkg/input"
+)
+
+// DefaultPort is Sunshine's control stream port (base port + 9)
+const DefaultPort = 47999
+
+// Control message types (Gen 7)
+const (
+	MsgStartA          uint16 = 0x0305
+	MsgStartB          uint16 = 0x0307
+	MsgInvalidateRefs  uint16 = 0x0301
+	MsgLossStats       uint16 = 0x0201
+	MsgInputData       uint16 = 0x0206
+	MsgRumble          uint16 = 0x010b
+	MsgTermination     uint16 = 0x0100
+	MsgTerminationExt  uint16 = 0x0109
+	MsgPeriodicPing    uint16 = 0x0200
+	MsgRequestIDRFrame uint16 = 0x0302
+	MsgHDRMode         uint16 = 0x010e
+)
+
+// ENet channels used by Moonlight clients
+const (
+	channelGeneric     uint8 = 0x00
+	channelUrgent      uint8 = 0x01
+	channelKeyboard    uint8 = 0x02
+	channelMouse       uint8 = 0x03
+	channelPen         uint8 = 0x04
+	channelTouch       uint8 = 0x05
+	channelUTF8        uint8 = 0x06
+	channelGamepadBase uint8 = 0x10
+	channelSensorBase  uint8 = 0x20
+	channelCount             = 0x30
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	pingInterval   = 100 * time.Millisecond
+)
+
+var (
+	ErrNotConnected = errors.New("control stream not connected")
+)
+
+// Client is a Moonlight control stream connection to Sunshine. It carries
+// input from the browser to the host and session events back.
+type Client struct {
+	mu sync.Mutex
+
+	host string
+	port int
+
+	peer *enetPeer
+
+	// connectData is sent in the ENet CONNECT so the host can match this
+	// connection to the RTSP session
+	connectData uint32
+
+	// Input encryption; inputMu keeps packets in the order they were sealed
+	inputMu     sync.Mutex
+	inputCipher *InputCipher
+
+	// Callbacks
+	onTerminate func(code uint32)
+	onHDRMode   func(enabled bool, metadata *HDRMetadata)
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// NewClient creates a new control stream client
+func NewClient(host string, port int) *Client {
+	if port == 0 {
+		port = DefaultPort
+	}
+	return &Client{
+		host:      host,
+		port:      port,
+		closeChan: make(chan struct{}),
+	}
+}
+
+// SetInputKey sets the rikey and rikeyid that were sent in the launch
+// request. Input is encrypted with them from then on.
+func (c *Client) SetInputKey(key [16]byte, keyID uint32) error {
+	ic, err := NewInputCipher(key, keyID)
+	if err != nil {
+		return err
+	}
+
+	c.inputMu.Lock()
+	c.inputCipher = ic
+	c.inputMu.Unlock()
+	return nil
+}
+
+// SetConnectData sets the value from the RTSP control stream SETUP
+// (X-SS-Connect-Data). It must be called before Connect.
+func (c *Client) SetConnectData(data uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connectData = data
+}
+
+// OnTerminate sets the callback for when the host ends the stream
+func (c *Client) OnTerminate(fn func(code uint32)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onTerminate = fn
+}
+
+// OnHDRMode sets the callback for when the host turns HDR video on or off.
+// metadata describes the host display and content when the host sends it.
+func (c *Client) OnHDRMode(fn func(enabled bool, metadata *HDRMetadata)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onHDRMode = fn
+}
+
+// Connect opens the ENet connection and performs the start handshake
+func (c *Client) Connect() error {
+	addr := net.JoinHostPort(c.host, strconv.Itoa(c.port))
+
+	c.mu.Lock()
+	connectData := c.connectData
+	c.mu.Unlock()
+
+	peer, err := dialENet(addr, channelCount, connectData, connectTimeout)
+	if err != nil {
+		return fmt.Errorf("connecting control stream: %w", err)
+	}
+
+	c.mu.Lock()
+	c.peer = peer
+	c.mu.Unlock()
+
+	if err := c.sendMessage(channelGeneric, MsgStartA, []byte{0, 0}); err != nil {
+		peer.Close()
+		return fmt.Errorf("sending start A: %w", err)
+	}
+	if err := c.sendMessage(channelGeneric, MsgStartB, []byte{0}); err != nil {
+		peer.Close()
+		return fmt.Errorf("sending start B: %w", err)
+	}
+
+	go c.receiveLoop(peer)
+	go c.pingLoop(peer)
+
+	return nil
+}
+
+// RequestIDRFrame asks the host to encode the next frame as an IDR frame,
+// which decoders can start from
+func (c *Client) RequestIDRFrame() error {
+	return c.sendMessage(channelUrgent, MsgRequestIDRFrame, nil)
+}
+
+// SendMouseMove forwards a relative mouse movement to the host
+func (c *Client) SendMouseMove(e input.MouseMoveEvent) error {
+	return c.sendInput(channelMouse, input.EncodeMouseMove(e))
+}
+
+// SendMousePosition forwards an absolute mouse position to the host
+func (c *Client) SendMousePosition(e input.MousePositionEvent) error {
+	return c.sendInput(channelMouse, input.EncodeMousePosition(e))
+}
+
+// SendMouseButton forwards a mouse button event to the host
+func (c *Client) SendMouseButton(e input.MouseButtonEvent) error {
+	return c.sendInput(channelMouse, input.EncodeMouseButton(e))
+}
+
+// SendMouseScroll forwards a scroll event to the host
+func (c *Client) SendMouseScroll(e input.MouseScrollEvent) error {
+	return c.sendInput(channelMouse, input.EncodeMouseScroll(e))
+}
+
+// SendKeyboard forwards a keyboard event to the host
+func (c *Client) SendKeyboard(e input.KeyboardEvent) error {
+	return c.sendInput(channelKeyboard, input.EncodeKeyboard(e))
+}
+
+// SendController forwards a controller state to the host. activeMask has a
+// bit set for every connected controller.
+func (c *Client) SendController(e input.ControllerEvent, activeMask uint16) error {
+	return c.sendInput(channelGamepadBase+e.ControllerNumber, input.EncodeController(e, activeMask))
+}
+
+// SendTouch forwards a touch event to the host
+func (c *Client) SendTouch(e input.TouchEvent) error {
+	return c.sendInput(channelTouch, input.EncodeTouch(e))
+}
+
+// Close disconnects the control stream
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+	})
+
+	c.mu.Lock()
+	peer := c.peer
+	c.peer = nil
+	c.mu.Unlock()
+
+	if peer != nil {
+		return peer.Close()
+	}
+	return nil
+}
+
+func (c *Client) sendInput(channel uint8, packet []byte) error {
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+
+	if c.inputCipher == nil {
+		return c.sendMessage(channel, MsgInputData, packet)
+	}
+
+	// The chained IV means the host must see packets in sealing order, and
+	// ENet only orders packets within a channel
+	return c.sendMessage(channelGeneric, MsgInputData, c.inputCipher.Seal(packet))
+}
+
+// sendMessage sends a control message with a V1 header (little-endian type)
+func (c *Client) sendMessage(channel uint8, msgType uint16, payload []byte) error {
+	c.mu.Lock()
+	peer := c.peer
+	c.mu.Unlock()
+
+	if peer == nil {
+		return ErrNotConnected
+	}
+
+	msg := make([]byte, 2+len(payload))
+	binary.LittleEndian.PutUint16(msg[0:2], msgType)
+	copy(msg[2:], payload)
+
+	return peer.SendReliable(channel, msg)
+}
+
+func (c *Client) receiveLoop(peer *enetPeer) {
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-peer.Done():
+			if err := peer.Err(); err != nil && !errors.Is(err, errENetDisconnected) {
+				log.Printf("Control stream closed: %v", err)
+			}
+			c.terminate(0)
+			return
+		case pkt := <-peer.Packets():
+			c.handleMessage(pkt.Data)
+		}
+	}
+}
+
+func (c *Client) handleMessage(data []byte) {
+	if len(data) < 2 {
+		return
+	}
+
+	msgType := binary.LittleEndian.Uint16(data[0:2])
+	payload := data[2:]
+
+	switch msgType {
+	case MsgTermination, MsgTerminationExt:
+		var code uint32
+		if len(payload) >= 4 {
+			code = binary.BigEndian.Uint32(payload[len(payload)-4:])
+		}
+		log.Printf("Host terminated the stream (code 0x%08x)", code)
+		c.terminate(code)
+	case MsgHDRMode:
+		c.handleHDRMode(payload)
+	}
+}
+
+// handleHDRMode parses an HDR mode message: an enabled byte, followed by
+// the static metadata on hosts that send it
+func (c *Client) handleHDRMode(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+
+	enabled := payload[len(payload)-1] != 0
+	var metadata *HDRMetadata
+	if len(payload) >= 1+hdrMetadataSize {
+		enabled = payload[len(payload)-1-hdrMetadataSize] != 0
+		metadata = parseHDRMetadata(payload[len(payload)-hdrMetadataSize:])
+	}
+	log.Printf("Host HDR mode: %v", enabled)
+
+	c.mu.Lock()
+	fn := c.onHDRMode
+	c.mu.Unlock()
+
+	if fn != nil {
+		fn(enabled, metadata)
+	}
+}
+
+func (c *Client) terminate(code uint32) {
+	c.mu.Lock()
+	fn := c.onTerminate
+	c.onTerminate = nil
+	c.mu.Unlock()
+
+	if fn != nil {
+		fn(code)
+	}
+}
+
+// pingLoop sends periodic pings so Sunshine doesn't time out an idle session
+func (c *Client) pingLoop(peer *enetPeer) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-peer.Done():
+			return
+		case <-ticker.C:
+			c.sendMessage(channelGeneric, MsgPeriodicPing, []byte{0, 0})
+		}
+	}
+}
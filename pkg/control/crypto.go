@@ -0,0 +1,67 @@
+package control
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	gcmTagSize = 16
+	gcmIVSize  = 16
+)
+
+// InputCipher encrypts input packets the way Sunshine expects on the Gen 7
+// input path. Packets are sealed with AES-128-GCM under the launch rikey and
+// sent as a big-endian length, the 16-byte tag, then the ciphertext.
+//
+// The IV is chained: it starts as the big-endian rikeyid followed by zeros,
+// and after any packet with at least 16 bytes of ciphertext it becomes the
+// last 16 bytes of that ciphertext. Packets must therefore reach the host in
+// the order they were sealed.
+type InputCipher struct {
+	mu  sync.Mutex
+	gcm cipher.AEAD
+	iv  [gcmIVSize]byte
+}
+
+// NewInputCipher creates an input cipher for the key and key ID sent in the
+// launch request
+func NewInputCipher(key [16]byte, keyID uint32) (*InputCipher, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCMWithNonceSize(block, gcmIVSize)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &InputCipher{gcm: gcm}
+	binary.BigEndian.PutUint32(c.iv[0:4], keyID)
+	return c, nil
+}
+
+// Seal encrypts an input packet and returns the control message payload
+func (c *InputCipher) Seal(packet []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Go appends the tag to the ciphertext; Sunshine wants it in front
+	sealed := c.gcm.Seal(nil, c.iv[:], packet, nil)
+	ciphertext := sealed[:len(sealed)-gcmTagSize]
+	tag := sealed[len(sealed)-gcmTagSize:]
+
+	out := make([]byte, 4+len(sealed))
+	binary.BigEndian.PutUint32(out[0:4], uint32(len(sealed)))
+	copy(out[4:4+gcmTagSize], tag)
+	copy(out[4+gcmTagSize:], ciphertext)
+
+	if len(ciphertext) >= gcmIVSize {
+		copy(c.iv[:], ciphertext[len(ciphertext)-gcmIVSize:])
+	}
+
+	return out
+}
@@ -0,0 +1,74 @@
+package control
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The vectors were produced with OpenSSL's EVP AES-128-GCM and a 16-byte IV,
+// the calls Sunshine's legacy input decryption makes, encrypting instead of
+// decrypting: the IV starts as the big-endian rikeyid followed by zeros and
+// becomes the last 16 bytes of any ciphertext at least that long.
+func TestInputCipherSeal(t *testing.T) {
+	key := [16]byte{
+		0x9f, 0x3c, 0x71, 0xa2, 0xe4, 0x58, 0x0b, 0x6d,
+		0x12, 0xc8, 0xf0, 0xa7, 0x33, 0x6e, 0x54, 0xd1,
+	}
+	const keyID = 0x1d2c3b4a
+
+	tests := []struct {
+		name   string
+		packet string
+		want   string // BE32 length, tag, ciphertext
+	}{
+		{
+			// Too short to change the IV
+			name:   "12 bytes under the rikeyid IV",
+			packet: "0000000a070000000005fff6",
+			want: "0000001c" +
+				"651b116880dd22c5029fe5dac47dd42c" +
+				"681f4d290b28601254bad59d",
+		},
+		{
+			name:   "22 bytes under the rikeyid IV",
+			packet: "000000120c00000001000412000001ff00020006000c",
+			want: "00000026" +
+				"6605659ad528578b74f6609ac6c5de2f" +
+				"681f4d310028601255bf2e79936f7a054dbd11e0ffd2",
+		},
+		{
+			name:   "11 bytes under the chained IV",
+			packet: "0000000603000000008000",
+			want: "0000001b" +
+				"1a47966cfbc4aabfc3aa86b44b2b85a5" +
+				"133354eb2e67227ebf8fec",
+		},
+	}
+
+	c, err := NewInputCipher(key, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex(t, "1d2c3b4a000000000000000000000000"); !bytes.Equal(c.iv[:], want) {
+		t.Fatalf("initial IV = %x, want %x", c.iv, want)
+	}
+
+	// The packets are sealed in order, each under the IV the last left
+	for _, tt := range tests {
+		got := c.Seal(mustHex(t, tt.packet))
+		if want := mustHex(t, tt.want); !bytes.Equal(got, want) {
+			t.Fatalf("%s:\n got %x\nwant %x", tt.name, got, want)
+		}
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
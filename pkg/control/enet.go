@@ -0,0 +1,566 @@
+package control
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// This file implements the subset of the ENet reliable UDP protocol that
+// Sunshine's control stream needs: connect, reliable/unreliable sends,
+// acknowledgements, pings and disconnect. Fragmented and compressed packets
+// are not used by the control stream and are not supported.
+
+const (
+	enetCmdAcknowledge            = 1
+	enetCmdConnect                = 2
+	enetCmdVerifyConnect          = 3
+	enetCmdDisconnect             = 4
+	enetCmdPing                   = 5
+	enetCmdSendReliable           = 6
+	enetCmdSendUnreliable         = 7
+	enetCmdSendFragment           = 8
+	enetCmdSendUnsequenced        = 9
+	enetCmdBandwidthLimit         = 10
+	enetCmdThrottleConfigure      = 11
+	enetCmdSendUnreliableFragment = 12
+
+	enetCmdMask         = 0x0F
+	enetFlagAcknowledge = 0x80
+	enetFlagUnsequenced = 0x40
+
+	enetHeaderFlagCompressed = 0x4000
+	enetHeaderFlagSentTime   = 0x8000
+	enetHeaderSessionShift   = 12
+
+	enetMaxPeerID     = 0x0FFF
+	enetMTU           = 1400
+	enetWindowSize    = 65536
+	enetConnectChanID = 0xFF
+
+	enetThrottleInterval     = 5000
+	enetThrottleAcceleration = 2
+	enetThrottleDeceleration = 2
+
+	enetRetransmitTimeout = 200 * time.Millisecond
+	enetPeerTimeout       = 10 * time.Second
+	enetPingInterval      = 500 * time.Millisecond
+)
+
+// enetCommandSizes holds the fixed size of each command, including the
+// 4-byte command header, indexed by command number
+var enetCommandSizes = [...]int{
+	0,
+	enetCmdAcknowledge:            8,
+	enetCmdConnect:                48,
+	enetCmdVerifyConnect:          44,
+	enetCmdDisconnect:             8,
+	enetCmdPing:                   4,
+	enetCmdSendReliable:           6,
+	enetCmdSendUnreliable:         8,
+	enetCmdSendFragment:           24,
+	enetCmdSendUnsequenced:        8,
+	enetCmdBandwidthLimit:         12,
+	enetCmdThrottleConfigure:      16,
+	enetCmdSendUnreliableFragment: 24,
+}
+
+var (
+	errENetTimeout      = errors.New("enet: peer timed out")
+	errENetDisconnected = errors.New("enet: peer disconnected")
+)
+
+// enetPacket is an application packet received from the remote peer
+type enetPacket struct {
+	Channel uint8
+	Data    []byte
+}
+
+// enetOutgoing is a reliable command waiting for acknowledgement
+type enetOutgoing struct {
+	command  []byte
+	sentAt   time.Time
+	firstAt  time.Time
+	attempts int
+}
+
+type enetChannel struct {
+	outgoingReliableSeq   uint16
+	outgoingUnreliableSeq uint16
+
+	incomingReliableSeq uint16
+	pending             map[uint16][]byte
+}
+
+// enetPeer is a client-side ENet connection to a single host
+type enetPeer struct {
+	mu sync.Mutex
+
+	conn      *net.UDPConn
+	startTime time.Time
+
+	outgoingPeerID    uint16
+	outgoingSessionID uint8
+	connectID         uint32
+	connected         bool
+
+	channels   []*enetChannel
+	connectCh  *enetChannel
+	unacked    map[uint32]*enetOutgoing
+	acks       []byte
+	lastRecvAt time.Time
+
+	packets   chan enetPacket
+	verified  chan struct{}
+	closeChan chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// dialENet connects to an ENet host and completes the connect handshake
+func dialENet(addr string, channelCount int, data uint32, timeout time.Duration) (*enetPeer, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", addr, err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", addr, err)
+	}
+
+	var connectID [4]byte
+	if _, err := rand.Read(connectID[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p := &enetPeer{
+		conn:           conn,
+		startTime:      time.Now(),
+		outgoingPeerID: enetMaxPeerID,
+		connectID:      binary.BigEndian.Uint32(connectID[:]),
+		channels:       make([]*enetChannel, channelCount),
+		connectCh:      &enetChannel{pending: make(map[uint16][]byte)},
+		unacked:        make(map[uint32]*enetOutgoing),
+		lastRecvAt:     time.Now(),
+		packets:        make(chan enetPacket, 64),
+		verified:       make(chan struct{}),
+		closeChan:      make(chan struct{}),
+	}
+	for i := range p.channels {
+		p.channels[i] = &enetChannel{pending: make(map[uint16][]byte)}
+	}
+
+	// CONNECT: outgoingPeerID, incomingSessionID, outgoingSessionID, mtu,
+	// windowSize, channelCount, incoming/outgoing bandwidth, throttle
+	// interval/acceleration/deceleration, connectID, data
+	body := make([]byte, 44)
+	binary.BigEndian.PutUint16(body[0:2], 0)
+	body[2] = 0xFF
+	body[3] = 0xFF
+	binary.BigEndian.PutUint32(body[4:8], enetMTU)
+	binary.BigEndian.PutUint32(body[8:12], enetWindowSize)
+	binary.BigEndian.PutUint32(body[12:16], uint32(channelCount))
+	binary.BigEndian.PutUint32(body[16:20], 0)
+	binary.BigEndian.PutUint32(body[20:24], 0)
+	binary.BigEndian.PutUint32(body[24:28], enetThrottleInterval)
+	binary.BigEndian.PutUint32(body[28:32], enetThrottleAcceleration)
+	binary.BigEndian.PutUint32(body[32:36], enetThrottleDeceleration)
+	binary.BigEndian.PutUint32(body[36:40], p.connectID)
+	binary.BigEndian.PutUint32(body[40:44], data)
+
+	go p.readLoop()
+	go p.serviceLoop()
+
+	p.mu.Lock()
+	err = p.queueReliableLocked(enetCmdConnect, enetConnectChanID, body)
+	p.mu.Unlock()
+	if err != nil {
+		p.close(err)
+		return nil, err
+	}
+
+	select {
+	case <-p.verified:
+		return p, nil
+	case <-p.closeChan:
+		return nil, p.err
+	case <-time.After(timeout):
+		p.close(errENetTimeout)
+		return nil, fmt.Errorf("connecting to %s: %w", addr, errENetTimeout)
+	}
+}
+
+// Packets returns the channel of packets received from the host
+func (p *enetPeer) Packets() <-chan enetPacket {
+	return p.packets
+}
+
+// Done is closed when the connection is closed
+func (p *enetPeer) Done() <-chan struct{} {
+	return p.closeChan
+}
+
+// Err returns the reason the connection was closed
+func (p *enetPeer) Err() error {
+	select {
+	case <-p.closeChan:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// SendReliable queues a reliable packet on the given channel
+func (p *enetPeer) SendReliable(channel uint8, data []byte) error {
+	if int(channel) >= len(p.channels) {
+		return fmt.Errorf("enet: invalid channel %d", channel)
+	}
+	if len(data) > enetMTU-16 {
+		return fmt.Errorf("enet: packet of %d bytes exceeds MTU", len(data))
+	}
+
+	body := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(body[0:2], uint16(len(data)))
+	copy(body[2:], data)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queueReliableLocked(enetCmdSendReliable, channel, body)
+}
+
+// SendUnreliable sends a sequenced unreliable packet on the given channel
+func (p *enetPeer) SendUnreliable(channel uint8, data []byte) error {
+	if int(channel) >= len(p.channels) {
+		return fmt.Errorf("enet: invalid channel %d", channel)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.Err(); err != nil {
+		return err
+	}
+
+	ch := p.channels[channel]
+	ch.outgoingUnreliableSeq++
+
+	cmd := make([]byte, 8+len(data))
+	cmd[0] = enetCmdSendUnreliable
+	cmd[1] = channel
+	binary.BigEndian.PutUint16(cmd[2:4], ch.outgoingReliableSeq)
+	binary.BigEndian.PutUint16(cmd[4:6], ch.outgoingUnreliableSeq)
+	binary.BigEndian.PutUint16(cmd[6:8], uint16(len(data)))
+	copy(cmd[8:], data)
+
+	return p.writeLocked(cmd, false)
+}
+
+// Close sends a disconnect to the host and closes the socket
+func (p *enetPeer) Close() error {
+	p.mu.Lock()
+	if p.connected && p.Err() == nil {
+		cmd := make([]byte, 8)
+		cmd[0] = enetCmdDisconnect | enetFlagUnsequenced
+		cmd[1] = enetConnectChanID
+		p.writeLocked(cmd, false)
+	}
+	p.mu.Unlock()
+
+	p.close(errENetDisconnected)
+	return nil
+}
+
+func (p *enetPeer) close(err error) {
+	p.closeOnce.Do(func() {
+		p.err = err
+		close(p.closeChan)
+		p.conn.Close()
+	})
+}
+
+func (p *enetPeer) channel(id uint8) *enetChannel {
+	if id == enetConnectChanID {
+		return p.connectCh
+	}
+	if int(id) < len(p.channels) {
+		return p.channels[id]
+	}
+	return nil
+}
+
+func (p *enetPeer) sentTime() uint16 {
+	return uint16(time.Since(p.startTime).Milliseconds())
+}
+
+// queueReliableLocked sends a command that must be acknowledged and keeps it
+// for retransmission until it is
+func (p *enetPeer) queueReliableLocked(command, channel uint8, body []byte) error {
+	if err := p.Err(); err != nil {
+		return err
+	}
+
+	ch := p.channel(channel)
+	ch.outgoingReliableSeq++
+	seq := ch.outgoingReliableSeq
+
+	cmd := make([]byte, 4+len(body))
+	cmd[0] = command | enetFlagAcknowledge
+	cmd[1] = channel
+	binary.BigEndian.PutUint16(cmd[2:4], seq)
+	copy(cmd[4:], body)
+
+	now := time.Now()
+	p.unacked[unackedKey(channel, seq)] = &enetOutgoing{
+		command:  cmd,
+		sentAt:   now,
+		firstAt:  now,
+		attempts: 1,
+	}
+
+	return p.writeLocked(cmd, true)
+}
+
+// writeLocked sends a datagram containing any pending acknowledgements
+// followed by cmd
+func (p *enetPeer) writeLocked(cmd []byte, needsAck bool) error {
+	peerID := p.outgoingPeerID
+	if peerID < enetMaxPeerID {
+		peerID |= uint16(p.outgoingSessionID) << enetHeaderSessionShift
+	}
+
+	withSentTime := needsAck || len(p.acks) > 0
+	buf := make([]byte, 0, 4+len(p.acks)+len(cmd))
+	if withSentTime {
+		buf = binary.BigEndian.AppendUint16(buf, peerID|enetHeaderFlagSentTime)
+		buf = binary.BigEndian.AppendUint16(buf, p.sentTime())
+	} else {
+		buf = binary.BigEndian.AppendUint16(buf, peerID)
+	}
+	buf = append(buf, p.acks...)
+	buf = append(buf, cmd...)
+	p.acks = p.acks[:0]
+
+	_, err := p.conn.Write(buf)
+	return err
+}
+
+func (p *enetPeer) queueAckLocked(channel uint8, seq, sentTime uint16) {
+	ack := make([]byte, 8)
+	ack[0] = enetCmdAcknowledge
+	ack[1] = channel
+	binary.BigEndian.PutUint16(ack[2:4], seq)
+	binary.BigEndian.PutUint16(ack[4:6], seq)
+	binary.BigEndian.PutUint16(ack[6:8], sentTime)
+	p.acks = append(p.acks, ack...)
+}
+
+func (p *enetPeer) flushAcksLocked() {
+	if len(p.acks) > 0 {
+		p.writeLocked(nil, false)
+	}
+}
+
+func unackedKey(channel uint8, seq uint16) uint32 {
+	return uint32(channel)<<16 | uint32(seq)
+}
+
+func (p *enetPeer) readLoop() {
+	buf := make([]byte, 2048)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			p.close(err)
+			return
+		}
+
+		p.handleDatagram(buf[:n])
+	}
+}
+
+func (p *enetPeer) handleDatagram(data []byte) {
+	if len(data) < 2 {
+		return
+	}
+
+	header := binary.BigEndian.Uint16(data[0:2])
+	data = data[2:]
+	if header&enetHeaderFlagCompressed != 0 {
+		return
+	}
+
+	var sentTime uint16
+	if header&enetHeaderFlagSentTime != 0 {
+		if len(data) < 2 {
+			return
+		}
+		sentTime = binary.BigEndian.Uint16(data[0:2])
+		data = data[2:]
+	}
+
+	p.mu.Lock()
+	p.lastRecvAt = time.Now()
+
+	var deliver []enetPacket
+	for len(data) >= 4 {
+		command := data[0] & enetCmdMask
+		if int(command) >= len(enetCommandSizes) || command == 0 {
+			break
+		}
+		size := enetCommandSizes[command]
+		if len(data) < size {
+			break
+		}
+
+		channel := data[1]
+		seq := binary.BigEndian.Uint16(data[2:4])
+
+		// Variable-length commands carry a data length after the fixed part
+		var payload []byte
+		switch command {
+		case enetCmdSendReliable, enetCmdSendUnreliable, enetCmdSendUnsequenced,
+			enetCmdSendFragment, enetCmdSendUnreliableFragment:
+			lengthOffset := size - 2
+			if command == enetCmdSendFragment || command == enetCmdSendUnreliableFragment {
+				lengthOffset = 6
+			}
+			dataLength := int(binary.BigEndian.Uint16(data[lengthOffset : lengthOffset+2]))
+			if len(data) < size+dataLength {
+				data = nil
+				continue
+			}
+			payload = data[size : size+dataLength]
+			size += dataLength
+		}
+
+		if data[0]&enetFlagAcknowledge != 0 {
+			p.queueAckLocked(channel, seq, sentTime)
+		}
+
+		switch command {
+		case enetCmdAcknowledge:
+			ackSeq := binary.BigEndian.Uint16(data[4:6])
+			delete(p.unacked, unackedKey(channel, ackSeq))
+
+		case enetCmdVerifyConnect:
+			if !p.connected && binary.BigEndian.Uint32(data[40:44]) == p.connectID {
+				p.outgoingPeerID = binary.BigEndian.Uint16(data[4:6])
+				p.outgoingSessionID = data[7]
+				p.connected = true
+				close(p.verified)
+			}
+
+		case enetCmdDisconnect:
+			p.mu.Unlock()
+			p.close(errENetDisconnected)
+			return
+
+		case enetCmdSendReliable:
+			deliver = append(deliver, p.receiveReliableLocked(channel, seq, payload)...)
+
+		case enetCmdSendFragment:
+			// Fragments are not reassembled, but they still occupy a slot in
+			// the channel's reliable sequence
+			deliver = append(deliver, p.receiveReliableLocked(channel, seq, nil)...)
+
+		case enetCmdSendUnreliable, enetCmdSendUnsequenced:
+			deliver = append(deliver, enetPacket{Channel: channel, Data: append([]byte(nil), payload...)})
+		}
+
+		data = data[size:]
+	}
+
+	p.flushAcksLocked()
+	p.mu.Unlock()
+
+	for _, pkt := range deliver {
+		select {
+		case p.packets <- pkt:
+		case <-p.closeChan:
+			return
+		}
+	}
+}
+
+// receiveReliableLocked returns the packets that are now deliverable in order
+// on the channel
+func (p *enetPeer) receiveReliableLocked(channel uint8, seq uint16, payload []byte) []enetPacket {
+	ch := p.channel(channel)
+	if ch == nil {
+		return nil
+	}
+
+	// Drop retransmissions of packets we have already delivered
+	if int16(seq-ch.incomingReliableSeq) <= 0 {
+		return nil
+	}
+	if payload != nil {
+		payload = append([]byte(nil), payload...)
+	}
+	ch.pending[seq] = payload
+
+	var ready []enetPacket
+	for {
+		next := ch.incomingReliableSeq + 1
+		data, ok := ch.pending[next]
+		if !ok {
+			break
+		}
+		delete(ch.pending, next)
+		ch.incomingReliableSeq = next
+		if data != nil {
+			ready = append(ready, enetPacket{Channel: channel, Data: data})
+		}
+	}
+	return ready
+}
+
+// serviceLoop retransmits unacknowledged commands, keeps the connection alive
+// and detects a dead peer
+func (p *enetPeer) serviceLoop() {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	lastPing := time.Now()
+	for {
+		select {
+		case <-p.closeChan:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		now := time.Now()
+
+		if now.Sub(p.lastRecvAt) > enetPeerTimeout {
+			p.mu.Unlock()
+			p.close(errENetTimeout)
+			return
+		}
+
+		for _, out := range p.unacked {
+			if now.Sub(out.firstAt) > enetPeerTimeout {
+				p.mu.Unlock()
+				p.close(errENetTimeout)
+				return
+			}
+			// The timeout doubles on each retransmission
+			if now.Sub(out.sentAt) >= enetRetransmitTimeout<<(out.attempts-1) {
+				out.sentAt = now
+				out.attempts++
+				p.writeLocked(out.command, true)
+			}
+		}
+
+		if p.connected && now.Sub(lastPing) >= enetPingInterval {
+			lastPing = now
+			p.queueReliableLocked(enetCmdPing, enetConnectChanID, nil)
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,340 @@
+package control
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testENetHost is the host end of an ENet connection on loopback. It
+// records every command the client sends and replies only when told to.
+type testENetHost struct {
+	t        *testing.T
+	conn     *net.UDPConn
+	client   chan *net.UDPAddr
+	commands chan testENetCommand
+}
+
+// testENetCommand is one command from a client datagram
+type testENetCommand struct {
+	peerID  uint16 // from the datagram header, without the flags
+	command uint8  // with its flags
+	channel uint8
+	seq     uint16
+	data    []byte // the whole command, header included
+	at      time.Time
+}
+
+func newTestENetHost(t *testing.T) *testENetHost {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	h := &testENetHost{
+		t:        t,
+		conn:     conn,
+		client:   make(chan *net.UDPAddr, 1),
+		commands: make(chan testENetCommand, 256),
+	}
+	go h.readLoop()
+	return h
+}
+
+func (h *testENetHost) addr() string {
+	return h.conn.LocalAddr().String()
+}
+
+func (h *testENetHost) readLoop() {
+	buf := make([]byte, 2048)
+	first := true
+	for {
+		n, addr, err := h.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if first {
+			h.client <- addr
+			first = false
+		}
+		now := time.Now()
+
+		data := buf[:n]
+		header := binary.BigEndian.Uint16(data[0:2])
+		data = data[2:]
+		if header&enetHeaderFlagSentTime != 0 {
+			data = data[2:]
+		}
+		peerID := header &^ (enetHeaderFlagSentTime | enetHeaderFlagCompressed)
+
+		for len(data) >= 4 {
+			size := enetCommandSizes[data[0]&enetCmdMask]
+			switch data[0] & enetCmdMask {
+			case enetCmdSendReliable:
+				size += int(binary.BigEndian.Uint16(data[4:6]))
+			case enetCmdSendUnreliable:
+				size += int(binary.BigEndian.Uint16(data[6:8]))
+			}
+			h.commands <- testENetCommand{
+				peerID:  peerID,
+				command: data[0],
+				channel: data[1],
+				seq:     binary.BigEndian.Uint16(data[2:4]),
+				data:    append([]byte(nil), data[:size]...),
+				at:      now,
+			}
+			data = data[size:]
+		}
+	}
+}
+
+// expect returns the next command matching command and channel, skipping
+// any others such as pings
+func (h *testENetHost) expect(command, channel uint8) testENetCommand {
+	h.t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case cmd := <-h.commands:
+			if cmd.command&enetCmdMask == command && cmd.channel == channel {
+				return cmd
+			}
+		case <-timeout:
+			h.t.Fatalf("no command %d on channel %d", command, channel)
+		}
+	}
+}
+
+// send writes commands to the client in one datagram
+func (h *testENetHost) send(commands ...[]byte) {
+	h.t.Helper()
+
+	var addr *net.UDPAddr
+	select {
+	case addr = <-h.client:
+		h.client <- addr
+	case <-time.After(5 * time.Second):
+		h.t.Fatal("client never sent anything")
+	}
+
+	buf := binary.BigEndian.AppendUint16(nil, enetHeaderFlagSentTime)
+	buf = binary.BigEndian.AppendUint16(buf, 0x1234)
+	for _, cmd := range commands {
+		buf = append(buf, cmd...)
+	}
+	if _, err := h.conn.WriteToUDP(buf, addr); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// ack acknowledges a reliable command from the client
+func (h *testENetHost) ack(cmd testENetCommand) {
+	h.t.Helper()
+
+	ack := make([]byte, 8)
+	ack[0] = enetCmdAcknowledge
+	ack[1] = cmd.channel
+	binary.BigEndian.PutUint16(ack[4:6], cmd.seq)
+	h.send(ack)
+}
+
+// accept answers the client's CONNECT, giving it peer ID 5 and session 2
+func (h *testENetHost) accept(connect testENetCommand) {
+	h.t.Helper()
+
+	verify := make([]byte, enetCommandSizes[enetCmdVerifyConnect])
+	verify[0] = enetCmdVerifyConnect | enetFlagAcknowledge
+	verify[1] = enetConnectChanID
+	binary.BigEndian.PutUint16(verify[2:4], 1)
+	binary.BigEndian.PutUint16(verify[4:6], 5)
+	verify[6] = 2
+	verify[7] = 2
+	binary.BigEndian.PutUint32(verify[8:12], enetMTU)
+	binary.BigEndian.PutUint32(verify[12:16], enetWindowSize)
+	copy(verify[16:20], connect.data[16:20])
+	copy(verify[40:44], connect.data[40:44])
+
+	ack := make([]byte, 8)
+	ack[0] = enetCmdAcknowledge
+	ack[1] = enetConnectChanID
+	binary.BigEndian.PutUint16(ack[4:6], connect.seq)
+	binary.BigEndian.PutUint16(ack[6:8], 0)
+	h.send(ack, verify)
+}
+
+// sendReliable sends a reliable packet to the client
+func (h *testENetHost) sendReliable(channel uint8, seq uint16, data []byte) {
+	h.t.Helper()
+
+	cmd := make([]byte, 6, 6+len(data))
+	cmd[0] = enetCmdSendReliable | enetFlagAcknowledge
+	cmd[1] = channel
+	binary.BigEndian.PutUint16(cmd[2:4], seq)
+	binary.BigEndian.PutUint16(cmd[4:6], uint16(len(data)))
+	h.send(append(cmd, data...))
+}
+
+func TestENetConnect(t *testing.T) {
+	host := newTestENetHost(t)
+
+	type result struct {
+		peer *enetPeer
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		peer, err := dialENet(host.addr(), channelCount, 0xCAFEF00D, 5*time.Second)
+		done <- result{peer, err}
+	}()
+
+	connect := host.expect(enetCmdConnect, enetConnectChanID)
+	if connect.command != enetCmdConnect|enetFlagAcknowledge {
+		t.Errorf("CONNECT flags = %#x, want acknowledge", connect.command)
+	}
+	if connect.peerID != enetMaxPeerID {
+		t.Errorf("CONNECT peer ID = %#x, want %#x", connect.peerID, enetMaxPeerID)
+	}
+	if len(connect.data) != 48 {
+		t.Fatalf("CONNECT is %d bytes, want 48", len(connect.data))
+	}
+	if got := binary.BigEndian.Uint32(connect.data[16:20]); got != channelCount {
+		t.Errorf("CONNECT channel count = %d, want %d", got, channelCount)
+	}
+	if got := binary.BigEndian.Uint32(connect.data[44:48]); got != 0xCAFEF00D {
+		t.Errorf("CONNECT data = %#x, want 0xcafef00d", got)
+	}
+
+	host.accept(connect)
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.peer.Close()
+
+	// The client acknowledges VERIFY_CONNECT as the peer the host assigned
+	ack := host.expect(enetCmdAcknowledge, enetConnectChanID)
+	if want := uint16(5 | 2<<enetHeaderSessionShift); ack.peerID != want {
+		t.Errorf("ack peer ID = %#x, want %#x", ack.peerID, want)
+	}
+	if got := binary.BigEndian.Uint16(ack.data[4:6]); got != 1 {
+		t.Errorf("ack of VERIFY_CONNECT has sequence %d, want 1", got)
+	}
+	if got := binary.BigEndian.Uint16(ack.data[6:8]); got != 0x1234 {
+		t.Errorf("ack sent time = %#x, want 0x1234", got)
+	}
+}
+
+func TestClientConnectStartsStream(t *testing.T) {
+	host := newTestENetHost(t)
+
+	_, portStr, _ := net.SplitHostPort(host.addr())
+	port, _ := strconv.Atoi(portStr)
+	client := NewClient("127.0.0.1", port)
+	defer client.Close()
+
+	terminated := make(chan uint32, 1)
+	client.OnTerminate(func(code uint32) { terminated <- code })
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- client.Connect() }()
+
+	host.accept(host.expect(enetCmdConnect, enetConnectChanID))
+
+	startA := host.expect(enetCmdSendReliable, channelGeneric)
+	if want := []byte{0x05, 0x03, 0x00, 0x00}; !bytes.Equal(startA.data[6:], want) {
+		t.Errorf("start A = % x, want % x", startA.data[6:], want)
+	}
+	startB := host.expect(enetCmdSendReliable, channelGeneric)
+	if want := []byte{0x07, 0x03, 0x00}; !bytes.Equal(startB.data[6:], want) {
+		t.Errorf("start B = % x, want % x", startB.data[6:], want)
+	}
+	if startB.seq != startA.seq+1 {
+		t.Errorf("start B sequence = %d, want %d", startB.seq, startA.seq+1)
+	}
+	host.ack(startA)
+	host.ack(startB)
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// A reliable termination from the host is acknowledged and delivered
+	host.sendReliable(channelGeneric, 1, []byte{0x00, 0x01, 0x80, 0x03, 0x00, 0x10})
+	ack := host.expect(enetCmdAcknowledge, channelGeneric)
+	if got := binary.BigEndian.Uint16(ack.data[4:6]); got != 1 {
+		t.Errorf("ack sequence = %d, want 1", got)
+	}
+
+	select {
+	case code := <-terminated:
+		if code != 0x80030010 {
+			t.Errorf("termination code = %#x, want 0x80030010", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("termination not delivered")
+	}
+}
+
+func TestENetRetransmit(t *testing.T) {
+	host := newTestENetHost(t)
+
+	done := make(chan *enetPeer, 1)
+	go func() {
+		peer, err := dialENet(host.addr(), channelCount, 0, 5*time.Second)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- peer
+	}()
+	host.accept(host.expect(enetCmdConnect, enetConnectChanID))
+	peer := <-done
+	if peer == nil {
+		t.FailNow()
+	}
+	defer peer.Close()
+
+	if err := peer.SendReliable(channelMouse, []byte("input")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unacknowledged, the packet is resent with the same sequence number,
+	// waiting twice as long each time. The service loop ticks every 50ms.
+	const tick = 50 * time.Millisecond
+	first := host.expect(enetCmdSendReliable, channelMouse)
+	prev := first
+	for i := 0; i < 3; i++ {
+		cmd := host.expect(enetCmdSendReliable, channelMouse)
+		if cmd.seq != first.seq || !bytes.Equal(cmd.data, first.data) {
+			t.Fatalf("retransmission = % x, want % x", cmd.data, first.data)
+		}
+		want := enetRetransmitTimeout << i
+		if gap := cmd.at.Sub(prev.at); gap < want-tick || gap > want+2*tick {
+			t.Errorf("retransmission %d after %v, want %v", i+1, gap, want)
+		}
+		prev = cmd
+	}
+
+	host.ack(first)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		peer.mu.Lock()
+		_, pending := peer.unacked[unackedKey(channelMouse, first.seq)]
+		peer.mu.Unlock()
+		if !pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("acknowledged packet still waiting for acknowledgement")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
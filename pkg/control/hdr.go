@@ -0,0 +1,45 @@
+package control
+
+import "encoding/binary"
+
+// hdrMetadataSize is the size of Sunshine's SS_HDR_METADATA
+const hdrMetadataSize = 26
+
+// HDRMetadata is the static HDR metadata the host sends with the HDR mode
+// message, as in SMPTE ST 2086 and CTA-861.3. Chromaticities are in units
+// of 0.00002; luminance is in nits except MinDisplayLuminance, which is in
+// 0.0001 nits.
+type HDRMetadata struct {
+	DisplayPrimaries [3][2]uint16 // red, green, blue x and y
+	WhitePoint       [2]uint16
+
+	MaxDisplayLuminance uint16
+	MinDisplayLuminance uint16
+
+	MaxContentLightLevel      uint16
+	MaxFrameAverageLightLevel uint16
+	MaxFullFrameLuminance     uint16
+}
+
+// parseHDRMetadata parses little-endian SS_HDR_METADATA
+func parseHDRMetadata(data []byte) *HDRMetadata {
+	if len(data) < hdrMetadataSize {
+		return nil
+	}
+
+	u16 := func(i int) uint16 {
+		return binary.LittleEndian.Uint16(data[2*i:])
+	}
+
+	var m HDRMetadata
+	for i := range m.DisplayPrimaries {
+		m.DisplayPrimaries[i] = [2]uint16{u16(2 * i), u16(2*i + 1)}
+	}
+	m.WhitePoint = [2]uint16{u16(6), u16(7)}
+	m.MaxDisplayLuminance = u16(8)
+	m.MinDisplayLuminance = u16(9)
+	m.MaxContentLightLevel = u16(10)
+	m.MaxFrameAverageLightLevel = u16(11)
+	m.MaxFullFrameLuminance = u16(12)
+	return &m
+}
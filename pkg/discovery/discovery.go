@@ -0,0 +1,384 @@
+// Package discovery finds Sunshine hosts on the local network with
+// multicast DNS service discovery (RFC 6762, RFC 6763)
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gamelight/gamelight/pkg/sunshine"
+)
+
+// ServiceType is the DNS-SD service Sunshine advertises
+const ServiceType = "_nvstream._tcp.local."
+
+// MDNSGroup is the IPv4 multicast DNS group and port
+var MDNSGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Host is a Sunshine host found on the network
+type Host struct {
+	// Instance is the advertised service instance name, usually the
+	// host's computer name
+	Instance string `json:"instance"`
+	Hostname string `json:"hostname"`
+	Address  string `json:"address"`
+	// Port is the host's HTTP port
+	Port     int    `json:"port"`
+	UniqueID string `json:"unique_id,omitempty"`
+}
+
+// ConfigName suggests a name for the host in the config file: the instance
+// name in lower case with anything but letters and digits turned into
+// dashes
+func (h Host) ConfigName() string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(h.Instance) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	name := strings.TrimSuffix(b.String(), "-")
+	if name == "" {
+		return "host"
+	}
+	return name
+}
+
+// Browser queries for Sunshine hosts
+type Browser struct {
+	// Group is where queries are sent, normally MDNSGroup. Responses are
+	// read both as unicast replies and, for a multicast group, from the
+	// group itself.
+	Group *net.UDPAddr
+
+	// Service is the DNS-SD service type to browse for
+	Service string
+
+	// Interval is how often queries are repeated while browsing
+	Interval time.Duration
+
+	// LookupUniqueID asks each found host for its unique ID over HTTP when
+	// the advertisement doesn't include it
+	LookupUniqueID bool
+}
+
+// NewBrowser creates a browser for Sunshine hosts on the local network
+func NewBrowser() *Browser {
+	return &Browser{
+		Group:          MDNSGroup,
+		Service:        ServiceType,
+		Interval:       time.Second,
+		LookupUniqueID: true,
+	}
+}
+
+// Discover browses for Sunshine hosts until ctx is done
+func Discover(ctx context.Context) ([]Host, error) {
+	return NewBrowser().Browse(ctx)
+}
+
+// instance is what we have learned about one service instance
+type instance struct {
+	name   string
+	target string
+	port   uint16
+	hasSRV bool
+	text   map[string]string
+
+	// source is the address the SRV record came from, used if no address
+	// record for the target arrives
+	source net.IP
+}
+
+// browseState collects records from responses
+type browseState struct {
+	service   string
+	instances map[string]*instance
+	addrs     map[string][]net.IP
+}
+
+// packet is a received datagram
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// Browse sends queries until ctx is done and returns the hosts that were
+// resolved to an address and port
+func (b *Browser) Browse(ctx context.Context) ([]Host, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+	}
+
+	// Queries go out from an ephemeral port, which makes them one-shot
+	// queries that responders answer directly (RFC 6762 section 5.1)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	conns := []*net.UDPConn{conn}
+
+	// Responses multicast to the group for other queriers are just as good
+	if b.Group.IP.IsMulticast() {
+		if group, err := net.ListenMulticastUDP("udp4", nil, b.Group); err == nil {
+			conns = append(conns, group)
+		}
+	}
+
+	packets := make(chan packet, 16)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *net.UDPConn) {
+			defer wg.Done()
+			readPackets(c, packets)
+		}(c)
+	}
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+		wg.Wait()
+	}()
+
+	state := &browseState{
+		service:   b.Service,
+		instances: make(map[string]*instance),
+		addrs:     make(map[string][]net.IP),
+	}
+
+	interval := b.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if err := b.query(conn, state); err != nil {
+		return nil, err
+	}
+
+browse:
+	for {
+		select {
+		case <-ctx.Done():
+			break browse
+		case <-ticker.C:
+			if err := b.query(conn, state); err != nil {
+				return nil, err
+			}
+		case p := <-packets:
+			msg, err := parseMessage(p.data)
+			if err != nil || !msg.response() {
+				continue
+			}
+			state.add(msg, p.from.IP)
+		}
+	}
+
+	hosts := state.hosts()
+	if b.LookupUniqueID {
+		lookupUniqueIDs(hosts)
+	}
+	return hosts, nil
+}
+
+// query asks for the service's instances, and for the details of any
+// instance or target still missing them
+func (b *Browser) query(conn *net.UDPConn, state *browseState) error {
+	msg := &dnsMessage{
+		Questions: []dnsQuestion{{Name: b.Service, Type: typePTR, Class: classIN}},
+	}
+	for _, inst := range state.instances {
+		if !inst.hasSRV {
+			msg.Questions = append(msg.Questions,
+				dnsQuestion{Name: inst.name, Type: typeSRV, Class: classIN},
+				dnsQuestion{Name: inst.name, Type: typeTXT, Class: classIN})
+		} else if len(state.addrs[strings.ToLower(inst.target)]) == 0 {
+			msg.Questions = append(msg.Questions,
+				dnsQuestion{Name: inst.target, Type: typeA, Class: classIN})
+		}
+	}
+
+	data, err := msg.pack()
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteToUDP(data, b.Group)
+	return err
+}
+
+// add records what a response tells us about the service
+func (s *browseState) add(msg *dnsMessage, from net.IP) {
+	for _, r := range msg.records() {
+		switch r.Type {
+		case typePTR:
+			if nameEqual(r.Name, s.service) {
+				s.instance(r.Target)
+			}
+		case typeSRV:
+			if inst := s.matchInstance(r.Name); inst != nil {
+				inst.target = r.Target
+				inst.port = r.Port
+				inst.hasSRV = true
+				inst.source = from
+			}
+		case typeTXT:
+			if inst := s.matchInstance(r.Name); inst != nil {
+				inst.text = parseText(r.Text)
+			}
+		case typeA, typeAAAA:
+			key := strings.ToLower(r.Name)
+			if !containsIP(s.addrs[key], r.IP) {
+				s.addrs[key] = append(s.addrs[key], r.IP)
+			}
+		}
+	}
+}
+
+// instance returns the named instance, adding it if it's new
+func (s *browseState) instance(name string) *instance {
+	key := strings.ToLower(name)
+	inst, ok := s.instances[key]
+	if !ok {
+		inst = &instance{name: name}
+		s.instances[key] = inst
+	}
+	return inst
+}
+
+// matchInstance returns the instance for a record name if it belongs to
+// our service
+func (s *browseState) matchInstance(name string) *instance {
+	suffix := "." + strings.ToLower(strings.TrimSuffix(s.service, "."))
+	if !strings.HasSuffix(strings.ToLower(strings.TrimSuffix(name, ".")), suffix) {
+		return nil
+	}
+	return s.instance(name)
+}
+
+// hosts returns the resolved instances sorted by name
+func (s *browseState) hosts() []Host {
+	var hosts []Host
+	for _, inst := range s.instances {
+		if !inst.hasSRV {
+			continue
+		}
+
+		addr := preferredIP(s.addrs[strings.ToLower(inst.target)])
+		if addr == nil {
+			addr = inst.source
+		}
+		if addr == nil {
+			continue
+		}
+
+		hosts = append(hosts, Host{
+			Instance: instanceLabel(inst.name, s.service),
+			Hostname: strings.TrimSuffix(inst.target, "."),
+			Address:  addr.String(),
+			Port:     int(inst.port),
+			UniqueID: inst.text["uniqueid"],
+		})
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Instance < hosts[j].Instance
+	})
+	return hosts
+}
+
+// lookupUniqueIDs fills in missing unique IDs from each host's server info
+func lookupUniqueIDs(hosts []Host) {
+	var wg sync.WaitGroup
+	for i := range hosts {
+		if hosts[i].UniqueID != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(h *Host) {
+			defer wg.Done()
+			// Sunshine's HTTPS port is always 5 below its HTTP port
+			client := sunshine.NewClient(h.Address, h.Port, h.Port-5)
+			if info, err := client.GetServerInfo(); err == nil {
+				h.UniqueID = info.UniqueID
+			}
+		}(&hosts[i])
+	}
+	wg.Wait()
+}
+
+// readPackets sends datagrams from conn to out until conn is closed
+func readPackets(conn *net.UDPConn, out chan<- packet) {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case out <- packet{data: data, from: from}:
+		default:
+		}
+	}
+}
+
+// parseText splits TXT strings into key=value pairs with lower-case keys
+func parseText(text []string) map[string]string {
+	m := make(map[string]string, len(text))
+	for _, t := range text {
+		k, v, _ := strings.Cut(t, "=")
+		m[strings.ToLower(k)] = v
+	}
+	return m
+}
+
+// instanceLabel returns the instance part of a full service instance name
+func instanceLabel(name, service string) string {
+	name = strings.TrimSuffix(name, ".")
+	service = strings.TrimSuffix(service, ".")
+	if len(name) > len(service)+1 && nameEqual(name[len(name)-len(service):], service) {
+		return name[:len(name)-len(service)-1]
+	}
+	return name
+}
+
+// preferredIP returns the first IPv4 address, or the first address if
+// there is none
+func preferredIP(ips []net.IP) net.IP {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	if len(ips) > 0 {
+		return ips[0]
+	}
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gamelight/gamelight/pkg/sunshinetest"
+)
+
+// browseResponder browses a responder on loopback, which answers like a
+// host's mDNS advertisement without needing multicast
+func browseResponder(t *testing.T, r *responder, lookupUniqueID bool) []Host {
+	t.Helper()
+
+	if err := r.Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b := NewBrowser()
+	b.Group = r.Addr()
+	b.Interval = 100 * time.Millisecond
+	b.LookupUniqueID = lookupUniqueID
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	hosts, err := b.Browse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hosts
+}
+
+func TestBrowseFindsHost(t *testing.T) {
+	r := newResponder("Gaming PC", net.IPv4(192, 168, 1, 50), 47989)
+	r.Text = map[string]string{"uniqueid": "0123456789ABCDEF"}
+
+	hosts := browseResponder(t, r, false)
+
+	want := Host{
+		Instance: "Gaming PC",
+		Hostname: "gaming-pc.local",
+		Address:  "192.168.1.50",
+		Port:     47989,
+		UniqueID: "0123456789ABCDEF",
+	}
+	if len(hosts) != 1 || hosts[0] != want {
+		t.Fatalf("hosts = %+v, want [%+v]", hosts, want)
+	}
+}
+
+func TestBrowseLooksUpUniqueID(t *testing.T) {
+	host, err := sunshinetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	// Without a uniqueid in TXT, it is asked for over HTTP
+	r := newResponder("sunshinetest", net.ParseIP(host.Host()), host.HTTPPort())
+	hosts := browseResponder(t, r, true)
+
+	if len(hosts) != 1 {
+		t.Fatalf("found %d hosts, want 1", len(hosts))
+	}
+	if hosts[0].Port != host.HTTPPort() || hosts[0].UniqueID != host.UniqueID {
+		t.Errorf("host = %+v, want port %d and unique ID %s", hosts[0], host.HTTPPort(), host.UniqueID)
+	}
+}
@@ -0,0 +1,351 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// DNS record types used by DNS-SD (RFC 6763)
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+	typeANY  = 255
+)
+
+const (
+	classIN = 1
+
+	// classMask strips the mDNS flag in the top bit of the class: unicast
+	// response requested in questions, cache flush in records
+	classMask = 0x7FFF
+	flagTop   = 0x8000
+
+	// flagResponse is the QR bit of the header flags
+	flagResponse = 0x8000
+	// flagAuthoritative is set on all mDNS responses
+	flagAuthoritative = 0x0400
+)
+
+var errMessage = errors.New("malformed DNS message")
+
+// dnsQuestion is an entry in the question section
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// dnsRecord is a resource record. Only the fields for its type are set.
+type dnsRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+
+	// Target is the name a PTR record points to or an SRV record's host
+	Target string
+	Port   uint16
+
+	// Text holds the strings of a TXT record
+	Text []string
+
+	// IP is the address of an A or AAAA record
+	IP net.IP
+}
+
+// dnsMessage is a DNS message (RFC 1035 section 4)
+type dnsMessage struct {
+	ID         uint16
+	Flags      uint16
+	Questions  []dnsQuestion
+	Answers    []dnsRecord
+	Authority  []dnsRecord
+	Additional []dnsRecord
+}
+
+// response reports whether the message is a response rather than a query
+func (m *dnsMessage) response() bool {
+	return m.Flags&flagResponse != 0
+}
+
+// records returns the records from every section
+func (m *dnsMessage) records() []dnsRecord {
+	all := make([]dnsRecord, 0, len(m.Answers)+len(m.Authority)+len(m.Additional))
+	all = append(all, m.Answers...)
+	all = append(all, m.Authority...)
+	return append(all, m.Additional...)
+}
+
+// pack encodes the message. Names are written without compression, which
+// every decoder must accept.
+func (m *dnsMessage) pack() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:2], m.ID)
+	binary.BigEndian.PutUint16(b[2:4], m.Flags)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:10], uint16(len(m.Authority)))
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(m.Additional)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+
+	for _, section := range [][]dnsRecord{m.Answers, m.Authority, m.Additional} {
+		for _, r := range section {
+			if b, err = appendRecord(b, r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+// appendRecord encodes a resource record
+func appendRecord(b []byte, r dnsRecord) ([]byte, error) {
+	b, err := appendName(b, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, r.Type)
+	b = binary.BigEndian.AppendUint16(b, r.Class)
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+
+	// Reserve the data length and fill it in once the data is written
+	lenPos := len(b)
+	b = append(b, 0, 0)
+
+	switch r.Type {
+	case typePTR:
+		b, err = appendName(b, r.Target)
+	case typeSRV:
+		b = append(b, 0, 0, 0, 0) // Priority and weight
+		b = binary.BigEndian.AppendUint16(b, r.Port)
+		b, err = appendName(b, r.Target)
+	case typeTXT:
+		if len(r.Text) == 0 {
+			// A TXT record holds at least one string, empty if need be
+			b = append(b, 0)
+		}
+		for _, s := range r.Text {
+			if len(s) > 255 {
+				return nil, errors.New("TXT string too long")
+			}
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+	case typeA:
+		ip := r.IP.To4()
+		if ip == nil {
+			return nil, errors.New("A record without an IPv4 address")
+		}
+		b = append(b, ip...)
+	case typeAAAA:
+		ip := r.IP.To16()
+		if ip == nil {
+			return nil, errors.New("AAAA record without an IPv6 address")
+		}
+		b = append(b, ip...)
+	default:
+		return nil, errors.New("unsupported record type")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	binary.BigEndian.PutUint16(b[lenPos:], uint16(len(b)-lenPos-2))
+	return b, nil
+}
+
+// appendName encodes a domain name as a sequence of labels
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, errors.New("invalid DNS name " + name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// parseMessage decodes a DNS message. Records of types we don't use are
+// kept with only their header fields set.
+func parseMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < 12 {
+		return nil, errMessage
+	}
+
+	m := &dnsMessage{
+		ID:    binary.BigEndian.Uint16(msg[0:2]),
+		Flags: binary.BigEndian.Uint16(msg[2:4]),
+	}
+	counts := [4]int{
+		int(binary.BigEndian.Uint16(msg[4:6])),
+		int(binary.BigEndian.Uint16(msg[6:8])),
+		int(binary.BigEndian.Uint16(msg[8:10])),
+		int(binary.BigEndian.Uint16(msg[10:12])),
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+4 > len(msg) {
+			return nil, errMessage
+		}
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[off : off+2]),
+			Class: binary.BigEndian.Uint16(msg[off+2 : off+4]),
+		})
+		off += 4
+	}
+
+	sections := []*[]dnsRecord{&m.Answers, &m.Authority, &m.Additional}
+	for s, section := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			r, n, err := readRecord(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			off = n
+			*section = append(*section, r)
+		}
+	}
+
+	return m, nil
+}
+
+// readRecord decodes the resource record at off and returns it with the
+// offset just past it
+func readRecord(msg []byte, off int) (dnsRecord, int, error) {
+	var r dnsRecord
+
+	name, off, err := readName(msg, off)
+	if err != nil {
+		return r, 0, err
+	}
+	if off+10 > len(msg) {
+		return r, 0, errMessage
+	}
+	r.Name = name
+	r.Type = binary.BigEndian.Uint16(msg[off : off+2])
+	r.Class = binary.BigEndian.Uint16(msg[off+2 : off+4])
+	r.TTL = binary.BigEndian.Uint32(msg[off+4 : off+8])
+	length := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+	off += 10
+
+	end := off + length
+	if end > len(msg) {
+		return r, 0, errMessage
+	}
+	data := msg[off:end]
+
+	switch r.Type {
+	case typePTR:
+		// Names in the data may point back into the message, so they are
+		// read from the whole message
+		if r.Target, _, err = readName(msg, off); err != nil {
+			return r, 0, err
+		}
+	case typeSRV:
+		if length < 7 {
+			return r, 0, errMessage
+		}
+		r.Port = binary.BigEndian.Uint16(data[4:6])
+		if r.Target, _, err = readName(msg, off+6); err != nil {
+			return r, 0, err
+		}
+	case typeTXT:
+		for i := 0; i < len(data); {
+			l := int(data[i])
+			if i+1+l > len(data) {
+				return r, 0, errMessage
+			}
+			if l > 0 {
+				r.Text = append(r.Text, string(data[i+1:i+1+l]))
+			}
+			i += 1 + l
+		}
+	case typeA:
+		if length != net.IPv4len {
+			return r, 0, errMessage
+		}
+		r.IP = net.IP(append([]byte(nil), data...))
+	case typeAAAA:
+		if length != net.IPv6len {
+			return r, 0, errMessage
+		}
+		r.IP = net.IP(append([]byte(nil), data...))
+	}
+
+	return r, end, nil
+}
+
+// readName decodes the possibly compressed name at off and returns it with
+// a trailing dot, along with the offset just past it in the original
+// position
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+
+	// Each pointer must go backwards, so following them terminates
+	limit := len(msg)
+	for {
+		if off >= len(msg) {
+			return "", 0, errMessage
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errMessage
+			}
+			ptr := int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+			if ptr >= limit {
+				return "", 0, errMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			limit = ptr
+			off = ptr
+		case l&0xC0 != 0:
+			return "", 0, errMessage
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// nameEqual compares domain names the way DNS does, ignoring case and the
+// trailing dot
+func nameEqual(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
@@ -0,0 +1,186 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// recordTTL is the TTL of the records a responder answers with
+const recordTTL = 120
+
+// responder answers multicast DNS queries for one Sunshine service
+// instance. It stands in for a host's advertisement, so discovery can be
+// tested without a real host on the network.
+type responder struct {
+	// Instance is the service instance name, for example "GAMING-PC"
+	Instance string
+	// Hostname is the host the service runs on, for example
+	// "gaming-pc.local."
+	Hostname string
+	// IP is the address answered for Hostname
+	IP net.IP
+	// Port is the advertised HTTP port
+	Port int
+	// Text holds the TXT record's key=value pairs
+	Text map[string]string
+
+	// Service is the DNS-SD service type answered for
+	Service string
+
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	wg    sync.WaitGroup
+}
+
+// newResponder creates a responder advertising a Sunshine host
+func newResponder(instance string, ip net.IP, port int) *responder {
+	return &responder{
+		Instance: instance,
+		Hostname: strings.ToLower(strings.ReplaceAll(instance, " ", "-")) + ".local.",
+		IP:       ip,
+		Port:     port,
+		Service:  ServiceType,
+	}
+}
+
+// Listen starts answering queries sent to addr. A multicast addr joins the
+// group, which needs a network with multicast; any other addr is a plain
+// UDP socket that a Browser can use as its Group.
+func (r *responder) Listen(addr *net.UDPAddr) error {
+	var conn *net.UDPConn
+	var err error
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp4", nil, addr)
+		r.group = addr
+	} else {
+		conn, err = net.ListenUDP("udp4", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("mdns responder: %w", err)
+	}
+	r.conn = conn
+
+	r.wg.Add(1)
+	go r.serve()
+	return nil
+}
+
+// Addr returns the address the responder is listening on
+func (r *responder) Addr() *net.UDPAddr {
+	return r.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Close stops the responder
+func (r *responder) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.wg.Wait()
+	return err
+}
+
+func (r *responder) serve() {
+	defer r.wg.Done()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		query, err := parseMessage(buf[:n])
+		if err != nil || query.response() {
+			continue
+		}
+
+		resp := r.answer(query)
+		if resp == nil {
+			continue
+		}
+
+		// One-shot queriers (not on port 5353) and questions asking for a
+		// unicast response get a direct reply; other answers go to the
+		// group (RFC 6762 section 6)
+		legacy := from.Port != MDNSGroup.Port
+		to := from
+		if !legacy && r.group != nil && !unicastRequested(query) {
+			to = r.group
+		}
+		if legacy {
+			// Legacy replies echo the ID and questions like unicast DNS
+			resp.ID = query.ID
+			resp.Questions = query.Questions
+		}
+
+		data, err := resp.pack()
+		if err != nil {
+			continue
+		}
+		r.conn.WriteToUDP(data, to)
+	}
+}
+
+// answer builds the response to a query, or nil if no question is ours
+func (r *responder) answer(query *dnsMessage) *dnsMessage {
+	instance := r.Instance + "." + r.Service
+
+	ptr := dnsRecord{Name: r.Service, Type: typePTR, Class: classIN, TTL: recordTTL, Target: instance}
+	srv := dnsRecord{Name: instance, Type: typeSRV, Class: classIN | flagTop, TTL: recordTTL, Target: r.Hostname, Port: uint16(r.Port)}
+	txt := dnsRecord{Name: instance, Type: typeTXT, Class: classIN | flagTop, TTL: recordTTL}
+	for k, v := range r.Text {
+		txt.Text = append(txt.Text, k+"="+v)
+	}
+	addr := dnsRecord{Name: r.Hostname, Type: typeA, Class: classIN | flagTop, TTL: recordTTL, IP: r.IP}
+	if r.IP.To4() == nil {
+		addr.Type = typeAAAA
+	}
+
+	resp := &dnsMessage{Flags: flagResponse | flagAuthoritative}
+	for _, q := range query.Questions {
+		if q.Class&classMask != classIN {
+			continue
+		}
+		match := func(t uint16) bool { return q.Type == t || q.Type == typeANY }
+
+		switch {
+		case nameEqual(q.Name, r.Service) && match(typePTR):
+			// Include everything needed to connect so the querier
+			// doesn't have to ask again
+			resp.Answers = append(resp.Answers, ptr)
+			resp.Additional = append(resp.Additional, srv, txt, addr)
+		case nameEqual(q.Name, instance):
+			if match(typeSRV) {
+				resp.Answers = append(resp.Answers, srv)
+				resp.Additional = append(resp.Additional, addr)
+			}
+			if match(typeTXT) {
+				resp.Answers = append(resp.Answers, txt)
+			}
+		case nameEqual(q.Name, r.Hostname) && match(addr.Type):
+			resp.Answers = append(resp.Answers, addr)
+		}
+	}
+
+	if len(resp.Answers) == 0 {
+		return nil
+	}
+	return resp
+}
+
+// unicastRequested reports whether any question has the QU bit set
+func unicastRequested(query *dnsMessage) bool {
+	for _, q := range query.Questions {
+		if q.Class&flagTop != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package input
 
 import (
 	"encoding/binary"
+	"math"
 	"sync"
 )
 
@@ -44,6 +45,19 @@ const (
 	KeyUp   KeyAction = 0x04
 )
 
+// TouchEventType represents touch actions
+type TouchEventType uint8
+
+const (
+	TouchHover      TouchEventType = 0x00
+	TouchDown       TouchEventType = 0x01
+	TouchUp         TouchEventType = 0x02
+	TouchMove       TouchEventType = 0x03
+	TouchCancel     TouchEventType = 0x04
+	TouchHoverLeave TouchEventType = 0x06
+	TouchCancelAll  TouchEventType = 0x07
+)
+
 // ControllerButton represents controller buttons (Xbox layout)
 type ControllerButton uint32
 
@@ -115,6 +129,18 @@ type ControllerEvent struct {
 	RightStickY      int16
 }
 
+// TouchEvent represents a touch contact. X and Y are normalized to 0.0-1.0.
+type TouchEvent struct {
+	Type         TouchEventType
+	PointerID    uint32
+	X            float32
+	Y            float32
+	Pressure     float32
+	Rotation     uint16
+	ContactMajor float32
+	ContactMinor float32
+}
+
 // Handler processes input events from clients
 type Handler struct {
 	mu sync.RWMutex
@@ -126,6 +152,7 @@ type Handler struct {
 	onMouseScroll   func(MouseScrollEvent)
 	onKeyboard      func(KeyboardEvent)
 	onController    func(ControllerEvent)
+	onTouch         func(TouchEvent)
 }
 
 // NewHandler creates a new input handler
@@ -175,6 +202,13 @@ func (h *Handler) OnController(fn func(ControllerEvent)) {
 	h.onController = fn
 }
 
+// OnTouch sets the callback for touch events
+func (h *Handler) OnTouch(fn func(TouchEvent)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onTouch = fn
+}
+
 // HandleMouseMove processes a mouse movement event
 func (h *Handler) HandleMouseMove(deltaX, deltaY int16) {
 	h.mu.RLock()
@@ -241,6 +275,17 @@ func (h *Handler) HandleController(event ControllerEvent) {
 	}
 }
 
+// HandleTouch processes a touch event
+func (h *Handler) HandleTouch(event TouchEvent) {
+	h.mu.RLock()
+	fn := h.onTouch
+	h.mu.RUnlock()
+
+	if fn != nil {
+		fn(event)
+	}
+}
+
 // ParseControllerData parses binary controller data from the browser
 func ParseControllerData(data []byte) (*ControllerEvent, error) {
 	if len(data) < 13 {
@@ -320,3 +365,20 @@ func ParseMouseScrollData(data []byte) (*MouseScrollEvent, error) {
 		Amount: int16(binary.LittleEndian.Uint16(data[0:2])),
 	}, nil
 }
+
+// ParseTouchData parses binary touch data: event type, pointer ID (uint32),
+// then X, Y and pressure as float32, all little-endian
+func ParseTouchData(data []byte) (*TouchEvent, error) {
+	if len(data) < 17 {
+		return nil, nil
+	}
+
+	return &TouchEvent{
+		Type:      TouchEventType(data[0]),
+		PointerID: binary.LittleEndian.Uint32(data[1:5]),
+		X:         math.Float32frombits(binary.LittleEndian.Uint32(data[5:9])),
+		Y:         math.Float32frombits(binary.LittleEndian.Uint32(data[9:13])),
+		Pressure:  math.Float32frombits(binary.LittleEndian.Uint32(data[13:17])),
+		Rotation:  TouchRotationUnknown,
+	}, nil
+}
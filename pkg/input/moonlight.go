@@ -0,0 +1,137 @@
+package input
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Moonlight input packet magics (Gen 5+), plus Sunshine extensions
+const (
+	magicKeyDown         uint32 = 0x00000003
+	magicKeyUp           uint32 = 0x00000004
+	magicMouseMoveAbs    uint32 = 0x00000005
+	magicMouseMoveRel    uint32 = 0x00000007
+	magicMouseButtonDown uint32 = 0x00000008
+	magicMouseButtonUp   uint32 = 0x00000009
+	magicScroll          uint32 = 0x0000000A
+	magicMultiController uint32 = 0x0000000C
+	magicTouch           uint32 = 0x55000002
+)
+
+// TouchRotationUnknown is sent when the browser doesn't report contact
+// rotation
+const TouchRotationUnknown uint16 = 0xFFFF
+
+// Multi-controller packet constants
+const (
+	mcHeaderB uint16 = 0x001A
+	mcMidB    uint16 = 0x0014
+	mcTailA   uint16 = 0x009C
+	mcTailB   uint16 = 0x0055
+)
+
+// newPacket allocates a Moonlight input packet with the NV_INPUT_HEADER
+// filled in. The size field is big-endian and excludes itself, the magic is
+// little-endian.
+func newPacket(magic uint32, payloadLen int) []byte {
+	pkt := make([]byte, 8+payloadLen)
+	binary.BigEndian.PutUint32(pkt[0:4], uint32(4+payloadLen))
+	binary.LittleEndian.PutUint32(pkt[4:8], magic)
+	return pkt
+}
+
+// EncodeMouseMove encodes a relative mouse movement as a Moonlight packet
+func EncodeMouseMove(e MouseMoveEvent) []byte {
+	pkt := newPacket(magicMouseMoveRel, 4)
+	binary.BigEndian.PutUint16(pkt[8:10], uint16(e.DeltaX))
+	binary.BigEndian.PutUint16(pkt[10:12], uint16(e.DeltaY))
+	return pkt
+}
+
+// EncodeMousePosition encodes an absolute mouse position as a Moonlight
+// packet. Width and Height are the reference area X and Y are relative to.
+func EncodeMousePosition(e MousePositionEvent) []byte {
+	pkt := newPacket(magicMouseMoveAbs, 10)
+	binary.BigEndian.PutUint16(pkt[8:10], uint16(e.X))
+	binary.BigEndian.PutUint16(pkt[10:12], uint16(e.Y))
+	// pkt[12:14] is unused
+	binary.BigEndian.PutUint16(pkt[14:16], uint16(e.Width))
+	binary.BigEndian.PutUint16(pkt[16:18], uint16(e.Height))
+	return pkt
+}
+
+// EncodeMouseButton encodes a mouse button press/release as a Moonlight
+// packet
+func EncodeMouseButton(e MouseButtonEvent) []byte {
+	magic := magicMouseButtonDown
+	if e.Action == MouseButtonUp {
+		magic = magicMouseButtonUp
+	}
+
+	pkt := newPacket(magic, 1)
+	pkt[8] = uint8(e.Button)
+	return pkt
+}
+
+// EncodeMouseScroll encodes a vertical scroll as a Moonlight high-resolution
+// scroll packet. Amount is in 1/120ths of a wheel notch.
+func EncodeMouseScroll(e MouseScrollEvent) []byte {
+	pkt := newPacket(magicScroll, 6)
+	binary.BigEndian.PutUint16(pkt[8:10], uint16(e.Amount))
+	binary.BigEndian.PutUint16(pkt[10:12], uint16(e.Amount))
+	// pkt[12:14] is zero
+	return pkt
+}
+
+// EncodeKeyboard encodes a key press/release as a Moonlight packet.
+// KeyCode is a Windows virtual key code.
+func EncodeKeyboard(e KeyboardEvent) []byte {
+	magic := magicKeyDown
+	if e.Action == KeyUp {
+		magic = magicKeyUp
+	}
+
+	pkt := newPacket(magic, 6)
+	pkt[8] = 0 // flags
+	binary.LittleEndian.PutUint16(pkt[9:11], 0x8000|e.KeyCode)
+	pkt[11] = e.Modifiers
+	// pkt[12:14] is zero padding
+	return pkt
+}
+
+// EncodeController encodes a controller state as a Moonlight multi-controller
+// packet. activeMask has bit N set for every connected controller N.
+func EncodeController(e ControllerEvent, activeMask uint16) []byte {
+	pkt := newPacket(magicMultiController, 26)
+	binary.LittleEndian.PutUint16(pkt[8:10], mcHeaderB)
+	binary.LittleEndian.PutUint16(pkt[10:12], uint16(e.ControllerNumber))
+	binary.LittleEndian.PutUint16(pkt[12:14], activeMask)
+	binary.LittleEndian.PutUint16(pkt[14:16], mcMidB)
+	binary.LittleEndian.PutUint16(pkt[16:18], uint16(e.Buttons))
+	pkt[18] = e.LeftTrigger
+	pkt[19] = e.RightTrigger
+	binary.LittleEndian.PutUint16(pkt[20:22], uint16(e.LeftStickX))
+	binary.LittleEndian.PutUint16(pkt[22:24], uint16(e.LeftStickY))
+	binary.LittleEndian.PutUint16(pkt[24:26], uint16(e.RightStickX))
+	binary.LittleEndian.PutUint16(pkt[26:28], uint16(e.RightStickY))
+	binary.LittleEndian.PutUint16(pkt[28:30], mcTailA)
+	binary.LittleEndian.PutUint16(pkt[30:32], uint16(e.Buttons>>16))
+	binary.LittleEndian.PutUint16(pkt[32:34], mcTailB)
+	return pkt
+}
+
+// EncodeTouch encodes a touch event as a Sunshine touch packet. Coordinates
+// are normalized to 0.0-1.0 of the stream area.
+func EncodeTouch(e TouchEvent) []byte {
+	pkt := newPacket(magicTouch, 28)
+	pkt[8] = uint8(e.Type)
+	// pkt[9] is reserved
+	binary.LittleEndian.PutUint16(pkt[10:12], e.Rotation)
+	binary.LittleEndian.PutUint32(pkt[12:16], e.PointerID)
+	binary.LittleEndian.PutUint32(pkt[16:20], math.Float32bits(e.X))
+	binary.LittleEndian.PutUint32(pkt[20:24], math.Float32bits(e.Y))
+	binary.LittleEndian.PutUint32(pkt[24:28], math.Float32bits(e.Pressure))
+	binary.LittleEndian.PutUint32(pkt[28:32], math.Float32bits(e.ContactMajor))
+	binary.LittleEndian.PutUint32(pkt[32:36], math.Float32bits(e.ContactMinor))
+	return pkt
+}
@@ -0,0 +1,110 @@
+package input
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The expected packets follow the structs in moonlight-common-c's Input.h:
+// a big-endian size that excludes itself, a little-endian magic, then the
+// fields with their documented byte order.
+func TestEncoders(t *testing.T) {
+	tests := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{
+			name: "relative mouse",
+			got:  EncodeMouseMove(MouseMoveEvent{DeltaX: -5, DeltaY: 300}),
+			want: "00000008 07000000 fffb 012c",
+		},
+		{
+			name: "absolute mouse",
+			got:  EncodeMousePosition(MousePositionEvent{X: 960, Y: 540, Width: 1920, Height: 1080}),
+			want: "0000000e 05000000 03c0 021c 0000 0780 0438",
+		},
+		{
+			name: "mouse button down",
+			got:  EncodeMouseButton(MouseButtonEvent{Button: MouseButtonLeft, Action: MouseButtonDown}),
+			want: "00000005 08000000 01",
+		},
+		{
+			name: "mouse button up",
+			got:  EncodeMouseButton(MouseButtonEvent{Button: MouseButtonRight, Action: MouseButtonUp}),
+			want: "00000005 09000000 03",
+		},
+		{
+			name: "scroll",
+			got:  EncodeMouseScroll(MouseScrollEvent{Amount: -120}),
+			want: "0000000a 0a000000 ff88 ff88 0000",
+		},
+		{
+			name: "key down with shift and ctrl",
+			got:  EncodeKeyboard(KeyboardEvent{KeyCode: 0x41, Action: KeyDown, Modifiers: 0x03}),
+			want: "0000000a 03000000 00 4180 03 0000",
+		},
+		{
+			name: "key up with alt",
+			got:  EncodeKeyboard(KeyboardEvent{KeyCode: 0x41, Action: KeyUp, Modifiers: 0x04}),
+			want: "0000000a 04000000 00 4180 04 0000",
+		},
+		{
+			name: "second of two controllers",
+			got: EncodeController(ControllerEvent{
+				ControllerNumber: 1,
+				Buttons:          ControllerButtonA | ControllerButtonStart | ControllerButtonPaddle1,
+				LeftTrigger:      0x80,
+				RightTrigger:     0xff,
+				LeftStickX:       -32768,
+				LeftStickY:       32767,
+				RightStickX:      0x1234,
+				RightStickY:      -1,
+			}, 0x0003),
+			want: "0000001e 0c000000 1a00 0100 0300 1400 1010 80 ff 0080 ff7f 3412 ffff 9c00 0100 5500",
+		},
+		{
+			name: "only controller idle",
+			got:  EncodeController(ControllerEvent{}, 0x0001),
+			want: "0000001e 0c000000 1a00 0000 0100 1400 0000 00 00 0000 0000 0000 0000 9c00 0000 5500",
+		},
+		{
+			name: "touch down",
+			got: EncodeTouch(TouchEvent{
+				Type:      TouchDown,
+				PointerID: 7,
+				X:         0.5,
+				Y:         0.25,
+				Pressure:  1,
+				Rotation:  TouchRotationUnknown,
+			}),
+			want: "00000020 02000055 01 00 ffff 07000000 0000003f 0000803e 0000803f 00000000 00000000",
+		},
+		{
+			name: "touch move with contact area",
+			got: EncodeTouch(TouchEvent{
+				Type:         TouchMove,
+				PointerID:    0x01020304,
+				X:            1,
+				Y:            0,
+				Pressure:     0.5,
+				Rotation:     90,
+				ContactMajor: 0.125,
+				ContactMinor: 0.0625,
+			}),
+			want: "00000020 02000055 03 00 5a00 04030201 0000803f 00000000 0000003f 0000003e 0000803d",
+		},
+	}
+
+	for _, tt := range tests {
+		want, err := hex.DecodeString(strings.ReplaceAll(tt.want, " ", ""))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(tt.got, want) {
+			t.Errorf("%s:\n got %x\nwant %x", tt.name, tt.got, want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package rtsp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VideoCodec selects the bitstream format requested from the host
+type VideoCodec int
+
+const (
+	CodecH264 VideoCodec = 0
+	CodecHEVC VideoCodec = 1
+	CodecAV1  VideoCodec = 2
+)
+
+// String returns the codec name
+func (c VideoCodec) String() string {
+	switch c {
+	case CodecHEVC:
+		return "HEVC"
+	case CodecAV1:
+		return "AV1"
+	default:
+		return "H264"
+	}
+}
+
+// Sunshine encryption flags (x-ss-general.encryptionEnabled)
+const (
+	encAudio = 0x04
+)
+
+// NVIDIA feature flags (x-nv-general.featureFlags)
+const (
+	nvFeatureBase           = 0x07
+	nvFeatureAudioEncrypted = 0x20
+)
+
+const (
+	// DefaultPacketSize is the video payload size per packet. It keeps
+	// datagrams under a 1500-byte MTU after headers.
+	DefaultPacketSize = 1392
+
+	// DefaultFECPercentage is the parity-to-data ratio requested for video
+	DefaultFECPercentage = 20
+
+	// Control stream protocol 13 is ENet, matching the control/13/0 stream ID
+	controlProtocolENet = 13
+)
+
+// StreamConfig describes the stream requested from the host in ANNOUNCE
+type StreamConfig struct {
+	Width   int
+	Height  int
+	FPS     int
+	Bitrate int // kbps
+
+	Codec         VideoCodec
+	HDR           bool // 10-bit BT.2020 video; HEVC or AV1 only
+	PacketSize    int
+	FECPercentage int
+
+	AudioChannels    int
+	AudioChannelMask int
+	AudioPacketMs    int
+
+	EncryptAudio bool
+}
+
+// withDefaults fills in zero fields with values Sunshine accepts
+func (cfg StreamConfig) withDefaults() StreamConfig {
+	if cfg.PacketSize == 0 {
+		cfg.PacketSize = DefaultPacketSize
+	}
+	if cfg.FECPercentage == 0 {
+		cfg.FECPercentage = DefaultFECPercentage
+	}
+	if cfg.AudioChannels == 0 {
+		cfg.AudioChannels = 2
+	}
+	if cfg.AudioChannelMask == 0 {
+		cfg.AudioChannelMask, _ = ChannelMask(cfg.AudioChannels)
+	}
+	if cfg.AudioPacketMs == 0 {
+		cfg.AudioPacketMs = 5
+	}
+	return cfg
+}
+
+// buildAnnounceSDP builds the SDP body for ANNOUNCE. Sunshine reads the
+// stream configuration from the x-nv-* and x-ss-* attributes.
+func buildAnnounceSDP(cfg StreamConfig, host string) string {
+	cfg = cfg.withDefaults()
+
+	var sb strings.Builder
+	attr := func(name string, value interface{}) {
+		fmt.Fprintf(&sb, "a=%s:%v \r\n", name, value)
+	}
+
+	sb.WriteString("v=0\r\n")
+	fmt.Fprintf(&sb, "o=android 0 14 IN IPv4 %s\r\n", host)
+	sb.WriteString("s=NVIDIA Streaming Client\r\n")
+
+	// Video
+	attr("x-nv-video[0].clientViewportWd", cfg.Width)
+	attr("x-nv-video[0].clientViewportHt", cfg.Height)
+	attr("x-nv-video[0].maxFPS", cfg.FPS)
+	attr("x-nv-video[0].clientRefreshRateX100", cfg.FPS*100)
+	attr("x-nv-video[0].packetSize", cfg.PacketSize)
+	attr("x-nv-video[0].rateControlMode", 4)
+	attr("x-nv-video[0].timeoutLengthMs", 7000)
+	attr("x-nv-video[0].framesWithInvalidRefThreshold", 0)
+	attr("x-nv-video[0].initialBitrateKbps", cfg.Bitrate)
+	attr("x-nv-video[0].initialPeakBitrateKbps", cfg.Bitrate)
+	attr("x-nv-video[0].videoEncoderSlicesPerFrame", 1)
+	attr("x-nv-video[0].maxNumReferenceFrames", 1)
+	// HDR video is BT.2020 in limited range, which Moonlight encodes as
+	// colorspace<<1 | fullRange
+	dynamicRangeMode, encoderCscMode := 0, 0
+	if cfg.HDR {
+		dynamicRangeMode, encoderCscMode = 1, 2<<1
+	}
+	attr("x-nv-video[0].dynamicRangeMode", dynamicRangeMode)
+	attr("x-nv-video[0].encoderCscMode", encoderCscMode)
+	attr("x-ml-video.configuredBitrateKbps", cfg.Bitrate)
+
+	attr("x-nv-vqos[0].bw.minimumBitrateKbps", cfg.Bitrate)
+	attr("x-nv-vqos[0].bw.maximumBitrateKbps", cfg.Bitrate)
+	attr("x-nv-vqos[0].videoQualityScoreUpdateTime", 5000)
+	attr("x-nv-vqos[0].qosTrafficType", 0)
+	attr("x-nv-vqos[0].bitStreamFormat", int(cfg.Codec))
+	attr("x-nv-vqos[0].drc.enable", 0)
+	attr("x-nv-vqos[0].bllFec.enable", 0)
+	attr("x-nv-vqos[0].fec.enable", 1)
+	attr("x-nv-vqos[0].fec.repairPercent", cfg.FECPercentage)
+	attr("x-nv-vqos[0].fec.minRequiredFecPackets", 2)
+
+	clientSupportHevc := 0
+	if cfg.Codec == CodecHEVC {
+		clientSupportHevc = 1
+	}
+	attr("x-nv-clientSupportHevc", clientSupportHevc)
+
+	// Audio
+	surround := 0
+	if cfg.AudioChannels > 2 {
+		surround = 1
+	}
+	attr("x-nv-audio.surround.numChannels", cfg.AudioChannels)
+	attr("x-nv-audio.surround.channelMask", cfg.AudioChannelMask)
+	attr("x-nv-audio.surround.enable", surround)
+	attr("x-nv-audio.surround.AudioQuality", 0)
+	attr("x-nv-aqos.packetDuration", cfg.AudioPacketMs)
+	attr("x-nv-aqos.qosTrafficType", 0)
+
+	// General
+	featureFlags := nvFeatureBase
+	encryption := 0
+	if cfg.EncryptAudio {
+		featureFlags |= nvFeatureAudioEncrypted
+		encryption |= encAudio
+	}
+	attr("x-nv-general.featureFlags", featureFlags)
+	attr("x-nv-general.useReliableUdp", controlProtocolENet)
+	attr("x-nv-general.enableRecoveryMode", 0)
+	attr("x-ml-general.featureFlags", 0)
+	attr("x-ss-general.featureFlags", 0)
+	attr("x-ss-general.encryptionEnabled", encryption)
+
+	sb.WriteString("t=0 0\r\n")
+	sb.WriteString("m=video 47998  \r\n")
+
+	return sb.String()
+}
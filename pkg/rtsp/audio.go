@@ -0,0 +1,330 @@
+package rtsp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+)
+
+// Sunshine sends audio as RTP packets carrying one Opus packet each, in
+// blocks of four data packets followed by two FEC packets. FEC is computed
+// over the (possibly encrypted) payloads, so packets are recovered first and
+// decrypted afterwards.
+const (
+	audioPayloadType    = 97
+	audioFECPayloadType = 127
+
+	audioDataShards   = 4
+	audioParityShards = 2
+	audioFECHeaderLen = 12
+
+	// OpusClockRate is the RTP clock rate of the Opus packets we output
+	OpusClockRate = 48000
+
+	maxPendingAudioBlocks = 16
+)
+
+// audioParityMatrix is the parity part of Sunshine's audio Reed-Solomon
+// matrix. It differs from the standard Vandermonde construction.
+var audioParityMatrix = [][]byte{
+	{0x77, 0x40, 0x38, 0x0e},
+	{0xc7, 0xa7, 0x0d, 0x6c},
+}
+
+var errAudioPadding = errors.New("invalid audio padding")
+
+// AudioPacket is one Opus packet from the host
+type AudioPacket struct {
+	Sequence  uint16
+	Timestamp uint32 // 48kHz RTP clock
+	Data      []byte
+}
+
+// audioBlock collects the shards of one FEC block
+type audioBlock struct {
+	baseSeq       uint16
+	baseTimestamp uint32
+	hasTimestamp  bool
+	shards        [audioDataShards + audioParityShards][]byte
+	delivered     [audioDataShards]bool
+	done          bool
+}
+
+// AudioDepacketizer turns Sunshine audio packets into Opus packets,
+// recovering lost packets from FEC and decrypting them if needed
+type AudioDepacketizer struct {
+	mu sync.Mutex
+
+	rs     *reedSolomon
+	blocks map[uint16]*audioBlock
+	newest uint16
+	seen   bool
+
+	// Decryption; nil when audio isn't encrypted
+	aesBlock cipher.Block
+	keyID    uint32
+
+	// packetMs is the Opus packet duration, used to timestamp recovered
+	// packets
+	packetMs uint32
+
+	// Stats
+	recovered uint64
+
+	onPacket func(AudioPacket)
+}
+
+// NewAudioDepacketizer creates a new audio depacketizer
+func NewAudioDepacketizer() *AudioDepacketizer {
+	return &AudioDepacketizer{
+		rs:       newReedSolomonWithParity(audioDataShards, audioParityMatrix),
+		blocks:   make(map[uint16]*audioBlock),
+		packetMs: 5,
+	}
+}
+
+// OnPacket sets the callback for Opus packets
+func (d *AudioDepacketizer) OnPacket(fn func(AudioPacket)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onPacket = fn
+}
+
+// SetKey enables AES-CBC decryption with the rikey and rikeyid that were
+// sent in the launch request
+func (d *AudioDepacketizer) SetKey(key [16]byte, keyID uint32) error {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.aesBlock = block
+	d.keyID = keyID
+	return nil
+}
+
+// setPacketDuration sets the Opus packet duration requested in ANNOUNCE
+func (d *AudioDepacketizer) setPacketDuration(ms int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ms > 0 {
+		d.packetMs = uint32(ms)
+	}
+}
+
+// Recovered returns the number of packets recovered by FEC
+func (d *AudioDepacketizer) Recovered() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.recovered
+}
+
+// Push processes one audio datagram
+func (d *AudioDepacketizer) Push(data []byte) {
+	if len(data) < rtpHeaderSize {
+		return
+	}
+
+	payloadType := data[1] & 0x7F
+	seq := binary.BigEndian.Uint16(data[2:4])
+	timestamp := binary.BigEndian.Uint32(data[4:8])
+	payload := data[rtpHeaderSize:]
+
+	d.mu.Lock()
+
+	var out []AudioPacket
+	switch payloadType {
+	case audioPayloadType:
+		out = d.pushDataLocked(seq, timestamp, payload)
+	case audioFECPayloadType:
+		out = d.pushFECLocked(payload)
+	}
+
+	onPacket := d.onPacket
+	d.mu.Unlock()
+
+	if onPacket != nil {
+		for _, pkt := range out {
+			onPacket(pkt)
+		}
+	}
+}
+
+func (d *AudioDepacketizer) pushDataLocked(seq uint16, timestamp uint32, payload []byte) []AudioPacket {
+	index := int(seq % audioDataShards)
+	block := d.blockLocked(seq - uint16(index))
+	if block == nil {
+		return nil
+	}
+
+	if !block.hasTimestamp {
+		block.baseTimestamp = timestamp - uint32(index)*d.packetMs
+		block.hasTimestamp = true
+	}
+
+	if block.shards[index] != nil {
+		return nil
+	}
+	block.shards[index] = payload
+
+	var out []AudioPacket
+	if !block.delivered[index] {
+		block.delivered[index] = true
+		if pkt, ok := d.decodeLocked(seq, timestamp, payload); ok {
+			out = append(out, pkt)
+		}
+	}
+
+	return append(out, d.recoverLocked(block)...)
+}
+
+func (d *AudioDepacketizer) pushFECLocked(payload []byte) []AudioPacket {
+	if len(payload) <= audioFECHeaderLen {
+		return nil
+	}
+
+	shardIndex := int(payload[0])
+	baseSeq := binary.BigEndian.Uint16(payload[2:4])
+	baseTimestamp := binary.BigEndian.Uint32(payload[4:8])
+	if shardIndex >= audioParityShards {
+		return nil
+	}
+
+	block := d.blockLocked(baseSeq)
+	if block == nil || block.shards[audioDataShards+shardIndex] != nil {
+		return nil
+	}
+	block.shards[audioDataShards+shardIndex] = payload[audioFECHeaderLen:]
+	block.baseTimestamp = baseTimestamp
+	block.hasTimestamp = true
+
+	return d.recoverLocked(block)
+}
+
+// blockLocked returns the FEC block starting at baseSeq, creating it if
+// needed. It returns nil for blocks that are too old to matter.
+func (d *AudioDepacketizer) blockLocked(baseSeq uint16) *audioBlock {
+	if block, ok := d.blocks[baseSeq]; ok {
+		return block
+	}
+
+	if d.seen && int16(baseSeq-d.newest) < -maxPendingAudioBlocks*audioDataShards {
+		return nil
+	}
+	if !d.seen || int16(baseSeq-d.newest) > 0 {
+		d.newest = baseSeq
+		d.seen = true
+	}
+
+	block := &audioBlock{baseSeq: baseSeq}
+	d.blocks[baseSeq] = block
+
+	// Forget blocks that have fallen out of the window
+	for seq := range d.blocks {
+		if int16(seq-d.newest) < -maxPendingAudioBlocks*audioDataShards {
+			delete(d.blocks, seq)
+		}
+	}
+
+	return block
+}
+
+// recoverLocked rebuilds missing data packets once enough shards of a block
+// have arrived
+func (d *AudioDepacketizer) recoverLocked(block *audioBlock) []AudioPacket {
+	if block.done {
+		return nil
+	}
+
+	present, missing := 0, 0
+	for i, shard := range block.shards {
+		if shard != nil {
+			present++
+		} else if i < audioDataShards {
+			missing++
+		}
+	}
+	if missing == 0 {
+		block.done = true
+		return nil
+	}
+	if present < audioDataShards || !block.hasTimestamp {
+		return nil
+	}
+	block.done = true
+
+	shards := make([][]byte, len(block.shards))
+	copy(shards, block.shards[:])
+	if err := d.rs.reconstructData(shards); err != nil {
+		log.Printf("Audio FEC recovery failed for block %d: %v", block.baseSeq, err)
+		return nil
+	}
+
+	var out []AudioPacket
+	for i := 0; i < audioDataShards; i++ {
+		if block.shards[i] != nil || block.delivered[i] {
+			continue
+		}
+		block.shards[i] = shards[i]
+		block.delivered[i] = true
+		d.recovered++
+
+		seq := block.baseSeq + uint16(i)
+		timestamp := block.baseTimestamp + uint32(i)*d.packetMs
+		if pkt, ok := d.decodeLocked(seq, timestamp, shards[i]); ok {
+			out = append(out, pkt)
+		}
+	}
+	return out
+}
+
+// decodeLocked decrypts a payload if needed and converts Sunshine's
+// millisecond timestamp to the Opus clock
+func (d *AudioDepacketizer) decodeLocked(seq uint16, timestamp uint32, payload []byte) (AudioPacket, bool) {
+	data := payload
+	if d.aesBlock != nil {
+		var err error
+		data, err = d.decryptLocked(seq, payload)
+		if err != nil {
+			log.Printf("Failed to decrypt audio packet %d: %v", seq, err)
+			return AudioPacket{}, false
+		}
+	}
+
+	return AudioPacket{
+		Sequence:  seq,
+		Timestamp: timestamp * (OpusClockRate / 1000),
+		Data:      data,
+	}, true
+}
+
+// decryptLocked decrypts an AES-CBC payload. The IV is the big-endian sum
+// of the rikeyid and the packet's sequence number, zero padded.
+func (d *AudioDepacketizer) decryptLocked(seq uint16, payload []byte) ([]byte, error) {
+	if len(payload) == 0 || len(payload)%aes.BlockSize != 0 {
+		return nil, errAudioPadding
+	}
+
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint32(iv[0:4], d.keyID+uint32(seq))
+
+	out := make([]byte, len(payload))
+	cipher.NewCBCDecrypter(d.aesBlock, iv[:]).CryptBlocks(out, payload)
+
+	// Strip PKCS#7 padding
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(out) {
+		return nil, errAudioPadding
+	}
+	for _, b := range out[len(out)-pad:] {
+		if int(b) != pad {
+			return nil, errAudioPadding
+		}
+	}
+	return out[:len(out)-pad], nil
+}
@@ -0,0 +1,141 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// The audio vectors are a block of four packets, sequence numbers 8 to 11,
+// encrypted with OpenSSL's AES-128-CBC and PKCS#7 padding under
+// testAudioKey and an IV of the big-endian rikeyid plus sequence number,
+// as Sunshine encrypts them. The parity was produced with
+// github.com/klauspost/reedsolomon using Sunshine's audio parity rows over
+// the ciphertexts.
+var (
+	testAudioKey = [16]byte{
+		0x5a, 0x1e, 0x9c, 0x0f, 0x7b, 0x3d, 0x26, 0xe8,
+		0xa4, 0xc1, 0xf0, 0x9d, 0x3b, 0x7e, 0x6a, 0x52,
+	}
+	testAudioKeyID uint32 = 0x0a0b0c0d
+
+	testAudioCiphertexts = []string{
+		"6c324abd45cb11746a7a8195cf1e36d2e821bc470b96cc6e310064789685c8ab",
+		"cfcee66d07f700e3a97d031a0ac1d897f72f95fb45fc83126e9904a802ba0206",
+		"39de883ae445a7ec3e2b32d0b32539b2d45d3fd35c7a940888fabe712f5f75f3",
+		"9aa939131384e56727705f0966e296801d14ee15626eee23b703b56ef29597dd",
+	}
+	testAudioParity = []string{
+		"f78b0da05191e183e0f22b704727c8ec4de26c36cc29fb9c5835a6677ae385c1",
+		"cac4170e2313bdb1520da5d17d054eef309d9e4ca1f97ba0952f608f83f821fc",
+	}
+)
+
+const (
+	testAudioBaseSeq       = 8
+	testAudioBaseTimestamp = 40 // milliseconds
+)
+
+// testAudioPlaintext is the Opus packet sent with a sequence number
+func testAudioPlaintext(seq uint16) []byte {
+	b := make([]byte, 20)
+	for i := range b {
+		b[i] = byte(int(seq)*31 + i*13)
+	}
+	return b
+}
+
+// testAudioPacket builds a data datagram as Sunshine sends it
+func testAudioPacket(t *testing.T, i int) []byte {
+	t.Helper()
+
+	pkt := make([]byte, 12)
+	pkt[0] = 0x80
+	pkt[1] = 97
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(testAudioBaseSeq+i))
+	binary.BigEndian.PutUint32(pkt[4:8], uint32(testAudioBaseTimestamp+5*i))
+	return append(pkt, mustHex(t, testAudioCiphertexts[i])...)
+}
+
+// testAudioFECPacket builds a parity datagram, with the block's base
+// sequence number and timestamp in its FEC header
+func testAudioFECPacket(t *testing.T, i int) []byte {
+	t.Helper()
+
+	pkt := make([]byte, 24)
+	pkt[0] = 0x80
+	pkt[1] = 127
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(testAudioBaseSeq+4+i))
+	binary.BigEndian.PutUint32(pkt[4:8], testAudioBaseTimestamp)
+	pkt[12] = byte(i)
+	pkt[13] = 97
+	binary.BigEndian.PutUint16(pkt[14:16], testAudioBaseSeq)
+	binary.BigEndian.PutUint32(pkt[16:20], testAudioBaseTimestamp)
+	return append(pkt, mustHex(t, testAudioParity[i])...)
+}
+
+func TestAudioDepacketizerDecrypt(t *testing.T) {
+	d := NewAudioDepacketizer()
+	if err := d.SetKey(testAudioKey, testAudioKeyID); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []AudioPacket
+	d.OnPacket(func(p AudioPacket) { got = append(got, p) })
+
+	d.Push(testAudioPacket(t, 0))
+
+	if len(got) != 1 {
+		t.Fatalf("got %d packets, want 1", len(got))
+	}
+	if got[0].Sequence != 8 || got[0].Timestamp != 40*48 {
+		t.Errorf("packet %d at %d, want 8 at %d", got[0].Sequence, got[0].Timestamp, 40*48)
+	}
+	if want := testAudioPlaintext(8); !bytes.Equal(got[0].Data, want) {
+		t.Errorf("decrypted %x, want %x", got[0].Data, want)
+	}
+}
+
+func TestAudioDepacketizerRecoversLostPackets(t *testing.T) {
+	for _, encrypted := range []bool{true, false} {
+		d := NewAudioDepacketizer()
+		if encrypted {
+			if err := d.SetKey(testAudioKey, testAudioKeyID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got := make(map[uint16]AudioPacket)
+		d.OnPacket(func(p AudioPacket) { got[p.Sequence] = p })
+
+		// Lose the second and fourth packets of the block
+		d.Push(testAudioPacket(t, 0))
+		d.Push(testAudioPacket(t, 2))
+		d.Push(testAudioFECPacket(t, 0))
+		if len(got) != 2 {
+			t.Fatalf("encrypted %v: got %d packets before the block could be recovered, want 2", encrypted, len(got))
+		}
+		d.Push(testAudioFECPacket(t, 1))
+
+		if len(got) != 4 {
+			t.Fatalf("encrypted %v: got %d packets, want 4", encrypted, len(got))
+		}
+		for i := 0; i < 4; i++ {
+			seq := uint16(testAudioBaseSeq + i)
+			pkt := got[seq]
+			want := mustHex(t, testAudioCiphertexts[i])
+			if encrypted {
+				want = testAudioPlaintext(seq)
+			}
+			if !bytes.Equal(pkt.Data, want) {
+				t.Errorf("encrypted %v: packet %d = %x, want %x", encrypted, seq, pkt.Data, want)
+			}
+			if wantTS := uint32(testAudioBaseTimestamp+5*i) * 48; pkt.Timestamp != wantTS {
+				t.Errorf("encrypted %v: packet %d at %d, want %d", encrypted, seq, pkt.Timestamp, wantTS)
+			}
+		}
+		if n := d.Recovered(); n != 2 {
+			t.Errorf("encrypted %v: recovered %d packets, want 2", encrypted, n)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -17,18 +18,36 @@ import (
 type Client struct {
 	mu sync.Mutex
 
-	conn    net.Conn
-	reader  *bufio.Reader
-	writer  *bufio.Writer
+	// host is the RTSP server's host:port. Sunshine handles one request per
+	// TCP connection, so every request dials it afresh.
+	host string
 
 	sessionID string
 	cseq      int
 	serverURL string
 
+	// connectData is sent in the control stream's ENet CONNECT
+	connectData uint32
+
+	// Server ports and ping payloads negotiated in SETUP
+	videoServerPort   int
+	audioServerPort   int
+	controlServerPort int
+	videoPingPayload  []byte
+	audioPingPayload  []byte
+
+	// Opus layouts offered in DESCRIBE and the channel count we announced
+	opusConfigs   []OpusConfig
+	audioChannels int
+
 	// Callbacks
 	onVideoRTP func(data []byte)
 	onAudioRTP func(data []byte)
 
+	// Reassemble Sunshine's FEC-protected media packets
+	video *VideoDepacketizer
+	audio *AudioDepacketizer
+
 	// RTP receivers
 	videoConn net.PacketConn
 	audioConn net.PacketConn
@@ -37,6 +56,32 @@ type Client struct {
 	closeChan chan struct{}
 }
 
+// Moonlight stream IDs used in SETUP. The control stream's "13" selects the
+// ENet control protocol.
+const (
+	StreamAudio   = "audio/0/0"
+	StreamVideo   = "video/0/0"
+	StreamControl = "control/13/0"
+)
+
+// rtspClientVersion is the protocol version Moonlight Gen 7 clients report
+const rtspClientVersion = "14"
+
+const (
+	requestTimeout = 10 * time.Second
+	pingInterval   = 500 * time.Millisecond
+)
+
+// Default ports of a host on the standard base port. Hosts that don't send
+// server_port in SETUP are reached on these, shifted by the host's offset
+// from the standard RTSP port, as Moonlight does.
+const (
+	defaultRTSPPort    = 48010
+	defaultVideoPort   = 47998
+	defaultControlPort = 47999
+	defaultAudioPort   = 48000
+)
+
 // SDPMedia represents a media description from SDP
 type SDPMedia struct {
 	Type       string // "video" or "audio"
@@ -54,11 +99,13 @@ func NewClient(serverURL string) *Client {
 	return &Client{
 		serverURL: serverURL,
 		cseq:      1,
+		video:     NewVideoDepacketizer(),
+		audio:     NewAudioDepacketizer(),
 		closeChan: make(chan struct{}),
 	}
 }
 
-// Connect establishes connection to the RTSP server
+// Connect resolves the RTSP server address and checks it responds to OPTIONS
 func (c *Client) Connect() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -66,35 +113,79 @@ func (c *Client) Connect() error {
 	// Parse URL to get host:port
 	url := c.serverURL
 	url = strings.TrimPrefix(url, "rtsp://")
+	if idx := strings.Index(url, "/"); idx != -1 {
+		url = url[:idx]
+	}
 
 	// Default port
 	host := url
-	if !strings.Contains(host, ":") {
-		host = host + ":48010"
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(defaultRTSPPort))
 	}
+	c.host = host
 
-	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	req := c.buildRequest("OPTIONS", c.serverURL)
+	req += "\r\n"
+
+	resp, _, err := c.sendRequest(req)
 	if err != nil {
 		return fmt.Errorf("connecting to RTSP server: %w", err)
 	}
 
-	c.conn = conn
-	c.reader = bufio.NewReader(conn)
-	c.writer = bufio.NewWriter(conn)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("OPTIONS failed: %d %s", resp.StatusCode, resp.StatusText)
+	}
 
 	return nil
 }
 
+// ControlPort returns the control stream's server port from SETUP
+func (c *Client) ControlPort() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.controlServerPort
+}
+
+// ConnectData returns the value the host expects in the control stream's
+// ENet CONNECT, as reported when the control stream was set up
+func (c *Client) ConnectData() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connectData
+}
+
 // OnVideoRTP sets the callback for video RTP packets
 func (c *Client) OnVideoRTP(fn func(data []byte)) {
 	c.onVideoRTP = fn
 }
 
+// OnVideoFrame sets the callback for reassembled video frames
+func (c *Client) OnVideoFrame(fn func(frame VideoFrame)) {
+	c.video.OnFrame(fn)
+}
+
+// OnVideoFrameLoss sets the callback for when video frames are lost despite
+// FEC, so the caller can request a new IDR frame
+func (c *Client) OnVideoFrameLoss(fn func(lastGood, next uint32)) {
+	c.video.OnFrameLoss(fn)
+}
+
 // OnAudioRTP sets the callback for audio RTP packets
 func (c *Client) OnAudioRTP(fn func(data []byte)) {
 	c.onAudioRTP = fn
 }
 
+// OnAudioPacket sets the callback for decrypted, FEC-recovered Opus packets
+func (c *Client) OnAudioPacket(fn func(pkt AudioPacket)) {
+	c.audio.OnPacket(fn)
+}
+
+// SetAudioKey sets the rikey and rikeyid used to decrypt audio when the
+// stream is announced with EncryptAudio
+func (c *Client) SetAudioKey(key [16]byte, keyID uint32) error {
+	return c.audio.SetKey(key, keyID)
+}
+
 // Describe sends DESCRIBE request and returns SDP
 func (c *Client) Describe() ([]SDPMedia, error) {
 	c.mu.Lock()
@@ -102,6 +193,7 @@ func (c *Client) Describe() ([]SDPMedia, error) {
 
 	req := c.buildRequest("DESCRIBE", c.serverURL)
 	req += "Accept: application/sdp\r\n"
+	req += "If-Modified-Since: Thu, 01 Jan 1970 00:00:00 GMT\r\n"
 	req += "\r\n"
 
 	resp, body, err := c.sendRequest(req)
@@ -113,21 +205,20 @@ func (c *Client) Describe() ([]SDPMedia, error) {
 		return nil, fmt.Errorf("DESCRIBE failed: %d %s", resp.StatusCode, resp.StatusText)
 	}
 
+	c.opusConfigs = parseSurroundParams(body)
+
 	return parseSDP(body), nil
 }
 
-// Setup sets up a media stream
-func (c *Client) Setup(media *SDPMedia, clientPort int) error {
+// Setup sets up one of the audio, video or control streams and returns the
+// server port the host assigned to it
+func (c *Client) Setup(stream string, clientPort int) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	controlURL := c.serverURL
-	if media.Control != "" && !strings.HasPrefix(media.Control, "rtsp://") {
-		controlURL = c.serverURL + "/" + media.Control
-	}
-
-	req := c.buildRequest("SETUP", controlURL)
-	req += fmt.Sprintf("Transport: RTP/AVP;unicast;client_port=%d-%d\r\n", clientPort, clientPort+1)
+	req := c.buildRequest("SETUP", "streamid="+stream)
+	req += fmt.Sprintf("Transport: unicast;X-GS-ClientPort=%d-%d\r\n", clientPort, clientPort+1)
+	req += "If-Modified-Since: Thu, 01 Jan 1970 00:00:00 GMT\r\n"
 	if c.sessionID != "" {
 		req += fmt.Sprintf("Session: %s\r\n", c.sessionID)
 	}
@@ -135,31 +226,172 @@ func (c *Client) Setup(media *SDPMedia, clientPort int) error {
 
 	resp, _, err := c.sendRequest(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("SETUP failed: %d %s", resp.StatusCode, resp.StatusText)
+		return 0, fmt.Errorf("SETUP failed: %d %s", resp.StatusCode, resp.StatusText)
 	}
 
 	// Extract session ID
-	if session, ok := resp.Headers["Session"]; ok {
+	if session := resp.Header("Session"); session != "" {
 		// Remove timeout parameter if present
 		if idx := strings.Index(session, ";"); idx != -1 {
 			session = session[:idx]
 		}
-		c.sessionID = session
+		c.sessionID = strings.TrimSpace(session)
+	}
+
+	serverPort, ok, err := parseServerPort(resp.Header("Transport"))
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		serverPort = c.defaultServerPortLocked(stream)
+	}
+
+	// Newer Sunshine versions expect this payload in the UDP pings so they
+	// can tell which client a ping came from
+	pingPayload := []byte(resp.Header("X-SS-Ping-Payload"))
+
+	switch stream {
+	case StreamVideo:
+		c.videoServerPort = serverPort
+		c.videoPingPayload = pingPayload
+	case StreamAudio:
+		c.audioServerPort = serverPort
+		c.audioPingPayload = pingPayload
+	case StreamControl:
+		c.controlServerPort = serverPort
+		if data := resp.Header("X-SS-Connect-Data"); data != "" {
+			v, err := strconv.ParseUint(data, 0, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid X-SS-Connect-Data %q: %w", data, err)
+			}
+			c.connectData = uint32(v)
+		}
+	}
+
+	return serverPort, nil
+}
+
+// parseServerPort extracts server_port from a SETUP Transport header,
+// reporting whether it is present
+func parseServerPort(transport string) (int, bool, error) {
+	for _, param := range strings.Split(transport, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(key, "server_port") {
+			continue
+		}
+		// A port range means RTP and RTCP; we only need the first
+		if idx := strings.Index(value, "-"); idx != -1 {
+			value = value[:idx]
+		}
+		port, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || port <= 0 || port > 65535 {
+			return 0, false, fmt.Errorf("invalid server_port in Transport %q", transport)
+		}
+		return port, true, nil
+	}
+	return 0, false, nil
+}
+
+// defaultServerPortLocked returns the port a stream is on when SETUP
+// doesn't say
+func (c *Client) defaultServerPortLocked(stream string) int {
+	offset := 0
+	if _, portStr, err := net.SplitHostPort(c.host); err == nil {
+		if port, err := strconv.Atoi(portStr); err == nil {
+			offset = port - defaultRTSPPort
+		}
+	}
+
+	switch stream {
+	case StreamVideo:
+		return defaultVideoPort + offset
+	case StreamAudio:
+		return defaultAudioPort + offset
+	default:
+		return defaultControlPort + offset
+	}
+}
+
+// Announce sends the stream configuration to the host
+func (c *Client) Announce(cfg StreamConfig) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg = cfg.withDefaults()
+	c.audio.setPacketDuration(cfg.AudioPacketMs)
+	c.audioChannels = cfg.AudioChannels
+
+	host, _, _ := net.SplitHostPort(c.host)
+	sdp := buildAnnounceSDP(cfg, host)
+
+	req := c.buildRequest("ANNOUNCE", "streamid="+StreamControl)
+	req += fmt.Sprintf("Session: %s\r\n", c.sessionID)
+	req += "Content-Type: application/sdp\r\n"
+	req += fmt.Sprintf("Content-Length: %d\r\n", len(sdp))
+	req += "\r\n"
+	req += sdp
+
+	resp, _, err := c.sendRequest(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("ANNOUNCE failed: %d %s", resp.StatusCode, resp.StatusText)
 	}
 
 	return nil
 }
 
+// Handshake runs the full Moonlight RTSP sequence: OPTIONS, DESCRIBE, SETUP
+// for audio, video and control, ANNOUNCE and PLAY. The RTP receivers must be
+// started first; once the host is playing they ping its server ports so it
+// knows where to send media.
+func (c *Client) Handshake(cfg StreamConfig) ([]SDPMedia, error) {
+	if err := c.Connect(); err != nil {
+		return nil, err
+	}
+
+	media, err := c.Describe()
+	if err != nil {
+		return nil, fmt.Errorf("RTSP DESCRIBE: %w", err)
+	}
+
+	if _, err := c.Setup(StreamAudio, localPort(c.audioConn)); err != nil {
+		return nil, fmt.Errorf("RTSP SETUP audio: %w", err)
+	}
+	if _, err := c.Setup(StreamVideo, localPort(c.videoConn)); err != nil {
+		return nil, fmt.Errorf("RTSP SETUP video: %w", err)
+	}
+	if _, err := c.Setup(StreamControl, 0); err != nil {
+		return nil, fmt.Errorf("RTSP SETUP control: %w", err)
+	}
+
+	if err := c.Announce(cfg); err != nil {
+		return nil, fmt.Errorf("RTSP ANNOUNCE: %w", err)
+	}
+
+	if err := c.Play(); err != nil {
+		return nil, fmt.Errorf("RTSP PLAY: %w", err)
+	}
+
+	if err := c.startPings(); err != nil {
+		return nil, err
+	}
+
+	return media, nil
+}
+
 // Play starts playback
 func (c *Client) Play() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	req := c.buildRequest("PLAY", c.serverURL)
+	req := c.buildRequest("PLAY", "/")
 	req += fmt.Sprintf("Session: %s\r\n", c.sessionID)
 	req += "Range: npt=0.000-\r\n"
 	req += "\r\n"
@@ -202,7 +434,8 @@ func (c *Client) Teardown() error {
 	return nil
 }
 
-// StartRTPReceiver starts receiving RTP packets on the specified port
+// StartRTPReceiver starts receiving RTP packets on the specified port. Port 0
+// binds an ephemeral port.
 func (c *Client) StartRTPReceiver(mediaType string, port int) error {
 	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
 	if err != nil {
@@ -221,6 +454,77 @@ func (c *Client) StartRTPReceiver(mediaType string, port int) error {
 	return nil
 }
 
+// startPings starts sending hole-punch pings from each receiver to the server
+// port the host assigned to it
+func (c *Client) startPings() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	host, _, err := net.SplitHostPort(c.host)
+	if err != nil {
+		return err
+	}
+
+	streams := []struct {
+		conn    net.PacketConn
+		port    int
+		payload []byte
+	}{
+		{c.videoConn, c.videoServerPort, c.videoPingPayload},
+		{c.audioConn, c.audioServerPort, c.audioPingPayload},
+	}
+
+	for _, st := range streams {
+		if st.conn == nil || st.port == 0 {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(st.port)))
+		if err != nil {
+			return fmt.Errorf("resolving RTP server address: %w", err)
+		}
+		go c.pingLoop(st.conn, addr, st.payload)
+	}
+
+	return nil
+}
+
+// pingLoop periodically sends Moonlight's UDP ping until the client closes.
+// With a ping payload the packet is the payload followed by a big-endian
+// sequence number, otherwise the legacy "PING".
+func (c *Client) pingLoop(conn net.PacketConn, addr net.Addr, payload []byte) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	var seq uint32
+	for {
+		var ping []byte
+		if len(payload) > 0 {
+			seq++
+			ping = binary.BigEndian.AppendUint32(append([]byte{}, payload...), seq)
+		} else {
+			ping = []byte("PING")
+		}
+		conn.WriteTo(ping, addr)
+
+		select {
+		case <-c.closeChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// localPort returns the local UDP port of a receiver, or 0 if it isn't bound
+func localPort(conn net.PacketConn) int {
+	if conn == nil {
+		return 0
+	}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
 func (c *Client) receiveRTP(conn net.PacketConn, mediaType string) {
 	buf := make([]byte, 65536)
 
@@ -247,10 +551,16 @@ func (c *Client) receiveRTP(conn net.PacketConn, mediaType string) {
 		data := make([]byte, n)
 		copy(data, buf[:n])
 
-		if mediaType == "video" && c.onVideoRTP != nil {
-			c.onVideoRTP(data)
-		} else if mediaType == "audio" && c.onAudioRTP != nil {
-			c.onAudioRTP(data)
+		if mediaType == "video" {
+			c.video.Push(data)
+			if c.onVideoRTP != nil {
+				c.onVideoRTP(data)
+			}
+		} else if mediaType == "audio" {
+			c.audio.Push(data)
+			if c.onAudioRTP != nil {
+				c.onAudioRTP(data)
+			}
 		}
 	}
 }
@@ -268,13 +578,6 @@ func (c *Client) Close() error {
 	}
 
 	c.Teardown()
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if c.conn != nil {
-		return c.conn.Close()
-	}
 	return nil
 }
 
@@ -285,29 +588,53 @@ type Response struct {
 	Headers    map[string]string
 }
 
+// Header returns a response header, matching the name case-insensitively
+func (r *Response) Header(name string) string {
+	if v, ok := r.Headers[name]; ok {
+		return v
+	}
+	for k, v := range r.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
 func (c *Client) buildRequest(method, url string) string {
 	req := fmt.Sprintf("%s %s RTSP/1.0\r\n", method, url)
 	req += fmt.Sprintf("CSeq: %d\r\n", c.cseq)
+	req += fmt.Sprintf("X-GS-ClientVersion: %s\r\n", rtspClientVersion)
+	req += fmt.Sprintf("Host: %s\r\n", c.host)
 	req += fmt.Sprintf("User-Agent: Gamelight/1.0\r\n")
 	c.cseq++
 	return req
 }
 
+// sendRequest sends a request on a new connection and reads the response
 func (c *Client) sendRequest(req string) (*Response, string, error) {
-	_, err := c.writer.WriteString(req)
+	if c.host == "" {
+		return nil, "", fmt.Errorf("RTSP client not connected")
+	}
+
+	conn, err := net.DialTimeout("tcp", c.host, requestTimeout)
 	if err != nil {
 		return nil, "", err
 	}
-	if err := c.writer.Flush(); err != nil {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	if _, err := io.WriteString(conn, req); err != nil {
 		return nil, "", err
 	}
 
-	return c.readResponse()
+	return readResponse(bufio.NewReader(conn))
 }
 
-func (c *Client) readResponse() (*Response, string, error) {
+func readResponse(reader *bufio.Reader) (*Response, string, error) {
 	// Read status line
-	line, err := c.reader.ReadString('\n')
+	line, err := reader.ReadString('\n')
 	if err != nil {
 		return nil, "", err
 	}
@@ -331,8 +658,9 @@ func (c *Client) readResponse() (*Response, string, error) {
 
 	// Read headers
 	contentLength := 0
+	contentLengthSet := false
 	for {
-		line, err := c.reader.ReadString('\n')
+		line, err := reader.ReadString('\n')
 		if err != nil {
 			return nil, "", err
 		}
@@ -350,15 +678,23 @@ func (c *Client) readResponse() (*Response, string, error) {
 
 			if strings.EqualFold(key, "Content-Length") {
 				contentLength, _ = strconv.Atoi(value)
+				contentLengthSet = true
 			}
 		}
 	}
 
-	// Read body if present
+	// Read body if present. Sunshine may omit Content-Length, in which case
+	// the body runs until it closes the connection.
 	var body string
 	if contentLength > 0 {
 		bodyBytes := make([]byte, contentLength)
-		_, err := io.ReadFull(c.reader, bodyBytes)
+		_, err := io.ReadFull(reader, bodyBytes)
+		if err != nil {
+			return nil, "", err
+		}
+		body = string(bodyBytes)
+	} else if !contentLengthSet {
+		bodyBytes, err := io.ReadAll(reader)
 		if err != nil {
 			return nil, "", err
 		}
@@ -0,0 +1,51 @@
+package rtsp
+
+import "testing"
+
+func TestParseServerPort(t *testing.T) {
+	tests := []struct {
+		transport string
+		port      int
+		ok        bool
+		err       bool
+	}{
+		{"server_port=48000", 48000, true, false},
+		{"unicast;server_port=47998-47999;ssrc=1", 47998, true, false},
+		{"unicast; SERVER_PORT=47999", 47999, true, false},
+		{"unicast;client_port=50000-50001", 0, false, false},
+		{"", 0, false, false},
+		{"server_port=http", 0, false, true},
+		{"server_port=70000", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		port, ok, err := parseServerPort(tt.transport)
+		if port != tt.port || ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("parseServerPort(%q) = %d, %v, %v; want %d, %v, error %v", tt.transport, port, ok, err, tt.port, tt.ok, tt.err)
+		}
+	}
+}
+
+func TestDefaultServerPort(t *testing.T) {
+	tests := []struct {
+		host    string
+		video   int
+		audio   int
+		control int
+	}{
+		{"192.168.1.10:48010", 47998, 48000, 47999},
+		// A host whose base port was moved up by 100
+		{"192.168.1.10:48110", 48098, 48100, 48099},
+		{"[fe80::1]:48010", 47998, 48000, 47999},
+	}
+
+	for _, tt := range tests {
+		c := NewClient("rtsp://" + tt.host)
+		c.host = tt.host
+		for stream, want := range map[string]int{StreamVideo: tt.video, StreamAudio: tt.audio, StreamControl: tt.control} {
+			if got := c.defaultServerPortLocked(stream); got != want {
+				t.Errorf("%s %s: port %d, want %d", tt.host, stream, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package rtsp
+
+import (
+	"errors"
+)
+
+// Reed-Solomon erasure coding over GF(2^8), compatible with the nanors
+// library Sunshine and Moonlight use. The encoding matrix is a Vandermonde
+// matrix made systematic by multiplying with the inverse of its top square,
+// so data shards are sent unmodified and parity rows are linear
+// combinations of them.
+
+var (
+	errTooFewShards    = errors.New("fec: too few shards to reconstruct")
+	errSingularMatrix  = errors.New("fec: matrix is singular")
+	errShardSizeDiffer = errors.New("fec: shard sizes differ")
+)
+
+// gfPoly is the field's generator polynomial x^8 + x^4 + x^3 + x^2 + 1
+const gfPoly = 0x11D
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// gfMatrix is a row-major matrix over GF(2^8)
+type gfMatrix [][]byte
+
+func newMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) multiply(o gfMatrix) gfMatrix {
+	out := newMatrix(len(m), len(o[0]))
+	for r := range m {
+		for c := range o[0] {
+			var v byte
+			for i := range o {
+				v ^= gfMul(m[r][i], o[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of a square matrix using Gauss-Jordan elimination
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := 0; r < n; r++ {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		if work[c][c] == 0 {
+			swapped := false
+			for r := c + 1; r < n; r++ {
+				if work[r][c] != 0 {
+					work[c], work[r] = work[r], work[c]
+					swapped = true
+					break
+				}
+			}
+			if !swapped {
+				return nil, errSingularMatrix
+			}
+		}
+
+		if scale := work[c][c]; scale != 1 {
+			inv := gfInv(scale)
+			for i := range work[c] {
+				work[c][i] = gfMul(work[c][i], inv)
+			}
+		}
+
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(factor, work[c][i])
+			}
+		}
+	}
+
+	out := newMatrix(n, n)
+	for r := 0; r < n; r++ {
+		copy(out[r], work[r][n:])
+	}
+	return out, nil
+}
+
+// reedSolomon holds the encoding matrix for a data/parity shard layout
+type reedSolomon struct {
+	dataShards   int
+	parityShards int
+	matrix       gfMatrix // (data+parity) x data, top rows are identity
+}
+
+// newReedSolomon builds the standard systematic Vandermonde code
+func newReedSolomon(dataShards, parityShards int) (*reedSolomon, error) {
+	total := dataShards + parityShards
+	if dataShards <= 0 || parityShards < 0 || total > 256 {
+		return nil, errors.New("fec: invalid shard counts")
+	}
+
+	vm := newMatrix(total, dataShards)
+	for r := 0; r < total; r++ {
+		for c := 0; c < dataShards; c++ {
+			vm[r][c] = gfPow(byte(r), c)
+		}
+	}
+
+	topInv, err := vm[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reedSolomon{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       vm.multiply(topInv),
+	}, nil
+}
+
+// newReedSolomonWithParity builds a code with explicit parity rows, for
+// streams whose sender doesn't use the standard matrix
+func newReedSolomonWithParity(dataShards int, parity [][]byte) *reedSolomon {
+	m := newMatrix(dataShards+len(parity), dataShards)
+	for i := 0; i < dataShards; i++ {
+		m[i][i] = 1
+	}
+	for i, row := range parity {
+		copy(m[dataShards+i], row)
+	}
+	return &reedSolomon{
+		dataShards:   dataShards,
+		parityShards: len(parity),
+		matrix:       m,
+	}
+}
+
+// encode fills in the parity shards from the data shards
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for p := 0; p < rs.parityShards; p++ {
+		row := rs.matrix[rs.dataShards+p]
+		out := shards[rs.dataShards+p]
+		for i := range out {
+			out[i] = 0
+		}
+		for d := 0; d < rs.dataShards; d++ {
+			gfMulAdd(row[d], shards[d], out)
+		}
+	}
+}
+
+// reconstructData recovers missing data shards in place. shards must have
+// dataShards+parityShards entries; missing shards are nil. Parity shards are
+// not rebuilt.
+func (rs *reedSolomon) reconstructData(shards [][]byte) error {
+	size := -1
+	present := 0
+	missingData := false
+	for i, s := range shards {
+		if s == nil {
+			if i < rs.dataShards {
+				missingData = true
+			}
+			continue
+		}
+		if size == -1 {
+			size = len(s)
+		} else if len(s) != size {
+			return errShardSizeDiffer
+		}
+		present++
+	}
+
+	if !missingData {
+		return nil
+	}
+	if present < rs.dataShards {
+		return errTooFewShards
+	}
+
+	// Pick the first dataShards available rows and invert them
+	sub := newMatrix(rs.dataShards, rs.dataShards)
+	inputs := make([][]byte, 0, rs.dataShards)
+	for i := 0; i < len(shards) && len(inputs) < rs.dataShards; i++ {
+		if shards[i] == nil {
+			continue
+		}
+		copy(sub[len(inputs)], rs.matrix[i])
+		inputs = append(inputs, shards[i])
+	}
+
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+
+	for d := 0; d < rs.dataShards; d++ {
+		if shards[d] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for i, in := range inputs {
+			gfMulAdd(decode[d][i], in, out)
+		}
+		shards[d] = out
+	}
+
+	return nil
+}
+
+// gfMulAdd computes out ^= c * in
+func gfMulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	if c == 1 {
+		for i := range in {
+			out[i] ^= in[i]
+		}
+		return
+	}
+	logC := int(gfLog[c])
+	for i, v := range in {
+		if v != 0 {
+			out[i] ^= gfExp[logC+int(gfLog[v])]
+		}
+	}
+}
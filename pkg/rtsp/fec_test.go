@@ -0,0 +1,147 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The parity vectors in these tests were produced with
+// github.com/klauspost/reedsolomon, whose default matrix is the Backblaze
+// Vandermonde construction that nanors (and moonlight-common-c's rs.c
+// before it) build, over shards from testShard.
+
+// testShard returns n bytes of test data, different for each seed
+func testShard(n, seed int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*37 + seed*101 + 11)
+	}
+	return b
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+var fecVectors = []struct {
+	dataShards int
+	parity     []string
+}{
+	{1, []string{"0b30557a9fc4e90e"}},
+	{4, []string{"d5f701762ad18920", "f152cb7e397b062a"}},
+	{10, []string{"9664a6abba69adca", "2c33931ddd1f1830", "222b008722e33520"}},
+	{30, []string{
+		"35ee1eb073c98a96", "f2c305553c6cf1bb", "95fa86d65303d90b",
+		"f51d3a129370d30f", "1926cb521943a2d9", "fce6e230fab41c55",
+		"8107e96914736534", "408685731093260c", "52a8959a9c17cf23",
+	}},
+}
+
+// vectorShards returns a vector's data shards followed by its parity
+func vectorShards(t *testing.T, dataShards int, parity []string) [][]byte {
+	t.Helper()
+
+	shards := make([][]byte, 0, dataShards+len(parity))
+	for i := 0; i < dataShards; i++ {
+		shards = append(shards, testShard(8, i))
+	}
+	for _, p := range parity {
+		shards = append(shards, mustHex(t, p))
+	}
+	return shards
+}
+
+func TestReedSolomonEncode(t *testing.T) {
+	for _, v := range fecVectors {
+		rs, err := newReedSolomon(v.dataShards, len(v.parity))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := vectorShards(t, v.dataShards, v.parity)
+		shards := make([][]byte, len(want))
+		copy(shards, want[:v.dataShards])
+		for i := v.dataShards; i < len(shards); i++ {
+			shards[i] = make([]byte, 8)
+		}
+		rs.encode(shards)
+
+		for i := v.dataShards; i < len(shards); i++ {
+			if !bytes.Equal(shards[i], want[i]) {
+				t.Errorf("%d+%d parity %d = %x, want %x", v.dataShards, len(v.parity), i-v.dataShards, shards[i], want[i])
+			}
+		}
+	}
+}
+
+func TestReedSolomonReconstruct(t *testing.T) {
+	for _, v := range fecVectors {
+		total := v.dataShards + len(v.parity)
+		rs, err := newReedSolomon(v.dataShards, len(v.parity))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := vectorShards(t, v.dataShards, v.parity)
+
+		// Every loss of no more shards than there is parity; for the largest
+		// code, losing the first or the last data shards
+		var losses [][]int
+		if total <= 13 {
+			for mask := 0; mask < 1<<total; mask++ {
+				var lost []int
+				for i := 0; i < total; i++ {
+					if mask&(1<<i) != 0 {
+						lost = append(lost, i)
+					}
+				}
+				if len(lost) <= len(v.parity) {
+					losses = append(losses, lost)
+				}
+			}
+		} else {
+			var first, last []int
+			for i := range v.parity {
+				first = append(first, i)
+				last = append(last, v.dataShards-1-i)
+			}
+			losses = [][]int{first, last}
+		}
+
+		for _, lost := range losses {
+			shards := make([][]byte, total)
+			copy(shards, want)
+			for _, i := range lost {
+				shards[i] = nil
+			}
+
+			if err := rs.reconstructData(shards); err != nil {
+				t.Fatalf("%d+%d losing %v: %v", v.dataShards, len(v.parity), lost, err)
+			}
+			for i := 0; i < v.dataShards; i++ {
+				if !bytes.Equal(shards[i], want[i]) {
+					t.Fatalf("%d+%d losing %v: shard %d = %x, want %x", v.dataShards, len(v.parity), lost, i, shards[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestReedSolomonTooFewShards(t *testing.T) {
+	rs, err := newReedSolomon(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards := vectorShards(t, 4, fecVectors[1].parity)
+	shards[0], shards[1], shards[4] = nil, nil, nil
+	if err := rs.reconstructData(shards); err != errTooFewShards {
+		t.Fatalf("reconstructData = %v, want %v", err, errTooFewShards)
+	}
+}
@@ -0,0 +1,107 @@
+package rtsp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Speaker channel masks (WAVE order) for the layouts Sunshine supports
+const (
+	ChannelMaskStereo = 0x3
+	ChannelMask51     = 0x3F
+	ChannelMask71     = 0x63F
+)
+
+// ChannelMask returns the speaker mask for a channel count
+func ChannelMask(channels int) (int, error) {
+	switch channels {
+	case 2:
+		return ChannelMaskStereo, nil
+	case 6:
+		return ChannelMask51, nil
+	case 8:
+		return ChannelMask71, nil
+	}
+	return 0, fmt.Errorf("unsupported audio channel count %d", channels)
+}
+
+// OpusConfig describes the host's multistream Opus layout. Mapping gives,
+// for each output channel in WAVE order, the decoded stream channel it
+// comes from.
+type OpusConfig struct {
+	Channels       int
+	Streams        int
+	CoupledStreams int
+	Mapping        []byte
+}
+
+// parseSurroundParams parses the surround-params fmtp attributes Sunshine
+// lists in DESCRIBE, one per supported layout
+func parseSurroundParams(sdp string) []OpusConfig {
+	var configs []OpusConfig
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		idx := strings.Index(line, "surround-params=")
+		if !strings.HasPrefix(line, "a=fmtp:") || idx == -1 {
+			continue
+		}
+
+		params := line[idx+len("surround-params="):]
+		if end := strings.IndexAny(params, "; "); end != -1 {
+			params = params[:end]
+		}
+		if len(params) < 3 {
+			continue
+		}
+
+		digits := make([]byte, len(params))
+		valid := true
+		for i := 0; i < len(params); i++ {
+			if params[i] < '0' || params[i] > '9' {
+				valid = false
+				break
+			}
+			digits[i] = params[i] - '0'
+		}
+		if !valid {
+			continue
+		}
+
+		cfg := OpusConfig{
+			Channels:       int(digits[0]),
+			Streams:        int(digits[1]),
+			CoupledStreams: int(digits[2]),
+		}
+		if len(digits) != 3+cfg.Channels {
+			continue
+		}
+		cfg.Mapping = digits[3:]
+
+		// Sunshine rotates channels 3-5 of the normal quality surround
+		// mappings left to match what GFE advertised; undo that to get the
+		// mapping its encoder really uses
+		if cfg.Channels > 2 && cfg.CoupledStreams > 0 {
+			m := cfg.Mapping
+			m[3], m[4], m[5] = m[5], m[3], m[4]
+		}
+
+		configs = append(configs, cfg)
+	}
+
+	return configs
+}
+
+// OpusConfig returns the host's Opus layout for the announced channel
+// count. It is only available after the handshake.
+func (c *Client) OpusConfig() (OpusConfig, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cfg := range c.opusConfigs {
+		if cfg.Channels == c.audioChannels {
+			return cfg, true
+		}
+	}
+	return OpusConfig{}, false
+}
@@ -0,0 +1,373 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+)
+
+// Sunshine video packets are RTP packets with a 4-byte extension, followed by
+// the NV video header and a fixed-size chunk of the frame. Each frame is split
+// into up to four FEC blocks; every block carries its data shards followed by
+// Reed-Solomon parity shards of the same size.
+const (
+	rtpHeaderSize     = 12
+	nvVideoHeaderSize = 16
+	videoHeaderSize   = rtpHeaderSize + 4 + nvVideoHeaderSize
+
+	maxFECBlocks      = 4
+	maxPendingFrames  = 8
+	shortFrameHeader  = 0x01
+	shortHeaderLength = 8
+	longFrameHeader   = 0x81
+	longHeaderLength  = 44
+)
+
+// Frame types reported in Sunshine's frame header
+const (
+	FrameTypePFrame        = 1
+	FrameTypeIDR           = 2
+	FrameTypeIntraRefresh  = 4
+	FrameTypeRefInvalidate = 5
+)
+
+// VideoFrame is a complete access unit reassembled from Sunshine's stream
+type VideoFrame struct {
+	Index     uint32
+	Timestamp uint32 // 90kHz RTP clock
+	FrameType uint8
+	Data      []byte
+}
+
+// IsKeyframe reports whether the frame can be decoded on its own
+func (f *VideoFrame) IsKeyframe() bool {
+	return f.FrameType == FrameTypeIDR
+}
+
+// nvVideoPacket is the parsed header of one video datagram
+type nvVideoPacket struct {
+	seq        uint16
+	timestamp  uint32
+	frameIndex uint32
+	flags      uint8
+	fecIndex   int
+	dataShards int
+	fecPercent int
+	block      int
+	lastBlock  int
+}
+
+func parseVideoPacket(data []byte) (*nvVideoPacket, bool) {
+	if len(data) < videoHeaderSize {
+		return nil, false
+	}
+
+	nv := data[rtpHeaderSize+4:]
+	fecInfo := binary.LittleEndian.Uint32(nv[12:16])
+	multiFecBlocks := nv[11]
+
+	return &nvVideoPacket{
+		seq:        binary.BigEndian.Uint16(data[2:4]),
+		timestamp:  binary.BigEndian.Uint32(data[4:8]),
+		frameIndex: binary.LittleEndian.Uint32(nv[4:8]),
+		flags:      nv[8],
+		fecIndex:   int(fecInfo>>12) & 0x3FF,
+		dataShards: int(fecInfo >> 22),
+		fecPercent: int(fecInfo>>4) & 0xFF,
+		block:      int(multiFecBlocks>>4) & 0x3,
+		lastBlock:  int(multiFecBlocks>>6) & 0x3,
+	}, true
+}
+
+// fecBlock collects the shards of one FEC block
+type fecBlock struct {
+	dataShards   int
+	parityShards int
+	shards       [][]byte
+	received     int
+	done         bool
+}
+
+func (b *fecBlock) complete() bool {
+	return b.received >= b.dataShards
+}
+
+// pendingFrame collects the FEC blocks of one frame
+type pendingFrame struct {
+	index     uint32
+	timestamp uint32
+	lastBlock int
+	blocks    [maxFECBlocks]*fecBlock
+}
+
+// VideoDepacketizer reassembles Sunshine video packets into frames,
+// recovering lost packets from FEC parity where possible
+type VideoDepacketizer struct {
+	mu sync.Mutex
+
+	frames    map[uint32]*pendingFrame
+	lastFrame uint32
+	started   bool
+
+	codes map[[2]int]*reedSolomon
+
+	// Stats
+	recovered uint64
+	dropped   uint64
+
+	onFrame     func(VideoFrame)
+	onFrameLoss func(lastGood, next uint32)
+}
+
+// NewVideoDepacketizer creates a new video depacketizer
+func NewVideoDepacketizer() *VideoDepacketizer {
+	return &VideoDepacketizer{
+		frames: make(map[uint32]*pendingFrame),
+		codes:  make(map[[2]int]*reedSolomon),
+	}
+}
+
+// OnFrame sets the callback for completed frames
+func (d *VideoDepacketizer) OnFrame(fn func(VideoFrame)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onFrame = fn
+}
+
+// OnFrameLoss sets the callback for when one or more frames could not be
+// reassembled. lastGood is the last frame delivered and next is the frame
+// delivered after the gap.
+func (d *VideoDepacketizer) OnFrameLoss(fn func(lastGood, next uint32)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onFrameLoss = fn
+}
+
+// Stats returns the number of packets recovered by FEC and frames dropped
+func (d *VideoDepacketizer) Stats() (recovered, dropped uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.recovered, d.dropped
+}
+
+// Push processes one video datagram
+func (d *VideoDepacketizer) Push(data []byte) {
+	pkt, ok := parseVideoPacket(data)
+	if !ok || pkt.dataShards == 0 {
+		return
+	}
+
+	d.mu.Lock()
+
+	// Ignore packets for frames we already delivered or gave up on
+	if d.started && int32(pkt.frameIndex-d.lastFrame) <= 0 {
+		d.mu.Unlock()
+		return
+	}
+
+	frame := d.frames[pkt.frameIndex]
+	if frame == nil {
+		frame = &pendingFrame{
+			index:     pkt.frameIndex,
+			timestamp: pkt.timestamp,
+			lastBlock: pkt.lastBlock,
+		}
+		d.frames[pkt.frameIndex] = frame
+		d.evictLocked()
+	}
+
+	block := frame.blocks[pkt.block]
+	if block == nil {
+		parity := (pkt.dataShards*pkt.fecPercent + 99) / 100
+		block = &fecBlock{
+			dataShards:   pkt.dataShards,
+			parityShards: parity,
+			shards:       make([][]byte, pkt.dataShards+parity),
+		}
+		frame.blocks[pkt.block] = block
+	}
+
+	if block.done || pkt.fecIndex >= len(block.shards) || block.shards[pkt.fecIndex] != nil {
+		d.mu.Unlock()
+		return
+	}
+	block.shards[pkt.fecIndex] = data
+	block.received++
+
+	if block.complete() {
+		d.finishBlockLocked(frame, block)
+	}
+
+	ready := d.collectLocked()
+	onFrame := d.onFrame
+	d.mu.Unlock()
+
+	if onFrame != nil {
+		for _, f := range ready {
+			onFrame(f)
+		}
+	}
+}
+
+// finishBlockLocked runs FEC recovery for a block with enough shards
+func (d *VideoDepacketizer) finishBlockLocked(frame *pendingFrame, block *fecBlock) {
+	block.done = true
+
+	missing := 0
+	for i := 0; i < block.dataShards; i++ {
+		if block.shards[i] == nil {
+			missing++
+		}
+	}
+	if missing == 0 {
+		return
+	}
+
+	rs, err := d.code(block.dataShards, block.parityShards)
+	if err == nil {
+		err = rs.reconstructData(block.shards)
+	}
+	if err != nil {
+		log.Printf("Video FEC recovery failed for frame %d: %v", frame.index, err)
+		block.shards = nil
+		return
+	}
+	d.recovered += uint64(missing)
+}
+
+func (d *VideoDepacketizer) code(dataShards, parityShards int) (*reedSolomon, error) {
+	key := [2]int{dataShards, parityShards}
+	if rs, ok := d.codes[key]; ok {
+		return rs, nil
+	}
+	rs, err := newReedSolomon(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	d.codes[key] = rs
+	return rs, nil
+}
+
+// collectLocked returns the frames that are complete, in order
+func (d *VideoDepacketizer) collectLocked() []VideoFrame {
+	var ready []VideoFrame
+	for {
+		var next *pendingFrame
+		for _, f := range d.frames {
+			if !frameComplete(f) {
+				continue
+			}
+			if next == nil || int32(f.index-next.index) < 0 {
+				next = f
+			}
+		}
+		if next == nil {
+			return ready
+		}
+
+		// Older frames that are still incomplete can no longer be shown
+		for idx := range d.frames {
+			if int32(idx-next.index) < 0 {
+				delete(d.frames, idx)
+				d.dropped++
+			}
+		}
+		delete(d.frames, next.index)
+
+		if d.started && next.index != d.lastFrame+1 && d.onFrameLoss != nil {
+			go d.onFrameLoss(d.lastFrame, next.index)
+		}
+		d.lastFrame = next.index
+		d.started = true
+
+		if frame, ok := assembleFrame(next); ok {
+			ready = append(ready, frame)
+		} else {
+			d.dropped++
+		}
+	}
+}
+
+// evictLocked bounds the number of frames waiting for packets
+func (d *VideoDepacketizer) evictLocked() {
+	for len(d.frames) > maxPendingFrames {
+		var oldest *pendingFrame
+		for _, f := range d.frames {
+			if oldest == nil || int32(f.index-oldest.index) < 0 {
+				oldest = f
+			}
+		}
+		delete(d.frames, oldest.index)
+		d.dropped++
+		if !d.started || int32(oldest.index-d.lastFrame) > 0 {
+			d.lastFrame = oldest.index
+			d.started = true
+		}
+	}
+}
+
+func frameComplete(f *pendingFrame) bool {
+	for i := 0; i <= f.lastBlock; i++ {
+		if f.blocks[i] == nil || !f.blocks[i].done {
+			return false
+		}
+	}
+	return true
+}
+
+// assembleFrame concatenates the data shard payloads of a complete frame and
+// strips Sunshine's frame header and trailing padding
+func assembleFrame(f *pendingFrame) (VideoFrame, bool) {
+	var data []byte
+	for i := 0; i <= f.lastBlock; i++ {
+		block := f.blocks[i]
+		if block.shards == nil {
+			return VideoFrame{}, false
+		}
+		for _, shard := range block.shards[:block.dataShards] {
+			if len(shard) < videoHeaderSize {
+				return VideoFrame{}, false
+			}
+			data = append(data, shard[videoHeaderSize:]...)
+		}
+	}
+
+	frame := VideoFrame{
+		Index:     f.index,
+		Timestamp: f.timestamp,
+	}
+
+	if len(data) < shortHeaderLength {
+		return VideoFrame{}, false
+	}
+
+	headerLen := shortHeaderLength
+	switch data[0] {
+	case shortFrameHeader:
+	case longFrameHeader:
+		headerLen = longHeaderLength
+	default:
+		log.Printf("Unknown video frame header type 0x%02x", data[0])
+		return VideoFrame{}, false
+	}
+	if len(data) < headerLen {
+		return VideoFrame{}, false
+	}
+
+	frame.FrameType = data[3]
+	lastPayloadLen := int(binary.LittleEndian.Uint16(data[4:6]))
+
+	// The last packet is zero padded to the full packet size; Sunshine tells
+	// us its real length for codecs that can't tolerate padding (AV1)
+	if lastPayloadLen > 0 {
+		lastBlock := f.blocks[f.lastBlock]
+		lastShard := lastBlock.shards[lastBlock.dataShards-1]
+		padding := len(lastShard) - videoHeaderSize - lastPayloadLen
+		if padding > 0 && padding <= len(data)-headerLen {
+			data = data[:len(data)-padding]
+		}
+	}
+
+	frame.Data = data[headerLen:]
+	return frame, true
+}
@@ -0,0 +1,198 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+const testPacketSize = 16
+
+// testVideoFrame returns a frame as Sunshine splits it into shards: its
+// short header, the frame and zero padding to a whole packet
+func testVideoFrame(frameType byte, frame []byte) []byte {
+	data := make([]byte, shortHeaderLength, shortHeaderLength+len(frame)+testPacketSize)
+	data[0] = shortFrameHeader
+	data[3] = frameType
+	data = append(data, frame...)
+	binary.LittleEndian.PutUint16(data[4:6], uint16((len(data)-1)%testPacketSize+1))
+	for len(data)%testPacketSize != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// testVideoBlock is one FEC block of a frame
+type testVideoBlock struct {
+	data   []byte   // the block's data shard payloads
+	parity []string // parity payloads
+}
+
+// testVideoPackets builds the datagrams of a frame's FEC blocks with the
+// headers laid out as Sunshine's RTP_PACKET, 4-byte extension and
+// NV_VIDEO_PACKET structs
+func testVideoPackets(t *testing.T, seq *uint16, frameIndex, timestamp uint32, fecPercent int, blocks ...testVideoBlock) [][][]byte {
+	t.Helper()
+
+	out := make([][][]byte, len(blocks))
+	for b, block := range blocks {
+		dataShards := len(block.data) / testPacketSize
+		payloads := make([][]byte, 0, dataShards+len(block.parity))
+		for i := 0; i < dataShards; i++ {
+			payloads = append(payloads, block.data[i*testPacketSize:(i+1)*testPacketSize])
+		}
+		for _, p := range block.parity {
+			payloads = append(payloads, mustHex(t, p))
+		}
+
+		for i, payload := range payloads {
+			pkt := make([]byte, 32, 32+len(payload))
+			pkt[0] = 0x90
+			binary.BigEndian.PutUint16(pkt[2:4], *seq)
+			binary.BigEndian.PutUint32(pkt[4:8], timestamp)
+			binary.LittleEndian.PutUint32(pkt[16:20], uint32(*seq)<<8)
+			binary.LittleEndian.PutUint32(pkt[20:24], frameIndex)
+			pkt[24] = 0x01
+			pkt[26] = 0x10
+			pkt[27] = byte(b<<4 | (len(blocks)-1)<<6)
+			binary.LittleEndian.PutUint32(pkt[28:32], uint32(dataShards)<<22|uint32(i)<<12|uint32(fecPercent)<<4)
+			out[b] = append(out[b], append(pkt, payload...))
+			*seq++
+		}
+	}
+	return out
+}
+
+// collectFrames records the frames a depacketizer delivers
+func collectFrames(d *VideoDepacketizer) *[]VideoFrame {
+	var frames []VideoFrame
+	d.OnFrame(func(f VideoFrame) { frames = append(frames, f) })
+	return &frames
+}
+
+func TestVideoDepacketizerRecoversLostShards(t *testing.T) {
+	d := NewVideoDepacketizer()
+	frames := collectFrames(d)
+
+	// 45 bytes of header and frame make three data shards; 50% FEC adds
+	// two parity shards
+	frame := testShard(37, 7)
+	var seq uint16
+	packets := testVideoPackets(t, &seq, 1, 90000, 50, testVideoBlock{
+		data:   testVideoFrame(FrameTypeIDR, frame),
+		parity: []string{"b170d0d25d50f0b0be23c86dd25050f0", "65bf7d8889293630e74758aef108d9de"},
+	})[0]
+
+	// Lose the first and last data shards
+	for _, i := range []int{3, 1, 4} {
+		d.Push(packets[i])
+	}
+
+	if len(*frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(*frames))
+	}
+	got := (*frames)[0]
+	if got.Index != 1 || got.Timestamp != 90000 || !got.IsKeyframe() {
+		t.Errorf("frame %d at %d, type %d; want IDR frame 1 at 90000", got.Index, got.Timestamp, got.FrameType)
+	}
+	if !bytes.Equal(got.Data, frame) {
+		t.Errorf("frame data\n got %x\nwant %x", got.Data, frame)
+	}
+	if recovered, dropped := d.Stats(); recovered != 2 || dropped != 0 {
+		t.Errorf("stats = %d recovered, %d dropped; want 2, 0", recovered, dropped)
+	}
+}
+
+func TestVideoDepacketizerMultipleFECBlocks(t *testing.T) {
+	d := NewVideoDepacketizer()
+	frames := collectFrames(d)
+
+	// 88 bytes of header and frame make six data shards, sent as two
+	// blocks of three with two parity shards each
+	frame := testShard(80, 7)
+	data := testVideoFrame(FrameTypePFrame, frame)
+	var seq uint16 = 0xFFFE
+	packets := testVideoPackets(t, &seq, 7, 123456, 50,
+		testVideoBlock{
+			data:   data[:3*testPacketSize],
+			parity: []string{"b170d0d15850f0b0be23c86dd2771c81", "65bf7d99ba293630e74758aef1da6ce5"},
+		},
+		testVideoBlock{
+			data:   data[3*testPacketSize:],
+			parity: []string{"46eb50f59a3fa449b0d05050f0b070d0", "d6287358ea66c0d9f45d827970b154b3"},
+		},
+	)
+
+	// The second block arrives first; each block loses data shards
+	d.Push(packets[1][4])
+	d.Push(packets[1][1])
+	d.Push(packets[1][3])
+	if len(*frames) != 0 {
+		t.Fatal("frame delivered before its first block")
+	}
+	d.Push(packets[0][0])
+	d.Push(packets[0][2])
+	d.Push(packets[0][3])
+
+	if len(*frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(*frames))
+	}
+	got := (*frames)[0]
+	if got.Index != 7 || got.Timestamp != 123456 || got.FrameType != FrameTypePFrame {
+		t.Errorf("frame %d at %d, type %d; want P frame 7 at 123456", got.Index, got.Timestamp, got.FrameType)
+	}
+	if !bytes.Equal(got.Data, frame) {
+		t.Errorf("frame data\n got %x\nwant %x", got.Data, frame)
+	}
+	if recovered, _ := d.Stats(); recovered != 3 {
+		t.Errorf("recovered %d packets, want 3", recovered)
+	}
+
+	// Late packets of the delivered frame are ignored
+	d.Push(packets[0][1])
+	if len(*frames) != 1 {
+		t.Errorf("got %d frames after a late packet, want 1", len(*frames))
+	}
+}
+
+func TestVideoDepacketizerUnrecoverableFrame(t *testing.T) {
+	d := NewVideoDepacketizer()
+	frames := collectFrames(d)
+
+	losses := make(chan [2]uint32, 1)
+	d.OnFrameLoss(func(lastGood, next uint32) { losses <- [2]uint32{lastGood, next} })
+
+	var seq uint16
+	first := testVideoPackets(t, &seq, 1, 0, 0, testVideoBlock{data: testVideoFrame(FrameTypeIDR, []byte("first"))})
+	lost := testVideoPackets(t, &seq, 2, 1500, 50, testVideoBlock{
+		data:   testVideoFrame(FrameTypePFrame, testShard(37, 7)),
+		parity: []string{"00000000000000000000000000000000", "00000000000000000000000000000000"},
+	})
+	third := testVideoPackets(t, &seq, 3, 3000, 0, testVideoBlock{data: testVideoFrame(FrameTypePFrame, []byte("third"))})
+
+	d.Push(first[0][0])
+	// Three of five shards are lost, more than the parity can replace
+	d.Push(lost[0][1])
+	d.Push(lost[0][3])
+	d.Push(third[0][0])
+
+	if len(*frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(*frames))
+	}
+	if string((*frames)[0].Data) != "first" || string((*frames)[1].Data) != "third" {
+		t.Errorf("frames = %q, %q; want first, third", (*frames)[0].Data, (*frames)[1].Data)
+	}
+	if _, dropped := d.Stats(); dropped != 1 {
+		t.Errorf("dropped %d frames, want 1", dropped)
+	}
+
+	select {
+	case loss := <-losses:
+		if loss != [2]uint32{1, 3} {
+			t.Errorf("frame loss between %d and %d, want 1 and 3", loss[0], loss[1])
+		}
+	case <-time.After(time.Second):
+		t.Error("frame loss not reported")
+	}
+}
@@ -46,12 +46,14 @@ type Participant struct {
 	CanMouse     bool       `json:"can_mouse"`     // Can use mouse
 }
 
-// StreamSettings holds the current stream quality settings
+// StreamSettings holds the host and quality settings of the stream
 type StreamSettings struct {
-	Bitrate int `json:"bitrate"`
-	FPS     int `json:"fps"`
-	Width   int `json:"width"`
-	Height  int `json:"height"`
+	Host    string `json:"host,omitempty"`
+	Bitrate int    `json:"bitrate"`
+	FPS     int    `json:"fps"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	HDR     bool   `json:"hdr,omitempty"` // Asks for HDR where the app, host and browsers allow
 }
 
 // Session represents an active streaming session
@@ -61,6 +63,8 @@ type Session struct {
 	ID           string
 	AppID        int
 	AppName      string
+	VideoCodec   string // MIME type of the stream's video
+	HDR          bool   // Whether the host is sending HDR video
 	Settings     StreamSettings
 	participants map[string]*Participant
 	slots        [5]*Participant // Index 0 unused, slots 1-4
@@ -117,6 +121,35 @@ func (m *Manager) EndSession() {
 	m.session = nil
 }
 
+// GetSettings returns the stream settings
+func (s *Session) GetSettings() StreamSettings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Settings
+}
+
+// SetApp records the app the session is streaming
+func (s *Session) SetApp(id int, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.AppID = id
+	s.AppName = name
+}
+
+// SetVideoCodec records the codec the stream's video is sent in
+func (s *Session) SetVideoCodec(mimeType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.VideoCodec = mimeType
+}
+
+// SetHDR records whether the host is sending HDR video
+func (s *Session) SetHDR(hdr bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.HDR = hdr
+}
+
 // Join adds a participant to the session
 func (s *Session) Join(id, name string) *Participant {
 	s.mu.Lock()
@@ -462,7 +495,10 @@ func (s *Session) OnParticipantUpdate(fn func(*Participant)) {
 type State struct {
 	Active      bool            `json:"active"`
 	ID          string          `json:"id,omitempty"`
+	AppID       int             `json:"app_id,omitempty"`
 	AppName     string          `json:"app_name,omitempty"`
+	VideoCodec  string          `json:"video_codec,omitempty"`
+	HDR         bool            `json:"hdr,omitempty"`
 	Players     []*Participant  `json:"players,omitempty"`
 	Spectators  int             `json:"spectators,omitempty"`
 	Settings    *StreamSettings `json:"settings,omitempty"`
@@ -476,7 +512,10 @@ func (s *Session) GetState() State {
 	return State{
 		Active:     true,
 		ID:         s.ID,
+		AppID:      s.AppID,
 		AppName:    s.AppName,
+		VideoCodec: s.VideoCodec,
+		HDR:        s.HDR,
 		Players:    s.GetPlayers(),
 		Spectators: s.GetSpectatorCount(),
 		Settings:   &s.Settings,
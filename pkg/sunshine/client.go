@@ -1,19 +1,32 @@
 package sunshine
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// requestTimeout bounds requests whose context has no deadline
+const requestTimeout = 10 * time.Second
+
+// ErrServerCertMismatch is returned when the host presents a certificate
+// other than the one pinned during pairing
+var ErrServerCertMismatch = errors.New("server certificate does not match the paired host")
+
 // Client communicates with a Sunshine server
 type Client struct {
 	host      string
@@ -23,49 +36,141 @@ type Client struct {
 	httpClient  *http.Client
 	httpsClient *http.Client
 
-	// Client identity
+	// Client identity. Pairing may replace the unique ID with the one
+	// stored by earlier pairings.
+	idMu     sync.RWMutex
 	uniqueID string
 	uuid     string
 
-	// Paired certificate (used for HTTPS after pairing)
+	// Paired certificates. Our certificate authenticates HTTPS requests;
+	// the host's is pinned and checked on every HTTPS connection.
+	certMu     sync.RWMutex
 	clientCert tls.Certificate
 	serverCert *x509.Certificate
+
+	// Last MAC address the host reported, for waking it
+	macMu sync.Mutex
+	mac   string
 }
 
 // NewClient creates a new Sunshine client
 func NewClient(host string, httpPort, httpsPort int) *Client {
-	return &Client{
+	c := &Client{
 		host:      host,
 		httpPort:  httpPort,
 		httpsPort: httpsPort,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
-		httpsClient: &http.Client{
-			Timeout: 10 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true, // Sunshine uses self-signed certs
+		httpClient: &http.Client{},
+		uniqueID: generateUniqueID(),
+		uuid:     generateUUID(),
+	}
+
+	c.httpsClient = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				// Sunshine uses a self-signed certificate, so instead of
+				// the usual chain and hostname checks the certificate is
+				// compared with the one pinned during pairing
+				InsecureSkipVerify:    true,
+				VerifyPeerCertificate: c.verifyServerCertificate,
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					cert := c.clientCertificate()
+					return &cert, nil
 				},
 			},
 		},
-		uniqueID: "0123456789ABCDEF",
-		uuid:     generateUUID(),
 	}
+
+	return c
+}
+
+// Host returns the host's address
+func (c *Client) Host() string {
+	return c.host
+}
+
+// SetUniqueID sets the persistent client ID the host knows us by
+func (c *Client) SetUniqueID(id string) {
+	c.idMu.Lock()
+	c.uniqueID = id
+	c.idMu.Unlock()
+}
+
+// UniqueID returns the client ID sent with every request
+func (c *Client) UniqueID() string {
+	c.idMu.RLock()
+	defer c.idMu.RUnlock()
+	return c.uniqueID
+}
+
+// SetServerCertificate pins the host certificate received during pairing.
+// HTTPS requests fail with ErrServerCertMismatch if the host presents a
+// different one.
+func (c *Client) SetServerCertificate(cert *x509.Certificate) {
+	c.certMu.Lock()
+	c.serverCert = cert
+	c.certMu.Unlock()
+
+	c.closeIdleHTTPS()
+}
+
+// ServerCertificate returns the pinned host certificate
+func (c *Client) ServerCertificate() *x509.Certificate {
+	c.certMu.RLock()
+	defer c.certMu.RUnlock()
+	return c.serverCert
 }
 
 // SetClientCertificate sets the client certificate for authenticated requests
 func (c *Client) SetClientCertificate(cert tls.Certificate) {
+	c.certMu.Lock()
 	c.clientCert = cert
-	c.httpsClient = &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-				Certificates:       []tls.Certificate{cert},
-			},
-		},
+	c.certMu.Unlock()
+
+	c.closeIdleHTTPS()
+}
+
+// SetMAC sets the host MAC address used for Wake-on-LAN
+func (c *Client) SetMAC(mac string) {
+	c.macMu.Lock()
+	c.mac = mac
+	c.macMu.Unlock()
+}
+
+// MAC returns the last MAC address the host reported, or the one set with
+// SetMAC
+func (c *Client) MAC() string {
+	c.macMu.Lock()
+	defer c.macMu.Unlock()
+	return c.mac
+}
+
+// Paired reports whether a client certificate from pairing is set
+func (c *Client) Paired() bool {
+	return len(c.clientCertificate().Certificate) > 0
+}
+
+func (c *Client) clientCertificate() tls.Certificate {
+	c.certMu.RLock()
+	defer c.certMu.RUnlock()
+	return c.clientCert
+}
+
+// closeIdleHTTPS drops pooled connections made with old certificates
+func (c *Client) closeIdleHTTPS() {
+	c.httpsClient.CloseIdleConnections()
+}
+
+// verifyServerCertificate checks the host's certificate against the pinned
+// one. Before pairing nothing is pinned and any certificate is accepted.
+func (c *Client) verifyServerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	pinned := c.ServerCertificate()
+	if pinned == nil {
+		return nil
 	}
+	if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned.Raw) {
+		return ErrServerCertMismatch
+	}
+	return nil
 }
 
 // ServerInfo contains information about the Sunshine server
@@ -85,6 +190,37 @@ type ServerInfo struct {
 	MaxLumaPixelsHEVC   int
 }
 
+// GameRunning reports whether the host has an app running that a client
+// can resume. Hosts report SUNSHINE_SERVER_FREE once the app has quit.
+func (i *ServerInfo) GameRunning() bool {
+	return i.CurrentGame != 0 && !strings.HasSuffix(i.State, "_SERVER_FREE")
+}
+
+// Codec mode bits of ServerCodecModeSupport
+const (
+	CodecModeH264       = 0x00001
+	CodecModeHEVC       = 0x00100
+	CodecModeHEVCMain10 = 0x00200
+	CodecModeAV1Main8   = 0x10000
+	CodecModeAV1Main10  = 0x20000
+)
+
+// SupportsCodecMode reports whether the host can encode a codec mode. Hosts
+// that don't report ServerCodecModeSupport encode H.264, and HEVC if they
+// report a MaxLumaPixelsHEVC.
+func (i *ServerInfo) SupportsCodecMode(mode int) bool {
+	if i.ServerCodecSupport != 0 {
+		return i.ServerCodecSupport&mode != 0
+	}
+	switch mode {
+	case CodecModeH264:
+		return true
+	case CodecModeHEVC:
+		return i.MaxLumaPixelsHEVC > 0
+	}
+	return false
+}
+
 // App represents an application on the Sunshine server
 type App struct {
 	ID           int
@@ -144,38 +280,75 @@ func (c *Client) httpsURL(endpoint string) string {
 }
 
 func (c *Client) addClientParams(params url.Values) {
-	params.Set("uniqueid", c.uniqueID)
+	params.Set("uniqueid", c.UniqueID())
 	params.Set("uuid", c.uuid)
 }
 
-func (c *Client) doRequest(client *http.Client, baseURL string, params url.Values) (*xmlRoot, error) {
+func (c *Client) doRequest(ctx context.Context, client *http.Client, baseURL string, params url.Values) (*xmlRoot, error) {
+	body, err := c.get(ctx, client, baseURL, params)
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(body)
+}
+
+// get fetches an endpoint and returns the response body. Requests without
+// a deadline time out after requestTimeout.
+func (c *Client) get(ctx context.Context, client *http.Client, baseURL string, params url.Values) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+
 	reqURL := baseURL
 	if len(params) > 0 {
 		reqURL = baseURL + "?" + params.Encode()
 	}
 
-	resp, err := client.Get(reqURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return nil, fmt.Errorf("request to %s: %w", baseURL, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Don't repeat the query string, it holds certificates and our ID
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, requestError(baseURL, err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("reading response: %w", err)
+		return nil, requestError(baseURL, fmt.Errorf("reading response: %w", err))
+	}
+
+	// Sunshine reports most errors in the XML with a 200 status, but some
+	// come as an HTTP error with or without an XML body
+	if resp.StatusCode >= 400 {
+		var statusErr *StatusError
+		if _, err := parseResponse(body); errors.As(err, &statusErr) {
+			return nil, err
+		}
+		return nil, newStatusError(resp.StatusCode, http.StatusText(resp.StatusCode))
 	}
+	return body, nil
+}
 
+// parseResponse parses an XML response, turning error statuses into a
+// *StatusError
+func parseResponse(body []byte) (*xmlRoot, error) {
 	var root xmlRoot
 	if err := xml.Unmarshal(body, &root); err != nil {
 		return nil, fmt.Errorf("parsing XML: %w", err)
 	}
 
-	if root.StatusCode/100 == 4 {
-		msg := root.StatusMessage
-		if msg == "" {
-			msg = "request failed"
-		}
-		return nil, fmt.Errorf("server error %d: %s", root.StatusCode, msg)
+	if root.StatusCode >= 400 {
+		return nil, newStatusError(root.StatusCode, root.StatusMessage)
 	}
 
 	return &root, nil
@@ -183,10 +356,29 @@ func (c *Client) doRequest(client *http.Client, baseURL string, params url.Value
 
 // GetServerInfo queries Sunshine for server information
 func (c *Client) GetServerInfo() (*ServerInfo, error) {
+	return c.GetServerInfoContext(context.Background())
+}
+
+// GetServerInfoContext is GetServerInfo with a context
+func (c *Client) GetServerInfoContext(ctx context.Context) (*ServerInfo, error) {
+	// The host only reports our pair status over HTTPS
+	return c.serverInfo(ctx, c.Paired())
+}
+
+func (c *Client) serverInfo(ctx context.Context, https bool) (*ServerInfo, error) {
 	params := url.Values{}
 	c.addClientParams(params)
 
-	root, err := c.doRequest(c.httpClient, c.httpURL("serverinfo"), params)
+	client, endpoint := c.httpClient, c.httpURL("serverinfo")
+	if https {
+		client, endpoint = c.httpsClient, c.httpsURL("serverinfo")
+	}
+
+	var root *xmlRoot
+	err := retry(ctx, func() (err error) {
+		root, err = c.doRequest(ctx, client, endpoint, params)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -220,15 +412,29 @@ func (c *Client) GetServerInfo() (*ServerInfo, error) {
 		info.MaxLumaPixelsHEVC = v
 	}
 
+	// Hosts that won't tell us their MAC report all zeros
+	if validMAC(info.MAC) {
+		c.SetMAC(info.MAC)
+	}
+
 	return info, nil
 }
 
 // GetAppList retrieves the list of available applications
 func (c *Client) GetAppList() ([]App, error) {
+	return c.GetAppListContext(context.Background())
+}
+
+// GetAppListContext is GetAppList with a context
+func (c *Client) GetAppListContext(ctx context.Context) ([]App, error) {
 	params := url.Values{}
 	c.addClientParams(params)
 
-	root, err := c.doRequest(c.httpsClient, c.httpsURL("applist"), params)
+	var root *xmlRoot
+	err := retry(ctx, func() (err error) {
+		root, err = c.doRequest(ctx, c.httpsClient, c.httpsURL("applist"), params)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -250,6 +456,38 @@ func (c *Client) GetAppList() ([]App, error) {
 	return apps, nil
 }
 
+// GetBoxArt retrieves an app's box art image, which Sunshine serves as PNG
+func (c *Client) GetBoxArt(appID int) ([]byte, error) {
+	return c.GetBoxArtContext(context.Background(), appID)
+}
+
+// GetBoxArtContext is GetBoxArt with a context
+func (c *Client) GetBoxArtContext(ctx context.Context, appID int) ([]byte, error) {
+	params := url.Values{}
+	c.addClientParams(params)
+	params.Set("appid", strconv.Itoa(appID))
+	params.Set("AssetType", "2")
+	params.Set("AssetIdx", "0")
+
+	var body []byte
+	err := retry(ctx, func() (err error) {
+		body, err = c.get(ctx, c.httpsClient, c.httpsURL("appasset"), params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Errors come back as XML instead of an image
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("<")) {
+		if _, err := parseResponse(body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no box art for app %d: %w", appID, ErrAppNotFound)
+	}
+	return body, nil
+}
+
 // LaunchRequest contains parameters for launching an application
 type LaunchRequest struct {
 	AppID      int
@@ -261,6 +499,32 @@ type LaunchRequest struct {
 	RIKeyID    uint32
 	LocalAudio bool
 	Gamepads   int
+
+	// SurroundAudioInfo selects the audio layout; see SurroundAudioInfo.
+	// Zero means stereo.
+	SurroundAudioInfo int
+
+	// HDR asks for 10-bit HDR video. The RTSP ANNOUNCE must ask for it
+	// too, and the host only sends it while its display is in HDR mode.
+	HDR bool
+}
+
+// SurroundAudioInfo encodes a channel count and speaker mask for the
+// surroundAudioInfo launch parameter
+func SurroundAudioInfo(channels, channelMask int) int {
+	return channelMask<<16 | channels
+}
+
+// GenerateRIKey creates a random remote input key and key ID for a launch
+func GenerateRIKey() ([16]byte, uint32, error) {
+	var buf [20]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return [16]byte{}, 0, fmt.Errorf("generating rikey: %w", err)
+	}
+
+	var key [16]byte
+	copy(key[:], buf[:16])
+	return key, binary.BigEndian.Uint32(buf[16:]), nil
 }
 
 // LaunchResponse contains the result of launching an application
@@ -271,27 +535,36 @@ type LaunchResponse struct {
 
 // Launch starts streaming an application
 func (c *Client) Launch(req LaunchRequest) (*LaunchResponse, error) {
-	params := url.Values{}
-	c.addClientParams(params)
+	return c.LaunchContext(context.Background(), req)
+}
 
-	params.Set("appid", strconv.Itoa(req.AppID))
-	params.Set("mode", fmt.Sprintf("%dx%dx%d", req.Width, req.Height, req.FPS))
-	params.Set("additionalStates", "1")
-	params.Set("sops", "1")
-	params.Set("rikey", strings.ToUpper(hex.EncodeToString(req.RIKey[:])))
-	params.Set("rikeyid", strconv.FormatUint(uint64(req.RIKeyID), 10))
+// LaunchContext is Launch with a context. A launch changes the host's
+// state, so unlike queries it isn't retried.
+func (c *Client) LaunchContext(ctx context.Context, req LaunchRequest) (*LaunchResponse, error) {
+	root, err := c.doRequest(ctx, c.httpsClient, c.httpsURL("launch"), c.launchParams(req))
+	if err != nil {
+		return nil, err
+	}
 
-	if req.LocalAudio {
-		params.Set("localAudioPlayMode", "1")
-	} else {
-		params.Set("localAudioPlayMode", "0")
+	resp := &LaunchResponse{
+		SessionURL: root.SessionURL0,
+	}
+	if v, err := strconv.Atoi(root.GameSession); err == nil {
+		resp.SessionID = v
 	}
 
-	params.Set("remoteControllersBitmap", strconv.Itoa(req.Gamepads))
-	params.Set("gcmap", strconv.Itoa(req.Gamepads))
-	params.Set("gcpersist", "0")
+	return resp, nil
+}
 
-	root, err := c.doRequest(c.httpsClient, c.httpsURL("launch"), params)
+// Resume resumes an existing streaming session. The host keeps running the
+// app it has; req.AppID only identifies it.
+func (c *Client) Resume(req LaunchRequest) (*LaunchResponse, error) {
+	return c.ResumeContext(context.Background(), req)
+}
+
+// ResumeContext is Resume with a context
+func (c *Client) ResumeContext(ctx context.Context, req LaunchRequest) (*LaunchResponse, error) {
+	root, err := c.doRequest(ctx, c.httpsClient, c.httpsURL("resume"), c.launchParams(req))
 	if err != nil {
 		return nil, err
 	}
@@ -299,15 +572,15 @@ func (c *Client) Launch(req LaunchRequest) (*LaunchResponse, error) {
 	resp := &LaunchResponse{
 		SessionURL: root.SessionURL0,
 	}
-	if v, err := strconv.Atoi(root.GameSession); err == nil {
+	if v, err := strconv.Atoi(root.Resume); err == nil {
 		resp.SessionID = v
 	}
 
 	return resp, nil
 }
 
-// Resume resumes an existing streaming session
-func (c *Client) Resume(req LaunchRequest) (*LaunchResponse, error) {
+// launchParams builds the query parameters shared by launch and resume
+func (c *Client) launchParams(req LaunchRequest) url.Values {
 	params := url.Values{}
 	c.addClientParams(params)
 
@@ -328,44 +601,68 @@ func (c *Client) Resume(req LaunchRequest) (*LaunchResponse, error) {
 	params.Set("gcmap", strconv.Itoa(req.Gamepads))
 	params.Set("gcpersist", "0")
 
-	root, err := c.doRequest(c.httpsClient, c.httpsURL("resume"), params)
-	if err != nil {
-		return nil, err
+	surroundAudioInfo := req.SurroundAudioInfo
+	if surroundAudioInfo == 0 {
+		surroundAudioInfo = SurroundAudioInfo(2, 0x3)
 	}
-
-	resp := &LaunchResponse{
-		SessionURL: root.SessionURL0,
-	}
-	if v, err := strconv.Atoi(root.Resume); err == nil {
-		resp.SessionID = v
+	params.Set("surroundAudioInfo", strconv.Itoa(surroundAudioInfo))
+
+	if req.HDR {
+		// Moonlight sends empty display capabilities; the host uses its own
+		params.Set("hdrMode", "1")
+		params.Set("clientHdrCapVersion", "0")
+		params.Set("clientHdrCapSupportFlags", "0")
+		params.Set("clientHdrCapMetaDataId", "NV_STATIC_METADATA_TYPE_1")
+		params.Set("clientHdrCapDisplayData", "0x0x0x0x0x0x0x0x0x0x0")
 	}
 
-	return resp, nil
+	return params
 }
 
 // Cancel stops the current streaming session
 func (c *Client) Cancel() error {
+	return c.CancelContext(context.Background())
+}
+
+// CancelContext is Cancel with a context
+func (c *Client) CancelContext(ctx context.Context) error {
 	params := url.Values{}
 	c.addClientParams(params)
 
-	_, err := c.doRequest(c.httpsClient, c.httpsURL("cancel"), params)
+	_, err := c.doRequest(ctx, c.httpsClient, c.httpsURL("cancel"), params)
 	return err
 }
 
 // Unpair removes the pairing with the server
 func (c *Client) Unpair() error {
+	return c.UnpairContext(context.Background())
+}
+
+// UnpairContext is Unpair with a context
+func (c *Client) UnpairContext(ctx context.Context) error {
 	params := url.Values{}
 	c.addClientParams(params)
 
-	_, err := c.doRequest(c.httpClient, c.httpURL("unpair"), params)
+	_, err := c.doRequest(ctx, c.httpClient, c.httpURL("unpair"), params)
 	return err
 }
 
+// generateUniqueID returns a random client ID in the 16 hex digit form
+// Moonlight clients use. It becomes our identity when we first pair.
+func generateUniqueID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Only possible if the OS random source is broken
+		panic(err)
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
 func generateUUID() string {
-	// Simple UUID v4 generation
 	b := make([]byte, 16)
-	for i := range b {
-		b[i] = byte(time.Now().UnixNano() >> (i * 8))
+	if _, err := rand.Read(b); err != nil {
+		// Only possible if the OS random source is broken
+		panic(err)
 	}
 	b[6] = (b[6] & 0x0f) | 0x40
 	b[8] = (b[8] & 0x3f) | 0x80
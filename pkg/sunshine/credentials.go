@@ -0,0 +1,247 @@
+package sunshine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotPaired is returned when no paired client certificate is stored
+var ErrNotPaired = errors.New("no stored pairing credentials")
+
+// Identity is the client identity that must stay the same across restarts
+// for the host to recognise us
+type Identity struct {
+	UniqueID string `json:"unique_id"`
+}
+
+// hostInfo is what we remember about a host between runs
+type hostInfo struct {
+	MAC string `json:"mac,omitempty"`
+}
+
+// Credentials are the stored results of pairing with a host
+type Credentials struct {
+	Identity   Identity
+	ClientCert tls.Certificate
+	ServerCert *x509.Certificate
+}
+
+// CredentialStore saves and loads the client identity and pairing
+// credentials as files
+type CredentialStore struct {
+	certPath       string
+	keyPath        string
+	serverCertPath string
+	identityPath   string
+
+	// hostInfoPath sits next to the server certificate, so each host has
+	// its own
+	hostInfoPath string
+}
+
+// NewCredentialStore creates a store using the given file paths
+func NewCredentialStore(certPath, keyPath, serverCertPath, identityPath string) *CredentialStore {
+	return &CredentialStore{
+		certPath:       certPath,
+		keyPath:        keyPath,
+		serverCertPath: serverCertPath,
+		identityPath:   identityPath,
+		hostInfoPath:   strings.TrimSuffix(serverCertPath, filepath.Ext(serverCertPath)) + ".json",
+	}
+}
+
+// CertPath returns the path of the client certificate file
+func (s *CredentialStore) CertPath() string {
+	return s.certPath
+}
+
+// LoadIdentity loads the client identity, or returns an empty one if no
+// host has been paired yet
+func (s *CredentialStore) LoadIdentity() (Identity, error) {
+	data, err := os.ReadFile(s.identityPath)
+	if os.IsNotExist(err) {
+		return Identity{}, nil
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var id Identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return Identity{}, fmt.Errorf("parsing %s: %w", s.identityPath, err)
+	}
+	return id, nil
+}
+
+// SaveIdentity writes the client identity
+func (s *CredentialStore) SaveIdentity(id Identity) error {
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(s.identityPath, data, 0600)
+}
+
+// LoadMAC returns the host's cached MAC address, or "" if none is saved
+func (s *CredentialStore) LoadMAC() (string, error) {
+	data, err := os.ReadFile(s.hostInfoPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var info hostInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return "", fmt.Errorf("parsing %s: %w", s.hostInfoPath, err)
+	}
+	return info.MAC, nil
+}
+
+// SaveMAC caches the host's MAC address for Wake-on-LAN
+func (s *CredentialStore) SaveMAC(mac string) error {
+	data, err := json.MarshalIndent(hostInfo{MAC: mac}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(s.hostInfoPath, data, 0644)
+}
+
+// Load loads the identity and pairing credentials. It returns ErrNotPaired
+// if no client certificate has been saved.
+func (s *CredentialStore) Load() (*Credentials, error) {
+	id, err := s.LoadIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(s.certPath); os.IsNotExist(err) {
+		return nil, ErrNotPaired
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certPath, s.keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate: %w", err)
+	}
+
+	creds := &Credentials{
+		Identity:   id,
+		ClientCert: cert,
+	}
+
+	// The server certificate is optional so credentials saved before it
+	// was known still load
+	data, err := os.ReadFile(s.serverCertPath)
+	switch {
+	case err == nil:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("parsing %s: no PEM data", s.serverCertPath)
+		}
+		creds.ServerCert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing server certificate: %w", err)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+// Save writes the credentials from a completed pairing, and the unique ID
+// the host paired us under
+func (s *CredentialStore) Save(state *PairState) error {
+	if state.UniqueID != "" {
+		if err := s.SaveIdentity(Identity{UniqueID: state.UniqueID}); err != nil {
+			return err
+		}
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(state.ClientKey)
+	if err != nil {
+		return fmt.Errorf("encoding client key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if err := writeFile(s.keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFile(s.certPath, state.ClientCertPEM, 0644); err != nil {
+		return err
+	}
+
+	if state.ServerCert != nil {
+		serverPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: state.ServerCert.Raw})
+		if err := writeFile(s.serverCertPath, serverPEM, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove deletes the pairing credentials and cached host MAC, keeping the
+// identity
+func (s *CredentialStore) Remove() error {
+	for _, path := range []string{s.certPath, s.keyPath, s.serverCertPath, s.hostInfoPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadCredentials applies stored credentials to the client: the unique ID,
+// if any host has been paired, and cached MAC always, and the client and
+// server certificates if we have paired with this one. It returns
+// ErrNotPaired if there is no client certificate.
+func (c *Client) LoadCredentials(store *CredentialStore) error {
+	mac, err := store.LoadMAC()
+	if err != nil {
+		return err
+	}
+	if mac != "" {
+		c.SetMAC(mac)
+	}
+
+	creds, err := store.Load()
+	if errors.Is(err, ErrNotPaired) {
+		id, idErr := store.LoadIdentity()
+		if idErr != nil {
+			return idErr
+		}
+		if id.UniqueID != "" {
+			c.SetUniqueID(id.UniqueID)
+		}
+		return ErrNotPaired
+	}
+	if err != nil {
+		return err
+	}
+
+	if creds.Identity.UniqueID != "" {
+		c.SetUniqueID(creds.Identity.UniqueID)
+	}
+	c.SetClientCertificate(creds.ClientCert)
+	if creds.ServerCert != nil {
+		c.SetServerCertificate(creds.ServerCert)
+	}
+	return nil
+}
+
+// writeFile writes data, creating the parent directory if needed
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
@@ -0,0 +1,134 @@
+package sunshine_test
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/gamelight/gamelight/pkg/sunshine"
+	"github.com/gamelight/gamelight/pkg/sunshinetest"
+)
+
+func newTestStore(t *testing.T) *sunshine.CredentialStore {
+	t.Helper()
+
+	dir := t.TempDir()
+	return sunshine.NewCredentialStore(
+		filepath.Join(dir, "client.crt"),
+		filepath.Join(dir, "client.key"),
+		filepath.Join(dir, "hosts", "server.crt"),
+		filepath.Join(dir, "identity.json"),
+	)
+}
+
+func TestCredentialStoreRoundTrip(t *testing.T) {
+	store := newTestStore(t)
+
+	if id, err := store.LoadIdentity(); err != nil || id.UniqueID != "" {
+		t.Fatalf("LoadIdentity before pairing = %+v, %v", id, err)
+	}
+	if _, err := store.Load(); !errors.Is(err, sunshine.ErrNotPaired) {
+		t.Fatalf("Load before pairing: %v, want ErrNotPaired", err)
+	}
+
+	state, err := sunshine.GeneratePairState("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := sunshine.GeneratePairState("host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.ServerCert = server.ClientCert
+	state.UniqueID = "00112233AABBCCDD"
+	if err := store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Identity.UniqueID != state.UniqueID {
+		t.Errorf("unique ID %q, want %q", creds.Identity.UniqueID, state.UniqueID)
+	}
+	if len(creds.ClientCert.Certificate) == 0 || !bytes.Equal(creds.ClientCert.Certificate[0], state.ClientCert.Raw) {
+		t.Error("client certificate differs from the one saved")
+	}
+	if key, ok := creds.ClientCert.PrivateKey.(*rsa.PrivateKey); !ok || !key.Equal(state.ClientKey) {
+		t.Error("client key differs from the one saved")
+	}
+	if creds.ServerCert == nil || !creds.ServerCert.Equal(state.ServerCert) {
+		t.Error("pinned server certificate differs from the one saved")
+	}
+
+	// Loading applies it all to a client
+	client := sunshine.NewClient("127.0.0.1", 47989, 47984)
+	if err := client.LoadCredentials(store); err != nil {
+		t.Fatal(err)
+	}
+	if client.UniqueID() != state.UniqueID {
+		t.Errorf("client unique ID %q, want %q", client.UniqueID(), state.UniqueID)
+	}
+	if cert := client.ServerCertificate(); cert == nil || !cert.Equal(state.ServerCert) {
+		t.Error("client doesn't pin the saved server certificate")
+	}
+
+	// Removing the pairing keeps the identity
+	if err := store.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); !errors.Is(err, sunshine.ErrNotPaired) {
+		t.Errorf("Load after Remove: %v, want ErrNotPaired", err)
+	}
+	if id, err := store.LoadIdentity(); err != nil || id.UniqueID != state.UniqueID {
+		t.Errorf("LoadIdentity after Remove = %+v, %v", id, err)
+	}
+}
+
+func TestPairingKeepsOneIdentity(t *testing.T) {
+	// Clients start with a random ID
+	a, b := sunshine.NewClient("", 0, 0), sunshine.NewClient("", 0, 0)
+	if len(a.UniqueID()) != 16 || a.UniqueID() == b.UniqueID() {
+		t.Fatalf("unique IDs %q and %q aren't random", a.UniqueID(), b.UniqueID())
+	}
+
+	// The first pairing stores the client's ID, and the next host is
+	// paired under it too
+	store := newTestStore(t)
+	var ids []string
+	for i := 0; i < 2; i++ {
+		srv, err := sunshinetest.NewUnstartedServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.PIN = "1234"
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		host := &sunshine.Host{Name: "test", Client: srv.Client(), Store: store}
+		state, err := sunshine.GeneratePairState("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := host.Pair(srv.PIN, state); err != nil {
+			t.Fatal(err)
+		}
+		if err := host.SavePairing(state); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, host.Client.UniqueID())
+	}
+
+	id, err := store.LoadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids[0] != ids[1] || id.UniqueID != ids[0] {
+		t.Errorf("paired as %q and %q, stored %q", ids[0], ids[1], id.UniqueID)
+	}
+}
@@ -0,0 +1,119 @@
+package sunshine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Request failures. Errors from Client methods wrap one of these where
+// the cause is known.
+var (
+	ErrClientRejected    = errors.New("host rejected the client certificate")
+	ErrAppNotFound       = errors.New("app not found on host")
+	ErrSessionInProgress = errors.New("host is busy with another session")
+	ErrHostUnreachable   = errors.New("host unreachable")
+)
+
+// sessionMessages are what the host's messages say when another session
+// or app is in the way
+var sessionMessages = []string{"already running", "in progress", "busy"}
+
+// Retries of requests that are safe to repeat
+const (
+	retryAttempts       = 3
+	retryInitialBackoff = 250 * time.Millisecond
+)
+
+// StatusError is an error status returned by the host
+type StatusError struct {
+	Code    int
+	Message string
+
+	// Err is the sentinel error the status maps to, if any
+	Err error
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server error %d: %s", e.Code, e.Message)
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// newStatusError maps a Sunshine status code and message to an error.
+// Sunshine doesn't always pick a distinct code, so some messages are
+// matched too. Other server errors, a 503 from a host still starting for
+// one, map to no sentinel and are retried.
+func newStatusError(code int, msg string) *StatusError {
+	if msg == "" {
+		msg = "request failed"
+	}
+	e := &StatusError{Code: code, Message: msg}
+
+	lower := strings.ToLower(msg)
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		e.Err = ErrClientRejected
+	case code == http.StatusNotFound || strings.Contains(lower, "no running app"):
+		e.Err = ErrAppNotFound
+	default:
+		for _, s := range sessionMessages {
+			if strings.Contains(lower, s) {
+				e.Err = ErrSessionInProgress
+			}
+		}
+	}
+	return e
+}
+
+// requestError wraps the error of a request that got no response. Network
+// failures are marked with ErrHostUnreachable; cancellation and a host
+// presenting the wrong certificate are not.
+func requestError(baseURL string, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrServerCertMismatch) {
+		return fmt.Errorf("request to %s failed: %w", baseURL, err)
+	}
+	return fmt.Errorf("%w: request to %s failed: %w", ErrHostUnreachable, baseURL, err)
+}
+
+// retry calls fn until it succeeds, fails in a way that won't go away by
+// itself, ctx is done or it has been called retryAttempts times
+func retry(ctx context.Context, fn func() error) error {
+	backoff := retryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retryAttempts || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether a failed request may succeed if repeated:
+// connections that were refused or dropped, as while Sunshine restarts, and
+// server errors Sunshine gives no reason for
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500 && statusErr.Err == nil
+	}
+	if !errors.Is(err, ErrHostUnreachable) {
+		return false
+	}
+
+	// A host that didn't answer in time won't answer a moment later
+	var netErr net.Error
+	return !errors.As(err, &netErr) || !netErr.Timeout()
+}
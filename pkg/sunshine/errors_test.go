@@ -0,0 +1,195 @@
+package sunshine_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gamelight/gamelight/pkg/sunshine"
+	"github.com/gamelight/gamelight/pkg/sunshinetest"
+)
+
+func launchRequest(appID int) sunshine.LaunchRequest {
+	return sunshine.LaunchRequest{AppID: appID, Width: 1280, Height: 720, FPS: 60, Bitrate: 10000}
+}
+
+func TestStatusErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     func(path string) (int, string) // for the fake host
+		unpaired bool
+		call     func(c *sunshine.Client, srv *sunshinetest.Server) error
+		want     error // sentinel, nil for none
+		code     int
+		calls    int // requests the call makes, counting retries
+	}{
+		{
+			name:     "401 from an unpaired client",
+			unpaired: true,
+			call:     func(c *sunshine.Client, _ *sunshinetest.Server) error { _, err := c.GetAppList(); return err },
+			want:     sunshine.ErrClientRejected,
+			code:     http.StatusUnauthorized,
+			calls:    1,
+		},
+		{
+			name:  "403",
+			fail:  func(string) (int, string) { return http.StatusForbidden, "Forbidden" },
+			call:  func(c *sunshine.Client, _ *sunshinetest.Server) error { _, err := c.GetAppList(); return err },
+			want:  sunshine.ErrClientRejected,
+			code:  http.StatusForbidden,
+			calls: 1,
+		},
+		{
+			name: "404 for an unknown app",
+			call: func(c *sunshine.Client, _ *sunshinetest.Server) error {
+				_, err := c.Launch(launchRequest(1))
+				return err
+			},
+			want:  sunshine.ErrAppNotFound,
+			code:  http.StatusNotFound,
+			calls: 1,
+		},
+		{
+			name: "no running app to resume",
+			call: func(c *sunshine.Client, srv *sunshinetest.Server) error {
+				_, err := c.Resume(launchRequest(srv.Apps[0].ID))
+				return err
+			},
+			want:  sunshine.ErrAppNotFound,
+			code:  http.StatusServiceUnavailable,
+			calls: 1,
+		},
+		{
+			name: "another app running",
+			call: func(c *sunshine.Client, srv *sunshinetest.Server) error {
+				if _, err := c.Launch(launchRequest(srv.Apps[0].ID)); err != nil {
+					return err
+				}
+				_, err := c.Launch(launchRequest(srv.Apps[1].ID))
+				return err
+			},
+			want:  sunshine.ErrSessionInProgress,
+			code:  http.StatusBadRequest,
+			calls: 2,
+		},
+		{
+			name:  "503 for a session in progress",
+			fail:  func(string) (int, string) { return http.StatusServiceUnavailable, "Another session in progress" },
+			call:  func(c *sunshine.Client, _ *sunshinetest.Server) error { _, err := c.GetAppList(); return err },
+			want:  sunshine.ErrSessionInProgress,
+			code:  http.StatusServiceUnavailable,
+			calls: 1,
+		},
+		{
+			name:  "503 without a reason is retried",
+			fail:  func(string) (int, string) { return http.StatusServiceUnavailable, "Service Unavailable" },
+			call:  func(c *sunshine.Client, _ *sunshinetest.Server) error { _, err := c.GetAppList(); return err },
+			code:  http.StatusServiceUnavailable,
+			calls: 3,
+		},
+		{
+			name: "launches aren't retried",
+			fail: func(string) (int, string) { return http.StatusInternalServerError, "" },
+			call: func(c *sunshine.Client, srv *sunshinetest.Server) error {
+				_, err := c.Launch(launchRequest(srv.Apps[0].ID))
+				return err
+			},
+			code:  http.StatusInternalServerError,
+			calls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestHost(t, "1234", nil)
+			client := srv.Client()
+			if !tt.unpaired {
+				var err error
+				if client, err = srv.PairedClient(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var calls atomic.Int32
+			srv.Fail = func(path string) (int, string) {
+				calls.Add(1)
+				if tt.fail != nil {
+					return tt.fail(path)
+				}
+				return 0, ""
+			}
+
+			err := tt.call(client, srv)
+			var statusErr *sunshine.StatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("got %v, want a StatusError", err)
+			}
+			if statusErr.Code != tt.code {
+				t.Errorf("status %d, want %d", statusErr.Code, tt.code)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && statusErr.Err != nil {
+				t.Errorf("got %v, want no sentinel", statusErr.Err)
+			}
+			if errors.Is(err, sunshine.ErrNotPaired) {
+				t.Errorf("host error %v taken for missing credentials", err)
+			}
+			if n := int(calls.Load()); n != tt.calls {
+				t.Errorf("made %d requests, want %d", n, tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	srv := newTestHost(t, "1234", nil)
+	client, err := srv.PairedClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls atomic.Int32
+	srv.Fail = func(string) (int, string) {
+		// Cancel while the client waits to retry
+		if calls.Add(1) == 1 {
+			time.AfterFunc(100*time.Millisecond, cancel)
+		}
+		return http.StatusInternalServerError, ""
+	}
+
+	start := time.Now()
+	_, err = client.GetAppListContext(ctx)
+	var statusErr *sunshine.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusInternalServerError {
+		t.Errorf("got %v, want the server error", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("made %d requests after the context was cancelled, want 1", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %s", elapsed)
+	}
+}
+
+func TestUnreachableHost(t *testing.T) {
+	// Nothing listens on a port just closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	client := sunshine.NewClient("127.0.0.1", port, port)
+	if _, err := client.GetServerInfo(); !errors.Is(err, sunshine.ErrHostUnreachable) {
+		t.Errorf("got %v, want ErrHostUnreachable", err)
+	}
+}
@@ -0,0 +1,84 @@
+package sunshine_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gamelight/gamelight/pkg/sunshine"
+	"github.com/gamelight/gamelight/pkg/sunshinetest"
+)
+
+// newTestHost starts a fake host that pairs with pin
+func newTestHost(t *testing.T, pin string, configure func(*sunshinetest.Server)) *sunshinetest.Server {
+	t.Helper()
+
+	srv, err := sunshinetest.NewUnstartedServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.PIN = pin
+	if configure != nil {
+		configure(srv)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPairWithLegacyHost(t *testing.T) {
+	// GameStream hosts before version 7 hash with SHA-1, but pairing
+	// secrets are still signed with SHA-256
+	srv := newTestHost(t, "1234", func(s *sunshinetest.Server) {
+		s.AppVersion = "5.1.0.0"
+	})
+
+	client, err := srv.PairedClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAppList(); err != nil {
+		t.Errorf("app list after pairing: %v", err)
+	}
+}
+
+func TestPairWithWrongPIN(t *testing.T) {
+	srv := newTestHost(t, "1234", nil)
+
+	state, err := sunshine.GeneratePairState("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := srv.Client()
+	err = client.Pair("4321", state)
+
+	var pairErr *sunshine.PairError
+	if !errors.As(err, &pairErr) || !errors.Is(err, sunshine.ErrWrongPIN) {
+		t.Fatalf("pairing with the wrong PIN: %v, want a PairError for ErrWrongPIN", err)
+	}
+	if srv.Paired() {
+		t.Error("host paired with the wrong PIN")
+	}
+	if client.ServerCertificate() != nil {
+		t.Error("client pinned the host certificate after failing to pair")
+	}
+}
+
+func TestPinnedCertificateMismatch(t *testing.T) {
+	srv := newTestHost(t, "1234", nil)
+	client, err := srv.PairedClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another host at the same address can't pass for the paired one
+	impostor, err := sunshine.GeneratePairState("impostor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetServerCertificate(impostor.ClientCert)
+	if _, err := client.GetAppList(); !errors.Is(err, sunshine.ErrServerCertMismatch) {
+		t.Errorf("app list from a host with another certificate: %v, want ErrServerCertMismatch", err)
+	}
+}
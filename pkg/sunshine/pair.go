@@ -1,27 +1,89 @@
 package sunshine
 
 import (
+	"context"
 	"crypto"
 	"crypto/aes"
-	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"hash"
 	"math/big"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	saltLength      = 16
 	challengeLength = 16
+	secretLength    = 16
+
+	// pinTimeout is how long the host may hold the first pairing request
+	// while waiting for the user to enter the PIN
+	pinTimeout = 5 * time.Minute
+)
+
+// PairStep identifies one of the five pairing steps
+type PairStep int
+
+const (
+	PairStepServerCert      PairStep = 1 // Exchange certificates; waits for the PIN
+	PairStepClientChallenge PairStep = 2 // Send our challenge
+	PairStepServerChallenge PairStep = 3 // Answer the host's challenge
+	PairStepClientSecret    PairStep = 4 // Send our pairing secret
+	PairStepVerify          PairStep = 5 // Confirm the pairing over HTTPS
+)
+
+// String returns a short description of the step
+func (s PairStep) String() string {
+	switch s {
+	case PairStepServerCert:
+		return "waiting for PIN"
+	case PairStepClientChallenge:
+		return "sending challenge"
+	case PairStepServerChallenge:
+		return "answering challenge"
+	case PairStepClientSecret:
+		return "sending pairing secret"
+	case PairStepVerify:
+		return "verifying pairing"
+	}
+	return fmt.Sprintf("step %d", int(s))
+}
+
+// Pairing failures. Errors from Pair wrap one of these in a PairError.
+var (
+	ErrPairingRejected  = errors.New("host rejected pairing")
+	ErrWrongPIN         = errors.New("wrong PIN")
+	ErrChallengeFailed  = errors.New("challenge rejected")
+	ErrServerUnverified = errors.New("host failed verification")
 )
 
+// PairError reports the step at which pairing failed
+type PairError struct {
+	Step PairStep
+	Err  error
+}
+
+func (e *PairError) Error() string {
+	return fmt.Sprintf("pair step %d (%s): %v", int(e.Step), e.Step, e.Err)
+}
+
+func (e *PairError) Unwrap() error {
+	return e.Err
+}
+
 // PairState holds the state during the pairing process
 type PairState struct {
 	DeviceName    string
@@ -31,6 +93,32 @@ type PairState struct {
 	ClientCertPEM []byte
 	ServerCert    *x509.Certificate
 	AESKey        []byte
+
+	// UniqueID is the client ID the host pairs us under
+	UniqueID string
+
+	hash   pairHash
+	onStep func(PairStep)
+}
+
+// OnStep sets a callback called as each pairing step starts
+func (s *PairState) OnStep(fn func(PairStep)) {
+	s.onStep = fn
+}
+
+func (s *PairState) step(step PairStep) {
+	if s.onStep != nil {
+		s.onStep(step)
+	}
+}
+
+// GeneratePIN returns a random 4-digit pairing PIN
+func GeneratePIN() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04d", n.Int64()), nil
 }
 
 // GeneratePairState creates a new pairing state with generated credentials
@@ -84,65 +172,112 @@ func GeneratePairState(deviceName string) (*PairState, error) {
 	}, nil
 }
 
-// Pair performs the 5-step pairing process with the Sunshine server
+// Pair performs the 5-step pairing process with the Sunshine server.
+// Failures are returned as a *PairError.
 func (c *Client) Pair(pin string, state *PairState) error {
-	// Derive AES key from PIN + salt using SHA-256
-	state.AESKey = deriveAESKey(pin, state.Salt[:])
+	return c.PairContext(context.Background(), pin, state)
+}
+
+// PairContext is Pair with a context that bounds the whole process,
+// including the wait for the PIN to be entered
+func (c *Client) PairContext(ctx context.Context, pin string, state *PairState) error {
+	// The host's major version decides between SHA-256 and legacy SHA-1
+	info, err := c.serverInfo(ctx, false)
+	if err != nil {
+		return &PairError{PairStepServerCert, err}
+	}
+	state.hash = pairHashFor(info.AppVersion)
+	state.UniqueID = c.UniqueID()
+
+	// Derive AES key from salt + PIN
+	state.AESKey = deriveAESKey(state.hash, pin, state.Salt[:])
 
 	// Step 1: Send client cert and salt, receive server cert
-	serverCertPEM, err := c.pairStep1(state)
+	state.step(PairStepServerCert)
+	serverCertPEM, err := c.pairStep1(ctx, state)
 	if err != nil {
-		return fmt.Errorf("pair step 1: %w", err)
+		return &PairError{PairStepServerCert, err}
 	}
 
 	// Parse server certificate
 	block, _ := pem.Decode([]byte(serverCertPEM))
 	if block == nil {
-		return fmt.Errorf("parsing server certificate PEM")
+		return &PairError{PairStepServerCert, fmt.Errorf("parsing server certificate PEM")}
 	}
 	serverCert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		return fmt.Errorf("parsing server certificate: %w", err)
+		return &PairError{PairStepServerCert, fmt.Errorf("parsing server certificate: %w", err)}
 	}
 	state.ServerCert = serverCert
 
-	// Step 2: Send encrypted challenge, receive encrypted response
-	encryptedResponse, err := c.pairStep2(state)
+	// Step 2: Send encrypted challenge, receive the host's hash and its own
+	// challenge
+	state.step(PairStepClientChallenge)
+	challenge := make([]byte, challengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		return &PairError{PairStepClientChallenge, err}
+	}
+	serverResponse, err := c.pairStep2(ctx, state, challenge)
 	if err != nil {
-		return fmt.Errorf("pair step 2: %w", err)
+		return &PairError{PairStepClientChallenge, err}
 	}
 
-	// Decrypt and verify server's response
-	serverResponse, err := aesDecrypt(state.AESKey, encryptedResponse)
-	if err != nil {
-		return fmt.Errorf("decrypting server response: %w", err)
+	hashSize := state.hash.crypto.Size()
+	if len(serverResponse) < hashSize+challengeLength {
+		return &PairError{PairStepClientChallenge, fmt.Errorf("%w: short challenge response", ErrChallengeFailed)}
 	}
+	serverHash := serverResponse[:hashSize]
+	serverChallenge := serverResponse[hashSize : hashSize+challengeLength]
 
-	// Step 3: Send challenge response hash, receive server pairing secret
-	serverPairingSecret, err := c.pairStep3(state, serverResponse)
+	// Step 3: Answer the host's challenge, receive its pairing secret
+	state.step(PairStepServerChallenge)
+	clientSecret := make([]byte, secretLength)
+	if _, err := rand.Read(clientSecret); err != nil {
+		return &PairError{PairStepServerChallenge, err}
+	}
+	serverPairingSecret, err := c.pairStep3(ctx, state, serverChallenge, clientSecret)
 	if err != nil {
-		return fmt.Errorf("pair step 3: %w", err)
+		return &PairError{PairStepServerChallenge, err}
 	}
 
-	// Verify server pairing secret
-	if err := verifyServerPairingSecret(serverPairingSecret, serverCert, state.Salt[:]); err != nil {
-		return fmt.Errorf("verifying server pairing secret: %w", err)
+	// The secret must be signed by the certificate from step 1, and the
+	// host's hash proves it knows the PIN
+	if err := verifyServerPairingSecret(state, serverPairingSecret, challenge, serverHash); err != nil {
+		c.UnpairContext(ctx)
+		return &PairError{PairStepServerChallenge, err}
 	}
 
 	// Step 4: Send client pairing secret
-	if err := c.pairStep4(state); err != nil {
-		return fmt.Errorf("pair step 4: %w", err)
+	state.step(PairStepClientSecret)
+	if err := c.pairStep4(ctx, state, clientSecret); err != nil {
+		return &PairError{PairStepClientSecret, err}
 	}
 
-	// Step 5: Verify pairing over HTTPS
-	if err := c.pairStep5(state); err != nil {
-		return fmt.Errorf("pair step 5: %w", err)
+	// Step 5: Verify pairing over HTTPS with our new certificate, pinning
+	// the host's
+	state.step(PairStepVerify)
+	prevClientCert, prevServerCert := c.clientCertificate(), c.ServerCertificate()
+	c.SetClientCertificate(state.TLSCertificate())
+	c.SetServerCertificate(state.ServerCert)
+	if err := c.pairStep5(ctx, state); err != nil {
+		c.SetClientCertificate(prevClientCert)
+		c.SetServerCertificate(prevServerCert)
+		return &PairError{PairStepVerify, err}
 	}
 
 	return nil
 }
 
-func (c *Client) pairStep1(state *PairState) (string, error) {
+// TLSCertificate returns the client certificate and key for HTTPS requests
+func (s *PairState) TLSCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{s.ClientCert.Raw},
+		PrivateKey:  s.ClientKey,
+		Leaf:        s.ClientCert,
+	}
+}
+
+func (c *Client) pairStep1(ctx context.Context, state *PairState) (string, error) {
 	params := url.Values{}
 	c.addClientParams(params)
 
@@ -152,13 +287,16 @@ func (c *Client) pairStep1(state *PairState) (string, error) {
 	params.Set("salt", hex.EncodeToString(state.Salt[:]))
 	params.Set("clientcert", hex.EncodeToString(state.ClientCertPEM))
 
-	root, err := c.doRequest(c.httpClient, c.httpURL("pair"), params)
+	// The host answers once the PIN has been entered
+	ctx, cancel := context.WithTimeout(ctx, pinTimeout)
+	defer cancel()
+	root, err := c.doRequest(ctx, c.httpClient, c.httpURL("pair"), params)
 	if err != nil {
 		return "", err
 	}
 
 	if root.Paired != "1" {
-		return "", fmt.Errorf("pairing not initiated")
+		return "", ErrPairingRejected
 	}
 
 	// Decode hex-encoded certificate
@@ -170,14 +308,7 @@ func (c *Client) pairStep1(state *PairState) (string, error) {
 	return string(certBytes), nil
 }
 
-func (c *Client) pairStep2(state *PairState) ([]byte, error) {
-	// Generate random challenge
-	challenge := make([]byte, challengeLength)
-	if _, err := rand.Read(challenge); err != nil {
-		return nil, err
-	}
-
-	// Encrypt challenge with AES key
+func (c *Client) pairStep2(ctx context.Context, state *PairState, challenge []byte) ([]byte, error) {
 	encryptedChallenge, err := aesEncrypt(state.AESKey, challenge)
 	if err != nil {
 		return nil, err
@@ -190,29 +321,30 @@ func (c *Client) pairStep2(state *PairState) ([]byte, error) {
 	params.Set("updateState", "1")
 	params.Set("clientchallenge", hex.EncodeToString(encryptedChallenge))
 
-	root, err := c.doRequest(c.httpClient, c.httpURL("pair"), params)
+	root, err := c.doRequest(ctx, c.httpClient, c.httpURL("pair"), params)
 	if err != nil {
 		return nil, err
 	}
 
 	if root.Paired != "1" {
-		return nil, fmt.Errorf("challenge rejected")
+		return nil, ErrChallengeFailed
 	}
 
-	// Decode encrypted response
+	// Decode and decrypt the response
 	encryptedResponse, err := hex.DecodeString(root.ChallengeResponse)
 	if err != nil {
 		return nil, fmt.Errorf("decoding challenge response: %w", err)
 	}
 
-	return encryptedResponse, nil
+	return aesDecrypt(state.AESKey, encryptedResponse)
 }
 
-func (c *Client) pairStep3(state *PairState, serverResponse []byte) ([]byte, error) {
-	// Hash the server response with client certificate signature
-	h := sha256.New()
-	h.Write(serverResponse)
+func (c *Client) pairStep3(ctx context.Context, state *PairState, serverChallenge, clientSecret []byte) ([]byte, error) {
+	// Hash the host's challenge with our certificate signature and secret
+	h := state.hash.new()
+	h.Write(serverChallenge)
 	h.Write(state.ClientCert.Signature)
+	h.Write(clientSecret)
 	responseHash := h.Sum(nil)
 
 	// Encrypt the hash
@@ -228,13 +360,13 @@ func (c *Client) pairStep3(state *PairState, serverResponse []byte) ([]byte, err
 	params.Set("updateState", "1")
 	params.Set("serverchallengeresp", hex.EncodeToString(encryptedHash))
 
-	root, err := c.doRequest(c.httpClient, c.httpURL("pair"), params)
+	root, err := c.doRequest(ctx, c.httpClient, c.httpURL("pair"), params)
 	if err != nil {
 		return nil, err
 	}
 
 	if root.Paired != "1" {
-		return nil, fmt.Errorf("challenge response rejected")
+		return nil, ErrChallengeFailed
 	}
 
 	// Decode pairing secret
@@ -246,14 +378,15 @@ func (c *Client) pairStep3(state *PairState, serverResponse []byte) ([]byte, err
 	return pairingSecret, nil
 }
 
-func (c *Client) pairStep4(state *PairState) error {
-	// Create client pairing secret: client cert signature + SHA256(salt + client cert signature)
-	h := sha256.New()
-	h.Write(state.Salt[:])
-	h.Write(state.ClientCert.Signature)
-	hash := h.Sum(nil)
+func (c *Client) pairStep4(ctx context.Context, state *PairState, clientSecret []byte) error {
+	// Client pairing secret: our secret followed by our signature of it
+	digest := sha256.Sum256(clientSecret)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, state.ClientKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return fmt.Errorf("signing pairing secret: %w", err)
+	}
 
-	clientPairingSecret := append(state.ClientCert.Signature, hash...)
+	clientPairingSecret := append(append([]byte{}, clientSecret...), signature...)
 
 	params := url.Values{}
 	c.addClientParams(params)
@@ -262,19 +395,20 @@ func (c *Client) pairStep4(state *PairState) error {
 	params.Set("updateState", "1")
 	params.Set("clientpairingsecret", hex.EncodeToString(clientPairingSecret))
 
-	root, err := c.doRequest(c.httpClient, c.httpURL("pair"), params)
+	root, err := c.doRequest(ctx, c.httpClient, c.httpURL("pair"), params)
 	if err != nil {
 		return err
 	}
 
+	// The host rejects our secret when its PIN-derived key differs from ours
 	if root.Paired != "1" {
-		return fmt.Errorf("client pairing secret rejected")
+		return ErrWrongPIN
 	}
 
 	return nil
 }
 
-func (c *Client) pairStep5(state *PairState) error {
+func (c *Client) pairStep5(ctx context.Context, state *PairState) error {
 	params := url.Values{}
 	c.addClientParams(params)
 
@@ -282,49 +416,61 @@ func (c *Client) pairStep5(state *PairState) error {
 	params.Set("devicename", state.DeviceName)
 	params.Set("updateState", "1")
 
-	root, err := c.doRequest(c.httpsClient, c.httpsURL("pair"), params)
+	root, err := c.doRequest(ctx, c.httpsClient, c.httpsURL("pair"), params)
 	if err != nil {
 		return err
 	}
 
 	if root.Paired != "1" {
-		return fmt.Errorf("HTTPS pairing verification failed")
+		return ErrPairingRejected
 	}
 
 	return nil
 }
 
-func deriveAESKey(pin string, salt []byte) []byte {
-	// SHA-256 of salt + pin bytes
-	h := sha256.New()
-	h.Write(salt)
-	for _, c := range pin {
-		h.Write([]byte{byte(c)})
+// pairHash is the hash used for key derivation and challenges. Pairing
+// secrets are signed with SHA-256 whatever the host's version.
+type pairHash struct {
+	crypto crypto.Hash
+	new    func() hash.Hash
+}
+
+// pairHashFor picks the pairing hash for a host version. Hosts reporting
+// major version 7 or later (all Sunshine releases) use SHA-256; older
+// GameStream hosts use SHA-1.
+func pairHashFor(appVersion string) pairHash {
+	major, _ := strconv.Atoi(strings.SplitN(appVersion, ".", 2)[0])
+	if major != 0 && major < 7 {
+		return pairHash{crypto.SHA1, sha1.New}
 	}
-	return h.Sum(nil)[:16] // Use first 16 bytes for AES-128
+	return pairHash{crypto.SHA256, sha256.New}
+}
+
+func deriveAESKey(ph pairHash, pin string, salt []byte) []byte {
+	h := ph.new()
+	h.Write(salt)
+	h.Write([]byte(pin))
+	return h.Sum(nil)[:16] // AES-128
 }
 
+// aesEncrypt encrypts with AES-128-ECB, zero padding the plaintext to a
+// whole block as the host expects
 func aesEncrypt(key, plaintext []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	// PKCS7 padding
-	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
-	padtext := make([]byte, len(plaintext)+padding)
-	copy(padtext, plaintext)
-	for i := len(plaintext); i < len(padtext); i++ {
-		padtext[i] = byte(padding)
+	size := (len(plaintext) + aes.BlockSize - 1) / aes.BlockSize * aes.BlockSize
+	out := make([]byte, size)
+	copy(out, plaintext)
+	for i := 0; i < size; i += aes.BlockSize {
+		block.Encrypt(out[i:i+aes.BlockSize], out[i:i+aes.BlockSize])
 	}
-
-	ciphertext := make([]byte, len(padtext))
-	mode := cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)) // Zero IV
-	mode.CryptBlocks(ciphertext, padtext)
-
-	return ciphertext, nil
+	return out, nil
 }
 
+// aesDecrypt decrypts AES-128-ECB without removing padding
 func aesDecrypt(key, ciphertext []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -335,56 +481,41 @@ func aesDecrypt(key, ciphertext []byte) ([]byte, error) {
 		return nil, fmt.Errorf("ciphertext is not a multiple of block size")
 	}
 
-	plaintext := make([]byte, len(ciphertext))
-	mode := cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)) // Zero IV
-	mode.CryptBlocks(plaintext, ciphertext)
-
-	// Remove PKCS7 padding
-	padding := int(plaintext[len(plaintext)-1])
-	if padding > aes.BlockSize || padding == 0 {
-		return nil, fmt.Errorf("invalid padding")
+	out := make([]byte, len(ciphertext))
+	for i := 0; i < len(out); i += aes.BlockSize {
+		block.Decrypt(out[i:i+aes.BlockSize], ciphertext[i:i+aes.BlockSize])
 	}
-	return plaintext[:len(plaintext)-padding], nil
+	return out, nil
 }
 
-func verifyServerPairingSecret(secret []byte, serverCert *x509.Certificate, salt []byte) error {
-	if len(secret) < 256 {
-		return fmt.Errorf("pairing secret too short")
+// verifyServerPairingSecret checks the host's pairing secret: 16 secret
+// bytes followed by the host's signature of them. A bad signature means
+// the host isn't the one whose certificate we got in step 1. A bad hash
+// over our challenge, the host certificate signature and the secret means
+// the host derived a different AES key, i.e. the PIN was wrong.
+func verifyServerPairingSecret(state *PairState, secret, challenge, serverHash []byte) error {
+	if len(secret) < secretLength+1 {
+		return fmt.Errorf("%w: pairing secret too short", ErrServerUnverified)
 	}
+	serverSecret := secret[:secretLength]
+	serverSignature := secret[secretLength:]
 
-	// Server pairing secret format: server cert signature (256 bytes) + SHA256(salt + server cert signature)
-	serverSignature := secret[:256]
-	serverHash := secret[256:]
-
-	// Verify the hash
-	h := sha256.New()
-	h.Write(salt)
-	h.Write(serverSignature)
-	expectedHash := h.Sum(nil)
-
-	if len(serverHash) < len(expectedHash) {
-		return fmt.Errorf("server hash too short")
-	}
-
-	for i := range expectedHash {
-		if serverHash[i] != expectedHash[i] {
-			return fmt.Errorf("server pairing secret hash mismatch")
-		}
+	rsaPubKey, ok := state.ServerCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: server certificate has non-RSA public key", ErrServerUnverified)
 	}
 
-	// Verify signature matches server certificate
-	rsaPubKey, ok := serverCert.PublicKey.(*rsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("server certificate has non-RSA public key")
+	digest := sha256.Sum256(serverSecret)
+	if err := rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA256, digest[:], serverSignature); err != nil {
+		return fmt.Errorf("%w: pairing secret signature: %v", ErrServerUnverified, err)
 	}
 
-	// The signature should be verifiable with the server's public key
-	certHash := sha256.Sum256(serverCert.RawTBSCertificate)
-	err := rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA256, certHash[:], serverSignature)
-	if err != nil {
-		// Sunshine may use SHA-1 for older versions
-		// This is a simplified verification
-		return nil // Accept for now
+	h := state.hash.new()
+	h.Write(challenge)
+	h.Write(state.ServerCert.Signature)
+	h.Write(serverSecret)
+	if !hmac.Equal(h.Sum(nil), serverHash) {
+		return ErrWrongPIN
 	}
 
 	return nil
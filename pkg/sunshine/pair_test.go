@@ -0,0 +1,87 @@
+package sunshine
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestVerifyServerCertificate(t *testing.T) {
+	host, err := GeneratePairState("host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GeneratePairState("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient("127.0.0.1", 47989, 47984)
+	if err := c.verifyServerCertificate([][]byte{other.ClientCert.Raw}, nil); err != nil {
+		t.Errorf("certificate refused before pairing: %v", err)
+	}
+
+	c.SetServerCertificate(host.ClientCert)
+	if err := c.verifyServerCertificate([][]byte{host.ClientCert.Raw}, nil); err != nil {
+		t.Errorf("pinned certificate refused: %v", err)
+	}
+	for _, raw := range [][][]byte{{other.ClientCert.Raw}, nil} {
+		if err := c.verifyServerCertificate(raw, nil); !errors.Is(err, ErrServerCertMismatch) {
+			t.Errorf("other certificate: %v, want ErrServerCertMismatch", err)
+		}
+	}
+}
+
+func TestVerifyServerPairingSecret(t *testing.T) {
+	host, err := GeneratePairState("host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := []byte("0123456789abcdef")
+	secret := []byte("fedcba9876543210")
+
+	// sign returns the host's pairing secret, signed with a hash
+	sign := func(h crypto.Hash, digest []byte) []byte {
+		sig, err := rsa.SignPKCS1v15(rand.Reader, host.ClientKey, h, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(append([]byte{}, secret...), sig...)
+	}
+	sha256Digest := sha256.Sum256(secret)
+	sha1Digest := sha1.Sum(secret)
+
+	// Legacy hosts hash challenges with SHA-1 but still sign with SHA-256
+	for _, version := range []string{"7.1.431.-1", "5.1.0.0"} {
+		state := &PairState{ServerCert: host.ClientCert, hash: pairHashFor(version)}
+		h := state.hash.new()
+		h.Write(challenge)
+		h.Write(host.ClientCert.Signature)
+		h.Write(secret)
+		serverHash := h.Sum(nil)
+
+		signed := sign(crypto.SHA256, sha256Digest[:])
+		if err := verifyServerPairingSecret(state, signed, challenge, serverHash); err != nil {
+			t.Errorf("%s: genuine secret refused: %v", version, err)
+		}
+
+		tampered := append([]byte{}, signed...)
+		tampered[len(tampered)-1] ^= 1
+		if err := verifyServerPairingSecret(state, tampered, challenge, serverHash); !errors.Is(err, ErrServerUnverified) {
+			t.Errorf("%s: tampered signature: %v, want ErrServerUnverified", version, err)
+		}
+
+		if err := verifyServerPairingSecret(state, sign(crypto.SHA1, sha1Digest[:]), challenge, serverHash); !errors.Is(err, ErrServerUnverified) {
+			t.Errorf("%s: SHA-1 signature: %v, want ErrServerUnverified", version, err)
+		}
+
+		// A hash that doesn't match means the host has another PIN
+		if err := verifyServerPairingSecret(state, signed, challenge, make([]byte, len(serverHash))); !errors.Is(err, ErrWrongPIN) {
+			t.Errorf("%s: wrong hash: %v, want ErrWrongPIN", version, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package sunshine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnknownHost is returned when a host name is not in the registry
+var ErrUnknownHost = errors.New("unknown Sunshine host")
+
+// Host is a named Sunshine host with its client and stored credentials
+type Host struct {
+	Name   string
+	Client *Client
+	Store  *CredentialStore
+
+	// savedMAC is the MAC address last written to Store
+	mu       sync.Mutex
+	savedMAC string
+}
+
+// Registry holds the Sunshine hosts gamelight can stream from. The first
+// host added is the default.
+type Registry struct {
+	mu     sync.RWMutex
+	hosts  []*Host
+	byName map[string]*Host
+}
+
+// NewRegistry creates an empty host registry
+func NewRegistry() *Registry {
+	return &Registry{
+		byName: make(map[string]*Host),
+	}
+}
+
+// Add registers a host. Names must be unique.
+func (r *Registry) Add(host *Host) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.byName[host.Name]; ok {
+		return fmt.Errorf("duplicate host name %q", host.Name)
+	}
+	r.hosts = append(r.hosts, host)
+	r.byName[host.Name] = host
+	return nil
+}
+
+// Get returns the host with the given name, or the default host if name is
+// empty
+func (r *Registry) Get(name string) (*Host, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if name == "" {
+		if len(r.hosts) == 0 {
+			return nil, ErrUnknownHost
+		}
+		return r.hosts[0], nil
+	}
+
+	host, ok := r.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownHost, name)
+	}
+	return host, nil
+}
+
+// Hosts returns all hosts in the order they were added
+func (r *Registry) Hosts() []*Host {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hosts := make([]*Host, len(r.hosts))
+	copy(hosts, r.hosts)
+	return hosts
+}
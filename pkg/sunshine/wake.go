@@ -0,0 +1,192 @@
+package sunshine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrNoMAC is returned when waking a host whose MAC address isn't known
+var ErrNoMAC = errors.New("host MAC address unknown")
+
+// wakePorts are the ports magic packets are sent to. Network cards listen
+// on any port; 7 and 9 are the conventional ones and the rest are
+// Sunshine's, which routers may already forward.
+var wakePorts = []int{7, 9, 47998, 47999, 48000, 48010}
+
+// Wake backoff: the first poll comes quickly since hosts waking from sleep
+// can answer within a few seconds, later ones space out for cold boots
+const (
+	wakeInitialBackoff = time.Second
+	wakeMaxBackoff     = 8 * time.Second
+	wakeResendEvery    = 4
+
+	// wakePollTimeout bounds each poll, since a sleeping host doesn't
+	// refuse connections but leaves them hanging
+	wakePollTimeout = 5 * time.Second
+)
+
+// SendMagicPacket sends a Wake-on-LAN magic packet for mac to the local
+// broadcast address and, if given, directly to addr
+func SendMagicPacket(mac string, addr string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %q: %w", mac, err)
+	}
+
+	// Six 0xFF bytes followed by the MAC sixteen times
+	packet := bytes.Repeat([]byte{0xFF}, 6)
+	packet = append(packet, bytes.Repeat(hw, 16)...)
+
+	targets := []net.IP{net.IPv4bcast}
+	if addr != "" {
+		// A sleeping host may still be reachable directly while the
+		// router remembers it
+		if ips, err := net.LookupIP(addr); err == nil {
+			targets = append(targets, ips...)
+		}
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sent := false
+	for _, ip := range targets {
+		if ip.To4() == nil {
+			continue
+		}
+		for _, port := range wakePorts {
+			if _, err := conn.WriteToUDP(packet, &net.UDPAddr{IP: ip, Port: port}); err == nil {
+				sent = true
+			}
+		}
+	}
+	if !sent {
+		return errors.New("could not send Wake-on-LAN packet")
+	}
+	return nil
+}
+
+// ServerInfo queries the host's server info and caches the MAC address it
+// reports with the stored credentials, so the host can be woken later
+func (h *Host) ServerInfo() (*ServerInfo, error) {
+	return h.ServerInfoContext(context.Background())
+}
+
+// ServerInfoContext is ServerInfo with a context
+func (h *Host) ServerInfoContext(ctx context.Context) (*ServerInfo, error) {
+	info, err := h.Client.GetServerInfoContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h.saveMAC()
+	return info, nil
+}
+
+// Wake sends Wake-on-LAN packets to the host and polls its server info
+// with backoff until it answers or ctx is done. onAttempt, if set, is
+// called before each poll.
+func (h *Host) Wake(ctx context.Context, onAttempt func(attempt int)) (*ServerInfo, error) {
+	mac := h.Client.MAC()
+	if mac == "" {
+		return nil, ErrNoMAC
+	}
+
+	backoff := wakeInitialBackoff
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		// Packets can be lost and a host may not be listening yet right
+		// after going to sleep, so send them again now and then
+		if attempt%wakeResendEvery == 1 {
+			if err := SendMagicPacket(mac, h.Client.Host()); err != nil {
+				return nil, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return nil, fmt.Errorf("host did not wake up: %w", lastErr)
+			}
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		if onAttempt != nil {
+			onAttempt(attempt)
+		}
+		pollCtx, cancel := context.WithTimeout(ctx, wakePollTimeout)
+		info, err := h.ServerInfoContext(pollCtx)
+		cancel()
+		if err == nil {
+			return info, nil
+		}
+		lastErr = err
+
+		backoff *= 2
+		if backoff > wakeMaxBackoff {
+			backoff = wakeMaxBackoff
+		}
+	}
+}
+
+// Pair pairs with the host under the client identity stored by earlier
+// pairings, so every host knows us by the same ID. The first pairing keeps
+// the client's random ID, which SavePairing then stores.
+func (h *Host) Pair(pin string, state *PairState) error {
+	if h.Store != nil {
+		id, err := h.Store.LoadIdentity()
+		if err != nil {
+			return fmt.Errorf("loading client identity: %w", err)
+		}
+		if id.UniqueID != "" {
+			h.Client.SetUniqueID(id.UniqueID)
+		}
+	}
+	return h.Client.Pair(pin, state)
+}
+
+// SavePairing saves the credentials from a completed pairing along with
+// the host's MAC address
+func (h *Host) SavePairing(state *PairState) error {
+	if err := h.Store.Save(state); err != nil {
+		return err
+	}
+	h.saveMAC()
+	return nil
+}
+
+// saveMAC writes the client's MAC for the host if it has changed
+func (h *Host) saveMAC() {
+	mac := h.Client.MAC()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.Store == nil || mac == "" || mac == h.savedMAC {
+		return
+	}
+	if err := h.Store.SaveMAC(mac); err == nil {
+		h.savedMAC = mac
+	}
+}
+
+// validMAC reports whether mac is a usable hardware address
+func validMAC(mac string) bool {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return false
+	}
+	for _, b := range hw {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package sunshinetest
+
+// The host only sends parity, so this is just the encoding half of the
+// Reed-Solomon code Sunshine uses over GF(2^8). It is written apart from
+// pkg/rtsp's decoder so the two check each other.
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// Generator polynomial x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	copy(gfExp[255:], gfExp[:255])
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// fecEncoder computes parity shards as linear combinations of data shards
+type fecEncoder struct {
+	parity [][]byte // one row of dataShards coefficients per parity shard
+}
+
+// newVideoFECEncoder builds the code nanors uses for video: a Vandermonde
+// matrix made systematic by multiplying with the inverse of its top square
+func newVideoFECEncoder(dataShards, parityShards int) *fecEncoder {
+	total := dataShards + parityShards
+	vm := make([][]byte, total)
+	for r := range vm {
+		vm[r] = make([]byte, dataShards)
+		x := byte(1)
+		for c := range vm[r] {
+			vm[r][c] = x
+			x = gfMul(x, byte(r))
+		}
+	}
+
+	// Row reduce [top | I] to [I | top⁻¹]. The top square of a Vandermonde
+	// matrix with distinct rows is never singular.
+	n := dataShards
+	work := make([][]byte, n)
+	for r := range work {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], vm[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for work[pivot][c] == 0 {
+			pivot++
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		inv := gfExp[255-int(gfLog[work[c][c]])]
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], inv)
+		}
+		for r := range work {
+			if f := work[r][c]; r != c && f != 0 {
+				for i := range work[r] {
+					work[r][i] ^= gfMul(f, work[c][i])
+				}
+			}
+		}
+	}
+
+	parity := make([][]byte, parityShards)
+	for p := range parity {
+		parity[p] = make([]byte, n)
+		for c := 0; c < n; c++ {
+			var v byte
+			for i := 0; i < n; i++ {
+				v ^= gfMul(vm[n+p][i], work[i][n+c])
+			}
+			parity[p][c] = v
+		}
+	}
+	return &fecEncoder{parity: parity}
+}
+
+// audioFECEncoder has the parity rows of Sunshine's audio code, which
+// aren't the Vandermonde construction
+var audioFECEncoder = &fecEncoder{parity: [][]byte{
+	{0x77, 0x40, 0x38, 0x0e},
+	{0xc7, 0xa7, 0x0d, 0x6c},
+}}
+
+// encode fills in the parity shards that follow the data shards
+func (e *fecEncoder) encode(shards [][]byte) {
+	dataShards := len(shards) - len(e.parity)
+	for p, row := range e.parity {
+		out := shards[dataShards+p]
+		for i := range out {
+			out[i] = 0
+		}
+		for d, coeff := range row {
+			for i, v := range shards[d] {
+				out[i] ^= gfMul(coeff, v)
+			}
+		}
+	}
+}
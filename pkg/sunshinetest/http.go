@@ -0,0 +1,262 @@
+package sunshinetest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	secure := r.TLS != nil
+
+	if s.Fail != nil {
+		if code, message := s.Fail(r.URL.Path); code != 0 {
+			replyError(w, code, message)
+			return
+		}
+	}
+
+	// Only serverinfo and pairing are open to unpaired clients, and the
+	// rest only over HTTPS
+	switch r.URL.Path {
+	case "/serverinfo", "/pair", "/unpair":
+	default:
+		if !secure {
+			replyError(w, http.StatusNotFound, "Not found")
+			return
+		}
+	}
+	if secure && r.URL.Path != "/pair" && !s.isPaired(r) {
+		replyError(w, http.StatusUnauthorized, "The client is not authorized. Certificate verification failed.")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/serverinfo":
+		s.handleServerInfo(w, secure)
+	case "/pair":
+		s.handlePair(w, r)
+	case "/unpair":
+		s.mu.Lock()
+		s.paired = nil
+		s.mu.Unlock()
+		reply(w)
+	case "/applist":
+		s.handleAppList(w)
+	case "/appasset":
+		s.handleAppAsset(w, r)
+	case "/launch":
+		s.handleLaunch(w, r, false)
+	case "/resume":
+		s.handleLaunch(w, r, true)
+	case "/cancel":
+		s.mu.Lock()
+		s.currentGame = 0
+		s.stats.Cancels++
+		s.stopStreamLocked()
+		s.mu.Unlock()
+		reply(w, "cancel", "1")
+	default:
+		replyError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// isPaired reports whether the request came with a paired certificate
+func (s *Server) isPaired(r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isPairedLocked(r.TLS.PeerCertificates)
+}
+
+func (s *Server) handleServerInfo(w http.ResponseWriter, secure bool) {
+	s.mu.Lock()
+	currentGame := s.currentGame
+	s.mu.Unlock()
+
+	// The pair status is only known from an HTTPS request's certificate,
+	// and those only get this far when paired
+	pairStatus, state := "0", "SUNSHINE_SERVER_FREE"
+	if secure {
+		pairStatus = "1"
+	}
+	if currentGame != 0 {
+		state = "SUNSHINE_SERVER_BUSY"
+	}
+
+	reply(w,
+		"hostname", s.Hostname,
+		"appversion", s.AppVersion,
+		"GfeVersion", "3.23.0.74",
+		"uniqueid", s.UniqueID,
+		"HttpsPort", strconv.Itoa(s.HTTPSPort()),
+		"ExternalPort", strconv.Itoa(s.HTTPPort()),
+		"mac", s.MAC,
+		"LocalIP", s.Host(),
+		"ServerCodecModeSupport", strconv.Itoa(s.CodecModes),
+		"PairStatus", pairStatus,
+		"currentgame", strconv.Itoa(currentGame),
+		"state", state,
+	)
+}
+
+func (s *Server) handleAppList(w http.ResponseWriter) {
+	type xmlApp struct {
+		Title string `xml:"AppTitle"`
+		ID    int    `xml:"ID"`
+		HDR   int    `xml:"IsHdrSupported"`
+	}
+	list := struct {
+		XMLName    xml.Name `xml:"root"`
+		StatusCode int      `xml:"status_code,attr"`
+		Apps       []xmlApp `xml:"App"`
+	}{StatusCode: http.StatusOK}
+
+	for _, app := range s.Apps {
+		a := xmlApp{Title: app.Title, ID: app.ID}
+		if app.IsHDRSupport {
+			a.HDR = 1
+		}
+		list.Apps = append(list.Apps, a)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(list)
+}
+
+// handleAppAsset serves a one-pixel box art image for every app
+func (s *Server) handleAppAsset(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.URL.Query().Get("appid"))
+	if _, ok := s.app(id); !ok {
+		replyError(w, http.StatusNotFound, "Cannot find requested application")
+		return
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.RGBA{R: byte(id), G: byte(id >> 8), B: byte(id >> 16), A: 0xFF})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// handleLaunch starts an app, or for resume takes over the running one
+func (s *Server) handleLaunch(w http.ResponseWriter, r *http.Request, resume bool) {
+	q := r.URL.Query()
+
+	appID, _ := strconv.Atoi(q.Get("appid"))
+	params, err := parseLaunchParams(q.Get("mode"), q.Get("rikey"), q.Get("rikeyid"))
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if resume {
+		if s.currentGame == 0 {
+			replyError(w, http.StatusServiceUnavailable, "No running app to resume")
+			return
+		}
+		s.stats.Resumes++
+	} else {
+		if _, ok := s.app(appID); !ok {
+			replyError(w, http.StatusNotFound, "Cannot find requested application")
+			return
+		}
+		if s.currentGame != 0 && s.currentGame != appID {
+			replyError(w, http.StatusBadRequest, "An app is already running on this host")
+			return
+		}
+		s.currentGame = appID
+		s.stats.Launches++
+	}
+
+	// A new session replaces the stream of the last one
+	s.stopStreamLocked()
+	s.launch = params
+
+	if resume {
+		reply(w, "sessionUrl0", s.RTSPURL(), "resume", "1")
+	} else {
+		reply(w, "sessionUrl0", s.RTSPURL(), "gamesession", "1")
+	}
+}
+
+func (s *Server) app(id int) (int, bool) {
+	for i, app := range s.Apps {
+		if app.ID == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseLaunchParams parses the mode and input key of a launch request
+func parseLaunchParams(mode, riKey, riKeyID string) (launchParams, error) {
+	var p launchParams
+
+	parts := strings.Split(mode, "x")
+	if len(parts) != 3 {
+		return p, fmt.Errorf("invalid mode %q", mode)
+	}
+	for i, v := range []*int{&p.width, &p.height, &p.fps} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n <= 0 {
+			return p, fmt.Errorf("invalid mode %q", mode)
+		}
+		*v = n
+	}
+
+	key, err := hex.DecodeString(riKey)
+	if err != nil || len(key) != len(p.riKey) {
+		return p, fmt.Errorf("invalid rikey")
+	}
+	copy(p.riKey[:], key)
+
+	// Moonlight sends the key ID as a signed decimal
+	id, err := strconv.ParseInt(riKeyID, 10, 64)
+	if err != nil {
+		return p, fmt.Errorf("invalid rikeyid")
+	}
+	p.riKeyID = uint32(id)
+
+	return p, nil
+}
+
+// reply writes a successful XML response with the given element name and
+// value pairs
+func reply(w http.ResponseWriter, elements ...string) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	b.WriteString(`<root status_code="200">`)
+	for i := 0; i+1 < len(elements); i += 2 {
+		fmt.Fprintf(&b, "<%s>", elements[i])
+		xml.EscapeText(&b, []byte(elements[i+1]))
+		fmt.Fprintf(&b, "</%s>", elements[i])
+	}
+	b.WriteString("</root>")
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(b.String()))
+}
+
+// replyError writes an XML error status. Like Sunshine, the HTTP status
+// stays 200 and the error is in the XML.
+func replyError(w http.ResponseWriter, code int, message string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="utf-8"?><root status_code="%d" status_message="`, code)
+	xml.EscapeText(&b, []byte(message))
+	b.WriteString(`"/>`)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(b.String()))
+}
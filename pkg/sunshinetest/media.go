@@ -0,0 +1,51 @@
+package sunshinetest
+
+import "encoding/binary"
+
+// defaultGOP is the number of frames in the default video, one IDR frame
+// followed by P-frames
+const defaultGOP = 30
+
+// DefaultVideo returns H.264 shaped frames: an IDR access unit with SPS and
+// PPS followed by P-frames. Each NAL unit carries the frame's index as a
+// big-endian uint16 after its header, so no zero bytes in it pass for a
+// start code, but the frames don't decode to a picture.
+func DefaultVideo() []Frame {
+	startCode := []byte{0x00, 0x00, 0x00, 0x01}
+	nal := func(header byte, index, size int) []byte {
+		b := append(append([]byte{}, startCode...), header)
+		b = binary.BigEndian.AppendUint16(b, uint16(index))
+		for len(b) < size {
+			b = append(b, byte(len(b)))
+		}
+		return b
+	}
+
+	frames := make([]Frame, defaultGOP)
+	for i := range frames {
+		if i == 0 {
+			var data []byte
+			data = append(data, nal(0x67, i, 16)...)   // SPS
+			data = append(data, nal(0x68, i, 8)...)    // PPS
+			data = append(data, nal(0x65, i, 6000)...) // IDR slice
+			frames[i] = Frame{Data: data, Keyframe: true}
+			continue
+		}
+		frames[i] = Frame{Data: nal(0x41, i, 1500)} // non-IDR slice
+	}
+	return frames
+}
+
+// DefaultAudio returns constant size packets with a 5 ms stereo CELT Opus
+// TOC byte, as Sunshine's constant bitrate encoder produces. They aren't
+// meant to be decoded.
+func DefaultAudio() [][]byte {
+	packets := make([][]byte, 200)
+	for i := range packets {
+		pkt := make([]byte, 120)
+		pkt[0] = 0xEC
+		binary.BigEndian.PutUint32(pkt[1:5], uint32(i))
+		packets[i] = pkt
+	}
+	return packets
+}
@@ -0,0 +1,283 @@
+package sunshinetest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/gamelight/gamelight/pkg/rtsp"
+)
+
+// The packetizers here do what Sunshine does: they turn frames and Opus
+// packets into the datagrams rtsp.Client reads.
+
+// Sizes and values of Sunshine's RTP_PACKET, NV_VIDEO_PACKET and
+// AUDIO_FEC_HEADER structs
+const (
+	rtpHeaderSize   = 12
+	videoHeaderSize = rtpHeaderSize + 4 + 16
+
+	shortFrameHeader  = 0x01
+	shortHeaderLength = 8
+
+	nvFlagPicData   = 0x01
+	nvFlagEOF       = 0x02
+	nvFlagSOF       = 0x04
+	nvMultiFECFlags = 0x10
+
+	audioPayloadType    = 97
+	audioFECPayloadType = 127
+	audioFECHeaderLen   = 12
+	audioDataShards     = 4
+	audioParityShards   = 2
+)
+
+// A frame is sent in at most maxFECBlocks FEC blocks of at most
+// maxBlockShards data and parity shards each
+const (
+	maxFECBlocks   = 4
+	maxBlockShards = 255
+)
+
+// videoPacketizer splits frames into video datagrams
+type videoPacketizer struct {
+	mu sync.Mutex
+
+	packetSize int
+	fecPercent int
+	seq        uint16
+	codes      map[[2]int]*fecEncoder
+}
+
+// newVideoPacketizer creates a packetizer sending packetSize bytes of frame
+// data per datagram with fecPercent parity shards per FEC block
+func newVideoPacketizer(packetSize, fecPercent int) *videoPacketizer {
+	if packetSize <= 0 {
+		packetSize = rtsp.DefaultPacketSize
+	}
+	if fecPercent < 0 {
+		fecPercent = 0
+	}
+	return &videoPacketizer{
+		packetSize: packetSize,
+		fecPercent: fecPercent,
+		codes:      make(map[[2]int]*fecEncoder),
+	}
+}
+
+// Packetize returns the datagrams for a frame, data shards first and then
+// parity for each FEC block. The frame's Index, Timestamp, FrameType and
+// Data are sent.
+func (p *videoPacketizer) Packetize(frame rtsp.VideoFrame) ([][]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Sunshine's short frame header, with the real length of the last
+	// packet's payload so the padding can be stripped
+	data := make([]byte, shortHeaderLength, shortHeaderLength+len(frame.Data))
+	data[0] = shortFrameHeader
+	data[3] = frame.FrameType
+	data = append(data, frame.Data...)
+	binary.LittleEndian.PutUint16(data[4:6], uint16((len(data)-1)%p.packetSize+1))
+
+	shards := (len(data) + p.packetSize - 1) / p.packetSize
+
+	// Split the frame into as few FEC blocks as fit the shard limit
+	perBlock := shards
+	for perBlock > 1 && perBlock+p.parityShards(perBlock) > maxBlockShards {
+		perBlock--
+	}
+	blocks := (shards + perBlock - 1) / perBlock
+	if blocks > maxFECBlocks {
+		return nil, fmt.Errorf("frame of %d bytes is too large to send", len(frame.Data))
+	}
+	perBlock = (shards + blocks - 1) / blocks
+
+	var out [][]byte
+	for b := 0; b < blocks; b++ {
+		first := b * perBlock
+		last := min(first+perBlock, shards)
+		chunk := data[first*p.packetSize : min(last*p.packetSize, len(data))]
+
+		out = append(out, p.packetizeBlock(frame, chunk, b, blocks-1)...)
+	}
+	return out, nil
+}
+
+// packetizeBlock builds the datagrams of one FEC block
+func (p *videoPacketizer) packetizeBlock(frame rtsp.VideoFrame, data []byte, block, lastBlock int) [][]byte {
+	dataShards := (len(data) + p.packetSize - 1) / p.packetSize
+	parityShards := p.parityShards(dataShards)
+
+	packets := make([][]byte, dataShards+parityShards)
+	for i := range packets {
+		packets[i] = make([]byte, videoHeaderSize+p.packetSize)
+		if i < dataShards {
+			copy(packets[i][videoHeaderSize:], data[i*p.packetSize:])
+		}
+	}
+
+	if parityShards > 0 {
+		p.code(dataShards, parityShards).encode(packets)
+	}
+
+	for i, pkt := range packets {
+		// RTP header announcing Sunshine's 4-byte extension, which stays
+		// zero like the rest of the headers while the parity is computed
+		pkt[0] = 0x90
+		binary.BigEndian.PutUint16(pkt[2:4], p.seq)
+		binary.BigEndian.PutUint32(pkt[4:8], frame.Timestamp)
+
+		nv := pkt[rtpHeaderSize+4 : videoHeaderSize]
+		binary.LittleEndian.PutUint32(nv[0:4], uint32(p.seq)<<8)
+		binary.LittleEndian.PutUint32(nv[4:8], frame.Index)
+		nv[8] = nvFlagPicData
+		if block == 0 && i == 0 {
+			nv[8] |= nvFlagSOF
+		}
+		if block == lastBlock && i == dataShards-1 {
+			nv[8] |= nvFlagEOF
+		}
+		nv[10] = nvMultiFECFlags
+		nv[11] = byte(block<<4 | lastBlock<<6)
+		fecInfo := uint32(dataShards)<<22 | uint32(i)<<12 | uint32(p.fecPercent)<<4
+		binary.LittleEndian.PutUint32(nv[12:16], fecInfo)
+
+		p.seq++
+	}
+	return packets
+}
+
+// parityShards returns the parity shard count for a block, rounding up as
+// the depacketizer does
+func (p *videoPacketizer) parityShards(dataShards int) int {
+	return (dataShards*p.fecPercent + 99) / 100
+}
+
+func (p *videoPacketizer) code(dataShards, parityShards int) *fecEncoder {
+	key := [2]int{dataShards, parityShards}
+	if _, ok := p.codes[key]; !ok {
+		p.codes[key] = newVideoFECEncoder(dataShards, parityShards)
+	}
+	return p.codes[key]
+}
+
+// audioPacketizer turns Opus packets into Sunshine audio datagrams,
+// encrypting them once a key is set. Every four data datagrams are
+// followed by two FEC datagrams, as long as the four payloads have the
+// same length; Sunshine's constant bitrate Opus always does.
+type audioPacketizer struct {
+	mu sync.Mutex
+
+	packetMs uint32
+	seq      uint16
+
+	// timestamp is in milliseconds, as Sunshine sends it
+	timestamp uint32
+
+	aesBlock cipher.Block
+	keyID    uint32
+
+	block [audioDataShards][]byte
+}
+
+// newAudioPacketizer creates a packetizer for Opus packets of packetMs
+// milliseconds
+func newAudioPacketizer(packetMs int) *audioPacketizer {
+	if packetMs <= 0 {
+		packetMs = 5
+	}
+	return &audioPacketizer{packetMs: uint32(packetMs)}
+}
+
+// SetKey enables AES-CBC encryption with a launch request's rikey and
+// rikeyid
+func (p *audioPacketizer) SetKey(key [16]byte, keyID uint32) error {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aesBlock = block
+	p.keyID = keyID
+	return nil
+}
+
+// Packetize returns the datagrams for one Opus packet: its data datagram
+// and, after every fourth packet, the block's FEC datagrams
+func (p *audioPacketizer) Packetize(opus []byte) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	seq, timestamp := p.seq, p.timestamp
+	p.seq++
+	p.timestamp += p.packetMs
+
+	payload := opus
+	if p.aesBlock != nil {
+		payload = p.encryptLocked(seq, opus)
+	}
+
+	pkt := make([]byte, rtpHeaderSize, rtpHeaderSize+len(payload))
+	pkt[0] = 0x80
+	pkt[1] = audioPayloadType
+	binary.BigEndian.PutUint16(pkt[2:4], seq)
+	binary.BigEndian.PutUint32(pkt[4:8], timestamp)
+	out := [][]byte{append(pkt, payload...)}
+
+	index := int(seq % audioDataShards)
+	p.block[index] = payload
+	if index != audioDataShards-1 {
+		return out
+	}
+
+	shards := make([][]byte, audioDataShards+audioParityShards)
+	copy(shards, p.block[:])
+	p.block = [audioDataShards][]byte{}
+	for _, shard := range shards[:audioDataShards] {
+		if shard == nil || len(shard) != len(payload) {
+			return out
+		}
+	}
+	for i := audioDataShards; i < len(shards); i++ {
+		shards[i] = make([]byte, len(payload))
+	}
+	audioFECEncoder.encode(shards)
+
+	baseSeq := seq - (audioDataShards - 1)
+	baseTimestamp := timestamp - (audioDataShards-1)*p.packetMs
+	for i, parity := range shards[audioDataShards:] {
+		fec := make([]byte, rtpHeaderSize+audioFECHeaderLen, rtpHeaderSize+audioFECHeaderLen+len(parity))
+		fec[0] = 0x80
+		fec[1] = audioFECPayloadType
+		binary.BigEndian.PutUint16(fec[2:4], baseSeq+audioDataShards+uint16(i))
+		binary.BigEndian.PutUint32(fec[4:8], baseTimestamp)
+
+		header := fec[rtpHeaderSize:]
+		header[0] = byte(i)
+		header[1] = audioPayloadType
+		binary.BigEndian.PutUint16(header[2:4], baseSeq)
+		binary.BigEndian.PutUint32(header[4:8], baseTimestamp)
+		out = append(out, append(fec, parity...))
+	}
+	return out
+}
+
+// encryptLocked encrypts a payload with AES-CBC and PKCS#7 padding, the
+// inverse of the depacketizer's decryption
+func (p *audioPacketizer) encryptLocked(seq uint16, payload []byte) []byte {
+	pad := aes.BlockSize - len(payload)%aes.BlockSize
+	padded := append(append([]byte{}, payload...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint32(iv[0:4], p.keyID+uint32(seq))
+
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(p.aesBlock, iv[:]).CryptBlocks(out, padded)
+	return out
+}
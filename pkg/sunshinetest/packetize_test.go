@@ -0,0 +1,186 @@
+package sunshinetest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/gamelight/gamelight/pkg/rtsp"
+)
+
+// The parity vectors are the ones pkg/rtsp's depacketizer tests use. They
+// were produced with github.com/klauspost/reedsolomon, whose default matrix
+// is nanors' Vandermonde construction, and, for audio, with Sunshine's
+// audio parity rows over ciphertexts from OpenSSL's AES-128-CBC.
+
+// testShard returns n bytes of test data, different for each seed
+func testShard(n, seed int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*37 + seed*101 + 11)
+	}
+	return b
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestVideoFECEncoder(t *testing.T) {
+	tests := []struct {
+		dataShards int
+		parity     []string
+	}{
+		{1, []string{"0b30557a9fc4e90e"}},
+		{4, []string{"d5f701762ad18920", "f152cb7e397b062a"}},
+		{10, []string{"9664a6abba69adca", "2c33931ddd1f1830", "222b008722e33520"}},
+		{30, []string{
+			"35ee1eb073c98a96", "f2c305553c6cf1bb", "95fa86d65303d90b",
+			"f51d3a129370d30f", "1926cb521943a2d9", "fce6e230fab41c55",
+			"8107e96914736534", "408685731093260c", "52a8959a9c17cf23",
+		}},
+	}
+
+	for _, tt := range tests {
+		shards := make([][]byte, tt.dataShards+len(tt.parity))
+		for i := range shards {
+			if i < tt.dataShards {
+				shards[i] = testShard(8, i)
+			} else {
+				shards[i] = make([]byte, 8)
+			}
+		}
+		newVideoFECEncoder(tt.dataShards, len(tt.parity)).encode(shards)
+
+		for i, want := range tt.parity {
+			if got := shards[tt.dataShards+i]; !bytes.Equal(got, mustHex(t, want)) {
+				t.Errorf("%d+%d parity %d = %x, want %s", tt.dataShards, len(tt.parity), i, got, want)
+			}
+		}
+	}
+}
+
+func TestVideoPacketizerVector(t *testing.T) {
+	// 45 bytes of header and frame make three 16-byte data shards; 50% FEC
+	// adds two parity shards
+	frame := testShard(37, 7)
+	packets, err := newVideoPacketizer(16, 50).Packetize(rtsp.VideoFrame{
+		Index:     1,
+		Timestamp: 90000,
+		FrameType: rtsp.FrameTypeIDR,
+		Data:      frame,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 5 {
+		t.Fatalf("got %d packets, want 5", len(packets))
+	}
+
+	// The first packet in full, with the SOF flag
+	want := mustHex(t, ""+
+		"90000000 00015f90 00000000 00000000"+ // RTP header and extension
+		"00000000 01000000 05001000 2003c000"+ // NV_VIDEO_PACKET: frame 1, SOF, 3 data shards, 50% FEC
+		"01000002 0d000000"+ // short frame header: IDR, 13 bytes in the last packet
+		"cef3183d6287acd1") // start of the frame
+	if got := packets[0]; !bytes.Equal(got, want) {
+		t.Errorf("first packet\n got %x\nwant %x", got, want)
+	}
+
+	// The last data shard has the EOF flag; parity shards have neither
+	if flags := packets[2][24]; flags != nvFlagPicData|nvFlagEOF {
+		t.Errorf("last data shard flags %#x", flags)
+	}
+	for i, parity := range []string{"b170d0d25d50f0b0be23c86dd25050f0", "65bf7d8889293630e74758aef108d9de"} {
+		pkt := packets[3+i]
+		if got := pkt[videoHeaderSize:]; !bytes.Equal(got, mustHex(t, parity)) {
+			t.Errorf("parity %d = %x, want %s", i, got, parity)
+		}
+		if flags := pkt[24]; flags != nvFlagPicData {
+			t.Errorf("parity %d flags %#x", i, flags)
+		}
+	}
+}
+
+func TestVideoPacketizerRoundTrip(t *testing.T) {
+	// A frame of 600 shards is sent as three FEC blocks
+	frame := testShard(600*16-shortHeaderLength-5, 3)
+	p := newVideoPacketizer(16, 20)
+
+	d := rtsp.NewVideoDepacketizer()
+	var frames []rtsp.VideoFrame
+	d.OnFrame(func(f rtsp.VideoFrame) { frames = append(frames, f) })
+
+	for index := uint32(1); index <= 2; index++ {
+		packets, err := p.Packetize(rtsp.VideoFrame{Index: index, Timestamp: index * 1500, Data: frame})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blocks := packets[len(packets)-1][27] >> 6; blocks != 2 {
+			t.Fatalf("last FEC block %d, want 2", blocks)
+		}
+
+		// Lose every tenth datagram, fewer than the parity replaces
+		for i, pkt := range packets {
+			if i%10 != 9 {
+				d.Push(pkt)
+			}
+		}
+	}
+
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	for _, f := range frames {
+		if !bytes.Equal(f.Data, frame) {
+			t.Errorf("frame %d differs", f.Index)
+		}
+	}
+	if _, dropped := d.Stats(); dropped != 0 {
+		t.Errorf("dropped %d frames", dropped)
+	}
+}
+
+func TestAudioPacketizerVector(t *testing.T) {
+	p := newAudioPacketizer(5)
+	p.SetKey([16]byte{
+		0x5a, 0x1e, 0x9c, 0x0f, 0x7b, 0x3d, 0x26, 0xe8,
+		0xa4, 0xc1, 0xf0, 0x9d, 0x3b, 0x7e, 0x6a, 0x52,
+	}, 0x0a0b0c0d)
+	p.seq, p.timestamp = 8, 40
+
+	var packets [][]byte
+	for seq := 8; seq < 12; seq++ {
+		opus := make([]byte, 20)
+		for i := range opus {
+			opus[i] = byte(seq*31 + i*13)
+		}
+		packets = append(packets, p.Packetize(opus)...)
+	}
+
+	want := []string{
+		"80610008 00000028 00000000 6c324abd45cb11746a7a8195cf1e36d2e821bc470b96cc6e310064789685c8ab",
+		"80610009 0000002d 00000000 cfcee66d07f700e3a97d031a0ac1d897f72f95fb45fc83126e9904a802ba0206",
+		"8061000a 00000032 00000000 39de883ae445a7ec3e2b32d0b32539b2d45d3fd35c7a940888fabe712f5f75f3",
+		"8061000b 00000037 00000000 9aa939131384e56727705f0966e296801d14ee15626eee23b703b56ef29597dd",
+		// FEC header: shard index, payload type, base sequence number and
+		// timestamp, SSRC
+		"807f000c 00000028 00000000 00610008 00000028 00000000 f78b0da05191e183e0f22b704727c8ec4de26c36cc29fb9c5835a6677ae385c1",
+		"807f000d 00000028 00000000 01610008 00000028 00000000 cac4170e2313bdb1520da5d17d054eef309d9e4ca1f97ba0952f608f83f821fc",
+	}
+	if len(packets) != len(want) {
+		t.Fatalf("got %d datagrams, want %d", len(packets), len(want))
+	}
+	for i, w := range want {
+		if w := mustHex(t, w); !bytes.Equal(packets[i], w) {
+			t.Errorf("datagram %d\n got %x\nwant %x", i, packets[i], w)
+		}
+	}
+}
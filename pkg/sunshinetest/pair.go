@@ -0,0 +1,245 @@
+package sunshinetest
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	challengeLength = 16
+	secretLength    = 16
+)
+
+var errPairingRejected = errors.New("pairing rejected")
+
+// pairing is the host side of a pairing in progress
+type pairing struct {
+	hash   func() hash.Hash
+	crypto crypto.Hash
+
+	key             []byte
+	clientCert      *x509.Certificate
+	serverSecret    []byte
+	serverChallenge []byte
+	clientHash      []byte
+}
+
+// handlePair runs the host side of the pairing handshake. Each step is
+// told apart by its parameters, as Sunshine does.
+func (s *Server) handlePair(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case q.Get("phrase") == "getservercert":
+		p, err := s.startPairing(q.Get("salt"), q.Get("clientcert"))
+		if err != nil {
+			reply(w, "paired", "0")
+			return
+		}
+		s.pairing = p
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Cert.Raw})
+		reply(w, "paired", "1", "plaincert", hex.EncodeToString(certPEM))
+
+	case q.Get("phrase") == "pairchallenge":
+		if r.TLS == nil || !s.isPairedLocked(r.TLS.PeerCertificates) {
+			reply(w, "paired", "0")
+			return
+		}
+		reply(w, "paired", "1")
+
+	case s.pairing == nil:
+		reply(w, "paired", "0")
+
+	case q.Get("clientchallenge") != "":
+		resp, ok := s.pairing.challenge(q.Get("clientchallenge"), s.Cert)
+		if !ok {
+			s.pairing = nil
+			reply(w, "paired", "0")
+			return
+		}
+		reply(w, "paired", "1", "challengeresponse", hex.EncodeToString(resp))
+
+	case q.Get("serverchallengeresp") != "":
+		secret, ok := s.pairing.pairingSecret(q.Get("serverchallengeresp"), s.identity.PrivateKey.(*rsa.PrivateKey))
+		if !ok {
+			s.pairing = nil
+			reply(w, "paired", "0")
+			return
+		}
+		reply(w, "paired", "1", "pairingsecret", hex.EncodeToString(secret))
+
+	case q.Get("clientpairingsecret") != "":
+		p := s.pairing
+		s.pairing = nil
+		if !p.verifyClient(q.Get("clientpairingsecret")) {
+			reply(w, "paired", "0")
+			return
+		}
+		s.paired = append(s.paired, p.clientCert)
+		reply(w, "paired", "1")
+
+	default:
+		replyError(w, http.StatusBadRequest, "Invalid pairing request")
+	}
+}
+
+// isPairedLocked reports whether the first of certs is a paired certificate
+func (s *Server) isPairedLocked(certs []*x509.Certificate) bool {
+	if len(certs) == 0 {
+		return false
+	}
+	for _, c := range s.paired {
+		if c.Equal(certs[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// startPairing handles the first step: the key is derived from the salt
+// and the PIN the user entered on the host
+func (s *Server) startPairing(saltHex, certHex string) (*pairing, error) {
+	if s.PIN == "" {
+		return nil, errPairingRejected
+	}
+
+	p := &pairing{hash: sha256.New, crypto: crypto.SHA256}
+	major, _ := strconv.Atoi(strings.SplitN(s.AppVersion, ".", 2)[0])
+	if major != 0 && major < 7 {
+		p.hash, p.crypto = sha1.New, crypto.SHA1
+	}
+
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return nil, err
+	}
+	h := p.hash()
+	h.Write(salt)
+	h.Write([]byte(s.PIN))
+	p.key = h.Sum(nil)[:16]
+
+	certPEM, err := hex.DecodeString(certHex)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errPairingRejected
+	}
+	if p.clientCert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// challenge answers the client's challenge with a hash over it, the host
+// certificate's signature and a new secret, followed by the host's own
+// challenge
+func (p *pairing) challenge(encHex string, cert *x509.Certificate) ([]byte, bool) {
+	challenge, ok := p.decrypt(encHex)
+	if !ok || len(challenge) < challengeLength {
+		return nil, false
+	}
+
+	p.serverSecret = make([]byte, secretLength)
+	p.serverChallenge = make([]byte, challengeLength)
+	rand.Read(p.serverSecret)
+	rand.Read(p.serverChallenge)
+
+	h := p.hash()
+	h.Write(challenge[:challengeLength])
+	h.Write(cert.Signature)
+	h.Write(p.serverSecret)
+	resp, err := aesEncrypt(p.key, append(h.Sum(nil), p.serverChallenge...))
+	return resp, err == nil
+}
+
+// pairingSecret keeps the client's challenge hash and returns the host's
+// secret signed with its key
+func (p *pairing) pairingSecret(encHex string, key *rsa.PrivateKey) ([]byte, bool) {
+	clientHash, ok := p.decrypt(encHex)
+	if !ok || len(clientHash) < p.crypto.Size() {
+		return nil, false
+	}
+	p.clientHash = clientHash[:p.crypto.Size()]
+
+	// Secrets are signed with SHA-256 even for legacy hosts
+	digest := sha256.Sum256(p.serverSecret)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, false
+	}
+	return append(append([]byte{}, p.serverSecret...), sig...), true
+}
+
+// verifyClient checks the client's signed secret and that its challenge
+// hash matches, which it only does if the client used the same PIN
+func (p *pairing) verifyClient(secretHex string) bool {
+	ps, err := hex.DecodeString(secretHex)
+	if err != nil || len(ps) <= secretLength || p.clientHash == nil {
+		return false
+	}
+	secret, sig := ps[:secretLength], ps[secretLength:]
+
+	pub, ok := p.clientCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return false
+	}
+	digest := sha256.Sum256(secret)
+	if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+		return false
+	}
+
+	h := p.hash()
+	h.Write(p.serverChallenge)
+	h.Write(p.clientCert.Signature)
+	h.Write(secret)
+	return hmac.Equal(h.Sum(nil), p.clientHash)
+}
+
+func (p *pairing) decrypt(encHex string) ([]byte, bool) {
+	enc, err := hex.DecodeString(encHex)
+	if err != nil || len(enc) == 0 || len(enc)%aes.BlockSize != 0 {
+		return nil, false
+	}
+	block, err := aes.NewCipher(p.key)
+	if err != nil {
+		return nil, false
+	}
+	out := make([]byte, len(enc))
+	for i := 0; i < len(out); i += aes.BlockSize {
+		block.Decrypt(out[i:i+aes.BlockSize], enc[i:i+aes.BlockSize])
+	}
+	return out, true
+}
+
+// aesEncrypt encrypts with AES-128-ECB, zero padding to a whole block
+func aesEncrypt(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	size := (len(plaintext) + aes.BlockSize - 1) / aes.BlockSize * aes.BlockSize
+	out := make([]byte, size)
+	copy(out, plaintext)
+	for i := 0; i < size; i += aes.BlockSize {
+		block.Encrypt(out[i:i+aes.BlockSize], out[i:i+aes.BlockSize])
+	}
+	return out, nil
+}
@@ -0,0 +1,217 @@
+package sunshinetest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gamelight/gamelight/pkg/rtsp"
+)
+
+const (
+	rtspSessionID = "DEADBEEFCAFE"
+
+	// pingPayload is the X-SS-Ping-Payload handed out in SETUP
+	pingPayload = "SUNSHINETESTPING"
+
+	// connectData is the X-SS-Connect-Data handed out for the control
+	// stream
+	connectData = 0x5375_6e73
+
+	// encAudio is Sunshine's audio bit of x-ss-general.encryptionEnabled
+	encAudio = 0x04
+
+	rtspTimeout = 10 * time.Second
+)
+
+// rtspSession is the stream configuration negotiated over RTSP
+type rtspSession struct {
+	playing bool
+
+	packetSize   int
+	fecPercent   int
+	fps          int
+	packetMs     int
+	encryptAudio bool
+}
+
+// serveRTSP accepts RTSP connections. Like Sunshine, each request comes
+// on its own connection.
+func (s *Server) serveRTSP() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.rtspListener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handleRTSP(conn)
+		}()
+	}
+}
+
+func (s *Server) handleRTSP(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(rtspTimeout))
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	method, target, _ := strings.Cut(strings.TrimSpace(line), " ")
+	target, _, _ = strings.Cut(target, " ")
+
+	headers := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			headers[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+
+	var body []byte
+	if n, _ := strconv.Atoi(headers["content-length"]); n > 0 {
+		body = make([]byte, n)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return
+		}
+	}
+
+	status, respHeaders, respBody := s.rtspResponse(method, target, headers, string(body))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %s\r\n", status)
+	fmt.Fprintf(&b, "CSeq: %s\r\n", headers["cseq"])
+	for _, h := range respHeaders {
+		b.WriteString(h + "\r\n")
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(respBody))
+	b.WriteString(respBody)
+	io.WriteString(conn, b.String())
+}
+
+// rtspResponse handles one RTSP request and returns the status, headers and
+// body of the response
+func (s *Server) rtspResponse(method, target string, headers map[string]string, body string) (string, []string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.currentGame == 0 {
+		return "503 Service Unavailable", nil, ""
+	}
+	if method != "OPTIONS" && method != "DESCRIBE" && method != "SETUP" {
+		if session, _, _ := strings.Cut(headers["session"], ";"); session != rtspSessionID {
+			return "454 Session Not Found", nil, ""
+		}
+	}
+
+	switch method {
+	case "OPTIONS":
+		return "200 OK", nil, ""
+
+	case "DESCRIBE":
+		return "200 OK", []string{"Content-Type: application/sdp"}, describeSDP
+
+	case "SETUP":
+		var conn *net.UDPConn
+		switch {
+		case strings.HasSuffix(target, rtsp.StreamVideo):
+			conn = s.videoConn
+		case strings.HasSuffix(target, rtsp.StreamAudio):
+			conn = s.audioConn
+		case strings.HasSuffix(target, rtsp.StreamControl):
+			conn = s.controlConn
+		default:
+			return "404 Not Found", nil, ""
+		}
+		resp := []string{
+			"Session: " + rtspSessionID + ";timeout = 90",
+			fmt.Sprintf("Transport: server_port=%d", conn.LocalAddr().(*net.UDPAddr).Port),
+		}
+		if conn == s.controlConn {
+			resp = append(resp, fmt.Sprintf("X-SS-Connect-Data: %d", connectData))
+		} else {
+			resp = append(resp, "X-SS-Ping-Payload: "+pingPayload)
+		}
+		return "200 OK", resp, ""
+
+	case "ANNOUNCE":
+		s.rtsp = parseAnnounce(body)
+		return "200 OK", nil, ""
+
+	case "PLAY":
+		s.rtsp.playing = true
+		return "200 OK", nil, ""
+
+	case "TEARDOWN":
+		s.rtsp.playing = false
+		s.stopStreamLocked()
+		return "200 OK", nil, ""
+	}
+	return "501 Not Implemented", nil, ""
+}
+
+// describeSDP advertises H.264 video and the stereo, 5.1 and 7.1 Opus
+// layouts, as Sunshine does
+const describeSDP = "v=0\r\n" +
+	"o=SystemName 0 0 IN IPv4 127.0.0.1\r\n" +
+	"s=Sunshine\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:97 surround-params=21101\r\n" +
+	"a=fmtp:97 surround-params=642014235\r\n" +
+	"a=fmtp:97 surround-params=85301423567\r\n"
+
+// parseAnnounce reads the stream configuration from the ANNOUNCE body's
+// attributes
+func parseAnnounce(sdp string) rtspSession {
+	session := rtspSession{
+		packetSize: rtsp.DefaultPacketSize,
+		fecPercent: rtsp.DefaultFECPercentage,
+		packetMs:   5,
+	}
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=") {
+			continue
+		}
+		key, value, ok := strings.Cut(line[2:], ":")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+
+		switch key {
+		case "x-nv-video[0].packetSize":
+			session.packetSize = n
+		case "x-nv-vqos[0].fec.repairPercent":
+			session.fecPercent = n
+		case "x-nv-video[0].maxFPS":
+			session.fps = n
+		case "x-nv-aqos.packetDuration":
+			session.packetMs = n
+		case "x-ss-general.encryptionEnabled":
+			session.encryptAudio = n&encAudio != 0
+		}
+	}
+	return session
+}
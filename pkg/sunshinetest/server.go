@@ -0,0 +1,293 @@
+// Package sunshinetest provides a fake Sunshine host for integration
+// tests. It runs in-process on loopback and answers the HTTP and HTTPS
+// endpoints, pairs with the real pairing handshake, negotiates streams over
+// RTSP and replays canned video and audio over RTP, so the path from
+// sunshine.Client through rtsp.Client to the WebRTC fan-out can be tested
+// without a gaming PC. The control stream is not emulated.
+package sunshinetest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gamelight/gamelight/pkg/sunshine"
+)
+
+// Frame is a canned video frame
+type Frame struct {
+	// Data is the frame's bitstream, for H.264 an Annex B access unit
+	Data     []byte
+	Keyframe bool
+}
+
+// Stats counts what clients asked of the host and what it sent
+type Stats struct {
+	Launches     int
+	Resumes      int
+	Cancels      int
+	VideoFrames  int
+	VideoPackets int
+	AudioPackets int
+}
+
+// Server is a fake Sunshine host. Change its exported fields before
+// calling Start.
+type Server struct {
+	// Identity reported by serverinfo
+	Hostname   string
+	AppVersion string
+	UniqueID   string
+	MAC        string
+
+	// PIN is the PIN the user "enters" on the host. Pairing with another
+	// PIN fails the way it does with Sunshine; an empty PIN rejects
+	// pairing.
+	PIN string
+
+	// Apps is the host's app list
+	Apps []sunshine.App
+
+	// CodecModes is the ServerCodecModeSupport reported in serverinfo, a
+	// mask of sunshine.CodecMode* bits
+	CodecModes int
+
+	// Video and Audio are replayed in a loop while streaming. Audio holds
+	// Opus packets of the announced packet duration.
+	Video []Frame
+	Audio [][]byte
+
+	// DropEvery drops every nth media datagram to exercise FEC recovery;
+	// zero sends everything
+	DropEvery int
+
+	// Fail, if set, is called with the path of each HTTP request. A
+	// nonzero code fails the request with that status and message, the
+	// way Sunshine reports errors.
+	Fail func(path string) (code int, message string)
+
+	// Cert is the host's certificate, which clients pin when pairing
+	Cert *x509.Certificate
+
+	identity tls.Certificate
+
+	httpServer   *httptest.Server
+	httpsServer  *httptest.Server
+	rtspListener net.Listener
+	videoConn    *net.UDPConn
+	audioConn    *net.UDPConn
+	controlConn  *net.UDPConn
+
+	mu          sync.Mutex
+	paired      []*x509.Certificate
+	pairing     *pairing
+	currentGame int
+	launch      launchParams
+	rtsp        rtspSession
+	stream      *stream
+	stats       Stats
+
+	wg     sync.WaitGroup
+	closed chan struct{}
+}
+
+// launchParams are the stream parameters of the last launch or resume
+type launchParams struct {
+	width, height, fps int
+	riKey              [16]byte
+	riKeyID            uint32
+}
+
+// NewUnstartedServer creates a fake host with one app, the default canned
+// media and a fresh certificate. Call Start to serve it.
+func NewUnstartedServer() (*Server, error) {
+	identity, err := sunshine.GeneratePairState("Sunshine Gamestream Host")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		Hostname:   "sunshinetest",
+		AppVersion: "7.1.431.-1",
+		UniqueID:   "0123456789ABCDEF0123456789ABCDEF",
+		MAC:        "02:00:00:00:00:01",
+		Apps: []sunshine.App{
+			{ID: 881448767, Title: "Desktop"},
+			{ID: 1093255277, Title: "Steam Big Picture", IsHDRSupport: true},
+		},
+		CodecModes: sunshine.CodecModeH264,
+		Video:      DefaultVideo(),
+		Audio:      DefaultAudio(),
+		Cert:       identity.ClientCert,
+		identity:   identity.TLSCertificate(),
+		closed:     make(chan struct{}),
+	}, nil
+}
+
+// NewServer creates and starts a fake host
+func NewServer() (*Server, error) {
+	s, err := NewUnstartedServer()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Start starts serving on loopback ports
+func (s *Server) Start() error {
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.handleHTTP))
+
+	s.httpsServer = httptest.NewUnstartedServer(http.HandlerFunc(s.handleHTTP))
+	s.httpsServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{s.identity},
+		// Like Sunshine, ask for a client certificate but check it
+		// against the paired ones in the handlers
+		ClientAuth: tls.RequestClientCert,
+	}
+	s.httpsServer.StartTLS()
+
+	var err error
+	if s.rtspListener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		s.Close()
+		return fmt.Errorf("rtsp listener: %w", err)
+	}
+	for _, conn := range []**net.UDPConn{&s.videoConn, &s.audioConn, &s.controlConn} {
+		if *conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			s.Close()
+			return fmt.Errorf("media listener: %w", err)
+		}
+	}
+
+	s.wg.Add(3)
+	go s.serveRTSP()
+	go s.receivePings(s.videoConn, mediaVideo)
+	go s.receivePings(s.audioConn, mediaAudio)
+	return nil
+}
+
+// Close stops the host
+func (s *Server) Close() {
+	select {
+	case <-s.closed:
+		return
+	default:
+		close(s.closed)
+	}
+
+	s.mu.Lock()
+	s.stopStreamLocked()
+	s.mu.Unlock()
+
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+	if s.httpsServer != nil {
+		s.httpsServer.Close()
+	}
+	if s.rtspListener != nil {
+		s.rtspListener.Close()
+	}
+	for _, conn := range []*net.UDPConn{s.videoConn, s.audioConn, s.controlConn} {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	s.wg.Wait()
+}
+
+// Host returns the address clients connect to
+func (s *Server) Host() string {
+	return "127.0.0.1"
+}
+
+// HTTPPort returns the port of the plain HTTP endpoints
+func (s *Server) HTTPPort() int {
+	return listenerPort(s.httpServer.Listener)
+}
+
+// HTTPSPort returns the port of the endpoints that need pairing
+func (s *Server) HTTPSPort() int {
+	return listenerPort(s.httpsServer.Listener)
+}
+
+// RTSPURL returns the session URL handed out by launch and resume
+func (s *Server) RTSPURL() string {
+	return "rtsp://" + net.JoinHostPort(s.Host(), strconv.Itoa(listenerPort(s.rtspListener)))
+}
+
+// Client returns a new, unpaired client for the host
+func (s *Server) Client() *sunshine.Client {
+	return sunshine.NewClient(s.Host(), s.HTTPPort(), s.HTTPSPort())
+}
+
+// PairedClient returns a new client paired with the host using its PIN
+func (s *Server) PairedClient() (*sunshine.Client, error) {
+	if s.PIN == "" {
+		return nil, errors.New("sunshinetest: set a PIN to pair")
+	}
+	state, err := sunshine.GeneratePairState("sunshinetest")
+	if err != nil {
+		return nil, err
+	}
+
+	client := s.Client()
+	if err := client.Pair(s.PIN, state); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Paired reports whether any client is paired
+func (s *Server) Paired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.paired) > 0
+}
+
+// CurrentGame returns the ID of the running app, or 0
+func (s *Server) CurrentGame() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.currentGame
+}
+
+// Streaming reports whether media is being sent
+func (s *Server) Streaming() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stream != nil
+}
+
+// Stats returns what the host has done so far
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// WaitStreaming waits until media is being sent, or returns false after
+// timeout
+func (s *Server) WaitStreaming(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if s.Streaming() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func listenerPort(l net.Listener) int {
+	return l.Addr().(*net.TCPAddr).Port
+}
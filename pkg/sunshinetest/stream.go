@@ -0,0 +1,189 @@
+package sunshinetest
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gamelight/gamelight/pkg/rtsp"
+)
+
+type media int
+
+const (
+	mediaVideo media = iota
+	mediaAudio
+)
+
+// defaultFPS is used when neither launch nor ANNOUNCE gave a frame rate
+const defaultFPS = 60
+
+// stream is the media being sent to a client
+type stream struct {
+	video, audio *net.UDPAddr
+	done         chan struct{}
+
+	// datagrams counts datagrams for DropEvery
+	datagrams atomic.Uint64
+}
+
+// receivePings waits for the client's UDP pings. Once the session is
+// playing, the first ping on each socket tells the host where to send that
+// media, as with Sunshine.
+func (s *Server) receivePings(conn *net.UDPConn, m media) {
+	defer s.wg.Done()
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !bytes.HasPrefix(buf[:n], []byte(pingPayload)) && string(buf[:n]) != "PING" {
+			continue
+		}
+
+		s.mu.Lock()
+		s.startStreamLocked(m, addr)
+		s.mu.Unlock()
+	}
+}
+
+// startStreamLocked starts sending one kind of media to addr, if the
+// session is playing and it isn't sent already
+func (s *Server) startStreamLocked(m media, addr *net.UDPAddr) {
+	if !s.rtsp.playing {
+		return
+	}
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+
+	if s.stream == nil {
+		s.stream = &stream{done: make(chan struct{})}
+	}
+	st := s.stream
+
+	switch {
+	case m == mediaVideo && st.video == nil && len(s.Video) > 0:
+		st.video = addr
+		s.wg.Add(1)
+		go s.sendVideo(st, s.videoParamsLocked())
+	case m == mediaAudio && st.audio == nil && len(s.Audio) > 0:
+		st.audio = addr
+		packetizer := newAudioPacketizer(s.rtsp.packetMs)
+		if s.rtsp.encryptAudio {
+			packetizer.SetKey(s.launch.riKey, s.launch.riKeyID)
+		}
+		s.wg.Add(1)
+		go s.sendAudio(st, packetizer, time.Duration(s.rtsp.packetMs)*time.Millisecond)
+	}
+}
+
+// stopStreamLocked stops sending media. The client has to PLAY again for
+// it to restart.
+func (s *Server) stopStreamLocked() {
+	s.rtsp.playing = false
+	if s.stream != nil {
+		close(s.stream.done)
+		s.stream = nil
+	}
+}
+
+type videoParams struct {
+	packetizer *videoPacketizer
+	fps        int
+}
+
+func (s *Server) videoParamsLocked() videoParams {
+	fps := s.rtsp.fps
+	if fps <= 0 {
+		fps = s.launch.fps
+	}
+	if fps <= 0 {
+		fps = defaultFPS
+	}
+	return videoParams{
+		packetizer: newVideoPacketizer(s.rtsp.packetSize, s.rtsp.fecPercent),
+		fps:        fps,
+	}
+}
+
+// sendVideo replays the canned frames at the stream's frame rate
+func (s *Server) sendVideo(st *stream, p videoParams) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Second / time.Duration(p.fps))
+	defer ticker.Stop()
+
+	for index := uint32(1); ; index++ {
+		frame := s.Video[int(index-1)%len(s.Video)]
+		frameType := uint8(rtsp.FrameTypePFrame)
+		if frame.Keyframe {
+			frameType = rtsp.FrameTypeIDR
+		}
+
+		packets, err := p.packetizer.Packetize(rtsp.VideoFrame{
+			Index:     index,
+			Timestamp: uint32(uint64(index) * 90000 / uint64(p.fps)),
+			FrameType: frameType,
+			Data:      frame.Data,
+		})
+		if err != nil {
+			return
+		}
+		sent := s.send(st, s.videoConn, st.video, packets)
+
+		s.mu.Lock()
+		s.stats.VideoFrames++
+		s.stats.VideoPackets += sent
+		s.mu.Unlock()
+
+		select {
+		case <-st.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendAudio replays the canned Opus packets, one per packet duration
+func (s *Server) sendAudio(st *stream, packetizer *audioPacketizer, interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		sent := s.send(st, s.audioConn, st.audio, packetizer.Packetize(s.Audio[i%len(s.Audio)]))
+
+		s.mu.Lock()
+		s.stats.AudioPackets += sent
+		s.mu.Unlock()
+
+		select {
+		case <-st.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send writes datagrams to addr, dropping every DropEvery-th, and returns
+// how many were sent
+func (s *Server) send(st *stream, conn *net.UDPConn, addr *net.UDPAddr, packets [][]byte) int {
+	sent := 0
+	for _, pkt := range packets {
+		n := st.datagrams.Add(1)
+		if s.DropEvery > 0 && n%uint64(s.DropEvery) == 0 {
+			continue
+		}
+		if _, err := conn.WriteToUDP(pkt, addr); err == nil {
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,421 @@
+package sunshinetest_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+
+	"github.com/gamelight/gamelight/internal/config"
+	"github.com/gamelight/gamelight/pkg/rtsp"
+	"github.com/gamelight/gamelight/pkg/sunshine"
+	"github.com/gamelight/gamelight/pkg/sunshinetest"
+	rtcfanout "github.com/gamelight/gamelight/pkg/webrtc"
+)
+
+// newPairedHost starts a fake host and pairs a client with it
+func newPairedHost(t *testing.T) (*sunshinetest.Server, *sunshine.Client) {
+	t.Helper()
+
+	host, err := sunshinetest.NewUnstartedServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.PIN = "1234"
+	if err := host.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(host.Close)
+
+	client, err := host.PairedClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, client
+}
+
+func launchRequest(appID int) sunshine.LaunchRequest {
+	return sunshine.LaunchRequest{AppID: appID, Width: 1280, Height: 720, FPS: 60, Bitrate: 10000}
+}
+
+func TestServerInfo(t *testing.T) {
+	host, client := newPairedHost(t)
+
+	// An unpaired client asks over HTTP and isn't told it is paired
+	for _, c := range []*sunshine.Client{host.Client(), client} {
+		info, err := c.GetServerInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Hostname != host.Hostname || info.UniqueID != host.UniqueID || info.MAC != host.MAC {
+			t.Errorf("server info %+v doesn't match the host", info)
+		}
+		if info.PairStatus != c.Paired() {
+			t.Errorf("pair status %v, want %v", info.PairStatus, c.Paired())
+		}
+		if info.GameRunning() || !info.SupportsCodecMode(sunshine.CodecModeH264) {
+			t.Errorf("server info %+v: wrong game or codecs", info)
+		}
+	}
+}
+
+func TestAppList(t *testing.T) {
+	host, client := newPairedHost(t)
+
+	apps, err := client.GetAppList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != len(host.Apps) {
+		t.Fatalf("got %d apps, want %d", len(apps), len(host.Apps))
+	}
+	for i, app := range apps {
+		if app != host.Apps[i] {
+			t.Errorf("app %d = %+v, want %+v", i, app, host.Apps[i])
+		}
+	}
+
+	if _, err := host.Client().GetAppList(); err == nil {
+		t.Error("unpaired client got the app list")
+	}
+}
+
+func TestResumeAndCancel(t *testing.T) {
+	host, client := newPairedHost(t)
+	app := host.Apps[1]
+
+	if _, err := client.Launch(launchRequest(app.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another session takes over the running app
+	info, err := client.GetServerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.GameRunning() || info.CurrentGame != app.ID {
+		t.Fatalf("server info reports game %d, want %d running", info.CurrentGame, app.ID)
+	}
+	resume, err := client.Resume(launchRequest(info.CurrentGame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resume.SessionURL != host.RTSPURL() {
+		t.Errorf("resume session URL %q, want %q", resume.SessionURL, host.RTSPURL())
+	}
+
+	if err := client.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if game := host.CurrentGame(); game != 0 {
+		t.Errorf("app %d still running after cancel", game)
+	}
+	if stats := host.Stats(); stats.Launches != 1 || stats.Resumes != 1 || stats.Cancels != 1 {
+		t.Errorf("stats %+v, want one launch, resume and cancel", stats)
+	}
+
+	// With nothing running there is nothing to resume
+	if _, err := client.Resume(launchRequest(app.ID)); !errors.Is(err, sunshine.ErrAppNotFound) {
+		t.Errorf("resume after cancel: %v, want ErrAppNotFound", err)
+	}
+}
+
+func TestPairWithWrongPIN(t *testing.T) {
+	host, err := sunshinetest.NewUnstartedServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.PIN = "1234"
+	if err := host.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	state, err := sunshine.GeneratePairState("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := host.Client()
+	if err := client.Pair("9876", state); !errors.Is(err, sunshine.ErrWrongPIN) {
+		t.Fatalf("pairing with the wrong PIN: %v, want ErrWrongPIN", err)
+	}
+	if host.Paired() {
+		t.Fatal("host paired with the wrong PIN")
+	}
+	if _, err := client.GetAppList(); err == nil {
+		t.Error("client got the app list after failing to pair")
+	}
+
+	// The right PIN still pairs
+	if _, err := host.PairedClient(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// received is what a browser receives from the fan-out
+type received struct {
+	mu         sync.Mutex
+	frames     [][]byte // reassembled access units
+	keyframes  int
+	audio      [][]byte
+	mismatches []string
+}
+
+func (r *received) count() (frames, keyframes, audio int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.frames), r.keyframes, len(r.audio)
+}
+
+// connectBrowser connects a receive-only peer connection to the fan-out,
+// standing in for a browser
+func connectBrowser(t *testing.T, fanOut *rtcfanout.FanOut, host *sunshinetest.Server) *received {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &received{}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		var h264 codecs.H264Packet // keeps FU-A fragments between packets
+		var frame []byte
+		synced := false // whether frame starts at an access unit
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			if track.Kind() == webrtc.RTPCodecTypeAudio {
+				r.audio = append(r.audio, pkt.Payload)
+			} else if synced {
+				nalus, err := h264.Unmarshal(pkt.Payload)
+				if err != nil {
+					r.mismatches = append(r.mismatches, err.Error())
+				}
+				frame = append(frame, nalus...)
+				if pkt.Marker {
+					r.checkFrame(host, frame)
+					frame = nil
+				}
+			}
+			synced = synced || pkt.Marker
+			r.mu.Unlock()
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	if _, err := fanOut.HandleOffer("browser", *pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	peer := fanOut.GetPeer("browser")
+	<-webrtc.GatheringCompletePromise(peer.Connection)
+	if err := pc.SetRemoteDescription(*peer.Connection.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// checkFrame compares an access unit with the canned frame whose index it
+// carries after its first NAL unit header. Packets sent while the
+// connection comes up may be lost, so checking starts at the first
+// keyframe, which begins with an SPS.
+func (r *received) checkFrame(host *sunshinetest.Server, frame []byte) {
+	if r.keyframes == 0 && (len(frame) < 5 || frame[4] != 0x67) {
+		return
+	}
+	if len(frame) < 7 {
+		r.mismatches = append(r.mismatches, "short frame")
+		return
+	}
+	index := int(binary.BigEndian.Uint16(frame[5:7]))
+	if index >= len(host.Video) || !bytes.Equal(frame, host.Video[index].Data) {
+		r.mismatches = append(r.mismatches, "frame differs from the one sent")
+		return
+	}
+	r.frames = append(r.frames, frame)
+	if host.Video[index].Keyframe {
+		r.keyframes++
+	}
+}
+
+func TestStreamReachesFanOut(t *testing.T) {
+	for _, dropEvery := range []int{0, 7} {
+		host, err := sunshinetest.NewUnstartedServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		host.PIN = "1234"
+		host.DropEvery = dropEvery
+		if err := host.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer host.Close()
+
+		client, err := host.PairedClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !host.Paired() {
+			t.Fatal("host isn't paired")
+		}
+
+		riKey, riKeyID, err := sunshine.GenerateRIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := host.Apps[0]
+		launch, err := client.Launch(sunshine.LaunchRequest{
+			AppID:   app.ID,
+			Width:   1280,
+			Height:  720,
+			FPS:     60,
+			Bitrate: 10000,
+			RIKey:   riKey,
+			RIKeyID: riKeyID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if game := host.CurrentGame(); game != app.ID {
+			t.Fatalf("host is running %d, want %d", game, app.ID)
+		}
+
+		fanOut, err := rtcfanout.NewFanOut(&config.WebRTCConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fanOut.Close()
+		videoTrack, err := rtcfanout.CreateVideoTrack(webrtc.MimeTypeH264)
+		if err != nil {
+			t.Fatal(err)
+		}
+		audioTrack, err := rtcfanout.CreateAudioTrack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fanOut.SetVideoTrack(videoTrack)
+		fanOut.SetAudioTrack(audioTrack)
+		videoWriter, err := fanOut.NewVideoWriter(videoTrack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		browser := connectBrowser(t, fanOut, host)
+
+		// Wire the RTSP client to the fan-out as gamelight serve does, and
+		// check what it reassembles against what the host sent
+		rc := rtsp.NewClient(launch.SessionURL)
+		defer rc.Close()
+
+		var mu sync.Mutex
+		var frameErrors, audioErrors, frameLosses int
+		rc.OnVideoFrame(func(frame rtsp.VideoFrame) {
+			want := host.Video[int(frame.Index-1)%len(host.Video)]
+			if !bytes.Equal(frame.Data, want.Data) || frame.IsKeyframe() != want.Keyframe {
+				mu.Lock()
+				frameErrors++
+				mu.Unlock()
+			}
+			videoWriter.WriteFrame(frame.Data, frame.Timestamp)
+		})
+		rc.OnVideoFrameLoss(func(lastGood, next uint32) {
+			mu.Lock()
+			frameLosses++
+			mu.Unlock()
+		})
+		audioPacketizer := rtcfanout.NewAudioPacketizer()
+		rc.OnAudioPacket(func(pkt rtsp.AudioPacket) {
+			if !bytes.Equal(pkt.Data, host.Audio[int(pkt.Sequence)%len(host.Audio)]) {
+				mu.Lock()
+				audioErrors++
+				mu.Unlock()
+			}
+			audioTrack.WriteRTP(audioPacketizer.Packetize(pkt.Data, pkt.Timestamp))
+		})
+		if err := rc.SetAudioKey(riKey, riKeyID); err != nil {
+			t.Fatal(err)
+		}
+		for _, media := range []string{"video", "audio"} {
+			if err := rc.StartRTPReceiver(media, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := rc.Handshake(rtsp.StreamConfig{
+			Width:        1280,
+			Height:       720,
+			FPS:          60,
+			Bitrate:      10000,
+			Codec:        rtsp.CodecH264,
+			EncryptAudio: true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !host.WaitStreaming(2 * time.Second) {
+			t.Fatal("host isn't streaming")
+		}
+
+		// A GOP and a half reach the browser, so at least one keyframe
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			frames, keyframes, audio := browser.count()
+			if frames >= 45 && keyframes >= 1 && audio >= 100 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("drop every %d: browser got %d frames, %d keyframes and %d audio packets", dropEvery, frames, keyframes, audio)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		browser.mu.Lock()
+		for _, m := range browser.mismatches {
+			t.Errorf("drop every %d: %s", dropEvery, m)
+		}
+		for _, opus := range browser.audio {
+			if len(opus) != 120 || opus[0] != 0xEC {
+				t.Errorf("drop every %d: browser got audio %x", dropEvery, opus)
+				break
+			}
+		}
+		browser.mu.Unlock()
+
+		mu.Lock()
+		if frameErrors != 0 || audioErrors != 0 {
+			t.Errorf("drop every %d: %d frames and %d audio packets differ from those sent", dropEvery, frameErrors, audioErrors)
+		}
+		mu.Unlock()
+
+		if stats := host.Stats(); dropEvery > 0 && stats.VideoPackets+stats.AudioPackets == 0 {
+			t.Errorf("drop every %d: host sent nothing", dropEvery)
+		}
+		mu.Lock()
+		if frameLosses != 0 {
+			t.Errorf("drop every %d: %d frames lost", dropEvery, frameLosses)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,138 @@
+package web
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/gamelight/gamelight/pkg/session"
+	"github.com/gamelight/gamelight/pkg/sunshine"
+)
+
+// AppInfo is an app returned by GET /api/apps
+type AppInfo struct {
+	ID      int    `json:"id"`
+	Title   string `json:"title"`
+	HDR     bool   `json:"hdr"`
+	Default bool   `json:"default"`
+	// Running is set for the app the host is already running, which a new
+	// session resumes
+	Running bool `json:"running,omitempty"`
+}
+
+func (s *Server) handleGetApps(w http.ResponseWriter, r *http.Request) {
+	host, ok := s.requestHost(w, r)
+	if !ok {
+		return
+	}
+
+	apps, err := host.Client.GetAppListContext(r.Context())
+	if err != nil {
+		writeHostError(w, err)
+		return
+	}
+
+	running := 0
+	if info, err := host.ServerInfoContext(r.Context()); err == nil && info.GameRunning() {
+		running = info.CurrentGame
+	}
+
+	infos := make([]AppInfo, len(apps))
+	for i, app := range apps {
+		infos[i] = AppInfo{
+			ID:      app.ID,
+			Title:   app.Title,
+			HDR:     app.IsHDRSupport,
+			Default: app.Title == s.config.Stream.DefaultApp,
+			Running: app.ID == running,
+		}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) handleGetBoxArt(w http.ResponseWriter, r *http.Request) {
+	appID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid app id", http.StatusBadRequest)
+		return
+	}
+	host, ok := s.requestHost(w, r)
+	if !ok {
+		return
+	}
+
+	image, err := host.Client.GetBoxArtContext(r.Context(), appID)
+	if err != nil {
+		writeHostError(w, err)
+		return
+	}
+
+	// Box art rarely changes, and every client of a session asks for it
+	w.Header().Set("Content-Type", http.DetectContentType(image))
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Write(image)
+}
+
+// requestHost returns the host named by the request's host parameter, or
+// the default host, writing an error response if there is none
+func (s *Server) requestHost(w http.ResponseWriter, r *http.Request) (*sunshine.Host, bool) {
+	if s.hosts == nil {
+		http.Error(w, "no Sunshine host configured", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	host, err := s.hosts.Get(r.URL.Query().Get("host"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, sunshine.ErrUnknownHost) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return nil, false
+	}
+	return host, true
+}
+
+func (c *Client) handleSwitchApp(msg SwitchAppMessage) {
+	sess := c.server.sessionManager.GetSession()
+	if sess == nil || !sess.IsHost(c.ID) {
+		return
+	}
+
+	// Relaunching takes a while, so don't hold up this client's messages
+	go c.server.switchApp(sess, msg.AppID)
+}
+
+// switchApp quits the session's app on the host and launches another
+func (s *Server) switchApp(sess *session.Session, appID int) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	s.waitStartedLocked()
+
+	// The session may have ended while we waited
+	if s.sessionManager.GetSession() != sess || sess.GetState().AppID == appID {
+		return
+	}
+
+	log.Printf("Switching to app %d", appID)
+	s.ReportStreamProgress(StreamProgress{State: StreamSwitching, Host: sess.GetSettings().Host})
+
+	if s.onStopStream != nil {
+		s.onStopStream()
+	}
+	sess.SetHDR(false)
+	if s.onStartStream == nil {
+		return
+	}
+
+	// Let clients join, leave and send offers while the app launches
+	s.starting = make(chan struct{})
+	s.streamMu.Unlock()
+	app, err := s.onStartStream(sess.GetSettings(), appID)
+	s.streamMu.Lock()
+
+	s.finishStartLocked(sess, app, err, "Failed to launch app")
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gamelight/gamelight/pkg/discovery"
+	"github.com/gamelight/gamelight/pkg/sunshine"
+)
+
+// DiscoveredHost is a host found by GET /api/discover
+type DiscoveredHost struct {
+	discovery.Host
+
+	// Name is the suggested name for adding the host
+	Name string `json:"name"`
+	// Configured is the name of the configured host at the same address
+	Configured string `json:"configured,omitempty"`
+}
+
+// AddHostRequest is the body of POST /api/hosts
+type AddHostRequest struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Port    int    `json:"port,omitempty"`
+}
+
+// ErrHostExists is returned by the add host callback when the name is taken
+var ErrHostExists = errors.New("host name already in use")
+
+// OnAddHost sets the callback that adds a host found by discovery
+func (s *Server) OnAddHost(fn func(req AddHostRequest) (*sunshine.Host, error)) {
+	s.onAddHost = fn
+}
+
+func (s *Server) handleDiscover(w http.ResponseWriter, r *http.Request) {
+	timeout := 3 * time.Second
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > 30*time.Second {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	found, err := discovery.Discover(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hosts := make([]DiscoveredHost, len(found))
+	for i, h := range found {
+		hosts[i] = DiscoveredHost{Host: h, Name: h.ConfigName()}
+		if s.hosts == nil {
+			continue
+		}
+		for _, configured := range s.hosts.Hosts() {
+			if addr := configured.Client.Host(); addr == h.Address || nameEqualHost(addr, h.Hostname) {
+				hosts[i].Configured = configured.Name
+				break
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, hosts)
+}
+
+func (s *Server) handleAddHost(w http.ResponseWriter, r *http.Request) {
+	var req AddHostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || req.Address == "" {
+		http.Error(w, "name and address are required", http.StatusBadRequest)
+		return
+	}
+	if s.onAddHost == nil {
+		http.Error(w, "adding hosts is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	host, err := s.onAddHost(req)
+	switch {
+	case errors.Is(err, ErrHostExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, hostStatus(r.Context(), host))
+}
+
+// nameEqualHost compares a configured address with an advertised hostname,
+// ignoring case and the trailing dot
+func nameEqualHost(addr, hostname string) bool {
+	return hostname != "" && strings.EqualFold(strings.TrimSuffix(addr, "."), strings.TrimSuffix(hostname, "."))
+}
@@ -0,0 +1,64 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gamelight/gamelight/pkg/sunshine"
+)
+
+// Error codes for failed requests to a Sunshine host
+const (
+	HostErrNotPaired         = "not_paired"
+	HostErrAppNotFound       = "app_not_found"
+	HostErrSessionInProgress = "session_in_progress"
+	HostErrUnreachable       = "unreachable"
+)
+
+// hostErrorCode maps an error from a Sunshine host to its API error code,
+// or "" if the cause isn't known
+func hostErrorCode(err error) string {
+	switch {
+	case errors.Is(err, sunshine.ErrNotPaired), errors.Is(err, sunshine.ErrClientRejected):
+		return HostErrNotPaired
+	case errors.Is(err, sunshine.ErrAppNotFound):
+		return HostErrAppNotFound
+	case errors.Is(err, sunshine.ErrSessionInProgress):
+		return HostErrSessionInProgress
+	case errors.Is(err, sunshine.ErrHostUnreachable):
+		return HostErrUnreachable
+	}
+	return ""
+}
+
+// hostErrorMessage describes an error from a Sunshine host for people
+// rather than logs
+func hostErrorMessage(err error) string {
+	switch hostErrorCode(err) {
+	case HostErrNotPaired:
+		return "Not paired with the host, pair with it from the Sunshine Host panel"
+	case HostErrAppNotFound:
+		return "The app isn't available on the host"
+	case HostErrSessionInProgress:
+		return "The host is busy streaming to another client"
+	case HostErrUnreachable:
+		return "Could not reach the host, check that it is on and Sunshine is running"
+	}
+	return err.Error()
+}
+
+// writeHostError writes the response for a request to a host that failed
+func writeHostError(w http.ResponseWriter, err error) {
+	code := http.StatusBadGateway
+	switch hostErrorCode(err) {
+	case HostErrNotPaired:
+		code = http.StatusForbidden
+	case HostErrAppNotFound:
+		code = http.StatusNotFound
+	case HostErrSessionInProgress:
+		code = http.StatusConflict
+	case HostErrUnreachable:
+		code = http.StatusGatewayTimeout
+	}
+	http.Error(w, hostErrorMessage(err), code)
+}
@@ -0,0 +1,82 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gamelight/gamelight/pkg/sunshine"
+)
+
+// HostStatus describes a configured Sunshine host for GET /api/hosts
+type HostStatus struct {
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	Default     bool   `json:"default"`
+	Reachable   bool   `json:"reachable"`
+	Paired      bool   `json:"paired"`
+	CanWake     bool   `json:"can_wake"`
+	Hostname    string `json:"hostname,omitempty"`
+	AppVersion  string `json:"app_version,omitempty"`
+	CurrentGame int    `json:"current_game,omitempty"`
+	ErrorCode   string `json:"error_code,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// SetHosts sets the Sunshine hosts clients can stream from and pair with
+func (s *Server) SetHosts(hosts *sunshine.Registry) {
+	s.hosts = hosts
+}
+
+func (s *Server) handleGetHosts(w http.ResponseWriter, r *http.Request) {
+	if s.hosts == nil {
+		writeJSON(w, http.StatusOK, []HostStatus{})
+		return
+	}
+
+	// Query every host at once so one unreachable host doesn't hold up the
+	// rest for the whole request timeout
+	hosts := s.hosts.Hosts()
+	statuses := make([]HostStatus, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host *sunshine.Host) {
+			defer wg.Done()
+			statuses[i] = hostStatus(r.Context(), host)
+			statuses[i].Default = i == 0
+		}(i, host)
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// hostStatus queries a host's server info
+func hostStatus(ctx context.Context, host *sunshine.Host) HostStatus {
+	status := HostStatus{
+		Name:    host.Name,
+		Address: host.Client.Host(),
+		Paired:  host.Client.Paired(),
+	}
+
+	// Querying the host may have taught us its MAC
+	info, err := host.ServerInfoContext(ctx)
+	status.CanWake = host.Client.MAC() != ""
+	if err != nil {
+		// A host that answers with an error is up, it just won't serve us
+		status.Reachable = !errors.Is(err, sunshine.ErrHostUnreachable)
+		status.Paired = status.Paired && hostErrorCode(err) != HostErrNotPaired
+		status.ErrorCode = hostErrorCode(err)
+		status.Error = err.Error()
+		return status
+	}
+
+	status.Reachable = true
+	status.Paired = status.Paired && info.PairStatus
+	status.Hostname = info.Hostname
+	status.AppVersion = info.AppVersion
+	status.CurrentGame = info.CurrentGame
+	return status
+}
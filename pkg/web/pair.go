@@ -0,0 +1,181 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gamelight/gamelight/pkg/sunshine"
+)
+
+// Pairing states reported by /api/pair/status
+const (
+	PairIdle    = "idle"
+	PairRunning = "running"
+	PairPaired  = "paired"
+	PairFailed  = "failed"
+)
+
+// Error codes for failed pairing attempts
+const (
+	PairErrWrongPIN        = "wrong_pin"
+	PairErrRejected        = "rejected"
+	PairErrChallenge       = "challenge_failed"
+	PairErrUnverified      = "server_unverified"
+	PairErrUnreachable     = "unreachable"
+	PairErrSaveCredentials = "save_failed"
+)
+
+// PairStatus is the progress of the current pairing attempt. It is returned
+// by the pairing endpoints and sent to WebSocket clients as pair_progress.
+type PairStatus struct {
+	State     string `json:"state"`
+	Host      string `json:"host,omitempty"`
+	PIN       string `json:"pin,omitempty"`
+	Step      int    `json:"step,omitempty"`
+	StepName  string `json:"step_name,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PairStartRequest is the optional body of POST /api/pair/start. An empty
+// host pairs with the default host.
+type PairStartRequest struct {
+	Host       string `json:"host"`
+	DeviceName string `json:"device_name"`
+}
+
+// pairing runs one pairing attempt at a time in the background
+type pairing struct {
+	mu     sync.Mutex
+	status PairStatus
+}
+
+func (s *Server) handlePairStart(w http.ResponseWriter, r *http.Request) {
+	req := PairStartRequest{DeviceName: "gamelight"}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s.hosts == nil {
+		http.Error(w, "no Sunshine host configured", http.StatusServiceUnavailable)
+		return
+	}
+	host, err := s.hosts.Get(req.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	p := &s.pairing
+	p.mu.Lock()
+	if p.status.State == PairRunning {
+		status := p.status
+		p.mu.Unlock()
+		writeJSON(w, http.StatusConflict, status)
+		return
+	}
+
+	pin, err := sunshine.GeneratePIN()
+	if err != nil {
+		p.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state, err := sunshine.GeneratePairState(req.DeviceName)
+	if err != nil {
+		p.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.status = PairStatus{State: PairRunning, Host: host.Name, PIN: pin}
+	status := p.status
+	p.mu.Unlock()
+
+	state.OnStep(func(step sunshine.PairStep) {
+		s.updatePairStatus(func(status *PairStatus) {
+			status.Step = int(step)
+			status.StepName = step.String()
+		})
+	})
+	go s.runPairing(host, pin, state)
+
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+func (s *Server) handlePairStatus(w http.ResponseWriter, r *http.Request) {
+	s.pairing.mu.Lock()
+	status := s.pairing.status
+	s.pairing.mu.Unlock()
+
+	if status.State == "" {
+		status.State = PairIdle
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// runPairing runs the pairing steps and saves the credentials on success
+func (s *Server) runPairing(host *sunshine.Host, pin string, state *sunshine.PairState) {
+	err := host.Pair(pin, state)
+	if err == nil && host.Store != nil {
+		if saveErr := host.SavePairing(state); saveErr != nil {
+			log.Printf("Failed to save pairing credentials for %s: %v", host.Name, saveErr)
+			s.updatePairStatus(func(status *PairStatus) {
+				status.State = PairFailed
+				status.ErrorCode = PairErrSaveCredentials
+				status.Error = saveErr.Error()
+			})
+			return
+		}
+	}
+
+	s.updatePairStatus(func(status *PairStatus) {
+		status.PIN = ""
+		if err != nil {
+			log.Printf("Pairing with %s failed: %v", host.Name, err)
+			status.State = PairFailed
+			status.ErrorCode = pairErrorCode(err)
+			status.Error = err.Error()
+			return
+		}
+		log.Printf("Paired with Sunshine host %s", host.Name)
+		status.State = PairPaired
+	})
+}
+
+// updatePairStatus changes the pairing status and sends it to all clients
+func (s *Server) updatePairStatus(fn func(*PairStatus)) {
+	s.pairing.mu.Lock()
+	fn(&s.pairing.status)
+	status := s.pairing.status
+	s.pairing.mu.Unlock()
+
+	s.broadcast("pair_progress", status)
+}
+
+// pairErrorCode maps a pairing error to its API error code
+func pairErrorCode(err error) string {
+	switch {
+	case errors.Is(err, sunshine.ErrWrongPIN):
+		return PairErrWrongPIN
+	case errors.Is(err, sunshine.ErrChallengeFailed):
+		return PairErrChallenge
+	case errors.Is(err, sunshine.ErrServerUnverified):
+		return PairErrUnverified
+	case errors.Is(err, sunshine.ErrPairingRejected):
+		return PairErrRejected
+	}
+	return PairErrUnreachable
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
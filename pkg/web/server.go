@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -16,9 +19,14 @@ import (
 	"github.com/gamelight/gamelight/internal/config"
 	"github.com/gamelight/gamelight/pkg/input"
 	"github.com/gamelight/gamelight/pkg/session"
+	"github.com/gamelight/gamelight/pkg/sunshine"
 	rtcfanout "github.com/gamelight/gamelight/pkg/webrtc"
 )
 
+// offerTimeout is how long a client starting a session has to send its
+// WebRTC offer before the stream is started without it
+const offerTimeout = 5 * time.Second
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for development
@@ -35,9 +43,19 @@ type Server struct {
 	clients   map[string]*Client
 	clientsMu sync.RWMutex
 
+	hosts   *sunshine.Registry
+	pairing pairing
+
+	// streamMu serialises starting, stopping and switching the stream.
+	// Starting takes a while, so it happens without the lock; starting is
+	// set meanwhile and closed once the stream has its tracks.
+	streamMu sync.Mutex
+	starting chan struct{}
+
 	// Callbacks
-	onStartStream func(settings session.StreamSettings) error
+	onStartStream func(settings session.StreamSettings, appID int) (*sunshine.App, error)
 	onStopStream  func()
+	onAddHost     func(req AddHostRequest) (*sunshine.Host, error)
 }
 
 // Client represents a connected WebSocket client
@@ -45,9 +63,15 @@ type Client struct {
 	ID       string
 	Conn     *websocket.Conn
 	send     chan []byte
+	messages chan WSMessage
 	server   *Server
 	peer     *rtcfanout.Peer
 	mu       sync.Mutex
+
+	// offer is the client's last WebRTC offer, which tells which video
+	// codecs it can decode; offerReady is closed once it has sent one
+	offer      string
+	offerReady chan struct{}
 }
 
 // Message types for WebSocket communication
@@ -80,6 +104,17 @@ type PermissionMessage struct {
 	Mouse    bool   `json:"mouse"`
 }
 
+type SwitchAppMessage struct {
+	AppID int `json:"app_id"`
+}
+
+// DeliveryMessage tells a client how much of the video its link is sent
+type DeliveryMessage struct {
+	Mode         string `json:"mode"`
+	EstimateKbps int    `json:"estimate_kbps"`
+	StreamKbps   int    `json:"stream_kbps"`
+}
+
 type SessionStateMessage struct {
 	Participant *session.Participant `json:"you"`
 	Session     session.State        `json:"session"`
@@ -102,12 +137,15 @@ func NewServer(cfg *config.Config) (*Server, error) {
 
 	// Handle data channel messages
 	fanOut.OnDataMessage(s.handleDataMessage)
+	fanOut.OnDeliveryChange(s.handleDeliveryChange)
 
 	return s, nil
 }
 
-// OnStartStream sets the callback for when a stream should start
-func (s *Server) OnStartStream(fn func(settings session.StreamSettings) error) {
+// OnStartStream sets the callback for when a stream should start. appID is
+// the app to launch, or 0 for the default; the callback returns the app it
+// launched.
+func (s *Server) OnStartStream(fn func(settings session.StreamSettings, appID int) (*sunshine.App, error)) {
 	s.onStartStream = fn
 }
 
@@ -121,11 +159,59 @@ func (s *Server) SetVideoTrack(track *webrtc.TrackLocalStaticRTP) {
 	s.fanOut.SetVideoTrack(track)
 }
 
+// NewVideoWriter creates the writer for a video track's frames
+func (s *Server) NewVideoWriter(track *webrtc.TrackLocalStaticRTP) (*rtcfanout.VideoWriter, error) {
+	return s.fanOut.NewVideoWriter(track)
+}
+
 // SetAudioTrack sets the audio track for streaming
 func (s *Server) SetAudioTrack(track *webrtc.TrackLocalStaticRTP) {
 	s.fanOut.SetAudioTrack(track)
 }
 
+// SetSurroundAudioTrack sets the multiopus audio track for peers that
+// support surround sound
+func (s *Server) SetSurroundAudioTrack(track *webrtc.TrackLocalStaticRTP) {
+	s.fanOut.SetSurroundAudioTrack(track)
+}
+
+// OnKeyframeRequest sets the callback that asks the host for a keyframe
+// when browsers need one. Requests are coalesced across browsers.
+func (s *Server) OnKeyframeRequest(fn func()) {
+	s.fanOut.OnKeyframeRequest(fn)
+}
+
+// RequestKeyframe asks the host for a keyframe for every browser, as when
+// video frames from the host were lost
+func (s *Server) RequestKeyframe() {
+	s.fanOut.RequestKeyframe()
+}
+
+// VideoCodecs returns the video codecs every client that has sent an offer
+// can decode, most preferred first. ok is false if none has sent one; an
+// empty list with ok set means the clients share no codec. With hdr only
+// codecs that can carry 10-bit video are returned.
+func (s *Server) VideoCodecs(hdr bool) (codecs []string, ok bool) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	offerCodecs := rtcfanout.OfferVideoCodecs
+	if hdr {
+		offerCodecs = rtcfanout.OfferHDRVideoCodecs
+	}
+
+	var offered [][]string
+	for _, client := range s.clients {
+		if offer := client.getOffer(); offer != "" {
+			offered = append(offered, offerCodecs(offer))
+		}
+	}
+	if len(offered) == 0 {
+		return nil, false
+	}
+	return rtcfanout.CommonVideoCodecs(offered...), true
+}
+
 // InputHandler returns the input handler
 func (s *Server) InputHandler() *input.Handler {
 	return s.inputHandler
@@ -152,6 +238,13 @@ func (s *Server) Router() http.Handler {
 
 	// API routes
 	r.Get("/api/session", s.handleGetSession)
+	r.Get("/api/hosts", s.handleGetHosts)
+	r.Post("/api/hosts", s.handleAddHost)
+	r.Get("/api/discover", s.handleDiscover)
+	r.Get("/api/apps", s.handleGetApps)
+	r.Get("/api/apps/{id}/boxart", s.handleGetBoxArt)
+	r.Post("/api/pair/start", s.handlePairStart)
+	r.Get("/api/pair/status", s.handlePairStatus)
 	r.Get("/ws", s.handleWebSocket)
 
 	// Serve static files
@@ -189,10 +282,12 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	clientID := uuid.New().String()
 	client := &Client{
-		ID:     clientID,
-		Conn:   conn,
-		send:   make(chan []byte, 256),
-		server: s,
+		ID:         clientID,
+		Conn:       conn,
+		send:       make(chan []byte, 256),
+		messages:   make(chan WSMessage, 256),
+		server:     s,
+		offerReady: make(chan struct{}),
 	}
 
 	s.clientsMu.Lock()
@@ -202,37 +297,62 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Start client goroutines
 	go client.writePump()
 	go client.readPump()
+	go client.messagePump()
 
-	// Join session or create one
-	s.handleClientJoin(client)
+	// Join session or create one. The client creating the session picks
+	// the host and app to stream, and whether to ask for HDR.
+	query := r.URL.Query()
+	appID, _ := strconv.Atoi(query.Get("app"))
+	s.handleClientJoin(client, query.Get("host"), appID, query.Get("hdr") == "1")
 }
 
-func (s *Server) handleClientJoin(client *Client) {
+// handleClientJoin adds a client to the session, creating and starting it
+// if there is none
+func (s *Server) handleClientJoin(client *Client, host string, appID int, hdr bool) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+
+	// A stream still starting for a session that has ended must stop
+	// before another starts
 	sess := s.sessionManager.GetSession()
+	if sess == nil {
+		s.waitStartedLocked()
+		sess = s.sessionManager.GetSession()
+	}
 
 	// Create session if none exists
+	start := false
 	if sess == nil {
+		// Resolve the host now so the session reports which one it uses
+		if s.hosts != nil {
+			h, err := s.hosts.Get(host)
+			if err != nil {
+				log.Printf("Failed to create session: %v", err)
+				client.sendJSON("error", err.Error())
+				return
+			}
+			host = h.Name
+		}
+
 		settings := session.StreamSettings{
+			Host:    host,
 			Bitrate: s.config.Stream.DefaultBitrate,
 			FPS:     s.config.Stream.DefaultFPS,
 			Width:   s.config.Stream.DefaultWidth,
 			Height:  s.config.Stream.DefaultHeight,
+			HDR:     hdr,
 		}
 
 		var err error
-		sess, err = s.sessionManager.CreateSession(0, s.config.Stream.DefaultApp, settings)
+		sess, err = s.sessionManager.CreateSession(appID, s.config.Stream.DefaultApp, settings)
 		if err != nil {
 			log.Printf("Failed to create session: %v", err)
 			return
 		}
 
-		// Start streaming
-		if s.onStartStream != nil {
-			if err := s.onStartStream(settings); err != nil {
-				log.Printf("Failed to start stream: %v", err)
-				s.sessionManager.EndSession()
-				return
-			}
+		start = s.onStartStream != nil
+		if start {
+			s.starting = make(chan struct{})
 		}
 	}
 
@@ -241,9 +361,64 @@ func (s *Server) handleClientJoin(client *Client) {
 
 	// Send initial state
 	s.sendSessionState(client, sess, participant)
+
+	if start {
+		// Start streaming. The video codec depends on what the browser can
+		// decode, so wait for its offer first.
+		s.streamMu.Unlock()
+		if !client.waitOffer(offerTimeout) {
+			log.Printf("Client %s sent no offer, starting the stream without its codecs", client.ID)
+		}
+		app, err := s.onStartStream(sess.GetSettings(), appID)
+		s.streamMu.Lock()
+
+		s.finishStartLocked(sess, app, err, "Failed to start stream")
+	}
+}
+
+// waitStartedLocked waits for a stream that is starting to have its
+// tracks. The caller holds streamMu, which is released while waiting.
+func (s *Server) waitStartedLocked() {
+	for s.starting != nil {
+		starting := s.starting
+		s.streamMu.Unlock()
+		<-starting
+		s.streamMu.Lock()
+	}
+}
+
+// finishStartLocked records the outcome of starting sess's stream and wakes
+// whatever waits for it. The caller holds streamMu.
+func (s *Server) finishStartLocked(sess *session.Session, app *sunshine.App, err error, failure string) {
+	close(s.starting)
+	s.starting = nil
+
+	if s.sessionManager.GetSession() != sess {
+		// Everyone left while the stream started
+		if err == nil && s.onStopStream != nil {
+			s.onStopStream()
+		}
+		return
+	}
+	if err != nil {
+		// Without a stream the session is no use, so end it and let the
+		// next client start afresh
+		log.Printf("%s: %v", failure, err)
+		s.broadcast("error", failure+": "+hostErrorMessage(err))
+		s.sessionManager.EndSession()
+		return
+	}
+
+	sess.SetApp(app.ID, app.Title)
+	sess.SetVideoCodec(s.fanOut.VideoCodec())
+	s.ReportStreamProgress(StreamProgress{State: StreamStarted})
+	s.broadcastSessionState()
 }
 
 func (s *Server) handleClientLeave(clientID string) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+
 	sess := s.sessionManager.GetSession()
 	if sess == nil {
 		return
@@ -252,7 +427,8 @@ func (s *Server) handleClientLeave(clientID string) {
 	_, sessionEnded := sess.Leave(clientID)
 
 	if sessionEnded {
-		if s.onStopStream != nil {
+		// A stream that is still starting is stopped once it has started
+		if s.starting == nil && s.onStopStream != nil {
 			s.onStopStream()
 		}
 		s.sessionManager.EndSession()
@@ -263,6 +439,8 @@ func (s *Server) handleClientLeave(clientID string) {
 }
 
 func (s *Server) sendSessionState(client *Client, sess *session.Session, participant *session.Participant) {
+	s.setAdaptiveDelivery(participant)
+
 	state := SessionStateMessage{
 		Participant: participant,
 		Session:     sess.GetState(),
@@ -278,6 +456,27 @@ func (s *Server) sendSessionState(client *Client, sess *session.Session, partici
 	}
 }
 
+// setAdaptiveDelivery lets the fan-out thin out a spectator's video when
+// their link can't keep up. Players always get every frame.
+func (s *Server) setAdaptiveDelivery(participant *session.Participant) {
+	s.fanOut.SetAdaptiveDelivery(participant.ID, participant.Role == session.RoleSpectator)
+}
+
+// handleDeliveryChange tells a client its video delivery mode changed
+func (s *Server) handleDeliveryChange(peerID string, d rtcfanout.Delivery) {
+	s.clientsMu.RLock()
+	client := s.clients[peerID]
+	s.clientsMu.RUnlock()
+
+	if client != nil {
+		client.sendJSON("delivery", DeliveryMessage{
+			Mode:         d.Mode.String(),
+			EstimateKbps: d.EstimateKbps,
+			StreamKbps:   d.StreamKbps,
+		})
+	}
+}
+
 func (s *Server) broadcastSessionState() {
 	sess := s.sessionManager.GetSession()
 	if sess == nil {
@@ -295,6 +494,50 @@ func (s *Server) broadcastSessionState() {
 	}
 }
 
+// Stream progress states sent to clients while a session starts
+const (
+	StreamWaking    = "waking"
+	StreamLaunching = "launching"
+	StreamSwitching = "switching"
+	StreamStarted   = "started"
+)
+
+// StreamProgress is sent to WebSocket clients as stream_progress while the
+// stream starts
+type StreamProgress struct {
+	State   string `json:"state"`
+	Host    string `json:"host,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+}
+
+// SetHDR records whether the host is sending HDR video and tells the
+// clients. Hosts report it on the control stream, which may happen while a
+// stream is starting.
+func (s *Server) SetHDR(hdr bool) {
+	sess := s.sessionManager.GetSession()
+	if sess == nil || sess.GetState().HDR == hdr {
+		return
+	}
+	sess.SetHDR(hdr)
+	s.broadcastSessionState()
+}
+
+// ReportStreamProgress sends the progress of starting the stream to all
+// clients
+func (s *Server) ReportStreamProgress(p StreamProgress) {
+	s.broadcast("stream_progress", p)
+}
+
+// broadcast sends a message to every WebSocket client
+func (s *Server) broadcast(msgType string, v interface{}) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	for _, client := range s.clients {
+		client.sendJSON(msgType, v)
+	}
+}
+
 func (s *Server) handleDataMessage(peerID string, channel string, data []byte) {
 	sess := s.sessionManager.GetSession()
 	if sess == nil {
@@ -342,6 +585,14 @@ func (s *Server) handleDataMessage(peerID string, channel string, data []byte) {
 			s.inputHandler.HandleKeyboard(event.KeyCode, event.Action, event.Modifiers)
 		}
 
+	case "touch":
+		if !sess.CanUseMouse(peerID) {
+			return
+		}
+		if event, err := input.ParseTouchData(data); err == nil && event != nil {
+			s.inputHandler.HandleTouch(*event)
+		}
+
 	case "controllers", "controller0", "controller1", "controller2", "controller3":
 		slot := sess.GetSlotByID(peerID)
 		if slot == session.SlotNone {
@@ -357,14 +608,13 @@ func (s *Server) handleDataMessage(peerID string, channel string, data []byte) {
 
 // Client methods
 
+// readPump reads the client's messages for messagePump. The client leaves
+// the session as soon as it disconnects, even while an offer waits for a
+// stream to start.
 func (c *Client) readPump() {
 	defer func() {
 		c.server.handleClientLeave(c.ID)
-		c.server.fanOut.RemovePeer(c.ID)
-		c.server.clientsMu.Lock()
-		delete(c.server.clients, c.ID)
-		c.server.clientsMu.Unlock()
-		c.Conn.Close()
+		close(c.messages)
 	}()
 
 	for {
@@ -382,6 +632,22 @@ func (c *Client) readPump() {
 			continue
 		}
 
+		c.messages <- msg
+	}
+}
+
+// messagePump handles the client's messages in order, then cleans up after
+// it has disconnected
+func (c *Client) messagePump() {
+	defer func() {
+		c.server.fanOut.RemovePeer(c.ID)
+		c.server.clientsMu.Lock()
+		delete(c.server.clients, c.ID)
+		c.server.clientsMu.Unlock()
+		c.Conn.Close()
+	}()
+
+	for msg := range c.messages {
 		c.handleMessage(msg)
 	}
 }
@@ -404,6 +670,7 @@ func (c *Client) handleMessage(msg WSMessage) {
 			log.Printf("Invalid offer: %v", err)
 			return
 		}
+		c.setOffer(sdp.SDP)
 		c.handleOffer(sdp)
 
 	case "ice_candidate":
@@ -433,6 +700,13 @@ func (c *Client) handleMessage(msg WSMessage) {
 			return
 		}
 		c.handleSetPermission(perm)
+
+	case "switch_app":
+		var app SwitchAppMessage
+		if err := json.Unmarshal(msg.Data, &app); err != nil {
+			return
+		}
+		c.handleSwitchApp(app)
 	}
 }
 
@@ -442,16 +716,33 @@ func (c *Client) handleOffer(sdp SDPMessage) {
 		SDP:  sdp.SDP,
 	}
 
+	// Wait for a stream that is starting, so the answer has its tracks
+	c.server.streamMu.Lock()
+	c.server.waitStartedLocked()
 	answer, err := c.server.fanOut.HandleOffer(c.ID, offer)
+	codec := c.server.fanOut.VideoCodec()
+	c.server.streamMu.Unlock()
 	if err != nil {
 		log.Printf("Failed to handle offer: %v", err)
 		return
 	}
 
+	// A browser joining later may not decode the codec chosen for the
+	// others
+	if codec != "" && !rtcfanout.OfferSupportsVideo(sdp.SDP, codec) {
+		log.Printf("Client %s can't decode %s video", c.ID, codec)
+		c.sendJSON("error", "This browser can't decode the stream's "+codecName(codec)+" video")
+	}
+
 	// Get the peer and set up ICE candidate handler
 	peer := c.server.fanOut.GetPeer(c.ID)
 	if peer != nil {
 		c.peer = peer
+		if sess := c.server.sessionManager.GetSession(); sess != nil {
+			if participant := sess.GetParticipant(c.ID); participant != nil {
+				c.server.setAdaptiveDelivery(participant)
+			}
+		}
 		peer.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 			if candidate == nil {
 				return
@@ -471,6 +762,48 @@ func (c *Client) handleOffer(sdp SDPMessage) {
 	}
 }
 
+// setOffer records the client's offer and marks it as sent
+func (c *Client) setOffer(sdp string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offer = sdp
+	select {
+	case <-c.offerReady:
+	default:
+		close(c.offerReady)
+	}
+}
+
+func (c *Client) getOffer() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offer
+}
+
+// waitOffer waits for the client's offer, returning false after timeout
+func (c *Client) waitOffer(timeout time.Duration) bool {
+	select {
+	case <-c.offerReady:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// codecName returns the name of a video codec's MIME type
+func codecName(mimeType string) string {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH265):
+		return "HEVC"
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return "AV1"
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return "H.264"
+	}
+	return mimeType
+}
+
 func (c *Client) handleICECandidate(ice ICEMessage) {
 	candidate := webrtc.ICECandidateInit{
 		Candidate:        ice.Candidate,
@@ -0,0 +1,182 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+
+	"github.com/gamelight/gamelight/internal/config"
+	"github.com/gamelight/gamelight/pkg/session"
+	"github.com/gamelight/gamelight/pkg/sunshine"
+)
+
+// testStarter is an OnStartStream callback that blocks until released
+type testStarter struct {
+	started chan struct{}
+	release chan struct{}
+	stopped chan struct{}
+}
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server, *testStarter) {
+	t.Helper()
+
+	s, err := NewServer(config.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := &testStarter{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+		stopped: make(chan struct{}, 1),
+	}
+	s.OnStartStream(func(settings session.StreamSettings, appID int) (*sunshine.App, error) {
+		st.started <- struct{}{}
+		<-st.release
+		return &sunshine.App{ID: 1, Title: "Desktop"}, nil
+	})
+	s.OnStopStream(func() { st.stopped <- struct{}{} })
+
+	ts := httptest.NewServer(s.Router())
+	t.Cleanup(ts.Close)
+	return s, ts, st
+}
+
+func dial(t *testing.T, ts *httptest.Server) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendOffer sends an offer, so the server needn't wait for one to start
+// the stream
+func sendOffer(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	data, _ := json.Marshal(SDPMessage{SDP: "v=0"})
+	if err := conn.WriteJSON(WSMessage{Type: "offer", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readMessage reads messages until one of msgType arrives
+func readMessage(t *testing.T, conn *websocket.Conn, msgType string) WSMessage {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func wait(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestJoinWhileStreamStarts(t *testing.T) {
+	s, ts, st := newTestServer(t)
+
+	first := dial(t, ts)
+	sendOffer(t, first)
+	wait(t, st.started, "the stream to start")
+
+	// Another client joins without waiting for the stream
+	second := dial(t, ts)
+	var state SessionStateMessage
+	if err := json.Unmarshal(readMessage(t, second, "session_state").Data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Participant.IsHost {
+		t.Error("the second client is the session's host")
+	}
+
+	close(st.release)
+	for _, conn := range []*websocket.Conn{first, second} {
+		var p StreamProgress
+		if err := json.Unmarshal(readMessage(t, conn, "stream_progress").Data, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.State != StreamStarted {
+			t.Errorf("stream progress %q, want %q", p.State, StreamStarted)
+		}
+	}
+	if state := s.SessionManager().GetSession().GetState(); state.AppName != "Desktop" {
+		t.Errorf("session app %q, want Desktop", state.AppName)
+	}
+}
+
+func TestLeaveWhileStreamStarts(t *testing.T) {
+	s, ts, st := newTestServer(t)
+
+	conn := dial(t, ts)
+	sendOffer(t, conn)
+	wait(t, st.started, "the stream to start")
+
+	// The session ends without waiting for the stream
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.SessionManager().GetSession() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("session still open after its only client left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and its stream stops once it has started
+	select {
+	case <-st.stopped:
+		t.Fatal("stream stopped before it started")
+	default:
+	}
+	close(st.release)
+	wait(t, st.stopped, "the stream to stop")
+}
+
+func TestVideoCodecs(t *testing.T) {
+	s, err := NewServer(config.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if codecs, ok := s.VideoCodecs(false); ok {
+		t.Errorf("VideoCodecs without offers = %v, true", codecs)
+	}
+
+	offer := func(codec string) *Client {
+		c := &Client{offerReady: make(chan struct{})}
+		c.setOffer("m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96 " + codec + "/90000\r\n")
+		return c
+	}
+	s.clients["a"] = offer("H264")
+	if codecs, ok := s.VideoCodecs(false); !ok || len(codecs) != 1 || codecs[0] != webrtc.MimeTypeH264 {
+		t.Errorf("VideoCodecs = %v, %v; want [%s], true", codecs, ok, webrtc.MimeTypeH264)
+	}
+
+	// Browsers with no codec in common aren't taken for no offers
+	s.clients["b"] = offer("AV1")
+	if codecs, ok := s.VideoCodecs(false); !ok || len(codecs) != 0 {
+		t.Errorf("VideoCodecs = %v, %v; want none, true", codecs, ok)
+	}
+}
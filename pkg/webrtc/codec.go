@@ -0,0 +1,186 @@
+package webrtc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// VideoCodecs are the video codecs the fan-out can send, most preferred
+// first. Browsers only offer HEVC where they can decode it in hardware, so
+// it goes before AV1, which they may decode in software.
+var VideoCodecs = []string{
+	webrtc.MimeTypeH265,
+	webrtc.MimeTypeAV1,
+	webrtc.MimeTypeH264,
+}
+
+// Payload types for HEVC, which RegisterDefaultCodecs doesn't register,
+// clear of the ones it uses
+const (
+	h265PayloadType    webrtc.PayloadType = 116
+	h265RTXPayloadType webrtc.PayloadType = 117
+)
+
+// videoRTCPFeedback is the feedback RegisterDefaultCodecs offers for video
+var videoRTCPFeedback = []webrtc.RTCPFeedback{
+	{Type: "goog-remb"},
+	{Type: "ccm", Parameter: "fir"},
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+	{Type: "transport-cc"},
+}
+
+// registerH265 registers HEVC and its retransmission codec
+func registerH265(m *webrtc.MediaEngine) error {
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH265,
+			ClockRate:    90000,
+			RTCPFeedback: videoRTCPFeedback,
+		},
+		PayloadType: h265PayloadType,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeRTX,
+			ClockRate:   90000,
+			SDPFmtpLine: fmt.Sprintf("apt=%d", h265PayloadType),
+		},
+		PayloadType: h265RTXPayloadType,
+	}, webrtc.RTPCodecTypeVideo)
+}
+
+// OfferVideoCodecs returns the codecs from VideoCodecs that an SDP offer
+// can receive, most preferred first
+func OfferVideoCodecs(sdp string) []string {
+	return offerCodecs(sdp, func(offerFormat) bool { return true })
+}
+
+// OfferHDRVideoCodecs returns the codecs from OfferVideoCodecs that can
+// carry 10-bit video: HEVC when the offer includes Main 10 (profile-id=2),
+// and AV1, whose Main profile covers 10-bit
+func OfferHDRVideoCodecs(sdp string) []string {
+	return offerCodecs(sdp, func(f offerFormat) bool {
+		switch {
+		case strings.EqualFold(f.mimeType, webrtc.MimeTypeH265):
+			return f.fmtp["profile-id"] == "2"
+		case strings.EqualFold(f.mimeType, webrtc.MimeTypeAV1):
+			return true
+		}
+		return false
+	})
+}
+
+// offerFormat is a video payload format from an SDP offer
+type offerFormat struct {
+	mimeType string
+	fmtp     map[string]string
+}
+
+// offerCodecs returns the codecs from VideoCodecs with a format in the offer
+// that accept reports true for, most preferred first
+func offerCodecs(sdp string, accept func(offerFormat) bool) []string {
+	offered := make(map[string]bool)
+	for _, f := range offerVideoFormats(sdp) {
+		if accept(f) {
+			offered[strings.ToLower(f.mimeType)] = true
+		}
+	}
+
+	var codecs []string
+	for _, codec := range VideoCodecs {
+		if offered[strings.ToLower(codec)] {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+// offerVideoFormats parses the payload formats of an offer's m=video
+// sections
+func offerVideoFormats(sdp string) []offerFormat {
+	var formats []*offerFormat
+	byPayloadType := make(map[string]*offerFormat)
+
+	video := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			video = strings.HasPrefix(line, "m=video ")
+			byPayloadType = make(map[string]*offerFormat)
+			continue
+		}
+		if !video {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			// a=rtpmap:<payload type> <encoding>/<clock rate>
+			pt, encoding, ok := strings.Cut(strings.TrimPrefix(line, "a=rtpmap:"), " ")
+			if !ok {
+				continue
+			}
+			name, _, _ := strings.Cut(encoding, "/")
+			f := &offerFormat{mimeType: "video/" + name, fmtp: make(map[string]string)}
+			formats = append(formats, f)
+			byPayloadType[pt] = f
+		case strings.HasPrefix(line, "a=fmtp:"):
+			// a=fmtp:<payload type> <key>=<value>;...
+			pt, params, ok := strings.Cut(strings.TrimPrefix(line, "a=fmtp:"), " ")
+			f := byPayloadType[pt]
+			if !ok || f == nil {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				if key, value, ok := strings.Cut(param, "="); ok {
+					f.fmtp[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+				}
+			}
+		}
+	}
+
+	out := make([]offerFormat, len(formats))
+	for i, f := range formats {
+		out[i] = *f
+	}
+	return out
+}
+
+// CommonVideoCodecs returns the codecs found in every list, in the order of
+// VideoCodecs
+func CommonVideoCodecs(lists ...[]string) []string {
+	var common []string
+	for _, codec := range VideoCodecs {
+		inAll := true
+		for _, list := range lists {
+			if !containsCodec(list, codec) {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			common = append(common, codec)
+		}
+	}
+	return common
+}
+
+// OfferSupportsVideo reports whether an SDP offer can receive a video codec
+func OfferSupportsVideo(sdp, mimeType string) bool {
+	return containsCodec(OfferVideoCodecs(sdp), mimeType)
+}
+
+// containsCodec reports whether a list holds a MIME type
+func containsCodec(codecs []string, mimeType string) bool {
+	for _, codec := range codecs {
+		if strings.EqualFold(codec, mimeType) {
+			return true
+		}
+	}
+	return false
+}
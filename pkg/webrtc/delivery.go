@@ -0,0 +1,265 @@
+package webrtc
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/gcc"
+)
+
+// DeliveryMode is how much of the video a peer is sent
+type DeliveryMode int32
+
+const (
+	// DeliveryFull sends every frame
+	DeliveryFull DeliveryMode = iota
+	// DeliveryThinned drops the frames no other frame refers to
+	DeliveryThinned
+	// DeliverySlideshow sends only keyframes, which are requested every
+	// slideshowKeyframeInterval
+	DeliverySlideshow
+)
+
+// String returns the mode's name, as sent to clients
+func (m DeliveryMode) String() string {
+	switch m {
+	case DeliveryThinned:
+		return "thinned"
+	case DeliverySlideshow:
+		return "slideshow"
+	}
+	return "full"
+}
+
+// Delivery is a peer's delivery mode and the rates it was chosen from
+type Delivery struct {
+	Mode DeliveryMode
+
+	// EstimateKbps is the bandwidth estimate for the peer's link
+	EstimateKbps int
+	// StreamKbps is the bitrate of the video from the host
+	StreamKbps int
+}
+
+const (
+	// deliveryInterval is how often the peers' delivery modes are updated
+	deliveryInterval = time.Second
+
+	// congestionHold is how long a peer must be congested before its mode
+	// steps down. A peer counts as congested while its estimate is below
+	// the stream bitrate and its estimator has seen overuse or loss within
+	// decreaseWindow. An estimate still rising from where it started, or
+	// following the lower rate of a thinned stream, doesn't count.
+	congestionHold = 3 * time.Second
+	decreaseWindow = 5 * time.Second
+
+	// congestionLoss is the packet loss above which GCC cuts its estimate
+	congestionLoss = 0.1
+
+	// A peer whose estimate doesn't recover steps up to probe its link,
+	// first after probeBackoff. A step down within probeWindow of a step up
+	// doubles the wait, up to maxProbeBackoff.
+	probeBackoff    = 5 * time.Second
+	probeWindow     = 10 * time.Second
+	maxProbeBackoff = time.Minute
+
+	// slideshowKeyframeInterval is how often keyframes are requested while
+	// a peer is in slideshow mode. Every peer gets them, so they are kept
+	// rare.
+	slideshowKeyframeInterval = 5 * time.Second
+)
+
+// Bandwidth estimator bounds. It starts from the stream bitrate, or
+// defaultInitialEstimate before there is one.
+const (
+	defaultInitialEstimate = 5_000_000
+	minEstimate            = 100_000
+	maxEstimate            = 500_000_000
+)
+
+// deliveryPolicy chooses a peer's delivery mode from its bandwidth estimate
+type deliveryPolicy struct {
+	mode DeliveryMode
+
+	// congestedSince is when the peer became congested, zero if it isn't
+	congestedSince time.Time
+
+	// nextStepUp is when the mode steps up even if the estimate hasn't
+	// recovered; steppedUp is when it last did
+	nextStepUp time.Time
+	steppedUp  time.Time
+	backoff    time.Duration
+
+	// lastDecrease is when the estimator last cut its estimate for
+	// congestion, in Unix nanoseconds. It reports changes from its own
+	// goroutine.
+	lastDecrease atomic.Int64
+}
+
+// onEstimate records a change of the peer's estimate, with the estimator's
+// stats at the time
+func (d *deliveryPolicy) onEstimate(stats map[string]interface{}) {
+	state, _ := stats["state"].(string)
+	loss, _ := stats["averageLoss"].(float64)
+	if state == "decrease" || loss > congestionLoss {
+		d.lastDecrease.Store(time.Now().UnixNano())
+	}
+}
+
+// update steps the mode for the peer's estimate and the stream's bitrate.
+// thinnable reports whether the stream has frames DeliveryThinned can drop;
+// if not, that mode is skipped.
+func (d *deliveryPolicy) update(now time.Time, estimate, bitrate int, thinnable bool) {
+	if d.backoff == 0 {
+		d.backoff = probeBackoff
+	}
+
+	fell := now.Sub(time.Unix(0, d.lastDecrease.Load())) < decreaseWindow
+	congested := bitrate > 0 && estimate < bitrate && fell
+	if !congested {
+		d.congestedSince = time.Time{}
+	} else if d.congestedSince.IsZero() {
+		d.congestedSince = now
+	}
+
+	switch {
+	case congested && now.Sub(d.congestedSince) >= congestionHold && d.mode < DeliverySlideshow:
+		if !d.steppedUp.IsZero() && now.Sub(d.steppedUp) < probeWindow {
+			d.backoff = min(2*d.backoff, maxProbeBackoff)
+			d.steppedUp = time.Time{}
+		}
+		d.mode++
+		if d.mode == DeliveryThinned && !thinnable {
+			d.mode = DeliverySlideshow
+		}
+		d.congestedSince = now
+		d.nextStepUp = now.Add(d.backoff)
+
+	case !congested && d.mode > DeliveryFull && (estimate >= bitrate || !now.Before(d.nextStepUp)):
+		d.mode--
+		if d.mode == DeliveryThinned && !thinnable {
+			d.mode = DeliveryFull
+		}
+		d.steppedUp = now
+		d.nextStepUp = now.Add(d.backoff)
+
+	case d.mode == DeliveryFull && now.Sub(d.steppedUp) >= maxProbeBackoff:
+		d.backoff = probeBackoff
+	}
+}
+
+// reset returns to full delivery
+func (d *deliveryPolicy) reset() {
+	d.mode = DeliveryFull
+	d.congestedSince = time.Time{}
+	d.nextStepUp = time.Time{}
+	d.steppedUp = time.Time{}
+	d.backoff = probeBackoff
+}
+
+// rtxEstimator is a GCC estimator whose pacer also takes the
+// retransmissions the video interceptor sends on a stream's RTX SSRC,
+// which it would otherwise refuse as an unknown stream
+type rtxEstimator struct {
+	*gcc.SendSideBWE
+}
+
+// AddStream implements cc.BandwidthEstimator
+func (e rtxEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if info.SSRCRetransmission != 0 {
+		rtx := *info
+		rtx.SSRC = info.SSRCRetransmission
+		e.SendSideBWE.AddStream(&rtx, writer)
+	}
+	return e.SendSideBWE.AddStream(info, writer)
+}
+
+// SetAdaptiveDelivery sets whether a peer's video is thinned out when its
+// link can't carry the stream. Players' peers should always get every
+// frame; the host's bitrate never changes for any peer.
+func (f *FanOut) SetAdaptiveDelivery(peerID string, enabled bool) {
+	if peer := f.GetPeer(peerID); peer != nil {
+		peer.adaptive.Store(enabled)
+	}
+}
+
+// OnDeliveryChange sets the callback for when a peer's delivery mode
+// changes
+func (f *FanOut) OnDeliveryChange(fn func(peerID string, delivery Delivery)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onDeliveryChange = fn
+}
+
+// deliveryLoop updates the peers' delivery modes until the fan-out is
+// closed, asking for keyframes while any peer is in slideshow mode
+func (f *FanOut) deliveryLoop() {
+	ticker := time.NewTicker(deliveryInterval)
+	defer ticker.Stop()
+
+	var lastKeyframe time.Time
+	for {
+		select {
+		case <-f.done:
+			return
+		case now := <-ticker.C:
+			if f.updateDelivery(now) && now.Sub(lastKeyframe) >= slideshowKeyframeInterval {
+				lastKeyframe = now
+				f.RequestKeyframe()
+			}
+		}
+	}
+}
+
+// updateDelivery updates each peer's delivery mode, reporting whether any
+// peer is in slideshow mode
+func (f *FanOut) updateDelivery(now time.Time) bool {
+	bitrate, thinnable := f.video.rate()
+
+	f.mu.RLock()
+	peers := make([]*Peer, 0, len(f.peers))
+	for _, peer := range f.peers {
+		peers = append(peers, peer)
+	}
+	fn := f.onDeliveryChange
+	f.mu.RUnlock()
+
+	slideshow := false
+	for _, peer := range peers {
+		if peer.estimator == nil || peer.video == nil {
+			continue
+		}
+
+		estimate := peer.estimator.GetTargetBitrate()
+		prev := peer.delivery.mode
+		if peer.adaptive.Load() {
+			peer.delivery.update(now, estimate, bitrate, thinnable)
+		} else {
+			peer.delivery.reset()
+		}
+		mode := peer.delivery.mode
+
+		if mode != prev {
+			log.Printf("Peer %s video delivery: %s (estimate %d kbps, stream %d kbps)", peer.ID, mode, estimate/1000, bitrate/1000)
+			peer.video.setMode(mode)
+
+			// The peer waits for a keyframe to resume
+			if prev == DeliverySlideshow {
+				f.RequestKeyframe()
+			}
+			if fn != nil {
+				fn(peer.ID, Delivery{
+					Mode:         mode,
+					EstimateKbps: estimate / 1000,
+					StreamKbps:   bitrate / 1000,
+				})
+			}
+		}
+		if mode == DeliverySlideshow {
+			slideshow = true
+		}
+	}
+	return slideshow
+}
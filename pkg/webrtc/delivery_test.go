@@ -0,0 +1,116 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+)
+
+const testBitrate = 10_000_000
+
+// policyStep is an update of a delivery policy, a number of seconds into a
+// test
+type policyStep struct {
+	second    int
+	estimate  int
+	decreased bool // whether the estimator cut its estimate just before
+	want      DeliveryMode
+}
+
+func runPolicy(t *testing.T, d *deliveryPolicy, thinnable bool, steps []policyStep) {
+	t.Helper()
+
+	start := time.Unix(1000, 0)
+	for _, step := range steps {
+		now := start.Add(time.Duration(step.second) * time.Second)
+		if step.decreased {
+			d.lastDecrease.Store(now.UnixNano())
+		}
+		d.update(now, step.estimate, testBitrate, thinnable)
+		if d.mode != step.want {
+			t.Fatalf("at %ds: mode %s, want %s", step.second, d.mode, step.want)
+		}
+	}
+}
+
+func TestDeliveryPolicyStepsDownAndUp(t *testing.T) {
+	d := &deliveryPolicy{}
+	runPolicy(t, d, true, []policyStep{
+		// Congestion must last congestionHold for each step down
+		{0, 5_000_000, true, DeliveryFull},
+		{2, 5_000_000, true, DeliveryFull},
+		{3, 5_000_000, true, DeliveryThinned},
+		{5, 5_000_000, true, DeliveryThinned},
+		{6, 5_000_000, true, DeliverySlideshow},
+		{7, 5_000_000, true, DeliverySlideshow},
+		// An estimate back at the stream bitrate steps up at once
+		{8, testBitrate, false, DeliveryThinned},
+		{9, testBitrate, false, DeliveryFull},
+		{10, testBitrate, false, DeliveryFull},
+	})
+}
+
+func TestDeliveryPolicySkipsThinned(t *testing.T) {
+	d := &deliveryPolicy{}
+	runPolicy(t, d, false, []policyStep{
+		{0, 5_000_000, true, DeliveryFull},
+		{3, 5_000_000, true, DeliverySlideshow},
+		{4, testBitrate, false, DeliveryFull},
+	})
+}
+
+func TestDeliveryPolicyIgnoresLowEstimateWithoutDecrease(t *testing.T) {
+	// An estimate still rising from where it started isn't congestion
+	d := &deliveryPolicy{}
+	runPolicy(t, d, true, []policyStep{
+		{0, 1_000_000, false, DeliveryFull},
+		{5, 1_000_000, false, DeliveryFull},
+	})
+
+	// and neither is a decrease without a stream to compare with
+	d.lastDecrease.Store(time.Unix(1010, 0).UnixNano())
+	d.update(time.Unix(1010, 0), 1_000_000, 0, true)
+	d.update(time.Unix(1020, 0), 1_000_000, 0, true)
+	if d.mode != DeliveryFull {
+		t.Errorf("mode %s without a stream, want %s", d.mode, DeliveryFull)
+	}
+}
+
+func TestDeliveryPolicyProbeBackoff(t *testing.T) {
+	d := &deliveryPolicy{}
+	runPolicy(t, d, true, []policyStep{
+		{0, 5_000_000, true, DeliveryFull},
+		{3, 5_000_000, true, DeliveryThinned},
+		// The estimate doesn't recover, but the decreases stop, so the
+		// mode steps up to probe once the backoff has passed
+		{8, 5_000_000, false, DeliveryFull},
+		// Congestion again within probeWindow doubles the backoff
+		{9, 5_000_000, true, DeliveryFull},
+		{12, 5_000_000, true, DeliveryThinned},
+		{17, 5_000_000, false, DeliveryThinned},
+		{21, 5_000_000, false, DeliveryThinned},
+		{22, 5_000_000, false, DeliveryFull},
+	})
+	if d.backoff != 2*probeBackoff {
+		t.Errorf("backoff %s, want %s", d.backoff, 2*probeBackoff)
+	}
+
+	// A minute in full delivery restores it
+	runPolicy(t, d, true, []policyStep{{82, testBitrate, false, DeliveryFull}})
+	if d.backoff != probeBackoff {
+		t.Errorf("backoff %s after a minute, want %s", d.backoff, probeBackoff)
+	}
+}
+
+func TestDeliveryPolicyReset(t *testing.T) {
+	d := &deliveryPolicy{}
+	runPolicy(t, d, true, []policyStep{
+		{0, 5_000_000, true, DeliveryFull},
+		{3, 5_000_000, true, DeliveryThinned},
+		{6, 5_000_000, true, DeliverySlideshow},
+	})
+
+	d.reset()
+	if d.mode != DeliveryFull || d.backoff != probeBackoff || !d.congestedSince.IsZero() {
+		t.Errorf("after reset: mode %s, backoff %s, congested since %v", d.mode, d.backoff, d.congestedSince)
+	}
+}
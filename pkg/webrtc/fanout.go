@@ -2,16 +2,29 @@ package webrtc
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
 	"github.com/pion/interceptor/pkg/intervalpli"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 
 	"github.com/gamelight/gamelight/internal/config"
 )
 
+// multiopusPayloadTypes are the payload types for multiopus codecs, clear of
+// the ones RegisterDefaultCodecs uses
+var multiopusPayloadTypes = map[int]webrtc.PayloadType{
+	6: 114,
+	8: 115,
+}
+
 var (
 	ErrNoVideoTrack = errors.New("no video track available")
 	ErrNoAudioTrack = errors.New("no audio track available")
@@ -21,18 +34,50 @@ var (
 type FanOut struct {
 	mu sync.RWMutex
 
-	api    *webrtc.API
-	config webrtc.Configuration
+	media    *webrtc.MediaEngine
+	settings webrtc.SettingEngine
+	config   webrtc.Configuration
+
+	// interceptors are the interceptors every peer connection has, besides
+	// its own estimator and video interceptor
+	interceptors sharedInterceptors
 
 	// Source tracks from Sunshine
 	videoTrack *webrtc.TrackLocalStaticRTP
 	audioTrack *webrtc.TrackLocalStaticRTP
 
+	// surroundTrack carries multiopus audio for peers that offer it; the
+	// others get audioTrack
+	surroundTrack *webrtc.TrackLocalStaticRTP
+
 	// Connected peers
 	peers map[string]*Peer
 
+	// keyframes coalesces the peers' keyframe requests
+	keyframes keyframeRequester
+
+	// history keeps recent video packets to answer the peers' NACKs
+	history *rtpHistory
+
+	// video follows the frames written, for the peers' delivery modes
+	video *videoStats
+
+	// done is closed when the fan-out is closed
+	done chan struct{}
+
 	// Callbacks
-	onDataMessage func(peerID string, channel string, data []byte)
+	onDataMessage    func(peerID string, channel string, data []byte)
+	onDeliveryChange func(peerID string, delivery Delivery)
+}
+
+// sharedInterceptors builds the interceptors of a registry as one
+type sharedInterceptors struct {
+	*interceptor.Registry
+}
+
+// NewInterceptor implements interceptor.Factory
+func (s sharedInterceptors) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return s.Build(id)
 }
 
 // Peer represents a connected WebRTC peer
@@ -43,6 +88,17 @@ type Peer struct {
 	videoSender *webrtc.RTPSender
 	audioSender *webrtc.RTPSender
 
+	// offer is the peer's SDP offer, used to pick its audio track
+	offer string
+
+	// estimator estimates the bandwidth of the peer's link. If adaptive is
+	// set, delivery picks from it how much video the peer is sent, and
+	// video sends that much.
+	estimator cc.BandwidthEstimator
+	video     *videoInterceptor
+	adaptive  atomic.Bool
+	delivery  deliveryPolicy
+
 	dataChannels map[string]*webrtc.DataChannel
 	mu           sync.RWMutex
 }
@@ -57,7 +113,31 @@ func NewFanOut(cfg *config.WebRTCConfig) (*FanOut, error) {
 		return nil, err
 	}
 
-	// Create interceptor registry
+	// Register HEVC, which browsers with hardware decoders offer
+	if err := registerH265(m); err != nil {
+		return nil, err
+	}
+
+	// Register multiopus for surround audio
+	for channels, payloadType := range multiopusPayloadTypes {
+		codec, _ := MultiopusCodec(channels)
+		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: codec,
+			PayloadType:        payloadType,
+		}, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &FanOut{
+		peers:   make(map[string]*Peer),
+		history: &rtpHistory{},
+		video:   &videoStats{},
+		done:    make(chan struct{}),
+	}
+
+	// Create the registry of the interceptors all peers have. Each peer's
+	// connection adds its own, in newPeerConnection.
 	i := &interceptor.Registry{}
 
 	// Add PLI interceptor for keyframe requests
@@ -67,8 +147,27 @@ func NewFanOut(cfg *config.WebRTCConfig) (*FanOut, error) {
 	}
 	i.Add(intervalPliFactory)
 
-	// Use default interceptors
-	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, err
+	}
+
+	// Use the default interceptors, except that NACKs are answered from
+	// one packet history for all peers rather than a copy for each
+	nackGenerator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	i.Add(nackGenerator)
+
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureTWCCSender(m, i); err != nil {
 		return nil, err
 	}
 
@@ -78,13 +177,6 @@ func NewFanOut(cfg *config.WebRTCConfig) (*FanOut, error) {
 		s.SetEphemeralUDPPortRange(cfg.PortRange.Min, cfg.PortRange.Max)
 	}
 
-	// Build API
-	api := webrtc.NewAPI(
-		webrtc.WithMediaEngine(m),
-		webrtc.WithInterceptorRegistry(i),
-		webrtc.WithSettingEngine(s),
-	)
-
 	// Convert ICE servers
 	iceServers := make([]webrtc.ICEServer, 0, len(cfg.ICEServers))
 	for _, server := range cfg.ICEServers {
@@ -99,13 +191,16 @@ func NewFanOut(cfg *config.WebRTCConfig) (*FanOut, error) {
 		iceServers = append(iceServers, ice)
 	}
 
-	return &FanOut{
-		api: api,
-		config: webrtc.Configuration{
-			ICEServers: iceServers,
-		},
-		peers: make(map[string]*Peer),
-	}, nil
+	f.media = m
+	f.settings = s
+	f.interceptors = sharedInterceptors{i}
+	f.config = webrtc.Configuration{
+		ICEServers: iceServers,
+	}
+
+	go f.deliveryLoop()
+
+	return f, nil
 }
 
 // SetVideoTrack sets the video track that will be fanned out to all peers
@@ -114,48 +209,109 @@ func (f *FanOut) SetVideoTrack(track *webrtc.TrackLocalStaticRTP) {
 	f.videoTrack = track
 	f.mu.Unlock()
 
-	// Add to existing peers
+	// The new track's sequence numbers start afresh
+	f.history.reset()
+
+	// Add to existing peers, or swap it in for a previous stream's track
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
 	for _, peer := range f.peers {
-		if peer.videoSender == nil {
-			sender, err := peer.Connection.AddTrack(track)
-			if err != nil {
-				log.Printf("Error adding video track to peer %s: %v", peer.ID, err)
-				continue
-			}
-			peer.videoSender = sender
-
-			// Handle RTCP
-			go f.handleRTCP(sender)
+		if err := f.attachTrack(peer, &peer.videoSender, track); err != nil {
+			log.Printf("Error adding video track to peer %s: %v", peer.ID, err)
 		}
 	}
 }
 
+// VideoCodec returns the MIME type of the video being fanned out, or "" if
+// there is no video track
+func (f *FanOut) VideoCodec() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.videoTrack == nil {
+		return ""
+	}
+	return f.videoTrack.Codec().MimeType
+}
+
 // SetAudioTrack sets the audio track that will be fanned out to all peers
 func (f *FanOut) SetAudioTrack(track *webrtc.TrackLocalStaticRTP) {
 	f.mu.Lock()
 	f.audioTrack = track
 	f.mu.Unlock()
 
-	// Add to existing peers
+	// Add to existing peers, or swap it in for a previous stream's track
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
 	for _, peer := range f.peers {
-		if peer.audioSender == nil {
-			sender, err := peer.Connection.AddTrack(track)
-			if err != nil {
-				log.Printf("Error adding audio track to peer %s: %v", peer.ID, err)
-				continue
-			}
-			peer.audioSender = sender
+		if f.peerAudioTrackLocked(peer) != track {
+			continue
+		}
+		if err := f.attachTrack(peer, &peer.audioSender, track); err != nil {
+			log.Printf("Error adding audio track to peer %s: %v", peer.ID, err)
+		}
+	}
+}
 
-			// Handle RTCP
-			go f.handleRTCP(sender)
+// SetSurroundAudioTrack sets the multiopus audio track sent to peers that
+// support it. A nil track sends stereo to everyone.
+func (f *FanOut) SetSurroundAudioTrack(track *webrtc.TrackLocalStaticRTP) {
+	f.mu.Lock()
+	f.surroundTrack = track
+	f.mu.Unlock()
+
+	if track == nil {
+		return
+	}
+
+	// Add to existing peers, or swap it in for a previous stream's track
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, peer := range f.peers {
+		if f.peerAudioTrackLocked(peer) != track {
+			continue
+		}
+		if err := f.attachTrack(peer, &peer.audioSender, track); err != nil {
+			log.Printf("Error adding surround audio track to peer %s: %v", peer.ID, err)
+		}
+	}
+}
+
+// attachTrack sends a track to a peer through one of its senders. The
+// first track is added to the connection; a relaunched stream's track is
+// swapped in, keeping the negotiated connection.
+func (f *FanOut) attachTrack(peer *Peer, sender **webrtc.RTPSender, track *webrtc.TrackLocalStaticRTP) error {
+	if *sender != nil {
+		if (*sender).Track() == track {
+			return nil
+		}
+		if err := (*sender).ReplaceTrack(track); err != nil {
+			log.Printf("Error replacing %s track for peer %s: %v", track.Kind(), peer.ID, err)
 		}
+		return nil
+	}
+
+	added, err := peer.Connection.AddTrack(track)
+	if err != nil {
+		return err
+	}
+	*sender = added
+
+	// Handle RTCP
+	go f.handleRTCP(added)
+	return nil
+}
+
+// peerAudioTrackLocked returns the audio track for a peer: the surround
+// track if its offer lists the matching multiopus codec, else stereo
+func (f *FanOut) peerAudioTrackLocked(peer *Peer) *webrtc.TrackLocalStaticRTP {
+	if f.surroundTrack != nil && offerSupports(peer.offer, f.surroundTrack.Codec()) {
+		return f.surroundTrack
 	}
+	return f.audioTrack
 }
 
 // OnDataMessage sets the callback for incoming data channel messages
@@ -165,43 +321,61 @@ func (f *FanOut) OnDataMessage(fn func(peerID string, channel string, data []byt
 	f.onDataMessage = fn
 }
 
+// OnKeyframeRequest sets the callback that asks the host for a keyframe.
+// Requests from peers are coalesced, so it runs at most once per
+// keyframeInterval.
+func (f *FanOut) OnKeyframeRequest(fn func()) {
+	f.keyframes.setOnRequest(fn)
+}
+
+// RequestKeyframe asks the host for a keyframe on behalf of all peers
+func (f *FanOut) RequestKeyframe() {
+	f.keyframes.request()
+}
+
 // AddPeer creates a new peer connection
 func (f *FanOut) AddPeer(id string) (*Peer, error) {
+	return f.addPeer(id, "")
+}
+
+// addPeer creates a new peer connection for an SDP offer
+func (f *FanOut) addPeer(id, offer string) (*Peer, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	peer := &Peer{
+		ID:           id,
+		offer:        offer,
+		dataChannels: make(map[string]*webrtc.DataChannel),
+	}
+
 	// Create peer connection
-	pc, err := f.api.NewPeerConnection(f.config)
+	pc, err := f.newPeerConnection(peer)
 	if err != nil {
 		return nil, err
 	}
+	peer.Connection = pc
 
-	peer := &Peer{
-		ID:           id,
-		Connection:   pc,
-		dataChannels: make(map[string]*webrtc.DataChannel),
+	if estimator := peer.estimator; estimator != nil {
+		estimator.OnTargetBitrateChange(func(int) {
+			peer.delivery.onEstimate(estimator.GetStats())
+		})
 	}
 
 	// Add video track if available
 	if f.videoTrack != nil {
-		sender, err := pc.AddTrack(f.videoTrack)
-		if err != nil {
+		if err := f.attachTrack(peer, &peer.videoSender, f.videoTrack); err != nil {
 			pc.Close()
 			return nil, err
 		}
-		peer.videoSender = sender
-		go f.handleRTCP(sender)
 	}
 
 	// Add audio track if available
-	if f.audioTrack != nil {
-		sender, err := pc.AddTrack(f.audioTrack)
-		if err != nil {
+	if track := f.peerAudioTrackLocked(peer); track != nil {
+		if err := f.attachTrack(peer, &peer.audioSender, track); err != nil {
 			pc.Close()
 			return nil, err
 		}
-		peer.audioSender = sender
-		go f.handleRTCP(sender)
 	}
 
 	// Handle incoming data channels
@@ -225,6 +399,12 @@ func (f *FanOut) AddPeer(id string) (*Peer, error) {
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("Peer %s connection state: %s", id, state)
 
+		// A peer joining mid-stream can't decode until the next keyframe,
+		// so ask for one rather than wait for its PLI
+		if state == webrtc.PeerConnectionStateConnected {
+			f.RequestKeyframe()
+		}
+
 		if state == webrtc.PeerConnectionStateFailed ||
 			state == webrtc.PeerConnectionStateClosed ||
 			state == webrtc.PeerConnectionStateDisconnected {
@@ -236,6 +416,59 @@ func (f *FanOut) AddPeer(id string) (*Peer, error) {
 	return peer, nil
 }
 
+// newPeerConnection creates a peer's connection. Its interceptors are the
+// shared ones between the peer's own bandwidth estimator and video
+// interceptor, which are set on the peer as they are created.
+func (f *FanOut) newPeerConnection(peer *Peer) (*webrtc.PeerConnection, error) {
+	// Estimate the peer's bandwidth with GCC from its TWCC feedback. The
+	// estimate only picks which frames the peer is sent, so packets aren't
+	// paced.
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		initial, _ := f.video.rate()
+		if initial == 0 {
+			initial = defaultInitialEstimate
+		}
+		bwe, err := gcc.NewSendSideBWE(
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+			gcc.SendSideBWEInitialBitrate(initial),
+			gcc.SendSideBWEMinBitrate(minEstimate),
+			gcc.SendSideBWEMaxBitrate(maxEstimate),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return rtxEstimator{bwe}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		peer.estimator = estimator
+	})
+
+	i := &interceptor.Registry{}
+	i.Add(congestionController)
+	i.Add(f.interceptors)
+
+	// Added last, the video interceptor sees packets as the track writes
+	// them, so frames it drops get no transport-wide sequence numbers and
+	// aren't counted by the estimator
+	i.Add(&videoInterceptorFactory{
+		history: f.history,
+		frames:  f.video,
+		onNew: func(v *videoInterceptor) {
+			peer.video = v
+		},
+	})
+
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(f.media),
+		webrtc.WithInterceptorRegistry(i),
+		webrtc.WithSettingEngine(f.settings),
+	)
+	return api.NewPeerConnection(f.config)
+}
+
 // RemovePeer removes a peer connection
 func (f *FanOut) RemovePeer(id string) {
 	f.mu.Lock()
@@ -269,7 +502,7 @@ func (f *FanOut) HandleOffer(peerID string, offer webrtc.SessionDescription) (*w
 	peer := f.GetPeer(peerID)
 	if peer == nil {
 		var err error
-		peer, err = f.AddPeer(peerID)
+		peer, err = f.addPeer(peerID, offer.SDP)
 		if err != nil {
 			return nil, err
 		}
@@ -347,15 +580,20 @@ func (p *Peer) SendDataChannel(label string, data []byte) error {
 	return dc.Send(data)
 }
 
-// handleRTCP handles RTCP packets from receivers
+// handleRTCP handles RTCP packets from receivers. Keyframe requests are
+// passed on to the host; the interceptors deal with the rest.
 func (f *FanOut) handleRTCP(sender *webrtc.RTPSender) {
-	rtcpBuf := make([]byte, 1500)
 	for {
-		if _, _, err := sender.Read(rtcpBuf); err != nil {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
 			return
 		}
-		// RTCP packets are handled automatically by pion
-		// This goroutine just needs to drain the channel
+		for _, pkt := range packets {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				f.RequestKeyframe()
+			}
+		}
 	}
 }
 
@@ -392,21 +630,40 @@ func (f *FanOut) Close() {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
+	}
+
 	for _, peer := range f.peers {
 		peer.Connection.Close()
 	}
 	f.peers = make(map[string]*Peer)
 }
 
-// CreateVideoTrack creates a new video track for the given codec
+// CreateVideoTrack creates a new video track for one of VideoCodecs
 func CreateVideoTrack(codecMimeType string) (*webrtc.TrackLocalStaticRTP, error) {
+	if !containsCodec(VideoCodecs, codecMimeType) {
+		return nil, fmt.Errorf("unsupported video codec %s", codecMimeType)
+	}
 	return webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: codecMimeType},
+		webrtc.RTPCodecCapability{MimeType: codecMimeType, ClockRate: 90000},
 		"video",
 		"gamelight-video",
 	)
 }
 
+// CreateSurroundAudioTrack creates a multiopus audio track for a channel
+// count
+func CreateSurroundAudioTrack(channels int) (*webrtc.TrackLocalStaticRTP, error) {
+	codec, ok := MultiopusCodec(channels)
+	if !ok {
+		return nil, fmt.Errorf("no multiopus layout for %d channels", channels)
+	}
+	return webrtc.NewTrackLocalStaticRTP(codec, "audio", "gamelight-audio")
+}
+
 // CreateAudioTrack creates a new audio track
 func CreateAudioTrack() (*webrtc.TrackLocalStaticRTP, error) {
 	return webrtc.NewTrackLocalStaticRTP(
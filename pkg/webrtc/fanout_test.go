@@ -0,0 +1,52 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+
+	"github.com/gamelight/gamelight/internal/config"
+)
+
+func TestSetTracksReplacesPeersTracks(t *testing.T) {
+	f, err := NewFanOut(&config.WebRTCConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	peer, err := f.AddPeer("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first stream's tracks are added, a relaunch's swapped in
+	var videoSender, audioSender *webrtc.RTPSender
+	for i := 0; i < 2; i++ {
+		video, err := CreateVideoTrack(webrtc.MimeTypeH264)
+		if err != nil {
+			t.Fatal(err)
+		}
+		audio, err := CreateAudioTrack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.SetVideoTrack(video)
+		f.SetAudioTrack(audio)
+
+		if peer.videoSender == nil || peer.videoSender.Track() != video {
+			t.Fatalf("stream %d: peer isn't sent the video track", i)
+		}
+		if peer.audioSender == nil || peer.audioSender.Track() != audio {
+			t.Fatalf("stream %d: peer isn't sent the audio track", i)
+		}
+		if i > 0 && (peer.videoSender != videoSender || peer.audioSender != audioSender) {
+			t.Errorf("stream %d: tracks were added rather than replaced", i)
+		}
+		videoSender, audioSender = peer.videoSender, peer.audioSender
+	}
+
+	if n := len(peer.Connection.GetSenders()); n != 2 {
+		t.Errorf("peer has %d senders, want 2", n)
+	}
+}
@@ -0,0 +1,267 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// videoInterceptorFactory creates the video interceptor for each peer
+// connection
+type videoInterceptorFactory struct {
+	history *rtpHistory
+	frames  *videoStats
+
+	// onNew is called with each interceptor created
+	onNew func(v *videoInterceptor)
+}
+
+// NewInterceptor implements interceptor.Factory
+func (f *videoInterceptorFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	v := &videoInterceptor{
+		history: f.history,
+		frames:  f.frames,
+		streams: make(map[uint32]*videoStream),
+	}
+	if f.onNew != nil {
+		f.onNew(v)
+	}
+	return v, nil
+}
+
+// videoInterceptor sends one peer the video its delivery mode allows, and
+// answers its generic NACKs with packets from the shared history, as RTX
+// where the peer negotiated it
+type videoInterceptor struct {
+	interceptor.NoOp
+
+	history *rtpHistory
+	frames  *videoStats
+
+	// mode is the peer's DeliveryMode
+	mode atomic.Int32
+
+	mu      sync.Mutex
+	streams map[uint32]*videoStream // by media SSRC
+}
+
+// seqPair maps a sequence number the peer sees to the track's
+type seqPair struct {
+	peer, track uint16
+	ok          bool
+}
+
+// videoStream is a video stream sent to the peer. Frames dropped for the
+// peer leave no gap in the sequence numbers it sees, so it doesn't NACK
+// them; seqs maps those back to the track's for the history.
+type videoStream struct {
+	ssrc        uint32
+	payloadType uint8
+	nack        bool
+
+	// Zero without RTX
+	rtxSSRC        uint32
+	rtxPayloadType uint8
+	rtxSequencer   rtp.Sequencer
+
+	writer interceptor.RTPWriter
+
+	mu sync.Mutex
+
+	// The frame being written and whether it is dropped
+	started   bool
+	timestamp uint32
+	dropping  bool
+
+	// mode is the delivery mode of the last frame; a peer leaving
+	// slideshow mode waits for a keyframe
+	mode         DeliveryMode
+	waitKeyframe bool
+
+	// dropped counts the packets dropped, the offset from the track's
+	// sequence numbers to the peer's
+	dropped uint16
+	seqs    [rtpHistorySize]seqPair
+}
+
+// setMode sets the peer's delivery mode, from the next frame on
+func (v *videoInterceptor) setMode(mode DeliveryMode) {
+	v.mode.Store(int32(mode))
+}
+
+// BindLocalStream filters the video packets sent to the peer and records
+// them for NACKs
+func (v *videoInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+
+	stream := &videoStream{
+		ssrc:           info.SSRC,
+		payloadType:    info.PayloadType,
+		nack:           supportsNack(info),
+		rtxSSRC:        info.SSRCRetransmission,
+		rtxPayloadType: info.PayloadTypeRetransmission,
+		rtxSequencer:   rtp.NewRandomSequencer(),
+		writer:         writer,
+	}
+	v.mu.Lock()
+	v.streams[info.SSRC] = stream
+	v.mu.Unlock()
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if stream.nack {
+			v.history.add(header, payload)
+		}
+
+		seq, ok := stream.admit(header, DeliveryMode(v.mode.Load()), v.frames)
+		if !ok {
+			return header.MarshalSize() + len(payload), nil
+		}
+
+		// The track shares the header between peers
+		out := *header
+		out.SequenceNumber = seq
+		return writer.Write(&out, payload, attributes)
+	})
+}
+
+// UnbindLocalStream forgets a stream that is no longer sent
+func (v *videoInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.streams, info.SSRC)
+}
+
+// BindRTCPReader answers the NACKs in the peer's RTCP
+func (v *videoInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		i, attr, err := reader.Read(b, a)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if attr == nil {
+			attr = make(interceptor.Attributes)
+		}
+		packets, err := attr.GetRTCPPackets(b[:i])
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, pkt := range packets {
+			if nack, ok := pkt.(*rtcp.TransportLayerNack); ok {
+				v.resend(nack)
+			}
+		}
+
+		return i, attr, nil
+	})
+}
+
+// resend sends the packets a NACK asks for that are still in the history.
+// The peer asks for a keyframe if it can't recover the rest.
+func (v *videoInterceptor) resend(nack *rtcp.TransportLayerNack) {
+	v.mu.Lock()
+	stream := v.streams[nack.MediaSSRC]
+	v.mu.Unlock()
+	if stream == nil || !stream.nack {
+		return
+	}
+
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			trackSeq, ok := stream.trackSeq(seq)
+			if !ok {
+				continue
+			}
+			pkt := v.history.get(trackSeq)
+			if pkt == nil {
+				continue
+			}
+			header, payload := stream.retransmission(pkt, seq)
+			stream.writer.Write(&header, payload, nil)
+		}
+	}
+}
+
+// admit decides whether a packet is sent to the peer, for the whole frame
+// on its first packet, and returns the sequence number the peer sees
+func (s *videoStream) admit(header *rtp.Header, mode DeliveryMode, frames *videoStats) (uint16, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started || header.Timestamp != s.timestamp {
+		s.started = true
+		s.timestamp = header.Timestamp
+		s.dropping = s.drop(mode, frames.frameKind(header.Timestamp))
+	}
+	if s.dropping {
+		s.dropped++
+		return 0, false
+	}
+
+	seq := header.SequenceNumber - s.dropped
+	s.seqs[int(seq)%rtpHistorySize] = seqPair{peer: seq, track: header.SequenceNumber, ok: true}
+	return seq, true
+}
+
+// drop decides whether to drop a frame in a delivery mode
+func (s *videoStream) drop(mode DeliveryMode, kind frameKind) bool {
+	// The frames after slideshow mode refer to ones the peer missed
+	if s.mode == DeliverySlideshow && mode != DeliverySlideshow {
+		s.waitKeyframe = true
+	}
+	s.mode = mode
+
+	if kind == frameKey {
+		s.waitKeyframe = false
+		return false
+	}
+	switch {
+	case s.waitKeyframe, mode == DeliverySlideshow:
+		return true
+	case mode == DeliveryThinned:
+		return kind == frameNonReference
+	}
+	return false
+}
+
+// trackSeq returns the track's sequence number for one the peer saw
+func (s *videoStream) trackSeq(seq uint16) (uint16, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pair := s.seqs[int(seq)%rtpHistorySize]
+	if !pair.ok || pair.peer != seq {
+		return 0, false
+	}
+	return pair.track, true
+}
+
+// retransmission builds the packet to resend, with the sequence number the
+// peer saw: per RFC 4588 with it in front of the payload if the peer
+// negotiated RTX, else the original packet
+func (s *videoStream) retransmission(pkt *historyPacket, seq uint16) (rtp.Header, []byte) {
+	header := pkt.header
+	if s.rtxSSRC == 0 || s.rtxPayloadType == 0 {
+		header.SSRC = s.ssrc
+		header.PayloadType = s.payloadType
+		header.SequenceNumber = seq
+		return header, pkt.payload
+	}
+
+	payload := make([]byte, 2+len(pkt.payload))
+	binary.BigEndian.PutUint16(payload, seq)
+	copy(payload[2:], pkt.payload)
+
+	header.SSRC = s.rtxSSRC
+	header.PayloadType = s.rtxPayloadType
+	header.SequenceNumber = s.rtxSequencer.NextSequenceNumber()
+	header.Padding = false
+	return header, payload
+}
@@ -0,0 +1,103 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+
+	"github.com/gamelight/gamelight/internal/config"
+)
+
+func TestVideoStreamDrop(t *testing.T) {
+	steps := []struct {
+		mode DeliveryMode
+		kind frameKind
+		drop bool
+	}{
+		{DeliveryFull, frameNonReference, false},
+		{DeliveryThinned, frameNonReference, true},
+		{DeliveryThinned, frameReference, false},
+		{DeliveryThinned, frameKey, false},
+		{DeliverySlideshow, frameReference, true},
+		{DeliverySlideshow, frameKey, false},
+		// Leaving slideshow mode, frames wait for a keyframe
+		{DeliveryFull, frameReference, true},
+		{DeliveryFull, frameNonReference, true},
+		{DeliveryFull, frameKey, false},
+		{DeliveryFull, frameReference, false},
+		// and so do they leaving it for thinned delivery
+		{DeliverySlideshow, frameKey, false},
+		{DeliveryThinned, frameReference, true},
+		{DeliveryThinned, frameKey, false},
+		{DeliveryThinned, frameReference, false},
+	}
+
+	s := &videoStream{}
+	for i, step := range steps {
+		if drop := s.drop(step.mode, step.kind); drop != step.drop {
+			t.Errorf("step %d: drop = %v, want %v", i, drop, step.drop)
+		}
+	}
+}
+
+func TestVideoStreamAdmitRenumbers(t *testing.T) {
+	frames := &videoStats{}
+	s := &videoStream{}
+
+	// Frames of two packets, the second thinned out
+	var sent []uint16
+	for i, kind := range []frameKind{frameReference, frameNonReference, frameReference} {
+		timestamp := uint32(i+1) * 1500
+		frames.add(timestamp, kind, 1000)
+		for j := 0; j < 2; j++ {
+			header := &rtp.Header{SequenceNumber: uint16(100 + 2*i + j), Timestamp: timestamp}
+			if seq, ok := s.admit(header, DeliveryThinned, frames); ok {
+				sent = append(sent, seq)
+			}
+		}
+	}
+
+	// The peer sees no gap, and its sequence numbers map back to the
+	// track's
+	want := []uint16{100, 101, 102, 103}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %v, want %v", sent, want)
+	}
+	for i, seq := range want {
+		if sent[i] != seq {
+			t.Fatalf("sent %v, want %v", sent, want)
+		}
+	}
+	for seq, track := range map[uint16]uint16{100: 100, 101: 101, 102: 104, 103: 105} {
+		if got, ok := s.trackSeq(seq); !ok || got != track {
+			t.Errorf("trackSeq(%d) = %d, %v; want %d", seq, got, ok, track)
+		}
+	}
+	if _, ok := s.trackSeq(104); ok {
+		t.Error("trackSeq found a packet the peer wasn't sent")
+	}
+}
+
+func TestPeersHaveOwnInterceptors(t *testing.T) {
+	f, err := NewFanOut(&config.WebRTCConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	a, err := f.AddPeer("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := f.AddPeer("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.estimator == nil || a.video == nil || b.estimator == nil || b.video == nil {
+		t.Fatal("peer without an estimator or video interceptor")
+	}
+	if a.estimator == b.estimator || a.video == b.video {
+		t.Error("peers share an estimator or video interceptor")
+	}
+}
@@ -0,0 +1,67 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+)
+
+// keyframeInterval is the shortest time between keyframe requests passed
+// on to the host. IDR frames are several times the size of other frames, so
+// a burst of PLIs from several peers, or one peer repeating its request,
+// must not become a burst of IDR frames.
+const keyframeInterval = 250 * time.Millisecond
+
+// keyframeRequester coalesces keyframe requests. A request is passed on at
+// once if none was in the last keyframeInterval, so a new peer gets a
+// keyframe within a round trip; otherwise all requests until the interval
+// ends are passed on as one.
+type keyframeRequester struct {
+	mu sync.Mutex
+
+	last    time.Time
+	pending bool
+
+	onRequest func()
+}
+
+// setOnRequest sets the function that asks the host for a keyframe
+func (k *keyframeRequester) setOnRequest(fn func()) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.onRequest = fn
+}
+
+// request asks for a keyframe, now or when the interval ends
+func (k *keyframeRequester) request() {
+	k.mu.Lock()
+	if k.pending {
+		k.mu.Unlock()
+		return
+	}
+	if wait := keyframeInterval - time.Since(k.last); wait > 0 {
+		k.pending = true
+		time.AfterFunc(wait, k.flush)
+		k.mu.Unlock()
+		return
+	}
+	k.last = time.Now()
+	fn := k.onRequest
+	k.mu.Unlock()
+
+	if fn != nil {
+		fn()
+	}
+}
+
+// flush passes on the requests made during the interval
+func (k *keyframeRequester) flush() {
+	k.mu.Lock()
+	k.pending = false
+	k.last = time.Now()
+	fn := k.onRequest
+	k.mu.Unlock()
+
+	if fn != nil {
+		fn()
+	}
+}
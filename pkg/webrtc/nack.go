@@ -0,0 +1,82 @@
+package webrtc
+
+import (
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// rtpHistorySize is the number of video packets kept for retransmission,
+// about a second of video at 20 Mbps. It divides 65536, so a sequence
+// number always maps to the same slot.
+const rtpHistorySize = 2048
+
+// historyPacket is a sent video packet, without the SSRC, payload type and
+// header extensions that differ between peers
+type historyPacket struct {
+	header  rtp.Header
+	payload []byte
+}
+
+// rtpHistory is a bounded history of the video packets sent to peers. Every
+// peer is sent packets from the same track, so one history, kept by the
+// track's sequence numbers, serves them all.
+type rtpHistory struct {
+	mu      sync.RWMutex
+	packets [rtpHistorySize]*historyPacket
+}
+
+// add records a packet unless it has been already, as it is once per peer
+func (h *rtpHistory) add(header *rtp.Header, payload []byte) {
+	slot := int(header.SequenceNumber) % rtpHistorySize
+
+	h.mu.RLock()
+	pkt := h.packets[slot]
+	h.mu.RUnlock()
+	if pkt != nil && pkt.header.SequenceNumber == header.SequenceNumber && pkt.header.Timestamp == header.Timestamp {
+		return
+	}
+
+	pkt = &historyPacket{
+		header:  *header,
+		payload: append([]byte(nil), payload...),
+	}
+	pkt.header.Extension = false
+	pkt.header.ExtensionProfile = 0
+	pkt.header.Extensions = nil
+
+	h.mu.Lock()
+	h.packets[slot] = pkt
+	h.mu.Unlock()
+}
+
+// get returns the packet with a sequence number if it is still kept
+func (h *rtpHistory) get(seq uint16) *historyPacket {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	pkt := h.packets[int(seq)%rtpHistorySize]
+	if pkt == nil || pkt.header.SequenceNumber != seq {
+		return nil
+	}
+	return pkt
+}
+
+// reset forgets all packets, as when a new video track starts its own
+// sequence numbers
+func (h *rtpHistory) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.packets = [rtpHistorySize]*historyPacket{}
+}
+
+// supportsNack reports whether a stream negotiated generic NACK feedback
+func supportsNack(info *interceptor.StreamInfo) bool {
+	for _, fb := range info.RTCPFeedback {
+		if fb.Type == "nack" && fb.Parameter == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,386 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// MimeTypeMultiopus is the MIME type browsers use for multichannel Opus
+const MimeTypeMultiopus = "audio/multiopus"
+
+var errOpusPacket = errors.New("malformed Opus packet")
+
+// multiopusLayout is a multistream layout in Vorbis channel order
+type multiopusLayout struct {
+	streams int
+	coupled int
+	mapping []byte
+}
+
+// multiopusLayouts are the layouts browsers offer for multiopus. Their
+// decoders use these fixed mappings, so streams have to be arranged to
+// match.
+var multiopusLayouts = map[int]multiopusLayout{
+	6: {streams: 4, coupled: 2, mapping: []byte{0, 4, 1, 2, 3, 5}},
+	8: {streams: 5, coupled: 3, mapping: []byte{0, 6, 1, 4, 5, 2, 3, 7}},
+}
+
+// vorbisToWave maps each Vorbis order channel (FL FC FR [SL SR] BL BR LFE)
+// to its WAVE order index (FL FR FC LFE BL BR [SL SR])
+var vorbisToWave = map[int][]int{
+	6: {0, 2, 1, 4, 5, 3},
+	8: {0, 2, 1, 6, 7, 4, 5, 3},
+}
+
+// MultiopusCodec returns the multiopus codec capability for a channel count
+func MultiopusCodec(channels int) (webrtc.RTPCodecCapability, bool) {
+	layout, ok := multiopusLayouts[channels]
+	if !ok {
+		return webrtc.RTPCodecCapability{}, false
+	}
+
+	mapping := make([]string, len(layout.mapping))
+	for i, m := range layout.mapping {
+		mapping[i] = fmt.Sprint(m)
+	}
+
+	return webrtc.RTPCodecCapability{
+		MimeType:  MimeTypeMultiopus,
+		ClockRate: 48000,
+		Channels:  uint16(channels),
+		SDPFmtpLine: fmt.Sprintf("channel_mapping=%s;num_streams=%d;coupled_streams=%d",
+			strings.Join(mapping, ","), layout.streams, layout.coupled),
+	}, true
+}
+
+// SurroundAudio converts the host's multistream Opus packets for browsers.
+// Packets are rearranged into the browser's multiopus layout when the
+// host's stream coupling allows it. Stereo peers get the stream carrying the
+// front left and right channels, since a real downmix would need decoding.
+type SurroundAudio struct {
+	channels int
+	streams  int
+
+	// order[i] is the host stream sent as browser stream i, or nil if the
+	// layouts can't be matched without re-encoding
+	order []int
+
+	// frontStream is the host stream used for stereo peers
+	frontStream int
+}
+
+// NewSurroundAudio creates a converter for the host's layout. mapping gives
+// the decoded channel for each output channel in WAVE order.
+func NewSurroundAudio(channels, streams, coupled int, mapping []byte) (*SurroundAudio, error) {
+	if len(mapping) != channels || streams < 1 || coupled > streams {
+		return nil, fmt.Errorf("invalid Opus layout: %d channels, %d streams, %d coupled", channels, streams, coupled)
+	}
+
+	s := &SurroundAudio{
+		channels: channels,
+		streams:  streams,
+	}
+
+	// Stereo peers get the stream holding front left, which is the full
+	// front pair when the host couples FL and FR
+	fl, _, ok := streamOf(mapping[0], streams, coupled)
+	if !ok {
+		return nil, fmt.Errorf("invalid Opus mapping %v", mapping)
+	}
+	s.frontStream = fl
+
+	s.order = matchMultiopus(channels, streams, coupled, mapping)
+	return s, nil
+}
+
+// Multiopus reports whether packets can be sent to multiopus peers
+func (s *SurroundAudio) Multiopus() bool {
+	return s.order != nil
+}
+
+// Codec returns the multiopus codec for the host's channel count
+func (s *SurroundAudio) Codec() (webrtc.RTPCodecCapability, bool) {
+	return MultiopusCodec(s.channels)
+}
+
+// ToMultiopus rearranges a host packet into the browser multiopus layout
+func (s *SurroundAudio) ToMultiopus(packet []byte) ([]byte, error) {
+	if s.order == nil {
+		return nil, errors.New("host Opus layout doesn't match multiopus")
+	}
+
+	packets, err := splitMultistream(packet, s.streams)
+	if err != nil {
+		return nil, err
+	}
+
+	reordered := make([][]byte, len(packets))
+	for i, src := range s.order {
+		reordered[i] = packets[src]
+	}
+	return joinMultistream(reordered)
+}
+
+// ToStereo extracts the front channels from a host packet as a plain Opus
+// packet
+func (s *SurroundAudio) ToStereo(packet []byte) ([]byte, error) {
+	packets, err := splitMultistream(packet, s.streams)
+	if err != nil {
+		return nil, err
+	}
+	return packets[s.frontStream], nil
+}
+
+// streamOf returns the stream carrying a decoded channel and the channel's
+// position in it
+func streamOf(channel byte, streams, coupled int) (stream, pos int, ok bool) {
+	c := int(channel)
+	switch {
+	case c < 2*coupled:
+		return c / 2, c % 2, true
+	case c < streams+coupled:
+		return c - coupled, 0, true
+	}
+	return 0, 0, false
+}
+
+// matchMultiopus finds the order of host streams that reproduces the
+// browser layout, or nil if there is none
+func matchMultiopus(channels, streams, coupled int, mapping []byte) []int {
+	layout, ok := multiopusLayouts[channels]
+	if !ok || layout.streams != streams || layout.coupled != coupled {
+		return nil
+	}
+
+	order := make([]int, streams)
+	for i := range order {
+		order[i] = -1
+	}
+
+	for v, w := range vorbisToWave[channels] {
+		bs, bp, ok := streamOf(layout.mapping[v], streams, coupled)
+		if !ok {
+			return nil
+		}
+		hs, hp, ok := streamOf(mapping[w], streams, coupled)
+		if !ok || bp != hp || (bs < coupled) != (hs < coupled) {
+			return nil
+		}
+		if order[bs] != -1 && order[bs] != hs {
+			return nil
+		}
+		order[bs] = hs
+	}
+
+	for _, o := range order {
+		if o == -1 {
+			return nil
+		}
+	}
+	return order
+}
+
+// splitMultistream splits a multistream packet into one standard Opus packet
+// per stream. All but the last stream use self-delimiting framing.
+func splitMultistream(data []byte, streams int) ([][]byte, error) {
+	packets := make([][]byte, streams)
+	for i := 0; i < streams-1; i++ {
+		p, n, err := parseSelfDelimited(data)
+		if err != nil {
+			return nil, err
+		}
+		packets[i] = p
+		data = data[n:]
+	}
+	if len(data) == 0 {
+		return nil, errOpusPacket
+	}
+	packets[streams-1] = data
+	return packets, nil
+}
+
+// joinMultistream combines standard Opus packets into a multistream packet
+func joinMultistream(packets [][]byte) ([]byte, error) {
+	var out []byte
+	for i, p := range packets {
+		if i == len(packets)-1 {
+			out = append(out, p...)
+			break
+		}
+		header, sdLen, body, _, err := opusFraming(p, false)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, header...)
+		out = appendOpusLength(out, sdLen)
+		out = append(out, body...)
+	}
+	return out, nil
+}
+
+// parseSelfDelimited reads one self-delimited Opus packet from the front of
+// data and returns it in standard framing with the bytes it consumed
+func parseSelfDelimited(data []byte) ([]byte, int, error) {
+	header, _, body, n, err := opusFraming(data, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	packet := make([]byte, 0, len(header)+len(body))
+	packet = append(packet, header...)
+	packet = append(packet, body...)
+	return packet, n, nil
+}
+
+// opusFraming splits an Opus packet (RFC 6716 section 3.2) around the point
+// where self-delimiting framing (appendix B) inserts its extra length.
+// header is everything before that point, sdLen is the length value the
+// self-delimited form carries and body is everything after it. n is the
+// number of bytes of data the packet occupies.
+func opusFraming(data []byte, selfDelimited bool) (header []byte, sdLen int, body []byte, n int, err error) {
+	if len(data) < 1 {
+		return nil, 0, nil, 0, errOpusPacket
+	}
+
+	pos := 1
+	var frameCount, fixedLen, padding int
+	vbr := false
+
+	switch data[0] & 0x3 {
+	case 0:
+		frameCount = 1
+	case 1:
+		frameCount = 2
+	case 2:
+		// The first frame's length is coded explicitly
+		n1, size, ok := readOpusLength(data[pos:])
+		if !ok {
+			return nil, 0, nil, 0, errOpusPacket
+		}
+		pos += size
+		frameCount, vbr, fixedLen = 2, true, n1
+	case 3:
+		if len(data) < 2 {
+			return nil, 0, nil, 0, errOpusPacket
+		}
+		countByte := data[pos]
+		pos++
+		frameCount = int(countByte & 0x3F)
+		vbr = countByte&0x80 != 0
+		if frameCount == 0 {
+			return nil, 0, nil, 0, errOpusPacket
+		}
+
+		if countByte&0x40 != 0 {
+			for {
+				if pos >= len(data) {
+					return nil, 0, nil, 0, errOpusPacket
+				}
+				b := int(data[pos])
+				pos++
+				if b == 255 {
+					padding += 254
+					continue
+				}
+				padding += b
+				break
+			}
+		}
+
+		if vbr {
+			for i := 0; i < frameCount-1; i++ {
+				l, size, ok := readOpusLength(data[pos:])
+				if !ok {
+					return nil, 0, nil, 0, errOpusPacket
+				}
+				pos += size
+				fixedLen += l
+			}
+		}
+	}
+
+	header = data[:pos]
+
+	if selfDelimited {
+		l, size, ok := readOpusLength(data[pos:])
+		if !ok {
+			return nil, 0, nil, 0, errOpusPacket
+		}
+		pos += size
+		sdLen = l
+
+		// Explicit lengths cover all but the last frame of a VBR packet;
+		// CBR frames all have the self-delimited length
+		size = frameCount * l
+		if vbr {
+			size = fixedLen + l
+		}
+		size += padding
+		if pos+size > len(data) {
+			return nil, 0, nil, 0, errOpusPacket
+		}
+		return header, sdLen, data[pos : pos+size], pos + size, nil
+	}
+
+	body = data[pos:]
+	frames := len(body) - padding
+	switch {
+	case frames < 0:
+		return nil, 0, nil, 0, errOpusPacket
+	case vbr:
+		sdLen = frames - fixedLen
+		if sdLen < 0 {
+			return nil, 0, nil, 0, errOpusPacket
+		}
+	default:
+		if frames%frameCount != 0 {
+			return nil, 0, nil, 0, errOpusPacket
+		}
+		sdLen = frames / frameCount
+	}
+	return header, sdLen, body, len(data), nil
+}
+
+// readOpusLength reads a one or two byte Opus frame length
+func readOpusLength(data []byte) (int, int, bool) {
+	if len(data) < 1 {
+		return 0, 0, false
+	}
+	if data[0] < 252 {
+		return int(data[0]), 1, true
+	}
+	if len(data) < 2 {
+		return 0, 0, false
+	}
+	return int(data[1])*4 + int(data[0]), 2, true
+}
+
+// appendOpusLength appends a one or two byte Opus frame length
+func appendOpusLength(out []byte, l int) []byte {
+	if l < 252 {
+		return append(out, byte(l))
+	}
+	b0 := 252 + (l-252)%4
+	return append(out, byte(b0), byte((l-b0)/4))
+}
+
+// offerSupports reports whether an SDP offer lists a codec with the given
+// MIME type and channel count
+func offerSupports(sdp string, codec webrtc.RTPCodecCapability) bool {
+	_, subtype, _ := strings.Cut(codec.MimeType, "/")
+	want := fmt.Sprintf("%s/%d/%d", subtype, codec.ClockRate, codec.Channels)
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=rtpmap:") {
+			continue
+		}
+		if _, encoding, ok := strings.Cut(line, " "); ok && strings.EqualFold(encoding, want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,387 @@
+package webrtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// rtpPayloadMTU is the largest RTP payload we send, leaving room for the
+// RTP header, SRTP and header extensions inside a 1200-byte datagram
+const rtpPayloadMTU = 1200 - 12
+
+// VideoClockRate is the RTP clock rate for all video codecs
+const VideoClockRate = 90000
+
+// VideoPacketizer splits complete encoded video frames into RTP packets a
+// browser can depacketize. It keeps its own sequence number space;
+// timestamps are the 90kHz frame timestamps from the host. The track sets
+// each peer's SSRC and payload type.
+type VideoPacketizer struct {
+	payloader rtp.Payloader
+	sequencer rtp.Sequencer
+}
+
+// NewVideoPacketizer creates a packetizer for the given codec MIME type
+func NewVideoPacketizer(mimeType string) (*VideoPacketizer, error) {
+	var payloader rtp.Payloader
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		payloader = &codecs.H264Payloader{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH265):
+		payloader = &h265Payloader{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		payloader = &av1Payloader{}
+	default:
+		return nil, fmt.Errorf("unsupported video codec %q", mimeType)
+	}
+
+	return &VideoPacketizer{
+		payloader: payloader,
+		sequencer: rtp.NewRandomSequencer(),
+	}, nil
+}
+
+// Packetize splits one access unit into RTP packets. The marker bit is set
+// on the last packet of the frame.
+func (p *VideoPacketizer) Packetize(frame []byte, timestamp uint32) []*rtp.Packet {
+	payloads := p.payloader.Payload(rtpPayloadMTU, frame)
+
+	packets := make([]*rtp.Packet, len(payloads))
+	for i, payload := range payloads {
+		packets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: p.sequencer.NextSequenceNumber(),
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		}
+	}
+	return packets
+}
+
+// AudioPacketizer wraps Opus packets in RTP packets with our own sequence
+// numbers
+type AudioPacketizer struct {
+	sequencer rtp.Sequencer
+}
+
+// NewAudioPacketizer creates a packetizer for Opus audio
+func NewAudioPacketizer() *AudioPacketizer {
+	return &AudioPacketizer{
+		sequencer: rtp.NewRandomSequencer(),
+	}
+}
+
+// Packetize wraps one Opus packet. timestamp is on the 48kHz Opus clock.
+func (p *AudioPacketizer) Packetize(opus []byte, timestamp uint32) *rtp.Packet {
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: p.sequencer.NextSequenceNumber(),
+			Timestamp:      timestamp,
+		},
+		Payload: opus,
+	}
+}
+
+// splitAnnexB returns the NAL units in an Annex B byte stream without their
+// start codes
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nalus = append(nalus, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	} else if start < 0 && len(data) > 0 {
+		nalus = append(nalus, data)
+	}
+
+	// Drop empty units left by stray start codes
+	out := nalus[:0]
+	for _, nalu := range nalus {
+		if len(nalu) > 0 {
+			out = append(out, nalu)
+		}
+	}
+	return out
+}
+
+// H.265 NAL unit types used by RFC 7798 payloads
+const (
+	h265NALTypeAUD = 35
+	h265NALTypeAP  = 48
+	h265NALTypeFU  = 49
+)
+
+// h265Payloader packetizes H.265 per RFC 7798: small NAL units (parameter
+// sets and SEI, including HDR metadata) are combined into aggregation
+// packets, large ones are split into fragmentation units
+type h265Payloader struct{}
+
+func (p *h265Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	var payloads [][]byte
+	var aggregate [][]byte
+	aggregateSize := 2
+
+	flush := func() {
+		switch len(aggregate) {
+		case 0:
+		case 1:
+			payloads = append(payloads, aggregate[0])
+		default:
+			payloads = append(payloads, h265AggregationPacket(aggregate, aggregateSize))
+		}
+		aggregate = nil
+		aggregateSize = 2
+	}
+
+	for _, nalu := range splitAnnexB(payload) {
+		if len(nalu) < 2 {
+			continue
+		}
+		if (nalu[0]>>1)&0x3F == h265NALTypeAUD {
+			continue
+		}
+
+		if len(nalu) > int(mtu) {
+			flush()
+			payloads = append(payloads, h265Fragment(nalu, int(mtu))...)
+			continue
+		}
+
+		if aggregateSize+2+len(nalu) > int(mtu) {
+			flush()
+		}
+		aggregate = append(aggregate, nalu)
+		aggregateSize += 2 + len(nalu)
+	}
+	flush()
+
+	return payloads
+}
+
+// h265AggregationPacket builds an AP from NAL units that fit in one packet
+func h265AggregationPacket(nalus [][]byte, size int) []byte {
+	// The AP header takes the F bit from any unit and the lowest layer and
+	// temporal IDs of all of them
+	var forbidden byte
+	layerID := byte(0x3F)
+	tid := byte(0x07)
+	for _, nalu := range nalus {
+		forbidden |= nalu[0] & 0x80
+		if l := (nalu[0]&0x01)<<5 | nalu[1]>>3; l < layerID {
+			layerID = l
+		}
+		if t := nalu[1] & 0x07; t < tid {
+			tid = t
+		}
+	}
+
+	out := make([]byte, 0, size)
+	out = append(out, forbidden|h265NALTypeAP<<1|layerID>>5, layerID<<3|tid)
+	for _, nalu := range nalus {
+		out = binary.BigEndian.AppendUint16(out, uint16(len(nalu)))
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// h265Fragment splits a NAL unit into FUs
+func h265Fragment(nalu []byte, mtu int) [][]byte {
+	const fuHeaderSize = 3
+
+	naluType := (nalu[0] >> 1) & 0x3F
+	header := [2]byte{nalu[0]&0x81 | h265NALTypeFU<<1, nalu[1]}
+	data := nalu[2:]
+	maxFragment := mtu - fuHeaderSize
+
+	var payloads [][]byte
+	for offset := 0; offset < len(data); offset += maxFragment {
+		end := offset + maxFragment
+		if end > len(data) {
+			end = len(data)
+		}
+
+		fu := naluType
+		if offset == 0 {
+			fu |= 0x80
+		}
+		if end == len(data) {
+			fu |= 0x40
+		}
+
+		out := make([]byte, 0, fuHeaderSize+end-offset)
+		out = append(out, header[0], header[1], fu)
+		out = append(out, data[offset:end]...)
+		payloads = append(payloads, out)
+	}
+	return payloads
+}
+
+// AV1 OBU types that matter for RTP packetization
+const (
+	av1OBUSequenceHeader         = 1
+	av1OBUTemporalDelimiter      = 2
+	av1OBUTileList               = 8
+	av1OBUHasExtension      byte = 0x04
+	av1OBUHasSizeField      byte = 0x02
+)
+
+// av1Payloader packetizes an AV1 temporal unit per the AV1 RTP payload
+// specification. Each OBU is sent as an element with an explicit length
+// and without its own size field; OBUs that don't fit are continued in the
+// next packet. pion's AV1Payloader takes one OBU at a time, size field and
+// all, so it can't packetize the temporal units the host sends.
+type av1Payloader struct{}
+
+func (p *av1Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	obus, newSequence := av1SplitOBUs(payload)
+	if len(obus) == 0 {
+		return nil
+	}
+
+	var payloads [][]byte
+	packet := []byte{0}
+	continuation := false
+
+	finish := func(continues bool) {
+		if continuation {
+			packet[0] |= 0x80 // Z
+		}
+		if continues {
+			packet[0] |= 0x40 // Y
+		}
+		if newSequence && len(payloads) == 0 {
+			packet[0] |= 0x08 // N
+		}
+		payloads = append(payloads, packet)
+		packet = []byte{0}
+		continuation = continues
+	}
+
+	for _, obu := range obus {
+		for len(obu) > 0 {
+			space := int(mtu) - len(packet)
+			n := space - leb128Size(space)
+			if n <= 0 {
+				finish(false)
+				continue
+			}
+			if n > len(obu) {
+				n = len(obu)
+			}
+
+			packet = appendLEB128(packet, n)
+			packet = append(packet, obu[:n]...)
+			obu = obu[n:]
+
+			if len(obu) > 0 {
+				finish(true)
+			}
+		}
+	}
+	if len(packet) > 1 {
+		finish(false)
+	}
+
+	return payloads
+}
+
+// av1SplitOBUs parses a low overhead bitstream into OBUs with their size
+// fields removed, dropping OBUs that must not be sent over RTP. Metadata
+// OBUs, which carry HDR mastering display and light levels, are kept. It
+// also reports whether the temporal unit starts a new coded video sequence.
+func av1SplitOBUs(data []byte) ([][]byte, bool) {
+	var obus [][]byte
+	newSequence := false
+
+	for len(data) > 0 {
+		header := data[0]
+		headerSize := 1
+		if header&av1OBUHasExtension != 0 {
+			headerSize = 2
+		}
+		if len(data) < headerSize {
+			break
+		}
+
+		var size, sizeLen int
+		if header&av1OBUHasSizeField != 0 {
+			v, n := readLEB128(data[headerSize:])
+			if n == 0 {
+				break
+			}
+			size, sizeLen = int(v), n
+		} else {
+			size = len(data) - headerSize
+		}
+
+		end := headerSize + sizeLen + size
+		if end > len(data) {
+			break
+		}
+
+		obuType := (header >> 3) & 0x0F
+		switch obuType {
+		case av1OBUTemporalDelimiter, av1OBUTileList:
+		default:
+			if obuType == av1OBUSequenceHeader {
+				newSequence = true
+			}
+			obu := make([]byte, 0, headerSize+size)
+			obu = append(obu, header&^av1OBUHasSizeField)
+			obu = append(obu, data[1:headerSize]...)
+			obu = append(obu, data[headerSize+sizeLen:end]...)
+			obus = append(obus, obu)
+		}
+
+		data = data[end:]
+	}
+
+	return obus, newSequence
+}
+
+func readLEB128(data []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(data) && i < 8; i++ {
+		v |= uint64(data[i]&0x7F) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func appendLEB128(out []byte, v int) []byte {
+	for v >= 0x80 {
+		out = append(out, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(out, byte(v))
+}
+
+func leb128Size(v int) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
@@ -0,0 +1,131 @@
+package webrtc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// testBytes returns n bytes of test data starting at first
+func testBytes(n int, first byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = first + byte(i)
+	}
+	return b
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func checkPayloads(t *testing.T, got [][]byte, want ...[]byte) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d payloads, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("payload %d:\n got %x\nwant %x", i, got[i], want[i])
+		}
+	}
+}
+
+func TestH265PayloaderAggregatesAndFragments(t *testing.T) {
+	start := []byte{0, 0, 0, 1}
+	aud := []byte{0x46, 0x01, 0x50}
+	vps := []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff}
+	sps := []byte{0x42, 0x01, 0x01, 0x01, 0x60}
+	sei := []byte{0x4e, 0x02, 0x01, 0x04}                // temporal ID 1
+	slice := join([]byte{0x26, 0x01}, testBytes(248, 0)) // IDR_W_RADL
+
+	frame := join(start, aud, start, vps, start[1:], sps, start, sei, start, slice)
+	got := (&h265Payloader{}).Payload(100, frame)
+
+	checkPayloads(t, got,
+		// The AUD is dropped and the parameter sets and SEI share an AP,
+		// whose header has the lowest temporal ID of its units
+		join(
+			[]byte{48 << 1, 0x01},
+			[]byte{0, 6}, vps,
+			[]byte{0, 5}, sps,
+			[]byte{0, 4}, sei,
+		),
+		// FUs of 97 bytes, S on the first and E on the last
+		join([]byte{49 << 1, 0x01, 0x80 | 19}, slice[2:99]),
+		join([]byte{49 << 1, 0x01, 19}, slice[99:196]),
+		join([]byte{49 << 1, 0x01, 0x40 | 19}, slice[196:]),
+	)
+}
+
+func TestH265PayloaderSingleUnit(t *testing.T) {
+	slice := []byte{0x02, 0x01, 0xaa, 0xbb} // TRAIL_R
+	got := (&h265Payloader{}).Payload(100, join([]byte{0, 0, 1}, slice))
+	checkPayloads(t, got, slice)
+}
+
+func TestAV1PayloaderKeyframe(t *testing.T) {
+	td := []byte{0x12, 0x00}
+	seq := []byte{0x0a, 0x03, 0xa1, 0xa2, 0xa3}
+	frameData := testBytes(200, 0)
+	frame := join([]byte{0x32, 0xc8, 0x01}, frameData) // 200-byte size field
+
+	got := (&av1Payloader{}).Payload(100, join(td, seq, frame))
+
+	// The temporal delimiter is dropped and OBUs lose their size fields.
+	// Every element has a length (W=0); N marks the new sequence, Y an OBU
+	// continued in the next packet and Z one continued from the last.
+	checkPayloads(t, got,
+		join([]byte{0x48, 4, 0x08, 0xa1, 0xa2, 0xa3, 93, 0x30}, frameData[:92]),
+		join([]byte{0xc0, 98}, frameData[92:190]),
+		join([]byte{0x80, 10}, frameData[190:]),
+	)
+}
+
+func TestAV1PayloaderWithoutSizeField(t *testing.T) {
+	// The last OBU may leave out its size and run to the end of the data
+	frameData := testBytes(20, 0x40)
+	got := (&av1Payloader{}).Payload(100, join([]byte{0x12, 0x00, 0x30}, frameData))
+	checkPayloads(t, got, join([]byte{0x00, 21, 0x30}, frameData))
+}
+
+func TestVideoPacketizerMarksLastPacket(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		frame    []byte
+	}{
+		{webrtc.MimeTypeH264, join([]byte{0, 0, 0, 1, 0x65}, testBytes(3000, 0))},
+		{webrtc.MimeTypeH265, join([]byte{0, 0, 0, 1, 0x26, 0x01}, testBytes(3000, 0))},
+		{webrtc.MimeTypeAV1, join([]byte{0x32, 0xb8, 0x17}, testBytes(3000, 0))},
+	}
+
+	for _, tt := range tests {
+		p, err := NewVideoPacketizer(tt.mimeType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, timestamp := range []uint32{3000, 4500} {
+			packets := p.Packetize(tt.frame, timestamp)
+			if len(packets) != 3 {
+				t.Fatalf("%s: got %d packets, want 3", tt.mimeType, len(packets))
+			}
+			for i, pkt := range packets {
+				if pkt.Marker != (i == len(packets)-1) {
+					t.Errorf("%s: packet %d marker = %v", tt.mimeType, i, pkt.Marker)
+				}
+				if pkt.Timestamp != timestamp {
+					t.Errorf("%s: packet %d timestamp = %d, want %d", tt.mimeType, i, pkt.Timestamp, timestamp)
+				}
+				if i > 0 && pkt.SequenceNumber != packets[i-1].SequenceNumber+1 {
+					t.Errorf("%s: packet %d sequence number %d follows %d", tt.mimeType, i, pkt.SequenceNumber, packets[i-1].SequenceNumber)
+				}
+				if len(pkt.Payload) > rtpPayloadMTU {
+					t.Errorf("%s: packet %d payload is %d bytes", tt.mimeType, i, len(pkt.Payload))
+				}
+			}
+		}
+	}
+}
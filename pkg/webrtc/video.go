@@ -0,0 +1,211 @@
+package webrtc
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// frameKind is how much of the stream depends on a video frame
+type frameKind int
+
+const (
+	// frameReference is a frame later frames may refer to
+	frameReference frameKind = iota
+	// frameNonReference is a frame no other frame refers to, which a peer
+	// can miss without harm to the rest
+	frameNonReference
+	// frameKey is a frame that decodes on its own
+	frameKey
+)
+
+// classifyFrame tells a frame's kind from its NAL unit or OBU headers
+func classifyFrame(mimeType string, frame []byte) frameKind {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return classifyH264(frame)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH265):
+		return classifyH265(frame)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		// The host sends a sequence header with every keyframe. Whether
+		// other frames are referenced is in the frame header, which can't
+		// be parsed without the sequence header, so they count as
+		// referenced.
+		if av1HasSequenceHeader(frame) {
+			return frameKey
+		}
+	}
+	return frameReference
+}
+
+// classifyH264 classifies an H.264 access unit. All slices of a picture
+// share nal_ref_idc, which is zero for non-reference pictures.
+func classifyH264(frame []byte) frameKind {
+	kind := frameReference
+	for _, nalu := range splitAnnexB(frame) {
+		switch nalu[0] & 0x1F {
+		case 5, 7: // IDR slice, SPS
+			return frameKey
+		case 1, 2, 3, 4: // non-IDR slice and data partitions
+			if nalu[0]&0x60 != 0 {
+				return frameReference
+			}
+			kind = frameNonReference
+		}
+	}
+	return kind
+}
+
+// classifyH265 classifies an H.265 access unit. IRAP pictures are types 16
+// to 23; the even types up to 14 are sub-layer non-reference pictures.
+func classifyH265(frame []byte) frameKind {
+	kind := frameReference
+	for _, nalu := range splitAnnexB(frame) {
+		naluType := (nalu[0] >> 1) & 0x3F
+		switch {
+		case naluType >= 16 && naluType <= 23:
+			return frameKey
+		case naluType <= 14 && naluType%2 == 0:
+			kind = frameNonReference
+		case naluType < 32:
+			return frameReference
+		}
+	}
+	return kind
+}
+
+// av1HasSequenceHeader reports whether a temporal unit holds a sequence
+// header OBU
+func av1HasSequenceHeader(data []byte) bool {
+	for len(data) > 0 {
+		header := data[0]
+		headerSize := 1
+		if header&av1OBUHasExtension != 0 {
+			headerSize = 2
+		}
+		if (header>>3)&0x0F == av1OBUSequenceHeader {
+			return true
+		}
+		if header&av1OBUHasSizeField == 0 || len(data) < headerSize {
+			return false
+		}
+
+		size, n := readLEB128(data[headerSize:])
+		if n == 0 || uint64(len(data)-headerSize-n) < size {
+			return false
+		}
+		data = data[headerSize+n+int(size):]
+	}
+	return false
+}
+
+// videoStatsWindow is the period the stream bitrate is measured over
+const videoStatsWindow = 2 * time.Second
+
+// videoStats follows the frames written to the video track: the kind of
+// the one being written, for the peers' video interceptors, and the
+// stream's bitrate, for the delivery policy
+type videoStats struct {
+	mu sync.Mutex
+
+	timestamp uint32
+	kind      frameKind
+
+	windowStart  time.Time
+	bytes        int
+	nonReference int
+
+	// From the last full window
+	bitrate   int
+	thinnable bool
+}
+
+// add records a frame about to be written
+func (s *videoStats) add(timestamp uint32, kind frameKind, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timestamp = timestamp
+	s.kind = kind
+
+	now := time.Now()
+	if elapsed := now.Sub(s.windowStart); elapsed >= videoStatsWindow {
+		if elapsed < 2*videoStatsWindow {
+			s.bitrate = int(int64(s.bytes) * 8 * int64(time.Second) / int64(elapsed))
+			s.thinnable = s.nonReference > 0
+		} else {
+			s.bitrate = 0
+			s.thinnable = false
+		}
+		s.windowStart = now
+		s.bytes = 0
+		s.nonReference = 0
+	}
+	s.bytes += size
+	if kind == frameNonReference {
+		s.nonReference++
+	}
+}
+
+// frameKind returns the kind of the frame with a timestamp if it is the
+// one being written
+func (s *videoStats) frameKind(timestamp uint32) frameKind {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if timestamp != s.timestamp {
+		return frameReference
+	}
+	return s.kind
+}
+
+// rate returns the stream's bitrate in bits per second, or 0 if no video
+// is being written, and whether it has non-reference frames to drop
+func (s *videoStats) rate() (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.windowStart) >= 2*videoStatsWindow {
+		return 0, false
+	}
+	return s.bitrate, s.thinnable
+}
+
+// VideoWriter packetizes the host's video frames onto a track, telling the
+// fan-out each frame's kind so it can send fewer to peers on slow links
+type VideoWriter struct {
+	stats      *videoStats
+	track      *webrtc.TrackLocalStaticRTP
+	packetizer *VideoPacketizer
+	mimeType   string
+}
+
+// NewVideoWriter creates a writer for a track made by CreateVideoTrack
+func (f *FanOut) NewVideoWriter(track *webrtc.TrackLocalStaticRTP) (*VideoWriter, error) {
+	mimeType := track.Codec().MimeType
+	packetizer, err := NewVideoPacketizer(mimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VideoWriter{
+		stats:      f.video,
+		track:      track,
+		packetizer: packetizer,
+		mimeType:   mimeType,
+	}, nil
+}
+
+// WriteFrame writes one access unit to the track
+func (w *VideoWriter) WriteFrame(frame []byte, timestamp uint32) error {
+	w.stats.add(timestamp, classifyFrame(w.mimeType, frame), len(frame))
+
+	for _, pkt := range w.packetizer.Packetize(frame, timestamp) {
+		if err := w.track.WriteRTP(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestClassifyFrame(t *testing.T) {
+	start := []byte{0, 0, 0, 1}
+	tests := []struct {
+		name     string
+		mimeType string
+		frame    []byte
+		want     frameKind
+	}{
+		{"H.264 IDR", webrtc.MimeTypeH264, join(start, []byte{0x09, 0xf0}, start, []byte{0x65, 0x88}), frameKey},
+		{"H.264 SPS", webrtc.MimeTypeH264, join(start, []byte{0x67, 0x42}, start, []byte{0x68, 0xce}), frameKey},
+		{"H.264 reference", webrtc.MimeTypeH264, join(start, []byte{0x41, 0x9a}), frameReference},
+		{"H.264 non-reference", webrtc.MimeTypeH264, join(start, []byte{0x06, 0x05}, start, []byte{0x01, 0x9e}), frameNonReference},
+		{"H.265 IDR", webrtc.MimeTypeH265, join(start, []byte{0x26, 0x01}), frameKey},
+		{"H.265 TRAIL_R", webrtc.MimeTypeH265, join(start, []byte{0x02, 0x01}), frameReference},
+		{"H.265 TRAIL_N", webrtc.MimeTypeH265, join(start, []byte{0x46, 0x01}, start, []byte{0x00, 0x01}), frameNonReference},
+		{"AV1 sequence header", webrtc.MimeTypeAV1, []byte{0x12, 0x00, 0x0a, 0x01, 0xa1, 0x32, 0x01, 0xff}, frameKey},
+		{"AV1 frame", webrtc.MimeTypeAV1, []byte{0x12, 0x00, 0x32, 0x01, 0xff}, frameReference},
+		{"lowercase MIME type", "video/h264", join(start, []byte{0x65, 0x88}), frameKey},
+	}
+
+	for _, tt := range tests {
+		if got := classifyFrame(tt.mimeType, tt.frame); got != tt.want {
+			t.Errorf("%s: kind %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
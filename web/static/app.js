@@ -12,13 +12,22 @@ class GamelightClient {
         this.elements = {
             video: document.getElementById('video'),
             loading: document.getElementById('loading'),
+            loadingMessage: document.getElementById('loading-message'),
+            appPicker: document.getElementById('app-picker'),
+            appGrid: document.getElementById('app-grid'),
+            hdrOption: document.getElementById('hdr-option'),
+            hdrToggle: document.getElementById('hdr-toggle'),
+            appSection: document.getElementById('app-section'),
+            appList: document.getElementById('app-list'),
             error: document.getElementById('error'),
+            deliveryNotice: document.getElementById('delivery-notice'),
             errorMessage: document.getElementById('error-message'),
             sidebar: document.getElementById('sidebar'),
             sidebarToggle: document.getElementById('sidebar-toggle'),
             sidebarClose: document.getElementById('sidebar-close'),
             yourRole: document.getElementById('your-role'),
             yourSlot: document.getElementById('your-slot'),
+            streamFormat: document.getElementById('stream-format'),
             playerActions: document.getElementById('player-actions'),
             btnJoinPlayer: document.getElementById('btn-join-player'),
             btnSpectate: document.getElementById('btn-spectate'),
@@ -32,13 +41,49 @@ class GamelightClient {
             fps: document.getElementById('fps'),
             resolution: document.getElementById('resolution'),
             applyQuality: document.getElementById('apply-quality'),
+            pairState: document.getElementById('pair-state'),
+            pairDetail: document.getElementById('pair-detail'),
+            pairPin: document.getElementById('pair-pin'),
+            btnPair: document.getElementById('btn-pair'),
+            hostSelect: document.getElementById('host-select'),
+            btnStreamHost: document.getElementById('btn-stream-host'),
+            btnDiscover: document.getElementById('btn-discover'),
+            discoverList: document.getElementById('discover-list'),
         };
 
+        // The host and app to stream if we end up creating the session
+        const params = new URLSearchParams(window.location.search);
+        this.hostName = params.get('host') || '';
+        this.appId = parseInt(params.get('app')) || 0;
+        this.hdr = params.get('hdr') === '1';
+        this.sessionApps = null;
+        this.switching = false;
+        this.hosts = [];
+        this.pairStatus = { state: 'idle' };
+
         this.init();
     }
 
     init() {
         this.setupEventListeners();
+        this.loadHosts();
+        this.loadPairStatus();
+        this.start();
+    }
+
+    // Join the running session, or let the user pick an app to start one
+    async start() {
+        if (!this.appId) {
+            try {
+                const res = await fetch('/api/session');
+                const session = await res.json();
+                if (!session.active && await this.showAppPicker()) {
+                    return;
+                }
+            } catch (e) {
+                console.error('Failed to load session:', e);
+            }
+        }
         this.connect();
     }
 
@@ -57,6 +102,14 @@ class GamelightClient {
         });
         this.elements.applyQuality.addEventListener('click', () => this.applyQuality());
 
+        // Pairing
+        this.elements.btnPair.addEventListener('click', () => this.startPairing());
+
+        // Host selection
+        this.elements.hostSelect.addEventListener('change', () => this.renderPairStatus());
+        this.elements.btnStreamHost.addEventListener('click', () => this.streamFromHost());
+        this.elements.btnDiscover.addEventListener('click', () => this.discoverHosts());
+
         // Video double-click for fullscreen
         this.elements.video.addEventListener('dblclick', () => this.toggleFullscreen());
 
@@ -72,13 +125,31 @@ class GamelightClient {
         document.addEventListener('mouseup', (e) => this.handleMouseButton(e, false));
         document.addEventListener('wheel', (e) => this.handleMouseWheel(e));
 
+        // Touch, passed through as touch rather than emulated mouse input
+        for (const type of ['touchstart', 'touchmove', 'touchend', 'touchcancel']) {
+            this.elements.video.addEventListener(type, (e) => this.handleTouch(e), { passive: false });
+        }
+
         // Gamepad polling
         this.startGamepadPolling();
     }
 
     connect() {
         const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const wsUrl = `${protocol}//${window.location.host}/ws`;
+        const params = new URLSearchParams();
+        if (this.hostName) {
+            params.set('host', this.hostName);
+        }
+        if (this.appId) {
+            params.set('app', this.appId);
+        }
+        if (this.hdr) {
+            params.set('hdr', '1');
+        }
+        let wsUrl = `${protocol}//${window.location.host}/ws`;
+        if (params.toString()) {
+            wsUrl += '?' + params.toString();
+        }
 
         this.ws = new WebSocket(wsUrl);
         this.ws.onopen = () => this.onWebSocketOpen();
@@ -105,6 +176,15 @@ class GamelightClient {
             case 'ice_candidate':
                 this.handleICECandidate(JSON.parse(msg.data));
                 break;
+            case 'pair_progress':
+                this.updatePairStatus(msg.data);
+                break;
+            case 'stream_progress':
+                this.updateStreamProgress(msg.data);
+                break;
+            case 'delivery':
+                this.updateDelivery(JSON.parse(msg.data));
+                break;
             case 'error':
                 this.showError(msg.data);
                 break;
@@ -140,8 +220,13 @@ class GamelightClient {
         // Handle incoming tracks
         this.pc.ontrack = (event) => {
             console.log('Received track:', event.track.kind);
+            // Video and audio arrive in separate streams; play both from
+            // the video element
+            if (!this.elements.video.srcObject) {
+                this.elements.video.srcObject = new MediaStream();
+            }
+            this.elements.video.srcObject.addTrack(event.track);
             if (event.track.kind === 'video') {
-                this.elements.video.srcObject = event.streams[0];
                 this.elements.loading.classList.add('hidden');
             }
         };
@@ -172,10 +257,12 @@ class GamelightClient {
         this.createDataChannel('mouse_scroll');
         this.createDataChannel('keyboard');
         this.createDataChannel('controllers');
+        this.createDataChannel('touch');
 
         // Add transceivers for receiving video/audio
         this.pc.addTransceiver('video', { direction: 'recvonly' });
-        this.pc.addTransceiver('audio', { direction: 'recvonly' });
+        const audio = this.pc.addTransceiver('audio', { direction: 'recvonly' });
+        this.preferSurroundAudio(audio);
 
         // Create offer
         const offer = await this.pc.createOffer();
@@ -183,6 +270,23 @@ class GamelightClient {
         this.send('offer', { sdp: offer.sdp });
     }
 
+    // Browsers that can decode multiopus don't offer it by default; listing
+    // it lets the server send surround audio
+    preferSurroundAudio(transceiver) {
+        if (!transceiver.setCodecPreferences || !RTCRtpReceiver.getCapabilities) return;
+
+        const codecs = RTCRtpReceiver.getCapabilities('audio').codecs;
+        const multiopus = codecs.filter(c => c.mimeType.toLowerCase() === 'audio/multiopus');
+        if (multiopus.length === 0) return;
+
+        const others = codecs.filter(c => c.mimeType.toLowerCase() !== 'audio/multiopus');
+        try {
+            transceiver.setCodecPreferences([...multiopus, ...others]);
+        } catch (e) {
+            console.warn('Could not offer surround audio:', e);
+        }
+    }
+
     createDataChannel(name) {
         const dc = this.pc.createDataChannel(name, {
             ordered: name !== 'mouse_relative', // Mouse movement can be unordered
@@ -232,6 +336,8 @@ class GamelightClient {
             `Gamepad ${this.participant.slot - 1}` :
             (isHost ? 'Keyboard + Mouse + Gamepad 0' : 'View only');
 
+        this.elements.streamFormat.textContent = this.streamFormat();
+
         // Show/hide player actions
         this.elements.playerActions.classList.remove('hidden');
         this.elements.btnJoinPlayer.classList.toggle('hidden', isPlayer);
@@ -262,6 +368,109 @@ class GamelightClient {
         if (isHost) {
             this.updatePermissionControls();
         }
+
+        // The session host can switch apps
+        this.elements.appSection.classList.toggle('hidden', !isHost);
+        if (isHost) {
+            this.updateAppList();
+        }
+    }
+
+    // Apps
+    async loadApps(host) {
+        const query = host ? '?host=' + encodeURIComponent(host) : '';
+        const res = await fetch('/api/apps' + query);
+        if (!res.ok) throw new Error(await res.text());
+        return res.json();
+    }
+
+    renderApps(container, apps, host, currentId, onPick) {
+        const query = host ? '?host=' + encodeURIComponent(host) : '';
+        container.innerHTML = '';
+        for (const app of apps) {
+            const item = document.createElement('button');
+            item.className = 'app-item' + (app.id === currentId ? ' current' : '');
+            item.title = app.title;
+
+            const art = document.createElement('img');
+            art.src = `/api/apps/${app.id}/boxart${query}`;
+            art.alt = '';
+            art.onerror = () => art.remove();
+            item.appendChild(art);
+
+            const title = document.createElement('span');
+            title.textContent = app.title;
+            if (app.hdr) {
+                const badge = document.createElement('span');
+                badge.className = 'app-hdr';
+                badge.textContent = 'HDR';
+                title.appendChild(badge);
+            }
+            item.appendChild(title);
+
+            item.addEventListener('click', () => onPick(app));
+            container.appendChild(item);
+        }
+    }
+
+    // showAppPicker asks which app to start the session with. It returns
+    // false if the apps can't be listed, to start with the default instead.
+    async showAppPicker() {
+        let apps;
+        try {
+            apps = await this.loadApps(this.hostName);
+        } catch (e) {
+            console.error('Failed to load apps:', e);
+            return false;
+        }
+        if (apps.length === 0) return false;
+
+        this.elements.loading.classList.add('hidden');
+        this.elements.appPicker.classList.remove('hidden');
+        // HDR is only worth asking for on a display that can show it
+        if (this.hdrDisplay() && apps.some((app) => app.hdr)) {
+            this.elements.hdrToggle.checked = this.hdr;
+            this.elements.hdrOption.classList.remove('hidden');
+        }
+        // A game the host is already running is resumed, so mark it
+        const running = apps.find((app) => app.running);
+        this.renderApps(this.elements.appGrid, apps, this.hostName, running?.id, (app) => {
+            this.appId = app.id;
+            this.hdr = app.hdr && this.hdrDisplay() && this.elements.hdrToggle.checked;
+            this.elements.appPicker.classList.add('hidden');
+            this.elements.loading.classList.remove('hidden');
+            this.connect();
+        });
+        return true;
+    }
+
+    hdrDisplay() {
+        return window.matchMedia('(dynamic-range: high)').matches;
+    }
+
+    // streamFormat describes the session's video, such as "HEVC HDR"
+    streamFormat() {
+        const names = { 'video/h264': 'H.264', 'video/h265': 'HEVC', 'video/av1': 'AV1' };
+        const codec = names[(this.session?.video_codec || '').toLowerCase()];
+        if (!codec) return '';
+        return this.session.hdr ? `${codec} HDR` : codec;
+    }
+
+    async updateAppList() {
+        const host = this.session?.settings?.host || '';
+        if (!this.sessionApps) {
+            try {
+                this.sessionApps = await this.loadApps(host);
+            } catch (e) {
+                console.error('Failed to load apps:', e);
+                this.sessionApps = [];
+            }
+        }
+        this.renderApps(this.elements.appList, this.sessionApps, host, this.session?.app_id, (app) => {
+            if (app.id !== this.session?.app_id) {
+                this.send('switch_app', { app_id: app.id });
+            }
+        });
     }
 
     updatePermissionControls() {
@@ -413,6 +622,38 @@ class GamelightClient {
         this.sendMouseScroll(amount);
     }
 
+    handleTouch(e) {
+        if (!this.canUseMouse()) return;
+
+        // Keeps the browser from also sending mouse events and scrolling
+        e.preventDefault();
+
+        const types = { touchstart: 0x01, touchend: 0x02, touchmove: 0x03, touchcancel: 0x04 };
+        const rect = this.videoContentRect();
+        for (const touch of e.changedTouches) {
+            const x = Math.min(Math.max((touch.clientX - rect.left) / rect.width, 0), 1);
+            const y = Math.min(Math.max((touch.clientY - rect.top) / rect.height, 0), 1);
+            this.sendTouch(types[e.type], touch.identifier, x, y, touch.force > 0 ? touch.force : 1);
+        }
+    }
+
+    // The area of the video element the picture fills, without letterboxing
+    videoContentRect() {
+        const video = this.elements.video;
+        const rect = video.getBoundingClientRect();
+        if (!video.videoWidth || !video.videoHeight) return rect;
+
+        const scale = Math.min(rect.width / video.videoWidth, rect.height / video.videoHeight);
+        const width = video.videoWidth * scale;
+        const height = video.videoHeight * scale;
+        return {
+            left: rect.left + (rect.width - width) / 2,
+            top: rect.top + (rect.height - height) / 2,
+            width,
+            height,
+        };
+    }
+
     // Data channel sends
     sendMouseMove(dx, dy) {
         const dc = this.dataChannels['mouse_relative'];
@@ -450,6 +691,20 @@ class GamelightClient {
         }
     }
 
+    sendTouch(type, pointerId, x, y, pressure) {
+        const dc = this.dataChannels['touch'];
+        if (dc && dc.readyState === 'open') {
+            const data = new ArrayBuffer(17);
+            const view = new DataView(data);
+            view.setUint8(0, type);
+            view.setUint32(1, pointerId, true);
+            view.setFloat32(5, x, true);
+            view.setFloat32(9, y, true);
+            view.setFloat32(13, pressure, true);
+            dc.send(data);
+        }
+    }
+
     sendController(controllerNum, buttons, lt, rt, lsx, lsy, rsx, rsy) {
         const dc = this.dataChannels['controllers'];
         if (dc && dc.readyState === 'open') {
@@ -573,6 +828,258 @@ class GamelightClient {
         });
     }
 
+    // Hosts
+    async loadHosts() {
+        try {
+            const res = await fetch('/api/hosts');
+            this.hosts = await res.json();
+        } catch (e) {
+            console.error('Failed to load hosts:', e);
+            return;
+        }
+
+        const select = this.elements.hostSelect;
+        const selected = select.value || this.hostName;
+        select.innerHTML = '';
+        for (const host of this.hosts) {
+            const option = document.createElement('option');
+            option.value = host.name;
+            option.textContent = host.reachable ? host.name : `${host.name} (offline)`;
+            option.selected = selected ? host.name === selected : host.default;
+            select.appendChild(option);
+        }
+        select.classList.toggle('hidden', this.hosts.length < 2);
+        this.renderPairStatus();
+    }
+
+    selectedHost() {
+        const name = this.elements.hostSelect.value;
+        return this.hosts.find(h => h.name === name) || null;
+    }
+
+    streamFromHost() {
+        const host = this.selectedHost();
+        if (!host) return;
+
+        // Reconnecting with the host starts a new session from it once the
+        // current one has ended
+        const params = new URLSearchParams(window.location.search);
+        params.set('host', host.name);
+        window.location.search = params.toString();
+    }
+
+    async discoverHosts() {
+        const list = this.elements.discoverList;
+        this.elements.btnDiscover.disabled = true;
+        list.textContent = 'Searching...';
+
+        let found = [];
+        try {
+            const res = await fetch('/api/discover');
+            if (!res.ok) throw new Error(await res.text());
+            found = await res.json();
+        } catch (e) {
+            list.textContent = 'Search failed: ' + e.message;
+            return;
+        } finally {
+            this.elements.btnDiscover.disabled = false;
+        }
+
+        list.innerHTML = '';
+        if (found.length === 0) {
+            list.textContent = 'No hosts found';
+            return;
+        }
+
+        for (const host of found) {
+            const item = document.createElement('div');
+            item.className = 'discover-item';
+
+            const label = document.createElement('span');
+            label.textContent = `${host.instance} (${host.address})`;
+            item.appendChild(label);
+
+            if (host.configured) {
+                const name = document.createElement('span');
+                name.className = 'discover-configured';
+                name.textContent = host.configured;
+                item.appendChild(name);
+            } else {
+                const add = document.createElement('button');
+                add.className = 'btn btn-secondary btn-small';
+                add.textContent = 'Add';
+                add.addEventListener('click', () => this.addHost(host, add));
+                item.appendChild(add);
+            }
+
+            list.appendChild(item);
+        }
+    }
+
+    async addHost(host, button) {
+        button.disabled = true;
+        try {
+            const res = await fetch('/api/hosts', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ name: host.name, address: host.address, port: host.port }),
+            });
+            if (!res.ok) throw new Error(await res.text());
+            button.replaceWith(Object.assign(document.createElement('span'), {
+                className: 'discover-configured',
+                textContent: host.name,
+            }));
+
+            // Select the new host so it can be paired right away
+            await this.loadHosts();
+            this.elements.hostSelect.value = host.name;
+            this.renderPairStatus();
+        } catch (e) {
+            button.disabled = false;
+            button.textContent = 'Retry';
+            button.title = e.message;
+        }
+    }
+
+    // Pairing
+    async loadPairStatus() {
+        try {
+            const res = await fetch('/api/pair/status');
+            this.updatePairStatus(await res.json());
+        } catch (e) {
+            console.error('Failed to load pairing status:', e);
+        }
+    }
+
+    async startPairing() {
+        try {
+            const host = this.selectedHost();
+            const res = await fetch('/api/pair/start', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ host: host ? host.name : '' }),
+            });
+            if (res.status === 202 || res.status === 409) {
+                this.updatePairStatus(await res.json());
+            } else {
+                this.updatePairStatus({ state: 'failed', error: await res.text() });
+            }
+        } catch (e) {
+            this.updatePairStatus({ state: 'failed', error: e.message });
+        }
+    }
+
+    updatePairStatus(status) {
+        const finished = this.pairStatus.state === 'running' && status.state !== 'running';
+        this.pairStatus = status;
+        if (finished) {
+            this.loadHosts();
+        }
+        this.renderPairStatus();
+    }
+
+    renderPairStatus() {
+        const host = this.selectedHost();
+        let status = this.pairStatus;
+
+        // Outside an attempt on the selected host, show what the host reports
+        if (host && (status.state === 'idle' || (status.host && status.host !== host.name))) {
+            status = {
+                state: host.paired ? 'paired' : 'idle',
+                host: host.name,
+                error_code: host.reachable ? '' : host.error_code,
+                error: host.reachable ? '' : host.error,
+            };
+            if (!host.reachable) {
+                status.state = 'offline';
+            }
+        }
+
+        const errors = {
+            wrong_pin: 'Wrong PIN entered on the host',
+            rejected: 'The host rejected pairing',
+            challenge_failed: 'The host rejected the pairing challenge',
+            server_unverified: 'The host could not be verified',
+            unreachable: 'Could not reach the host',
+            save_failed: 'Paired, but saving the credentials failed',
+        };
+
+        const labels = {
+            idle: 'Not paired',
+            running: 'Pairing...',
+            paired: 'Paired',
+            failed: 'Pairing failed',
+            offline: 'Offline',
+        };
+
+        this.elements.pairState.textContent = labels[status.state] || status.state;
+        this.elements.pairState.className = 'status-role ' + status.state;
+
+        let detail = '';
+        if (status.state === 'running') {
+            detail = status.step > 1 ?
+                `Step ${status.step}/5: ${status.step_name}` :
+                'Enter this PIN in the Sunshine web UI:';
+        } else if (status.state === 'offline' && host.can_wake) {
+            detail = 'Asleep or off; it will be woken when you stream from it';
+        } else if (status.state === 'failed' || status.state === 'offline') {
+            detail = errors[status.error_code] || status.error || '';
+        } else if (host) {
+            detail = host.hostname ? `${host.hostname} (${host.address})` : host.address;
+        }
+        this.elements.pairDetail.textContent = detail;
+
+        const showPin = status.state === 'running' && status.pin;
+        this.elements.pairPin.textContent = showPin ? status.pin : '';
+        this.elements.pairPin.classList.toggle('hidden', !showPin);
+
+        this.elements.btnPair.disabled = this.pairStatus.state === 'running';
+        this.elements.btnStreamHost.disabled = !host || !host.paired;
+        this.elements.btnPair.textContent = status.state === 'paired' ? 'Pair Again' : 'Pair with Host';
+    }
+
+    updateStreamProgress(progress) {
+        if (progress.state === 'switching') {
+            this.switching = true;
+            this.elements.loading.classList.remove('hidden');
+        } else if (progress.state === 'started' && this.switching) {
+            // The new app's video arrives on the same track
+            this.switching = false;
+            this.elements.loading.classList.add('hidden');
+            return;
+        }
+
+        let message = 'Connecting to stream...';
+        if (progress.state === 'waking') {
+            message = `Waking ${progress.host}\u2026`;
+            if (progress.attempt) {
+                message += ` (check ${progress.attempt})`;
+            }
+        } else if (progress.state === 'launching') {
+            message = 'Launching stream...';
+        } else if (progress.state === 'switching') {
+            message = 'Switching app...';
+        }
+        this.elements.loadingMessage.textContent = message;
+    }
+
+    // updateDelivery tells a spectator when their connection is too slow for
+    // every frame and the server is sending fewer
+    updateDelivery(delivery) {
+        let message = '';
+        if (delivery.mode === 'thinned') {
+            message = 'Your connection is slow, so some frames are skipped';
+        } else if (delivery.mode === 'slideshow') {
+            message = 'Your connection is too slow for video; showing a still every few seconds';
+        }
+        if (message && delivery.estimate_kbps && delivery.stream_kbps) {
+            const mbps = (kbps) => (kbps / 1000).toFixed(1);
+            message += ` (${mbps(delivery.estimate_kbps)} of ${mbps(delivery.stream_kbps)} Mbps)`;
+        }
+        this.elements.deliveryNotice.textContent = message;
+        this.elements.deliveryNotice.classList.toggle('hidden', !message);
+    }
+
     showError(message) {
         this.elements.loading.classList.add('hidden');
         this.elements.error.classList.remove('hidden');